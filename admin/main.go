@@ -0,0 +1,68 @@
+package main
+
+import (
+	"dmap"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: dmap-admin [flags] <slots|rebalance>\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	nodes := flag.String("nodes", "localhost:8080", "comma separated host:port of the HTTP servers of the cluster nodes, the ones to add included")
+	batch := flag.Int("batch", 100, "keys streamed at a time while migrating a slot range")
+	dry := flag.Bool("dry-run", false, "print the moves planned by rebalance, without executing them")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+	ca, err := dmap.NewClusterAdmin(strings.Split(*nodes, ",")...)
+	if err != nil {
+		log.Printf("error: unable to reach the nodes: %s\n", err.Error())
+		os.Exit(1)
+	}
+	switch flag.Arg(0) {
+	case "slots":
+		slots, err := ca.Slots()
+		if err != nil {
+			log.Printf("error: unable to read the slots: %s\n", err.Error())
+			os.Exit(1)
+		}
+		for _, sr := range slots {
+			fmt.Printf("%d-%d %s %s\n", sr.Start, sr.End, sr.Node.Addr, sr.Node.HTTP)
+		}
+	case "rebalance":
+		moves, err := ca.Plan()
+		if err != nil {
+			log.Printf("error: unable to plan the moves: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if len(moves) == 0 {
+			fmt.Println("balanced: nothing to move")
+		}
+		for _, mv := range moves {
+			fmt.Printf("move %d-%d from %s to %s", mv.Start, mv.End, mv.From.Addr, mv.To.Addr)
+			if *dry {
+				fmt.Println()
+				continue
+			}
+			n, err := ca.Move(mv, *batch)
+			if err != nil {
+				fmt.Println()
+				log.Printf("error: unable to move the slots: %s\n", err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf(": %d keys\n", n)
+		}
+	default:
+		usage()
+	}
+}
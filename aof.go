@@ -0,0 +1,394 @@
+package dmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type Fsync int
+
+const (
+	FsyncAlways Fsync = iota
+	FsyncEverySecond
+	FsyncNever
+)
+
+func ParseFsync(policy string) (Fsync, error) {
+	switch policy {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySecond, nil
+	case "no", "never":
+		return FsyncNever, nil
+	}
+	return FsyncNever, fmt.Errorf("unrecognized fsync policy: %s, <always|everysec|no>", policy)
+}
+
+const (
+	aofMagic          = "DMAPAOF1"
+	aofRewriteMinSize = 64 << 20
+	aofRewriteGrowth  = 100
+	aofCheckInterval  = time.Second
+	aofMaxRecord      = 1 << 30
+)
+
+// AOF is an append-only log of the mutations applied to a Map: it is
+// replayed when opened, and rewritten from the Map contents as soon as it
+// doubles its size since the last rewrite.
+type AOF struct {
+	path   string
+	fsync  Fsync
+	m      *Map
+	f      *os.File
+	size   int64
+	base   int64
+	mu     sync.Mutex
+	rw     *aofRewrite
+	detach func()
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// aofRewrite collects the mutations applied to the shards already dumped
+// while rewriting the log.
+type aofRewrite struct {
+	buf    bytes.Buffer
+	dumped []bool
+}
+
+func NewAOF(path string, m *Map, fsync Fsync) (*AOF, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a := &AOF{
+		path:  path,
+		fsync: fsync,
+		m:     m,
+		f:     f,
+		done:  make(chan struct{}),
+	}
+	err = a.replay()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a.base = a.size
+	a.detach = m.observe(a.append)
+	a.wg.Add(1)
+	go a.loop()
+	return a, nil
+}
+
+// replay applies the logged mutations to the Map: a torn record at the end
+// of the log, e.g. after a crash, is truncated away.
+func (a *AOF) replay() error {
+	st, err := a.f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() == 0 {
+		_, err = a.f.Write([]byte(aofMagic))
+		a.size = int64(len(aofMagic))
+		return err
+	}
+	r := bufio.NewReader(a.f)
+	magic := make([]byte, len(aofMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || string(magic) != aofMagic {
+		return errors.New("not an append-only log: " + a.path)
+	}
+	offset := int64(len(aofMagic))
+	count := 0
+	for {
+		mu, l, err := readMutation(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("warning: truncating the append-only log at %d: %s\n", offset, err.Error())
+			err = a.f.Truncate(offset)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		a.m.apply(&mu)
+		offset += int64(l)
+		count++
+	}
+	a.size = offset
+	log.Printf("info: replayed %d mutations from %s\n", count, a.path)
+	return nil
+}
+
+func (a *AOF) append(shard int, mu Mutation) {
+	rec := appendMutation(nil, &mu)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return
+	}
+	_, err := a.f.Write(rec)
+	if err != nil {
+		log.Printf("error: unable to append to the log: %s\n", err.Error())
+		return
+	}
+	a.size += int64(len(rec))
+	if a.fsync == FsyncAlways {
+		a.f.Sync()
+	}
+	if a.rw == nil {
+		return
+	}
+	if shard < 0 {
+		for i := range a.rw.dumped {
+			a.rw.dumped[i] = true
+		}
+	}
+	if shard < 0 || a.rw.dumped[shard] {
+		a.rw.buf.Write(rec)
+	}
+}
+
+func (a *AOF) loop() {
+	defer a.wg.Done()
+	t := time.NewTicker(aofCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-t.C:
+			a.mu.Lock()
+			if a.fsync == FsyncEverySecond && a.f != nil {
+				a.f.Sync()
+			}
+			rewrite := a.rw == nil && a.size >= aofRewriteMinSize &&
+				a.size >= a.base+a.base*aofRewriteGrowth/100
+			a.mu.Unlock()
+			if rewrite {
+				go func() {
+					err := a.Rewrite()
+					if err != nil {
+						log.Printf("error: unable to rewrite the log: %s\n", err.Error())
+					}
+				}()
+			}
+		}
+	}
+}
+
+// Rewrite compacts the log dumping the Map contents shard by shard, while
+// writers go on: the mutations applied to the shards already dumped are
+// appended to the new log before it replaces the actual one.
+func (a *AOF) Rewrite() error {
+	a.mu.Lock()
+	if a.rw != nil {
+		a.mu.Unlock()
+		return errors.New("rewrite already in progress")
+	}
+	a.rw = &aofRewrite{dumped: make([]bool, len(a.m.e))}
+	a.mu.Unlock()
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".rewrite-*")
+	if err != nil {
+		a.abort(nil)
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	w.WriteString(aofMagic)
+	var rec []byte
+	for i := range a.m.e {
+		var mus []Mutation
+		e := &a.m.e[i]
+		now := time.Now().UnixNano()
+		e.l.RLock()
+		a.mu.Lock()
+		dumped := a.rw.dumped[i]
+		a.rw.dumped[i] = true
+		a.mu.Unlock()
+		if !dumped {
+			for k, it := range e.m {
+				if !it.expired(now) {
+					mus = append(mus, it.mutation(k))
+				}
+			}
+		}
+		e.l.RUnlock()
+		for j := range mus {
+			rec = appendMutation(rec[:0], &mus[j])
+			_, err = w.Write(rec)
+			if err != nil {
+				a.abort(tmp)
+				return err
+			}
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = w.Write(a.rw.buf.Bytes())
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		a.rw = nil
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	st, err := tmp.Stat()
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), a.path)
+	}
+	if err != nil {
+		a.rw = nil
+		os.Remove(tmp.Name())
+		return err
+	}
+	syncDir(filepath.Dir(a.path))
+	a.rw = nil
+	f, err := os.OpenFile(a.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if a.f != nil {
+		a.f.Close()
+		a.f = f
+	} else {
+		f.Close()
+	}
+	a.size = st.Size()
+	a.base = a.size
+	log.Printf("info: rewritten the log %s: %d bytes\n", a.path, a.size)
+	return nil
+}
+
+func (a *AOF) abort(tmp *os.File) {
+	a.mu.Lock()
+	a.rw = nil
+	a.mu.Unlock()
+	if tmp != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+}
+
+func (a *AOF) Size() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.size
+}
+
+// Close detaches the log from the Map and closes it, once: later calls do
+// nothing.
+func (a *AOF) Close() error {
+	a.once.Do(func() {
+		a.detach()
+		close(a.done)
+	})
+	a.wg.Wait()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	a.f.Sync()
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// appendMutation encodes the mutation as a record: length and CRC32 of the
+// payload, followed by the payload itself (op, key, value and expiration).
+func appendMutation(buf []byte, mu *Mutation) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0, byte(mu.Op))
+	buf = binary.AppendUvarint(buf, uint64(len(mu.Key)))
+	buf = append(buf, mu.Key...)
+	buf = binary.AppendUvarint(buf, uint64(len(mu.Value)))
+	buf = append(buf, mu.Value...)
+	buf = binary.AppendVarint(buf, mu.Expire)
+	payload := buf[start+8:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(payload))
+	return buf
+}
+
+// readMutation decodes a record, returning the number of bytes read: io.EOF
+// only if no byte at all is left.
+func readMutation(r *bufio.Reader) (Mutation, int, error) {
+	var mu Mutation
+	var header [8]byte
+	n, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return mu, 0, io.EOF
+	}
+	if err != nil {
+		return mu, n, err
+	}
+	l := binary.LittleEndian.Uint32(header[:])
+	if l > aofMaxRecord {
+		return mu, n, errors.New("record too large")
+	}
+	payload := make([]byte, l)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return mu, n, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+		return mu, n, errors.New("checksum mismatch")
+	}
+	err = decodeMutation(payload, &mu)
+	return mu, len(header) + len(payload), err
+}
+
+func decodeMutation(payload []byte, mu *Mutation) error {
+	bad := errors.New("malformed record")
+	if len(payload) < 1 {
+		return bad
+	}
+	mu.Op = Op(payload[0])
+	p := payload[1:]
+	l, n := binary.Uvarint(p)
+	if n <= 0 || uint64(len(p)-n) < l {
+		return bad
+	}
+	mu.Key = string(p[n : n+int(l)])
+	p = p[n+int(l):]
+	l, n = binary.Uvarint(p)
+	if n <= 0 || uint64(len(p)-n) < l {
+		return bad
+	}
+	mu.Value = p[n : n+int(l)]
+	p = p[n+int(l):]
+	mu.Expire, n = binary.Varint(p)
+	if n <= 0 {
+		return bad
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package dmap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAOFReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dmap.aof")
+	m := NewMap()
+	a, err := NewAOF(path, m, FsyncAlways)
+	if err != nil {
+		t.Fatalf("unable to open the log: %s\n", err.Error())
+	}
+	m.Put("cleared", []byte("value"))
+	m.Clear()
+	m.Put("key", []byte("value"))
+	m.Put("deleted", []byte("value"))
+	m.Delete("deleted")
+	m.PutWithTTL("session", []byte("token"), time.Hour)
+	m.PutWithTTL("expired", []byte("token"), 10*time.Millisecond)
+	m.Put("persisted", []byte("value"))
+	m.Expire("persisted", time.Hour)
+	m.Persist("persisted")
+	a.Close()
+	if err := a.Close(); err != nil {
+		t.Logf("expected a second close to do nothing: %s\n", err.Error())
+		t.Fail()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	r := NewMap()
+	a, err = NewAOF(path, r, FsyncNever)
+	if err != nil {
+		t.Fatalf("unable to reopen the log: %s\n", err.Error())
+	}
+	defer a.Close()
+	if r.Size() != 3 {
+		t.Logf("expected size 3: %d\n", r.Size())
+		t.Fail()
+	}
+	if string(r.Get("key")) != "value" || r.Get("deleted") != nil || r.Get("cleared") != nil {
+		t.Logf("unexpected contents after the replay\n")
+		t.Fail()
+	}
+	if ttl := r.TTL("session"); ttl <= 0 || r.TTL("persisted") != -1 {
+		t.Logf("unexpected ttl after the replay: %v %v\n", ttl, r.TTL("persisted"))
+		t.Fail()
+	}
+}
+
+func TestAOFTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dmap.aof")
+	m := NewMap()
+	a, err := NewAOF(path, m, FsyncAlways)
+	if err != nil {
+		t.Fatalf("unable to open the log: %s\n", err.Error())
+	}
+	m.Put("key1", []byte("value1"))
+	m.Put("key2", []byte("value2"))
+	size := a.Size()
+	a.Close()
+	os.Truncate(path, size-3)
+
+	r := NewMap()
+	a, err = NewAOF(path, r, FsyncAlways)
+	if err != nil {
+		t.Fatalf("unable to reopen the log: %s\n", err.Error())
+	}
+	if r.Size() != 1 || string(r.Get("key1")) != "value1" {
+		t.Logf("expected only the first record: %d\n", r.Size())
+		t.Fail()
+	}
+	r.Put("key3", []byte("value3"))
+	a.Close()
+
+	r = NewMap()
+	a, err = NewAOF(path, r, FsyncAlways)
+	if err != nil {
+		t.Fatalf("unable to reopen the log: %s\n", err.Error())
+	}
+	defer a.Close()
+	if r.Size() != 2 || string(r.Get("key3")) != "value3" {
+		t.Logf("expected the records appended after the truncation: %d\n", r.Size())
+		t.Fail()
+	}
+}
+
+func TestAOFRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dmap.aof")
+	m := NewMap()
+	a, err := NewAOF(path, m, FsyncNever)
+	if err != nil {
+		t.Fatalf("unable to open the log: %s\n", err.Error())
+	}
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 100; j++ {
+			m.Put(fmt.Sprintf("key%d", j), []byte(fmt.Sprintf("value%d", i)))
+		}
+	}
+	before := a.Size()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 1000; j++ {
+			m.Put(fmt.Sprintf("concurrent%d", j), []byte("value"))
+			if j%10 == 0 {
+				m.Delete(fmt.Sprintf("concurrent%d", j))
+			}
+		}
+	}()
+	err = a.Rewrite()
+	if err != nil {
+		t.Fatalf("unable to rewrite the log: %s\n", err.Error())
+	}
+	wg.Wait()
+	if a.Size() >= before {
+		t.Logf("expected the log to shrink: %d >= %d\n", a.Size(), before)
+		t.Fail()
+	}
+	m.Put("after", []byte("rewrite"))
+	a.Close()
+
+	r := NewMap()
+	a, err = NewAOF(path, r, FsyncNever)
+	if err != nil {
+		t.Fatalf("unable to reopen the log: %s\n", err.Error())
+	}
+	defer a.Close()
+	if r.Size() != m.Size() {
+		t.Logf("expected size %d: %d\n", m.Size(), r.Size())
+		t.Fail()
+	}
+	if string(r.Get("key42")) != "value99" || string(r.Get("after")) != "rewrite" {
+		t.Logf("unexpected contents after the rewrite\n")
+		t.Fail()
+	}
+}
@@ -1,7 +1,10 @@
 package dmap
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,76 +14,201 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Client interface {
 	Dial() error
 	Close() error
 	Put(string, []byte) error
+	PutIfAbsent(string, []byte) (bool, error)
+	Replace(string, []byte) (bool, error)
+	CompareAndSwap(string, []byte, []byte) (bool, error)
+	CompareAndDelete(string, []byte) (bool, error)
 	Get(string) ([]byte, error)
 	Delete(string) error
+	MGet(...string) ([][]byte, error)
+	MPut(map[string][]byte) error
+	MDelete(...string) (int, error)
+	Incr(string, int64) (int64, error)
 	Size() (int, error)
 	Clear() error
+	Watch(context.Context, string) (<-chan Event, error)
 }
 
 type MapClient struct {
-	conn net.Conn
-	host string
-	port int
+	conn   net.Conn
+	r      *bufio.Reader
+	host   string
+	port   int
+	binary bool
+	id     uint32
+	ns     string
+	slots  map[int]string
+	nodes  map[string]*MapClient
+	it     time.Duration
 }
 
-func (mc *MapClient) Close() error {
-	mc.conn.Write([]byte("CLOSE"))
-	return mc.conn.Close()
+// SetBinary switches the client to the binary protocol, which is safe for
+// keys and values holding spaces, newlines or arbitrary bytes: it must be
+// set before Dial.
+func (mc *MapClient) SetBinary(enabled bool) {
+	mc.binary = enabled
 }
 
-func (mc *MapClient) Put(key string, value []byte) error {
-	command := fmt.Sprintf("PUT %s %s", key, string(value[:]))
-	_, err := mc.conn.Write([]byte(command))
+func (mc *MapClient) dial(network string) error {
+	conn, err := net.Dial(network, net.JoinHostPort(mc.host, strconv.Itoa(mc.port)))
 	if err != nil {
 		return err
 	}
-	var buf [1024]byte
-	l, err := mc.conn.Read(buf[:])
+	mc.conn = conn
+	mc.r = bufio.NewReaderSize(conn, 65536)
+	err = mc.selectNamespace()
 	if err != nil {
-		return nil
+		conn.Close()
 	}
-	_, err = mc.parse(buf[:], l)
-	if err != nil {
+	return err
+}
+
+func (mc *MapClient) Close() error {
+	for _, c := range mc.nodes {
+		c.Close()
+	}
+	mc.nodes = nil
+	if !mc.binary {
+		mc.conn.Write([]byte("CLOSE\r\n"))
+	}
+	return mc.conn.Close()
+}
+
+func (mc *MapClient) Put(key string, value []byte) error {
+	if mc.binary {
+		_, err := mc.roundTrip(opPut, key, value)
 		return err
 	}
-	return nil
+	_, err := mc.call(fmt.Sprintf("PUT %s %s", key, string(value)))
+	return err
 }
 
+func (mc *MapClient) PutIfAbsent(key string, value []byte) (bool, error) {
+	if mc.binary {
+		return mc.frameCondition(opPutNX, key, value)
+	}
+	return mc.condition(fmt.Sprintf("PUTNX %s %s", key, string(value)))
+}
+
+func (mc *MapClient) Replace(key string, value []byte) (bool, error) {
+	if mc.binary {
+		return mc.frameCondition(opPutXX, key, value)
+	}
+	return mc.condition(fmt.Sprintf("PUTXX %s %s", key, string(value)))
+}
+
+func (mc *MapClient) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	if mc.binary {
+		return mc.frameCondition(opCAS, key, casValue(old, new))
+	}
+	return mc.condition(fmt.Sprintf("CAS %s %s %s", key, string(old), string(new)))
+}
+
+func (mc *MapClient) CompareAndDelete(key string, old []byte) (bool, error) {
+	if mc.binary {
+		return mc.frameCondition(opCAD, key, old)
+	}
+	return mc.condition(fmt.Sprintf("CAD %s %s", key, string(old)))
+}
+
+// Get returns a nil value, and no error, if the key is not found.
 func (mc *MapClient) Get(key string) ([]byte, error) {
-	command := fmt.Sprintf("GET %s", key)
-	_, err := mc.conn.Write([]byte(command))
-	if err != nil {
+	if mc.binary {
+		res, err := mc.roundTrip(opGet, key, nil)
+		if err != nil || res.op == statusNotFound {
+			return nil, err
+		}
+		return res.value, nil
+	}
+	b, err := mc.call(fmt.Sprintf("GET %s", key))
+	if err != nil {
+		if err.Error() == "null" {
+			return nil, nil
+		}
 		return nil, err
 	}
-	var buf [1024]byte
-	l, err := mc.conn.Read(buf[:])
-	if err != nil {
-		return nil, nil
-	}
-	b, err := mc.parse(buf[:], l)
-	if err != nil {
+	return []byte(b), nil
+}
+
+// GetWithMeta returns the value of the key and its Meta, a nil value and a
+// zero Meta if the key is not found.
+func (mc *MapClient) GetWithMeta(key string) ([]byte, Meta, error) {
+	if mc.binary {
+		res, err := mc.roundTrip(opGetV, key, nil)
+		if err != nil || res.op == statusNotFound {
+			return nil, Meta{}, err
+		}
+		if len(res.value) < 16 {
+			return nil, Meta{}, errors.New("Unexpected response: malformed meta")
+		}
+		meta := Meta{
+			Version:  binary.BigEndian.Uint64(res.value),
+			Modified: time.Unix(0, int64(binary.BigEndian.Uint64(res.value[8:]))),
+		}
+		return res.value[16:], meta, nil
+	}
+	b, err := mc.call(fmt.Sprintf("GETV %s", key))
+	if err != nil {
+		if err.Error() == "null" {
+			return nil, Meta{}, nil
+		}
+		return nil, Meta{}, err
+	}
+	parts := strings.SplitN(b, " ", 3)
+	if len(parts) != 3 {
+		return nil, Meta{}, errors.New("Unexpected response: OK=" + b)
+	}
+	version, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, Meta{}, errors.New("Unexpected response: OK=" + b)
+	}
+	ms, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, Meta{}, errors.New("Unexpected response: OK=" + b)
+	}
+	return []byte(parts[2]), Meta{Version: version, Modified: time.Unix(0, ms*int64(time.Millisecond))}, nil
+}
+
+// GetAt returns the value the key held at the version, nil if not found or
+// no longer retained by the server (see WithHistory).
+func (mc *MapClient) GetAt(key string, version uint64) ([]byte, error) {
+	if mc.binary {
+		res, err := mc.roundTrip(opGet, key, binary.BigEndian.AppendUint64(nil, version))
+		if err != nil || res.op == statusNotFound {
+			return nil, err
+		}
+		return res.value, nil
+	}
+	b, err := mc.call(fmt.Sprintf("GET %s AT %d", key, version))
+	if err != nil {
+		if err.Error() == "null" {
+			return nil, nil
+		}
 		return nil, err
 	}
 	return []byte(b), nil
 }
 
 func (mc *MapClient) Size() (int, error) {
-	_, err := mc.conn.Write([]byte("SIZE"))
-	if err != nil {
-		return 0, err
-	}
-	var buf [1024]byte
-	l, err := mc.conn.Read(buf[:])
-	if err != nil {
-		return 0, err
-	}
-	b, err := mc.parse(buf[:], l)
+	if mc.binary {
+		res, err := mc.roundTrip(opSize, "", nil)
+		if err != nil {
+			return -1, err
+		}
+		if len(res.value) != 8 {
+			return -1, errors.New("Unexpected response: malformed size")
+		}
+		return int(binary.BigEndian.Uint64(res.value)), nil
+	}
+	b, err := mc.call("SIZE")
 	if err != nil {
 		return 0, err
 	}
@@ -92,53 +220,215 @@ func (mc *MapClient) Size() (int, error) {
 }
 
 func (mc *MapClient) Clear() error {
-	_, err := mc.conn.Write([]byte("CLEAR"))
-	if err != nil {
+	if mc.binary {
+		_, err := mc.roundTrip(opClear, "", nil)
 		return err
 	}
-	var buf [1024]byte
-	l, err := mc.conn.Read(buf[:])
-	if err != nil {
+	_, err := mc.call("CLEAR")
+	return err
+}
+
+func (mc *MapClient) Delete(key string) error {
+	if mc.binary {
+		_, err := mc.roundTrip(opDel, key, nil)
 		return err
 	}
-	_, err = mc.parse(buf[:], l)
+	_, err := mc.call(fmt.Sprintf("DEL %s", key))
+	return err
+}
+
+// MGet returns the values of the keys, nil for the keys not found.
+func (mc *MapClient) MGet(keys ...string) ([][]byte, error) {
+	if mc.binary {
+		items := make([][]byte, len(keys))
+		for i, key := range keys {
+			items[i] = []byte(key)
+		}
+		res, err := mc.roundTrip(opMGet, "", packList(items))
+		if err != nil {
+			return nil, err
+		}
+		values, err := unpackList(res.value)
+		if err == nil && len(values) != len(keys) {
+			err = errors.New("Unexpected response: malformed values")
+		}
+		return values, err
+	}
+	c, b, err := mc.exchange("MGET " + strings.Join(keys, " "))
 	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(b)
+	if err != nil || n != len(keys) {
+		return nil, errors.New("Unexpected response: OK=" + b)
+	}
+	return c.readValues(n)
+}
+
+// readValues reads the lines following OK=<n>, a value each, nil for the
+// ones answered by KO=null.
+func (mc *MapClient) readValues(n int) ([][]byte, error) {
+	values := make([][]byte, n)
+	for i := range values {
+		line, err := mc.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		b, err := mc.parse(strings.TrimRight(line, "\r\n"))
+		if err != nil && err.Error() != "null" {
+			return nil, err
+		}
+		if err == nil {
+			values[i] = []byte(b)
+		}
+	}
+	return values, nil
+}
+
+// MPut stores all the values, or none of them.
+func (mc *MapClient) MPut(values map[string][]byte) error {
+	if mc.binary {
+		items := make([][]byte, 0, 2*len(values))
+		for key, value := range values {
+			items = append(items, []byte(key), value)
+		}
+		_, err := mc.roundTrip(opMSet, "", packList(items))
 		return err
 	}
-	return nil
+	parts := make([]string, 0, 2*len(values)+1)
+	parts = append(parts, "MSET")
+	for key, value := range values {
+		parts = append(parts, key, string(value))
+	}
+	_, err := mc.call(strings.Join(parts, " "))
+	return err
 }
 
-func (mc *MapClient) Delete(key string) error {
-	command := fmt.Sprintf("DEL %s", key)
-	_, err := mc.conn.Write([]byte(command))
+// MDelete returns how many of the keys were found.
+func (mc *MapClient) MDelete(keys ...string) (int, error) {
+	if mc.binary {
+		items := make([][]byte, len(keys))
+		for i, key := range keys {
+			items[i] = []byte(key)
+		}
+		res, err := mc.roundTrip(opMDel, "", packList(items))
+		if err != nil {
+			return 0, err
+		}
+		if len(res.value) != 8 {
+			return 0, errors.New("Unexpected response: malformed count")
+		}
+		return int(binary.BigEndian.Uint64(res.value)), nil
+	}
+	b, err := mc.call("MDEL " + strings.Join(keys, " "))
 	if err != nil {
-		return err
+		return 0, err
 	}
-	var buf [1024]byte
-	l, err := mc.conn.Read(buf[:])
+	return strconv.Atoi(b)
+}
+
+// Incr adds delta to the value of the key, returning the result.
+func (mc *MapClient) Incr(key string, delta int64) (int64, error) {
+	if mc.binary {
+		res, err := mc.roundTrip(opIncr, key, binary.BigEndian.AppendUint64(nil, uint64(delta)))
+		if err != nil {
+			return 0, err
+		}
+		if len(res.value) != 8 {
+			return 0, errors.New("Unexpected response: malformed value")
+		}
+		return int64(binary.BigEndian.Uint64(res.value)), nil
+	}
+	b, err := mc.call(fmt.Sprintf("INCRBY %s %d", key, delta))
 	if err != nil {
-		return nil
+		return 0, err
 	}
-	_, err = mc.parse(buf[:], l)
+	return strconv.ParseInt(b, 10, 64)
+}
+
+func (mc *MapClient) call(command string) (string, error) {
+	_, res, err := mc.exchange(command)
+	return res, err
+}
+
+func (mc *MapClient) send(command string) (string, error) {
+	_, err := mc.conn.Write([]byte(command + "\r\n"))
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	line, err := mc.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return mc.parse(strings.TrimRight(line, "\r\n"))
+}
+
+// condition runs a conditional command, answering OK=1 when it applies.
+func (mc *MapClient) condition(command string) (bool, error) {
+	b, err := mc.call(command)
+	if err != nil {
+		return false, err
+	}
+	return b == "1", nil
 }
 
-func (mc *MapClient) parse(buf []byte, length int) (string, error) {
-	res := string(buf[:length])
+func (mc *MapClient) parse(res string) (string, error) {
 	log.Println(res)
-	parts := strings.Split(res, "=")
+	parts := strings.SplitN(res, "=", 2)
 	if len(parts) != 2 {
 		return "", errors.New("Unexpected response: " + res)
 	}
 	if parts[0] != "OK" {
-		return "", errors.New(parts[1])
+		return "", knownError(parts[1])
 	}
 	return parts[1], nil
 }
 
+// sendFrame sends a frame and waits for the response with the same id,
+// skipping stale ones (e.g. late UDP datagrams).
+func (mc *MapClient) sendFrame(op byte, key string, value []byte) (*frame, error) {
+	mc.id++
+	req := &frame{op: op, id: mc.id, key: []byte(key), value: value}
+	_, err := mc.conn.Write(req.encode(nil))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		res, err := readFrame(mc.r)
+		if err != nil {
+			return nil, err
+		}
+		if res.id != req.id {
+			continue
+		}
+		switch res.op {
+		case statusError:
+			return nil, knownError(string(res.value))
+		case statusOOM:
+			return nil, ErrOutOfMemory
+		}
+		return res, nil
+	}
+}
+
+func (mc *MapClient) frameCondition(op byte, key string, value []byte) (bool, error) {
+	res, err := mc.roundTrip(op, key, value)
+	if err != nil {
+		return false, err
+	}
+	return res.op == statusOK, nil
+}
+
+// knownError returns the error of the package carrying the message, if any.
+func knownError(msg string) error {
+	for _, err := range []error{ErrOutOfMemory, ErrNotInteger, ErrOverflow, ErrWrongType, ErrReadOnly} {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
 type UDPMapClient struct {
 	MapClient
 }
@@ -154,12 +444,7 @@ func NewUDPMapClient(host string, port int) *UDPMapClient {
 }
 
 func (uc *UDPMapClient) Dial() error {
-	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", uc.host, uc.port))
-	if err != nil {
-		return err
-	}
-	uc.conn = conn
-	return nil
+	return uc.dial("udp")
 }
 
 type TCPMapClient struct {
@@ -177,17 +462,13 @@ func NewTCPMapClient(host string, port int) *TCPMapClient {
 }
 
 func (uc *TCPMapClient) Dial() error {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", uc.host, uc.port))
-	if err != nil {
-		return err
-	}
-	uc.conn = conn
-	return nil
+	return uc.dial("tcp")
 }
 
 type HTTPMapClient struct {
 	MapClient
 	client *http.Client
+	sl     sync.Mutex
 }
 
 func NewHTTPMapClient(host string, port int) *HTTPMapClient {
@@ -199,6 +480,7 @@ func NewHTTPMapClient(host string, port int) *HTTPMapClient {
 			port: port,
 		},
 	}
+	client.CheckRedirect = hc.redirected
 	return hc
 }
 
@@ -213,7 +495,7 @@ func (hc *HTTPMapClient) Close() error {
 }
 
 func (hc *HTTPMapClient) Put(key string, value []byte) error {
-	url := fmt.Sprintf("http://%s:%d/api/v1/map", hc.host, hc.port)
+	url := fmt.Sprintf("http://%s%s/map", hc.node(key), hc.api())
 	body := fmt.Sprintf("{ \"key\": \"%s\", \"value\": \"%s\" }", key, string(value))
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(body)))
 	if err != nil {
@@ -235,8 +517,67 @@ func (hc *HTTPMapClient) Put(key string, value []byte) error {
 	return nil
 }
 
+func (hc *HTTPMapClient) PutIfAbsent(key string, value []byte) (bool, error) {
+	return hc.conditionalPut(key, value, "If-None-Match", "*")
+}
+
+func (hc *HTTPMapClient) Replace(key string, value []byte) (bool, error) {
+	return hc.conditionalPut(key, value, "If-Match", "*")
+}
+
+func (hc *HTTPMapClient) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	return hc.conditionalPut(key, new, "If-Match", etag(old))
+}
+
+func (hc *HTTPMapClient) CompareAndDelete(key string, old []byte) (bool, error) {
+	url := fmt.Sprintf("http://%s%s/map?key=%s", hc.node(key), hc.api(), key)
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Add("If-Match", etag(old))
+	return hc.conditional(req)
+}
+
+func (hc *HTTPMapClient) conditionalPut(key string, value []byte, header, tag string) (bool, error) {
+	url := fmt.Sprintf("http://%s%s/map", hc.node(key), hc.api())
+	body, err := json.Marshal(map[string]string{"key": key, "value": string(value)})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Add(header, tag)
+	return hc.conditional(req)
+}
+
+// conditional sends a request carrying a precondition: a 412 means that the
+// precondition did not hold.
+func (hc *HTTPMapClient) conditional(req *http.Request) (bool, error) {
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		resp.Body.Close()
+		return false, nil
+	}
+	json, err := hc.parseBody(resp)
+	if err != nil {
+		return false, err
+	}
+	if json["outcome"].(string) == "KO" {
+		return false, errors.New(json["error"].(string))
+	}
+	return true, nil
+}
+
 func (hc *HTTPMapClient) Get(key string) ([]byte, error) {
-	url := fmt.Sprintf("http://%s:%d/api/v1/map?key=%s", hc.host, hc.port, key)
+	url := fmt.Sprintf("http://%s%s/map?key=%s", hc.node(key), hc.api(), key)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -257,8 +598,66 @@ func (hc *HTTPMapClient) Get(key string) ([]byte, error) {
 	return []byte(json["value"].(string)), nil
 }
 
+// GetWithMeta reads the Meta from the ETag and Last-Modified headers: the
+// latter comes with a precision of a second.
+func (hc *HTTPMapClient) GetWithMeta(key string) ([]byte, Meta, error) {
+	url := fmt.Sprintf("http://%s%s/map?key=%s", hc.node(key), hc.api(), key)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	json, err := hc.parseBody(resp)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	tag := resp.Header.Get("ETag")
+	if tag == "" {
+		return nil, Meta{}, nil
+	}
+	var meta Meta
+	_, err = fmt.Sscanf(tag, "\"v%d\"", &meta.Version)
+	if err != nil {
+		return nil, Meta{}, errors.New("Unexpected response: ETag " + tag)
+	}
+	meta.Modified, err = http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	value, _ := json["value"].(string)
+	return []byte(value), meta, nil
+}
+
+func (hc *HTTPMapClient) GetAt(key string, version uint64) ([]byte, error) {
+	url := fmt.Sprintf("http://%s%s/map?key=%s&version=%d", hc.node(key), hc.api(), key, version)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	json, err := hc.parseBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	if json["outcome"] != "OK" || json["value"] == "null" {
+		return nil, nil
+	}
+	value, _ := json["value"].(string)
+	return []byte(value), nil
+}
+
 func (hc *HTTPMapClient) Delete(key string) error {
-	url := fmt.Sprintf("http://%s:%d/api/v1/map?key=%s", hc.host, hc.port, key)
+	url := fmt.Sprintf("http://%s%s/map?key=%s", hc.node(key), hc.api(), key)
 	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
 		return err
@@ -277,7 +676,7 @@ func (hc *HTTPMapClient) Delete(key string) error {
 }
 
 func (hc *HTTPMapClient) Clear() error {
-	url := fmt.Sprintf("http://%s:%d/api/v1/map?key=*", hc.host, hc.port)
+	url := fmt.Sprintf("http://%s:%d%s/map?key=*", hc.host, hc.port, hc.api())
 	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
 		return err
@@ -296,7 +695,7 @@ func (hc *HTTPMapClient) Clear() error {
 }
 
 func (hc *HTTPMapClient) Size() (int, error) {
-	url := fmt.Sprintf("http://%s:%d/api/v1/map?key=*", hc.host, hc.port)
+	url := fmt.Sprintf("http://%s:%d%s/map?key=*", hc.host, hc.port, hc.api())
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return -1, err
@@ -317,7 +716,119 @@ func (hc *HTTPMapClient) Size() (int, error) {
 	return int(json["size"].(float64)), nil
 }
 
+func (hc *HTTPMapClient) MGet(keys ...string) ([][]byte, error) {
+	json, err := hc.batch(map[string]interface{}{"get": keys})
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := json["values"].([]interface{})
+	if !ok || len(raw) != len(keys) {
+		return nil, errors.New("Unexpected response: malformed values")
+	}
+	values := make([][]byte, len(raw))
+	for i, v := range raw {
+		if s, ok := v.(string); ok {
+			values[i] = []byte(s)
+		}
+	}
+	return values, nil
+}
+
+func (hc *HTTPMapClient) MPut(values map[string][]byte) error {
+	put := make(map[string]string, len(values))
+	for key, value := range values {
+		put[key] = string(value)
+	}
+	_, err := hc.batch(map[string]interface{}{"put": put})
+	return err
+}
+
+func (hc *HTTPMapClient) MDelete(keys ...string) (int, error) {
+	json, err := hc.batch(map[string]interface{}{"delete": keys})
+	if err != nil {
+		return 0, err
+	}
+	return int(json["deleted"].(float64)), nil
+}
+
+func (hc *HTTPMapClient) batch(body map[string]interface{}) (map[string]interface{}, error) {
+	url := fmt.Sprintf("http://%s:%d%s/map/batch", hc.host, hc.port, hc.api())
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	json, err := hc.parseBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	if json["outcome"].(string) == "KO" {
+		return nil, errors.New(json["error"].(string))
+	}
+	return json, nil
+}
+
+func (hc *HTTPMapClient) Incr(key string, delta int64) (int64, error) {
+	url := fmt.Sprintf("http://%s%s/map", hc.node(key), hc.api())
+	body, err := json.Marshal(map[string]interface{}{"key": key, "delta": delta})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	c, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode == http.StatusInsufficientStorage {
+		return 0, ErrOutOfMemory
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return 0, ErrReadOnly
+	}
+	var res struct {
+		Outcome string      `json:"outcome"`
+		Error   string      `json:"error"`
+		Value   json.Number `json:"value"`
+	}
+	err = json.Unmarshal(c, &res)
+	if err != nil {
+		return 0, err
+	}
+	if res.Outcome != "OK" {
+		return 0, knownError(res.Error)
+	}
+	return res.Value.Int64()
+}
+
 func (hc *HTTPMapClient) parseBody(res *http.Response) (map[string]interface{}, error) {
+	if res.StatusCode == http.StatusInsufficientStorage {
+		return nil, ErrOutOfMemory
+	}
+	if res.StatusCode == http.StatusConflict {
+		return nil, ErrWrongType
+	}
+	if res.StatusCode == http.StatusForbidden {
+		return nil, ErrReadOnly
+	}
 	if res.StatusCode != 200 {
 		return nil, errors.New(res.Status)
 	}
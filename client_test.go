@@ -1,6 +1,9 @@
 package dmap
 
 import (
+	"bufio"
+	"fmt"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -37,6 +40,9 @@ func TestUDPMapClient(t *testing.T) {
 		t.Logf("error: unexpected value: %s\n", string(b))
 		t.Fail()
 	}
+	testConditional(t, uc)
+	testMulti(t, uc)
+	testIncr(t, uc)
 	s, err := uc.Size()
 	if err != nil {
 		t.Logf("error: unable to retrieve the size: %s\n", err.Error())
@@ -90,6 +96,9 @@ func TestTCPMapClient(t *testing.T) {
 		t.Logf("error: unexpected value: %s\n", string(b))
 		t.Fail()
 	}
+	testConditional(t, uc)
+	testMulti(t, uc)
+	testIncr(t, uc)
 	s, err := uc.Size()
 	if err != nil {
 		t.Logf("error: unable to retrieve the size: %s\n", err.Error())
@@ -144,6 +153,9 @@ func TestHTTPMapClient(t *testing.T) {
 		t.Logf("error: unexpected value: %s\n", string(b))
 		t.Fail()
 	}
+	testConditional(t, uc)
+	testMulti(t, uc)
+	testIncr(t, uc)
 	s, err := uc.Size()
 	if err != nil {
 		t.Logf("error: unable to retrieve the size: %s\n", err.Error())
@@ -170,3 +182,291 @@ func TestHTTPMapClient(t *testing.T) {
 	uc.Close()
 	time.Sleep(1 * time.Second)
 }
+
+func TestMapServerTTL(t *testing.T) {
+	m := NewMap()
+	ms := MapServer{m: m}
+	commands := []struct {
+		command  string
+		expected string
+	}{
+		{"PUT session token EX 10", "OK=5"},
+		{"TTL session", "OK=10"},
+		{"PERSIST session", "OK=1"},
+		{"TTL session", "OK=-1"},
+		{"EXPIRE session 20", "OK=1"},
+		{"TTL missing", "OK=-2"},
+		{"PUT session token EX 0", "KO=Bad command, EX expects a positive number of seconds"},
+	}
+	for _, c := range commands {
+		outcome, err := ms.execute([]byte(c.command))
+		if err != nil {
+			outcome = err.Error()
+		}
+		if outcome != c.expected {
+			t.Logf("error: %s: expected %s, got %s\n", c.command, c.expected, outcome)
+			t.Fail()
+		}
+	}
+}
+
+// testIncr leaves the map as it finds it.
+func testIncr(t *testing.T, c Client) {
+	n, err := c.Incr("counter12345", 5)
+	if err != nil || n != 5 {
+		t.Logf("error: unexpected counter: %d %v\n", n, err)
+		t.Fail()
+	}
+	n, err = c.Incr("counter12345", -7)
+	if err != nil || n != -2 {
+		t.Logf("error: unexpected counter: %d %v\n", n, err)
+		t.Fail()
+	}
+	_, err = c.Incr("key12345", 1)
+	if err != ErrNotInteger {
+		t.Logf("error: expected ErrNotInteger: %v\n", err)
+		t.Fail()
+	}
+	err = c.Delete("counter12345")
+	if err != nil {
+		t.Fatalf("error: unable to delete: %s\n", err.Error())
+	}
+}
+
+// testMulti leaves the map as it finds it.
+func testMulti(t *testing.T, c Client) {
+	err := c.MPut(map[string][]byte{"multi1": []byte("value1"), "multi2": []byte("value2")})
+	if err != nil {
+		t.Fatalf("error: unable to store: %s\n", err.Error())
+	}
+	values, err := c.MGet("multi1", "missing12345", "multi2")
+	if err != nil || len(values) != 3 {
+		t.Fatalf("error: unexpected values: %q %v\n", values, err)
+	}
+	if string(values[0]) != "value1" || values[1] != nil || string(values[2]) != "value2" {
+		t.Logf("error: unexpected values: %q\n", values)
+		t.Fail()
+	}
+	n, err := c.MDelete("multi1", "multi2", "missing12345")
+	if err != nil || n != 2 {
+		t.Logf("error: unexpected deletions: %d %v\n", n, err)
+		t.Fail()
+	}
+}
+
+func testConditional(t *testing.T, c Client) {
+	ok, err := c.PutIfAbsent("key12345", []byte("other"))
+	if err != nil || ok {
+		t.Logf("error: expected PutIfAbsent to be refused: %v\n", err)
+		t.Fail()
+	}
+	ok, err = c.CompareAndSwap("key12345", []byte("other"), []byte("swapped"))
+	if err != nil || ok {
+		t.Logf("error: expected CompareAndSwap to be refused: %v\n", err)
+		t.Fail()
+	}
+	ok, err = c.CompareAndSwap("key12345", []byte("value12345"), []byte("swapped"))
+	if err != nil || !ok {
+		t.Logf("error: expected CompareAndSwap to be applied: %v\n", err)
+		t.Fail()
+	}
+	ok, err = c.Replace("missing12345", []byte("value"))
+	if err != nil || ok {
+		t.Logf("error: expected Replace to be refused: %v\n", err)
+		t.Fail()
+	}
+	ok, err = c.PutIfAbsent("absent12345", []byte("value"))
+	if err != nil || !ok {
+		t.Logf("error: expected PutIfAbsent to be applied: %v\n", err)
+		t.Fail()
+	}
+	ok, err = c.CompareAndDelete("absent12345", []byte("value"))
+	if err != nil || !ok {
+		t.Logf("error: expected CompareAndDelete to be applied: %v\n", err)
+		t.Fail()
+	}
+	b, err := c.Get("key12345")
+	if err != nil || string(b) != "swapped" {
+		t.Logf("error: unexpected value: %s\n", string(b))
+		t.Fail()
+	}
+	ok, err = c.Replace("key12345", []byte("value12345"))
+	if err != nil || !ok {
+		t.Logf("error: expected Replace to be applied: %v\n", err)
+		t.Fail()
+	}
+}
+
+func TestBinaryMapClients(t *testing.T) {
+	m := NewMap()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	ts, err := NewTCPMapServer("localhost", 12347, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	go ts.Serve()
+	us, err := NewUDPMapServer("localhost", 12348, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the UDP server: %s\n", err.Error())
+	}
+	go us.Serve()
+	time.Sleep(100 * time.Millisecond)
+	tc := NewTCPMapClient("localhost", 12347)
+	tc.SetBinary(true)
+	uc := NewUDPMapClient("localhost", 12348)
+	uc.SetBinary(true)
+	value := []byte("a value with spaces,\r\nnewlines and \x00 bytes")
+	for _, c := range []Client{tc, uc} {
+		err = c.Dial()
+		if err != nil {
+			t.Fatalf("error: unable to dial in: %s\n", err.Error())
+		}
+		err = c.Put("key with spaces", value)
+		if err != nil {
+			t.Fatalf("error: unable to store: %s\n", err.Error())
+		}
+		b, err := c.Get("key with spaces")
+		if err != nil || string(b) != string(value) {
+			t.Logf("error: unexpected value: %q %v\n", string(b), err)
+			t.Fail()
+		}
+		b, err = c.Get("missing")
+		if err != nil || b != nil {
+			t.Logf("error: expected no value: %q %v\n", string(b), err)
+			t.Fail()
+		}
+		err = c.Put("key12345", []byte("value12345"))
+		if err != nil {
+			t.Fatalf("error: unable to store: %s\n", err.Error())
+		}
+		testConditional(t, c)
+		testMulti(t, c)
+		testIncr(t, c)
+		s, err := c.Size()
+		if err != nil || s != 2 {
+			t.Logf("error: unexpected size: %d %v\n", s, err)
+			t.Fail()
+		}
+		err = c.Delete("key with spaces")
+		if err != nil {
+			t.Logf("error: unable to delete: %s\n", err.Error())
+			t.Fail()
+		}
+		err = c.Clear()
+		if err != nil {
+			t.Logf("error: unable to clear: %s\n", err.Error())
+			t.Fail()
+		}
+		s, err = c.Size()
+		if err != nil || s != 0 {
+			t.Logf("error: unexpected size: %d %v\n", s, err)
+			t.Fail()
+		}
+		c.Close()
+	}
+	ts.Shutdown()
+	us.Shutdown()
+}
+
+func TestTCPMapClientPipeline(t *testing.T) {
+	m := NewMap()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ts, err := NewTCPMapServer("localhost", 12350, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	go ts.Serve()
+	defer ts.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	for _, binary := range []bool{false, true} {
+		tc := NewTCPMapClient("localhost", 12350)
+		tc.SetBinary(binary)
+		err = tc.Dial()
+		if err != nil {
+			t.Fatalf("error: unable to dial in: %s\n", err.Error())
+		}
+		p := tc.Pipeline()
+		n := 5000
+		for i := 0; i < n; i++ {
+			p.Put(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)))
+		}
+		p.Get("key42")
+		p.Get("missing")
+		p.PutIfAbsent("key42", []byte("other"))
+		p.CompareAndSwap("key42", []byte("value42"), []byte("swapped"))
+		p.Incr("counter", -3)
+		p.Size()
+		p.Clear()
+		results, err := p.Exec()
+		if err != nil {
+			t.Fatalf("error: unable to execute the pipeline: %s\n", err.Error())
+		}
+		if len(results) != n+7 || p.Len() != 0 {
+			t.Fatalf("error: unexpected results: %d\n", len(results))
+		}
+		for i := 0; i < n; i++ {
+			if results[i].Err != nil {
+				t.Fatalf("error: unable to store: %s\n", results[i].Err.Error())
+			}
+		}
+		results = results[n:]
+		if string(results[0].Value) != "value42" || results[1].Value != nil {
+			t.Logf("error: unexpected values: %q %q\n", results[0].Value, results[1].Value)
+			t.Fail()
+		}
+		if results[2].Bool() || !results[3].Bool() {
+			t.Logf("error: unexpected conditional outcomes\n")
+			t.Fail()
+		}
+		if c, err := results[4].Int(); err != nil || c != -3 {
+			t.Logf("error: unexpected counter: %d %v\n", c, err)
+			t.Fail()
+		}
+		if s, err := results[5].Int(); err != nil || s != n+1 {
+			t.Logf("error: unexpected size: %d %v\n", s, err)
+			t.Fail()
+		}
+		tc.Close()
+	}
+	// commands written one at a time with no newline, as older clients do
+	conn, err := net.Dial("tcp", "localhost:12350")
+	if err != nil {
+		t.Fatalf("error: unable to dial in: %s\n", err.Error())
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, c := range [][2]string{{"PUT plain value", "OK=5\r\n"}, {"GET plain", "OK=value\r\n"}, {"GET pla", ""}, {"in\r\n", "OK=value\r\n"}} {
+		conn.Write([]byte(c[0]))
+		if c[1] == "" {
+			continue
+		}
+		line, _ := r.ReadString('\n')
+		if line != c[1] {
+			t.Logf("error: unexpected response to %q: %q\n", c[0], line)
+			t.Fail()
+		}
+	}
+	// a connection having sent a newline waits for it, however slow the rest
+	lines, err := net.Dial("tcp", "localhost:12350")
+	if err != nil {
+		t.Fatalf("error: unable to dial in: %s\n", err.Error())
+	}
+	defer lines.Close()
+	lines.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r = bufio.NewReader(lines)
+	for _, c := range [][2]string{{"PUT split value\r\n", "OK=5\r\n"}, {"GET spl", ""}, {"it\r\n", "OK=value\r\n"}} {
+		lines.Write([]byte(c[0]))
+		if c[1] == "" {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		line, _ := r.ReadString('\n')
+		if line != c[1] {
+			t.Logf("error: unexpected response to %q: %q\n", c[0], line)
+			t.Fail()
+		}
+	}
+}
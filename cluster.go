@@ -0,0 +1,473 @@
+package dmap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ringReplicas is the number of virtual nodes per node on the ring.
+const ringReplicas = 160
+
+var ErrNoNodes = errors.New("No nodes in the cluster")
+
+// Ring is a consistent hash ring: every node is placed on the ring at many
+// points, its virtual nodes, and a key belongs to the node of the first point
+// following the hash of the key. Adding or removing a node moves only the
+// keys between its points and the previous ones, about 1/N of the keys.
+type Ring struct {
+	h      Hasher
+	n      int
+	points []uint64
+	owners map[uint64]string
+	nodes  map[string]struct{}
+}
+
+// NewRing returns an empty ring placing n virtual nodes per node, hashing
+// with XXH64.
+func NewRing(n int) *Ring {
+	if n <= 0 {
+		n = ringReplicas
+	}
+	return &Ring{h: XXH64, n: n, owners: make(map[uint64]string), nodes: make(map[string]struct{})}
+}
+
+func (r *Ring) Add(node string) {
+	if _, ok := r.nodes[node]; ok {
+		return
+	}
+	r.nodes[node] = struct{}{}
+	for i := 0; i < r.n; i++ {
+		p := r.h(node + "#" + strconv.Itoa(i))
+		if _, taken := r.owners[p]; taken {
+			continue
+		}
+		r.owners[p] = node
+		r.points = append(r.points, p)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func (r *Ring) Remove(node string) {
+	if _, ok := r.nodes[node]; !ok {
+		return
+	}
+	delete(r.nodes, node)
+	points := r.points[:0]
+	for _, p := range r.points {
+		if r.owners[p] == node {
+			delete(r.owners, p)
+			continue
+		}
+		points = append(points, p)
+	}
+	r.points = points
+}
+
+// Locate returns the node owning the key, empty if the ring is empty.
+func (r *Ring) Locate(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := r.h(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Nodes returns the nodes on the ring, in ascending order.
+func (r *Ring) Nodes() []string {
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// ClusterClient partitions the keys across many servers, a Client per node,
+// with a consistent hash ring: the commands on a key go to the node owning
+// it, the ones on many keys are split by node, and Size and Clear go to all
+// the nodes. The commands on many keys are atomic on each node, not across
+// the nodes. Nodes can be added and removed while in use: the keys whose
+// owner changes are not moved, and are to be copied by the caller.
+type ClusterClient struct {
+	l       sync.RWMutex
+	ring    *Ring
+	clients map[string]Client
+	dial    func(host string, port int) Client
+	dialed  bool
+}
+
+// NewClusterClient returns a client of the nodes, given as host:port, using
+// dial to make the client of each node, e.g. TCPNode.
+func NewClusterClient(dial func(host string, port int) Client, nodes ...string) (*ClusterClient, error) {
+	cc := &ClusterClient{ring: NewRing(ringReplicas), clients: make(map[string]Client), dial: dial}
+	for _, node := range nodes {
+		err := cc.AddNode(node)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cc, nil
+}
+
+// TCPNode makes a TCPMapClient, for NewClusterClient.
+func TCPNode(host string, port int) Client {
+	return NewTCPMapClient(host, port)
+}
+
+// HTTPNode makes an HTTPMapClient, for NewClusterClient.
+func HTTPNode(host string, port int) Client {
+	return NewHTTPMapClient(host, port)
+}
+
+// AddNode adds the node, dialing it in if the cluster is dialed in: about
+// 1/N of the keys move to it.
+func (cc *ClusterClient) AddNode(addr string) error {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return errors.New("Bad port: " + p)
+	}
+	cc.l.Lock()
+	defer cc.l.Unlock()
+	if cc.clients[addr] != nil {
+		return nil
+	}
+	c := cc.dial(host, port)
+	if cc.dialed {
+		err = c.Dial()
+		if err != nil {
+			return err
+		}
+	}
+	cc.clients[addr] = c
+	cc.ring.Add(addr)
+	return nil
+}
+
+// RemoveNode removes the node, closing its client: its keys move to the
+// following nodes on the ring.
+func (cc *ClusterClient) RemoveNode(addr string) error {
+	cc.l.Lock()
+	c := cc.clients[addr]
+	delete(cc.clients, addr)
+	cc.ring.Remove(addr)
+	dialed := cc.dialed
+	cc.l.Unlock()
+	if c != nil && dialed {
+		return c.Close()
+	}
+	return nil
+}
+
+// Nodes returns the nodes of the cluster, in ascending order.
+func (cc *ClusterClient) Nodes() []string {
+	cc.l.RLock()
+	defer cc.l.RUnlock()
+	return cc.ring.Nodes()
+}
+
+// Locate returns the node owning the key.
+func (cc *ClusterClient) Locate(key string) string {
+	cc.l.RLock()
+	defer cc.l.RUnlock()
+	return cc.ring.Locate(key)
+}
+
+// client returns the client of the node owning the key.
+func (cc *ClusterClient) client(key string) (Client, error) {
+	cc.l.RLock()
+	defer cc.l.RUnlock()
+	c := cc.clients[cc.ring.Locate(key)]
+	if c == nil {
+		return nil, ErrNoNodes
+	}
+	return c, nil
+}
+
+// each calls fn on the client of every node, concurrently, returning the
+// first error.
+func (cc *ClusterClient) each(fn func(c Client) error) error {
+	cc.l.RLock()
+	clients := make([]Client, 0, len(cc.clients))
+	for _, c := range cc.clients {
+		clients = append(clients, c)
+	}
+	cc.l.RUnlock()
+	if len(clients) == 0 {
+		return ErrNoNodes
+	}
+	errs := make([]error, len(clients))
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			errs[i] = fn(c)
+		}(i, c)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partition groups the keys by node, keeping the positions of the keys.
+func (cc *ClusterClient) partition(keys []string) (map[Client][]int, error) {
+	cc.l.RLock()
+	defer cc.l.RUnlock()
+	parts := make(map[Client][]int)
+	for i, key := range keys {
+		c := cc.clients[cc.ring.Locate(key)]
+		if c == nil {
+			return nil, ErrNoNodes
+		}
+		parts[c] = append(parts[c], i)
+	}
+	return parts, nil
+}
+
+// Dial dials in all the nodes, and the ones added later.
+func (cc *ClusterClient) Dial() error {
+	cc.l.Lock()
+	cc.dialed = true
+	cc.l.Unlock()
+	return cc.each(func(c Client) error {
+		return c.Dial()
+	})
+}
+
+func (cc *ClusterClient) Close() error {
+	cc.l.Lock()
+	cc.dialed = false
+	cc.l.Unlock()
+	return cc.each(func(c Client) error {
+		return c.Close()
+	})
+}
+
+func (cc *ClusterClient) Put(key string, value []byte) error {
+	c, err := cc.client(key)
+	if err != nil {
+		return err
+	}
+	return c.Put(key, value)
+}
+
+func (cc *ClusterClient) PutIfAbsent(key string, value []byte) (bool, error) {
+	c, err := cc.client(key)
+	if err != nil {
+		return false, err
+	}
+	return c.PutIfAbsent(key, value)
+}
+
+func (cc *ClusterClient) Replace(key string, value []byte) (bool, error) {
+	c, err := cc.client(key)
+	if err != nil {
+		return false, err
+	}
+	return c.Replace(key, value)
+}
+
+func (cc *ClusterClient) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	c, err := cc.client(key)
+	if err != nil {
+		return false, err
+	}
+	return c.CompareAndSwap(key, old, new)
+}
+
+func (cc *ClusterClient) CompareAndDelete(key string, old []byte) (bool, error) {
+	c, err := cc.client(key)
+	if err != nil {
+		return false, err
+	}
+	return c.CompareAndDelete(key, old)
+}
+
+func (cc *ClusterClient) Get(key string) ([]byte, error) {
+	c, err := cc.client(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.Get(key)
+}
+
+func (cc *ClusterClient) Delete(key string) error {
+	c, err := cc.client(key)
+	if err != nil {
+		return err
+	}
+	return c.Delete(key)
+}
+
+func (cc *ClusterClient) Incr(key string, delta int64) (int64, error) {
+	c, err := cc.client(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.Incr(key, delta)
+}
+
+// Watch watches the pattern on all the nodes, merging their events on a
+// channel closed once the channels of all the nodes are, e.g. when ctx is
+// done.
+func (cc *ClusterClient) Watch(ctx context.Context, pattern string) (<-chan Event, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	var l sync.Mutex
+	var chans []<-chan Event
+	err := cc.each(func(c Client) error {
+		ch, err := c.Watch(ctx, pattern)
+		if err != nil {
+			return err
+		}
+		l.Lock()
+		chans = append(chans, ch)
+		l.Unlock()
+		return nil
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	merged := make(chan Event, watchBuffer)
+	var wg sync.WaitGroup
+	for _, ch := range chans {
+		wg.Add(1)
+		go func(ch <-chan Event) {
+			defer wg.Done()
+			for ev := range ch {
+				select {
+				case merged <- ev:
+				case <-ctx.Done():
+				}
+			}
+		}(ch)
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(merged)
+	}()
+	return merged, nil
+}
+
+// MGet gets the values from the nodes concurrently, in the order of the keys.
+func (cc *ClusterClient) MGet(keys ...string) ([][]byte, error) {
+	parts, err := cc.partition(keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, len(keys))
+	err = cc.fanOut(parts, func(c Client, idx []int) error {
+		part := make([]string, len(idx))
+		for i, j := range idx {
+			part[i] = keys[j]
+		}
+		vs, err := c.MGet(part...)
+		if err != nil {
+			return err
+		}
+		for i, j := range idx {
+			values[j] = vs[i]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (cc *ClusterClient) MPut(values map[string][]byte) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	parts, err := cc.partition(keys)
+	if err != nil {
+		return err
+	}
+	return cc.fanOut(parts, func(c Client, idx []int) error {
+		part := make(map[string][]byte, len(idx))
+		for _, j := range idx {
+			part[keys[j]] = values[keys[j]]
+		}
+		return c.MPut(part)
+	})
+}
+
+// MDelete returns the number of keys deleted across the nodes.
+func (cc *ClusterClient) MDelete(keys ...string) (int, error) {
+	parts, err := cc.partition(keys)
+	if err != nil {
+		return 0, err
+	}
+	var l sync.Mutex
+	n := 0
+	err = cc.fanOut(parts, func(c Client, idx []int) error {
+		part := make([]string, len(idx))
+		for i, j := range idx {
+			part[i] = keys[j]
+		}
+		deleted, err := c.MDelete(part...)
+		l.Lock()
+		n += deleted
+		l.Unlock()
+		return err
+	})
+	return n, err
+}
+
+// fanOut calls fn on the keys of every node, concurrently, returning the
+// first error.
+func (cc *ClusterClient) fanOut(parts map[Client][]int, fn func(c Client, idx []int) error) error {
+	errs := make(chan error, len(parts))
+	for c, idx := range parts {
+		go func(c Client, idx []int) {
+			errs <- fn(c, idx)
+		}(c, idx)
+	}
+	var err error
+	for range parts {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Size returns the sum of the sizes of the nodes.
+func (cc *ClusterClient) Size() (int, error) {
+	var l sync.Mutex
+	n := 0
+	err := cc.each(func(c Client) error {
+		size, err := c.Size()
+		l.Lock()
+		n += size
+		l.Unlock()
+		return err
+	})
+	return n, err
+}
+
+// Clear clears all the nodes.
+func (cc *ClusterClient) Clear() error {
+	return cc.each(func(c Client) error {
+		return c.Clear()
+	})
+}
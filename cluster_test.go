@@ -0,0 +1,198 @@
+package dmap
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	r := NewRing(0)
+	if r.Locate("key") != "" {
+		t.Fatalf("expected no node on an empty ring\n")
+	}
+	for _, node := range []string{"a:1", "b:1", "c:1"} {
+		r.Add(node)
+	}
+	before := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		before[key] = r.Locate(key)
+		counts[before[key]]++
+	}
+	for node, n := range counts {
+		if n < 7000 || n > 13000 {
+			t.Logf("unbalanced node %s: %d keys\n", node, n)
+			t.Fail()
+		}
+	}
+	r.Add("d:1")
+	moved := 0
+	for key, node := range before {
+		if now := r.Locate(key); now != node {
+			moved++
+			if now != "d:1" {
+				t.Fatalf("expected the keys to move to the new node only: %s\n", now)
+			}
+		}
+	}
+	if moved < 5000 || moved > 10000 {
+		t.Logf("expected about a quarter of the keys moved: %d\n", moved)
+		t.Fail()
+	}
+	r.Remove("d:1")
+	for key, node := range before {
+		if r.Locate(key) != node {
+			t.Fatalf("expected the keys back on their nodes\n")
+		}
+	}
+	r.Remove("b:1")
+	for key, node := range before {
+		if now := r.Locate(key); node != "b:1" && now != node {
+			t.Fatalf("expected only the keys of the removed node moved\n")
+		}
+	}
+	if nodes := r.Nodes(); len(nodes) != 2 || nodes[0] != "a:1" || nodes[1] != "c:1" {
+		t.Logf("unexpected nodes: %v\n", nodes)
+		t.Fail()
+	}
+}
+
+func TestClusterClient(t *testing.T) {
+	var wg sync.WaitGroup
+	maps := make(map[string]*Map)
+	var nodes []string
+	for port := 12366; port <= 12369; port++ {
+		m := NewMap()
+		wg.Add(1)
+		ts, err := NewTCPMapServer("localhost", port, &wg, m, true)
+		if err != nil {
+			t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+		}
+		go ts.Serve()
+		defer ts.Shutdown()
+		addr := fmt.Sprintf("localhost:%d", port)
+		maps[addr] = m
+		nodes = append(nodes, addr)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := NewClusterClient(TCPNode, "localhost"); err == nil {
+		t.Fatalf("expected a bad address refused\n")
+	}
+	cc, err := NewClusterClient(TCPNode, nodes[:3]...)
+	if err != nil {
+		t.Fatalf("error: unable to make the client: %s\n", err.Error())
+	}
+	if err := cc.Dial(); err != nil {
+		t.Fatalf("error: unable to dial in: %s\n", err.Error())
+	}
+	defer cc.Close()
+	var keys []string
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%d", i)
+		keys = append(keys, key)
+		if err := cc.Put(key, []byte(key)); err != nil {
+			t.Fatalf("error: unable to put: %s\n", err.Error())
+		}
+	}
+	for _, key := range keys {
+		if !maps[cc.Locate(key)].Exists(key) {
+			t.Fatalf("expected the key on its node: %s\n", key)
+		}
+	}
+	for _, addr := range nodes[:3] {
+		if maps[addr].Size() == 0 || maps[addr].Size() == 300 {
+			t.Logf("expected the keys spread: %s %d\n", addr, maps[addr].Size())
+			t.Fail()
+		}
+	}
+	if n, err := cc.Size(); err != nil || n != 300 {
+		t.Logf("unexpected size: %d %v\n", n, err)
+		t.Fail()
+	}
+	values, err := cc.MGet("key7", "none", "key250", "key3")
+	if err != nil || string(values[0]) != "key7" || values[1] != nil || string(values[2]) != "key250" || string(values[3]) != "key3" {
+		t.Logf("unexpected values: %q %v\n", values, err)
+		t.Fail()
+	}
+	if n, err := cc.Incr("counter", 5); err != nil || n != 5 || !maps[cc.Locate("counter")].Exists("counter") {
+		t.Logf("unexpected increment: %d %v\n", n, err)
+		t.Fail()
+	}
+	if n, err := cc.MDelete("key1", "key2", "none", "counter"); err != nil || n != 3 {
+		t.Logf("unexpected deletions: %d %v\n", n, err)
+		t.Fail()
+	}
+	owners := make(map[string]string)
+	for _, key := range keys {
+		owners[key] = cc.Locate(key)
+	}
+	if err := cc.AddNode(nodes[3]); err != nil {
+		t.Fatalf("error: unable to add a node: %s\n", err.Error())
+	}
+	moved := 0
+	for _, key := range keys {
+		if now := cc.Locate(key); now != owners[key] {
+			if now != nodes[3] {
+				t.Fatalf("expected the keys to move to the new node only\n")
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 150 {
+		t.Logf("unexpected keys moved: %d\n", moved)
+		t.Fail()
+	}
+	cc.Put("new", []byte("value"))
+	if cc.Locate("new") == nodes[3] && !maps[nodes[3]].Exists("new") {
+		t.Logf("expected the new node dialed in\n")
+		t.Fail()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := cc.Watch(ctx, "watched:*")
+	if err != nil {
+		t.Fatalf("error: unable to watch: %s\n", err.Error())
+	}
+	watched := make(map[string]bool)
+	for i := 0; len(watched) < 3 && i < 100; i++ {
+		key := fmt.Sprintf("watched:%d", i)
+		if owner := cc.Locate(key); !watched[owner] {
+			watched[owner] = true
+			maps[owner].Put(key, []byte("value"))
+		}
+	}
+	for n := len(watched); n > 0; n-- {
+		select {
+		case ev := <-events:
+			delete(watched, cc.Locate(ev.Key))
+		case <-time.After(time.Second):
+			t.Fatalf("expected the changes on every node: %v\n", watched)
+		}
+	}
+	if len(watched) != 0 {
+		t.Logf("expected the changes on every node: %v\n", watched)
+		t.Fail()
+	}
+	cancel()
+	for range events {
+	}
+	if err := cc.Clear(); err != nil {
+		t.Fatalf("error: unable to clear: %s\n", err.Error())
+	}
+	if n, _ := cc.Size(); n != 0 {
+		t.Logf("expected all the nodes cleared: %d\n", n)
+		t.Fail()
+	}
+	cc.RemoveNode(nodes[0])
+	if len(cc.Nodes()) != 3 {
+		t.Logf("unexpected nodes: %v\n", cc.Nodes())
+		t.Fail()
+	}
+	if err := cc.MPut(map[string][]byte{"a": []byte("1"), "b": []byte("2"), "c": []byte("3")}); err != nil || maps[nodes[0]].Size() != 0 {
+		t.Logf("expected the removed node unused: %v\n", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,141 @@
+package dmap
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var ErrOutOfMemory = errors.New("OOM command not allowed when used memory > max memory")
+
+type Eviction int
+
+const (
+	EvictNone Eviction = iota
+	EvictLRU
+	EvictLFU
+	EvictRandom
+	EvictVolatileTTL
+)
+
+const (
+	evictionSamples = 5
+	lfuDecay        = time.Minute
+)
+
+func ParseEviction(policy string) (Eviction, error) {
+	switch policy {
+	case "noeviction":
+		return EvictNone, nil
+	case "lru":
+		return EvictLRU, nil
+	case "lfu":
+		return EvictLFU, nil
+	case "random":
+		return EvictRandom, nil
+	case "volatile-ttl":
+		return EvictVolatileTTL, nil
+	}
+	return EvictNone, fmt.Errorf("unrecognized eviction policy: %s, <noeviction|lru|lfu|random|volatile-ttl>", policy)
+}
+
+// WithMaxMemory bounds the bytes taken by keys and values: the bound is split
+// evenly among the shards, a byte each at least, and enforced per shard by
+// the eviction policy. A bound below the number of shards fits hardly any
+// key: the shards are to be lowered along with it, by WithShards.
+func WithMaxMemory(bytes int64) Option {
+	return func(m *Map) {
+		m.max = bytes
+	}
+}
+
+// WithEviction sets the policy picking the keys to evict when a shard is out
+// of memory: EvictNone, the default, refuses the writes instead.
+func WithEviction(policy Eviction) Option {
+	return func(m *Map) {
+		m.ev = policy
+	}
+}
+
+func (ev Eviction) tracks() bool {
+	return ev == EvictLRU || ev == EvictLFU
+}
+
+func (it *item) touch(now int64) {
+	atomic.StoreInt64(&it.a, now)
+	f := atomic.LoadUint32(&it.f)
+	if f < ^uint32(0) {
+		atomic.CompareAndSwapUint32(&it.f, f, f+1)
+	}
+}
+
+// frequency halves the access count for every lfuDecay the item has been idle.
+func (it *item) frequency(now int64) uint32 {
+	idle := time.Duration(now - atomic.LoadInt64(&it.a))
+	decay := idle / lfuDecay
+	if decay > 31 {
+		return 0
+	}
+	return atomic.LoadUint32(&it.f) >> uint(decay)
+}
+
+// reserve makes room in the shard for delta more bytes, evicting keys other
+// than key, and than the ones of the batch being written, according to the
+// policy: the write lock must be held.
+func (e *entry) reserve(key string, delta int64, now int64) error {
+	max := e.p.max
+	if max <= 0 {
+		return nil
+	}
+	for e.u+delta > max {
+		victim, ok := e.victim(key, now)
+		if !ok {
+			return ErrOutOfMemory
+		}
+		e.remove(victim)
+	}
+	return nil
+}
+
+// victim samples a few keys of the shard, approximating the policy as Redis
+// does, and returns the best one to evict.
+func (e *entry) victim(key string, now int64) (string, bool) {
+	ev := e.p.ev
+	if ev == EvictNone {
+		return "", false
+	}
+	candidates := e.m
+	if ev == EvictVolatileTTL {
+		candidates = e.x
+	}
+	var victim string
+	var best *item
+	n := 0
+	for k, it := range candidates {
+		if _, ok := e.b[k]; ok || k == key {
+			continue
+		}
+		if best == nil || ev.prefers(it, best, now) {
+			victim, best = k, it
+		}
+		n++
+		if n == evictionSamples || ev == EvictRandom {
+			break
+		}
+	}
+	return victim, best != nil
+}
+
+func (ev Eviction) prefers(it, best *item, now int64) bool {
+	switch ev {
+	case EvictLRU:
+		return atomic.LoadInt64(&it.a) < atomic.LoadInt64(&best.a)
+	case EvictLFU:
+		f, g := it.frequency(now), best.frequency(now)
+		return f < g || (f == g && atomic.LoadInt64(&it.a) < atomic.LoadInt64(&best.a))
+	case EvictVolatileTTL:
+		return it.x < best.x
+	}
+	return false
+}
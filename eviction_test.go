@@ -0,0 +1,125 @@
+package dmap
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMapMemory(t *testing.T) {
+	m := NewMap()
+	m.Put("key", []byte("value"))
+	m.Put("key", []byte("longer value"))
+	m.Put("other", []byte("value"))
+	if m.Memory() != int64(3+12+5+5) {
+		t.Logf("unexpected memory: %d\n", m.Memory())
+		t.Fail()
+	}
+	m.Delete("key")
+	if m.Memory() != 10 {
+		t.Logf("unexpected memory: %d\n", m.Memory())
+		t.Fail()
+	}
+	m.Clear()
+	if m.Memory() != 0 {
+		t.Logf("unexpected memory: %d\n", m.Memory())
+		t.Fail()
+	}
+}
+
+func TestMapNoEviction(t *testing.T) {
+	m := NewMap(WithShards(1), WithMaxMemory(20))
+	if m.Put("key1", []byte("value1")) != nil || m.Put("key2", []byte("value2")) != nil {
+		t.Fatalf("unexpected refusal\n")
+	}
+	if m.Put("key3", []byte("value3")) != ErrOutOfMemory {
+		t.Logf("expected the write to be refused\n")
+		t.Fail()
+	}
+	if _, err := m.PutIfAbsent("key3", []byte("value3")); err != ErrOutOfMemory {
+		t.Logf("expected the conditional write to be refused\n")
+		t.Fail()
+	}
+	if m.Put("key1", []byte("value")) != nil {
+		t.Logf("expected a shrinking write to be accepted\n")
+		t.Fail()
+	}
+	ms := MapServer{m: m}
+	_, err := ms.execute([]byte("PUT key3 value3"))
+	if err == nil || err.Error() != "KO="+ErrOutOfMemory.Error() {
+		t.Logf("expected KO=OOM: %v\n", err)
+		t.Fail()
+	}
+	small := NewMap(WithMaxMemory(100))
+	refused := 0
+	for i := 0; i < 1000; i++ {
+		if small.Put(fmt.Sprintf("key%d", i), []byte("value")) == ErrOutOfMemory {
+			refused++
+		}
+	}
+	if refused == 0 || small.Memory() > 100 {
+		t.Logf("expected the bound kept below the number of shards: %d %d\n", refused, small.Memory())
+		t.Fail()
+	}
+}
+
+func TestMapEvictLRU(t *testing.T) {
+	m := NewMap(WithShards(1), WithMaxMemory(30), WithEviction(EvictLRU))
+	for i := 0; i < 3; i++ {
+		m.Put(fmt.Sprintf("key%d", i), []byte("value"))
+		time.Sleep(time.Millisecond)
+	}
+	m.Get("key0")
+	m.Put("key3", []byte("value"))
+	if m.Size() != 3 || m.Get("key1") != nil || m.Get("key0") == nil {
+		t.Logf("expected key1 to be evicted: %d\n", m.Size())
+		t.Fail()
+	}
+}
+
+func TestMapEvictLFU(t *testing.T) {
+	m := NewMap(WithShards(1), WithMaxMemory(30), WithEviction(EvictLFU))
+	for i := 0; i < 3; i++ {
+		m.Put(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+	for i := 0; i < 10; i++ {
+		m.Get("key0")
+		m.Get("key2")
+	}
+	m.Put("key3", []byte("value"))
+	if m.Size() != 3 || m.Get("key1") != nil {
+		t.Logf("expected key1 to be evicted: %d\n", m.Size())
+		t.Fail()
+	}
+}
+
+func TestMapEvictVolatileTTL(t *testing.T) {
+	m := NewMap(WithShards(1), WithMaxMemory(30), WithEviction(EvictVolatileTTL))
+	m.Put("key0", []byte("value"))
+	m.PutWithTTL("key1", []byte("value"), time.Hour)
+	m.PutWithTTL("key2", []byte("value"), time.Minute)
+	m.Put("key3", []byte("value"))
+	if m.Get("key2") != nil || m.Get("key1") == nil || m.Get("key0") == nil {
+		t.Logf("expected key2 to be evicted\n")
+		t.Fail()
+	}
+	m.Put("key4", []byte("value"))
+	if m.Put("key5", []byte("value")) != ErrOutOfMemory {
+		t.Logf("expected the write to be refused with no volatile key left\n")
+		t.Fail()
+	}
+}
+
+func TestMapEvictRandom(t *testing.T) {
+	m := NewMap(WithShards(1), WithMaxMemory(100), WithEviction(EvictRandom))
+	for i := 0; i < 100; i++ {
+		err := m.Put(fmt.Sprintf("key%d", i%100), []byte("value"))
+		if err != nil {
+			t.Fatalf("unexpected refusal: %s\n", err.Error())
+		}
+	}
+	if m.Memory() > 100 {
+		t.Logf("memory above the bound: %d\n", m.Memory())
+		t.Fail()
+	}
+}
@@ -0,0 +1,349 @@
+package dmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The binary protocol exchanges frames made of a 14 bytes header, i.e. magic
+// byte, opcode (status, in responses), request id, key length and value
+// length (big endian), followed by key and value: a connection (or a UDP
+// datagram) starting with the magic byte speaks it, instead of the text one.
+const (
+	frameMagic  = 0xdb
+	frameHeader = 14
+	frameMaxLen = 64 << 20
+)
+
+const (
+	opPut byte = iota + 1
+	opGet
+	opDel
+	opSize
+	opClear
+	opPutNX
+	opPutXX
+	opCAS
+	opCAD
+	opPing
+	opMGet
+	opMSet
+	opMDel
+	opPublish
+	opIncr
+	opTyped
+	opGetV
+	opSelect
+	opAsking
+	opImport
+)
+
+// writeOps are the opcodes refused by read-only replicas, along with the
+// write commands carried by opTyped.
+var writeOps = map[byte]bool{
+	opPut: true, opDel: true, opClear: true, opPutNX: true, opPutXX: true,
+	opCAS: true, opCAD: true, opMSet: true, opMDel: true, opIncr: true,
+	opImport: true,
+}
+
+const (
+	statusOK byte = iota
+	statusNotFound
+	statusError
+	statusOOM
+	statusFalse
+)
+
+type frame struct {
+	op    byte
+	id    uint32
+	key   []byte
+	value []byte
+}
+
+func (f *frame) encode(buf []byte) []byte {
+	buf = append(buf, frameMagic, f.op)
+	buf = binary.BigEndian.AppendUint32(buf, f.id)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(f.key)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(f.value)))
+	buf = append(buf, f.key...)
+	return append(buf, f.value...)
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	var header [frameHeader]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	f, kl, vl, err := parseHeader(header[:])
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, kl+vl)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	f.key, f.value = payload[:kl], payload[kl:]
+	return f, nil
+}
+
+// parseFrame decodes a frame received as a whole, e.g. a UDP datagram,
+// copying its payload out of buf.
+func parseFrame(buf []byte) (*frame, error) {
+	if len(buf) < frameHeader {
+		return nil, io.ErrUnexpectedEOF
+	}
+	f, kl, vl, err := parseHeader(buf[:frameHeader])
+	if err != nil {
+		return nil, err
+	}
+	if len(buf)-frameHeader != kl+vl {
+		return nil, errors.New("frame length mismatch")
+	}
+	payload := append([]byte(nil), buf[frameHeader:]...)
+	f.key, f.value = payload[:kl], payload[kl:]
+	return f, nil
+}
+
+func parseHeader(header []byte) (*frame, int, int, error) {
+	if header[0] != frameMagic {
+		return nil, 0, 0, errors.New("bad frame magic")
+	}
+	kl := binary.BigEndian.Uint32(header[6:])
+	vl := binary.BigEndian.Uint32(header[10:])
+	if kl > frameMaxLen || vl > frameMaxLen {
+		return nil, 0, 0, errors.New("frame too large")
+	}
+	f := &frame{op: header[1], id: binary.BigEndian.Uint32(header[2:])}
+	return f, int(kl), int(vl), nil
+}
+
+// casValue packs old and new values of a CAS as the frame value: length of
+// the old one (4 bytes, big endian), old and new.
+func casValue(old, new []byte) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(old)))
+	buf = append(buf, old...)
+	return append(buf, new...)
+}
+
+func splitCASValue(value []byte) ([]byte, []byte, error) {
+	if len(value) < 4 {
+		return nil, nil, errors.New("malformed CAS value")
+	}
+	l := binary.BigEndian.Uint32(value)
+	if uint64(l) > uint64(len(value)-4) {
+		return nil, nil, errors.New("malformed CAS value")
+	}
+	return value[4 : 4+l], value[4+l:], nil
+}
+
+// packList packs the items of a multi-key command as the frame value: each
+// one is preceded by its length (4 bytes, big endian), 0xffffffff for nil.
+func packList(items [][]byte) []byte {
+	var buf []byte
+	for _, it := range items {
+		if it == nil {
+			buf = binary.BigEndian.AppendUint32(buf, ^uint32(0))
+			continue
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(it)))
+		buf = append(buf, it...)
+	}
+	return buf
+}
+
+func unpackList(value []byte) ([][]byte, error) {
+	var items [][]byte
+	for len(value) > 0 {
+		if len(value) < 4 {
+			return nil, errors.New("malformed list value")
+		}
+		l := binary.BigEndian.Uint32(value)
+		value = value[4:]
+		if l == ^uint32(0) {
+			items = append(items, nil)
+			continue
+		}
+		if uint64(l) > uint64(len(value)) {
+			return nil, errors.New("malformed list value")
+		}
+		items = append(items, value[:l])
+		value = value[l:]
+	}
+	return items, nil
+}
+
+// executeFrame runs the command carried by the request, answering with a
+// frame having the same id.
+func (ms *MapServer) executeFrame(req *frame) *frame {
+	res := &frame{op: statusOK, id: req.id}
+	key := string(req.key)
+	var err error
+	var ok bool
+	if writeOps[req.op] && ms.repl != nil && ms.repl.ReadOnly() {
+		return &frame{op: statusError, id: req.id, value: []byte(ErrReadOnly.Error())}
+	}
+	if err := ms.resolve(writeOps[req.op]); err != nil {
+		return &frame{op: statusError, id: req.id, value: []byte(err.Error())}
+	}
+	if req.op == opAsking {
+		ms.asking = true
+		return res
+	}
+	done, err := ms.moved(frameKeys(req.op, req.key, req.value))
+	if err != nil {
+		return &frame{op: statusError, id: req.id, value: []byte(err.Error())}
+	}
+	defer done()
+	if writeOps[req.op] && ms.raft != nil && ms.m == ms.raft.m {
+		return ms.executeRaftFrame(req)
+	}
+	switch req.op {
+	case opPut:
+		err = ms.m.Put(key, req.value)
+		res.value = []byte(strconv.Itoa(len(req.value)))
+	case opGet:
+		if len(req.value) == 8 {
+			var ok bool
+			res.value, ok = ms.m.GetAt(key, binary.BigEndian.Uint64(req.value))
+			if !ok {
+				res.op = statusNotFound
+			}
+			break
+		}
+		res.value = ms.m.Get(key)
+		if res.value == nil && ms.m.typedKey(key) {
+			err = ErrWrongType
+		} else if res.value == nil {
+			res.op = statusNotFound
+		}
+	case opGetV:
+		value, meta, ok := ms.m.GetWithMeta(key)
+		if !ok {
+			res.op = statusNotFound
+		} else if value == nil && ms.m.typedKey(key) {
+			err = ErrWrongType
+		} else {
+			res.value = binary.BigEndian.AppendUint64(nil, meta.Version)
+			res.value = binary.BigEndian.AppendUint64(res.value, uint64(meta.Modified.UnixNano()))
+			res.value = append(res.value, value...)
+		}
+	case opSelect:
+		err = ms.selectNamespace(key)
+	case opDel:
+		ms.m.Delete(key)
+	case opSize:
+		res.value = binary.BigEndian.AppendUint64(nil, uint64(ms.m.Size()))
+	case opClear:
+		ms.m.Clear()
+	case opPutNX:
+		ok, err = ms.m.PutIfAbsent(key, req.value)
+		res.op = condition(ok)
+	case opPutXX:
+		ok, err = ms.m.Replace(key, req.value)
+		res.op = condition(ok)
+	case opCAS:
+		var old, new []byte
+		old, new, err = splitCASValue(req.value)
+		if err == nil {
+			ok, err = ms.m.CompareAndSwap(key, old, new)
+			res.op = condition(ok)
+		}
+	case opCAD:
+		res.op = condition(ms.m.CompareAndDelete(key, req.value))
+	case opPing:
+		res.value = req.value
+	case opIncr:
+		if len(req.value) != 8 {
+			err = errors.New("malformed delta")
+			break
+		}
+		var n int64
+		n, err = ms.m.Incr(key, int64(binary.BigEndian.Uint64(req.value)))
+		res.value = binary.BigEndian.AppendUint64(nil, uint64(n))
+	case opPublish:
+		if ms.ps == nil {
+			err = errPubSubDisabled
+		} else {
+			res.value = binary.BigEndian.AppendUint64(nil, uint64(ms.ps.Publish(key, req.value)))
+		}
+	case opMGet, opMSet, opMDel:
+		res.value, err = ms.executeMulti(req.op, req.value)
+	case opImport:
+		err = ms.executeImport(req.value)
+	case opTyped:
+		var args [][]byte
+		args, err = unpackList(req.value)
+		if err == nil && len(args) == 0 {
+			err = errors.New("malformed list value: no command")
+		}
+		if err != nil {
+			break
+		}
+		if ms.readOnly(strings.ToLower(string(args[0]))) {
+			err = ErrReadOnly
+			break
+		}
+		if err = ms.resolve(writeCommands[strings.ToLower(string(args[0]))]); err != nil {
+			break
+		}
+		if ms.consensus(strings.ToLower(string(args[0]))) {
+			err = errRaftUnsupported
+			break
+		}
+		var r reply
+		r, ok, err = ms.executeTyped(args)
+		if err == nil && !ok {
+			err = errors.New("Unrecognized command: " + string(args[0]))
+		}
+		if err == nil {
+			res = r.frame(req.id)
+		}
+	default:
+		err = errors.New("Unrecognized opcode: " + strconv.Itoa(int(req.op)))
+	}
+	if err == ErrOutOfMemory {
+		return &frame{op: statusOOM, id: req.id, value: []byte(err.Error())}
+	}
+	if err != nil {
+		return &frame{op: statusError, id: req.id, value: []byte(err.Error())}
+	}
+	return res
+}
+
+func (ms *MapServer) executeMulti(op byte, value []byte) ([]byte, error) {
+	items, err := unpackList(value)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(items))
+	for i, it := range items {
+		keys[i] = string(it)
+	}
+	switch op {
+	case opMGet:
+		return packList(ms.m.MGet(keys...)), nil
+	case opMSet:
+		if len(items)%2 != 0 {
+			return nil, errors.New("malformed list value: odd number of items")
+		}
+		values := make(map[string][]byte, len(items)/2)
+		for i := 0; i < len(items); i += 2 {
+			values[keys[i]] = items[i+1]
+		}
+		return nil, ms.m.MPut(values)
+	}
+	return binary.BigEndian.AppendUint64(nil, uint64(ms.m.MDelete(keys...))), nil
+}
+
+func condition(ok bool) byte {
+	if ok {
+		return statusOK
+	}
+	return statusFalse
+}
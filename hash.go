@@ -0,0 +1,98 @@
+package dmap
+
+// Hasher maps a key onto a 64 bits hash, used to address the Map shards.
+type Hasher func(key string) uint64
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// FNV1a is the 64 bits FNV-1a hash, it is the default Hasher.
+func FNV1a(key string) uint64 {
+	h := uint64(fnvOffset64)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= fnvPrime64
+	}
+	return h
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// XXH64 is the 64 bits xxHash (seed 0): faster than FNV1a on long keys.
+func XXH64(key string) uint64 {
+	n := len(key)
+	p := 0
+	var h uint64
+	if n >= 32 {
+		p1, p2 := xxPrime1, xxPrime2
+		v1 := p1 + p2
+		v2 := p2
+		v3 := uint64(0)
+		v4 := -p1
+		for ; p+32 <= n; p += 32 {
+			v1 = xxRound(v1, read64(key, p))
+			v2 = xxRound(v2, read64(key, p+8))
+			v3 = xxRound(v3, read64(key, p+16))
+			v4 = xxRound(v4, read64(key, p+24))
+		}
+		h = rotl64(v1, 1) + rotl64(v2, 7) + rotl64(v3, 12) + rotl64(v4, 18)
+		h = xxMerge(h, v1)
+		h = xxMerge(h, v2)
+		h = xxMerge(h, v3)
+		h = xxMerge(h, v4)
+	} else {
+		h = xxPrime5
+	}
+	h += uint64(n)
+	for ; p+8 <= n; p += 8 {
+		h ^= xxRound(0, read64(key, p))
+		h = rotl64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if p+4 <= n {
+		h ^= uint64(read32(key, p)) * xxPrime1
+		h = rotl64(h, 23)*xxPrime2 + xxPrime3
+		p += 4
+	}
+	for ; p < n; p++ {
+		h ^= uint64(key[p]) * xxPrime5
+		h = rotl64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = rotl64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMerge(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func rotl64(x uint64, r uint) uint64 {
+	return (x << r) | (x >> (64 - r))
+}
+
+func read64(s string, p int) uint64 {
+	return uint64(s[p]) | uint64(s[p+1])<<8 | uint64(s[p+2])<<16 | uint64(s[p+3])<<24 |
+		uint64(s[p+4])<<32 | uint64(s[p+5])<<40 | uint64(s[p+6])<<48 | uint64(s[p+7])<<56
+}
+
+func read32(s string, p int) uint32 {
+	return uint32(s[p]) | uint32(s[p+1])<<8 | uint32(s[p+2])<<16 | uint32(s[p+3])<<24
+}
@@ -0,0 +1,244 @@
+package dmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Range calls fn for every key and its value, nil for lists, sets and
+// hashes, until fn returns false. Shards are visited one at a time: the keys
+// of a shard are copied under its read lock, as they are at that point in
+// time, and fn is called once the lock is released, so that it can read and
+// write the Map. Writes to the shards not visited yet may or may not be seen.
+func (m *Map) Range(fn func(key string, value []byte) bool) {
+	m.rangeItems(func(key string, it *item) bool {
+		return fn(key, it.v)
+	})
+}
+
+func (m *Map) rangeItems(fn func(key string, it *item) bool) {
+	var keys []string
+	var items []*item
+	for i := range m.e {
+		e := &m.e[i]
+		keys, items = keys[:0], items[:0]
+		now := time.Now().UnixNano()
+		e.l.RLock()
+		for k, it := range e.m {
+			if !it.expired(now) {
+				keys = append(keys, k)
+				items = append(items, it)
+			}
+		}
+		e.l.RUnlock()
+		for j := range keys {
+			if !fn(keys[j], items[j]) {
+				return
+			}
+		}
+	}
+}
+
+// Values returns the values of all the keys, in ascending order of the keys
+// and nil for lists, sets and hashes: all the shards are read locked at once,
+// so the values are those held by the Map at a point in time.
+func (m *Map) Values() [][]byte {
+	unlock := m.lockAll(false)
+	defer unlock()
+	now := time.Now().UnixNano()
+	var keys []string
+	for i := range m.e {
+		keys = append(keys, m.e[i].keys("", "", 0, now)...)
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = m.shard(key).m[key].v
+	}
+	return values
+}
+
+// Clone returns a deep copy of the Map, taken at a point in time as Values
+// is: the copy has the same options but no observers, e.g. the append-only
+// log, and it has to be closed on its own.
+func (m *Map) Clone() *Map {
+	c := &Map{
+		s:    m.s,
+		h:    m.h,
+		i:    m.i,
+		max:  m.max,
+		ev:   m.ev,
+		ix:   m.ix,
+		hist: m.hist,
+		e:    make([]entry, len(m.e)),
+		done: make(chan struct{}),
+	}
+	c.o.Store([]*observer{})
+	unlock := m.lockAll(false)
+	c.ver = atomic.LoadUint64(&m.ver)
+	for i := range m.e {
+		e, ce := &m.e[i], &c.e[i]
+		ce.m = make(map[string]*item, len(e.m))
+		ce.x = make(map[string]*item, len(e.x))
+		ce.p, ce.i, ce.u = c, i, e.u
+		if c.ix {
+			ce.k = newSkiplist()
+		}
+		for k, it := range e.m {
+			cit := it.clone()
+			ce.m[k] = cit
+			if cit.x != 0 {
+				ce.x[k] = cit
+				c.expiring()
+			}
+			if ce.k != nil {
+				ce.k.insert(k)
+			}
+		}
+	}
+	unlock()
+	return c
+}
+
+// lockAll locks all the shards, in ascending order, returning the function
+// to unlock them.
+func (m *Map) lockAll(write bool) func() {
+	for i := range m.e {
+		if write {
+			m.e[i].l.Lock()
+		} else {
+			m.e[i].l.RLock()
+		}
+	}
+	return func() {
+		for i := range m.e {
+			if write {
+				m.e[i].l.Unlock()
+			} else {
+				m.e[i].l.RUnlock()
+			}
+		}
+	}
+}
+
+// clone returns a deep copy of the item, past values included.
+func (it *item) clone() *item {
+	c := *it
+	c.v = bytes.Clone(it.v)
+	if it.h != nil {
+		c.h = make([]revision, len(it.h))
+		for i, r := range it.h {
+			c.h[i] = revision{n: r.n, w: r.w, v: bytes.Clone(r.v)}
+		}
+	}
+	switch v := it.c.(type) {
+	case *listValue:
+		l := &listValue{e: make([][]byte, 0, v.len()), n: v.n}
+		for _, e := range v.e[v.h:] {
+			l.e = append(l.e, bytes.Clone(e))
+		}
+		c.c = l
+	case *setValue:
+		s := &setValue{m: make(map[string]struct{}, len(v.m)), n: v.n}
+		for member := range v.m {
+			s.m[member] = struct{}{}
+		}
+		c.c = s
+	case *hashValue:
+		h := &hashValue{m: make(map[string][]byte, len(v.m)), n: v.n}
+		for field, value := range v.m {
+			h.m[field] = bytes.Clone(value)
+		}
+		c.c = h
+	}
+	return &c
+}
+
+// matchKeys returns the keys matching the glob-style pattern, in ascending
+// order, as Keys does.
+func (m *Map) matchKeys(pattern string) []string {
+	keys := m.Keys(literalPrefix(pattern))
+	matched := keys[:0]
+	for _, key := range keys {
+		if match(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+	return matched
+}
+
+// KEYS <pattern>
+func (ms *MapServer) executeKeys(parts []string) (string, error) {
+	if len(parts) != 2 {
+		return "", errors.New("KO=Bad command, format: KEYS <pattern>")
+	}
+	return "OK=" + strings.Join(ms.m.matchKeys(parts[1]), " "), nil
+}
+
+// ?pattern=<pattern>&limit=<n>, answering with the first keys matching the
+// pattern, their types and the values of the strings, for debugging
+func (hs *HTTPMapServer) entriesHandler(w http.ResponseWriter, r *http.Request) {
+	rs := make(map[string]interface{})
+	w.Header().Add("Content-Type", "application/json")
+	qs := r.URL.Query()
+	log.Printf("info: serving GET entries %v\n", qs)
+	pattern, limit := "*", keysLimit
+	var err error
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		err = errors.New("Bad method: only GET accepted")
+	} else if qs.Get("limit") != "" {
+		limit, err = strconv.Atoi(qs.Get("limit"))
+		if err != nil || limit <= 0 || limit > keysMaxLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			err = fmt.Errorf("Bad limit: a number in [1, %d] expected", keysMaxLimit)
+		}
+	}
+	if qs.Get("pattern") != "" {
+		pattern = qs.Get("pattern")
+	}
+	if err != nil {
+		rs["outcome"] = "KO"
+		rs["error"] = err.Error()
+		buf, _ := json.Marshal(rs)
+		w.Write(buf[:])
+		return
+	}
+	type listed struct {
+		Key   string  `json:"key"`
+		Type  string  `json:"type"`
+		Value *string `json:"value,omitempty"`
+	}
+	entries := []listed{}
+	hs.m.rangeItems(func(key string, it *item) bool {
+		if match(pattern, key) {
+			e := listed{Key: key, Type: it.t.String()}
+			if it.t == kindString {
+				v := string(it.v)
+				e.Value = &v
+			}
+			entries = append(entries, e)
+		}
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	rs["outcome"] = "OK"
+	rs["truncated"] = len(entries) > limit
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	rs["entries"] = entries
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
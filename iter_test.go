@@ -0,0 +1,184 @@
+package dmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMapRange(t *testing.T) {
+	m := NewMap(WithShards(4))
+	for i := 0; i < 100; i++ {
+		m.Put(fmt.Sprintf("key%02d", i), []byte(fmt.Sprintf("value%02d", i)))
+	}
+	m.SAdd("set", "a")
+	seen := make(map[string]string)
+	m.Range(func(key string, value []byte) bool {
+		seen[key] = string(value)
+		m.Delete(key)
+		return true
+	})
+	if len(seen) != 101 || seen["key42"] != "value42" || seen["set"] != "" {
+		t.Logf("unexpected keys seen: %d\n", len(seen))
+		t.Fail()
+	}
+	if m.Size() != 0 {
+		t.Logf("expected the keys deleted while ranging: %d\n", m.Size())
+		t.Fail()
+	}
+	for i := 0; i < 10; i++ {
+		m.Put(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+	n := 0
+	m.Range(func(key string, value []byte) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Logf("expected the range to stop: %d\n", n)
+		t.Fail()
+	}
+}
+
+func TestMapValues(t *testing.T) {
+	m := NewMap()
+	m.Put("b", []byte("2"))
+	m.Put("a", []byte("1"))
+	m.Put("c", []byte("3"))
+	m.LPush("l", []byte("x"))
+	m.PutWithTTL("gone", []byte("4"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	values := m.Values()
+	if len(values) != 4 || string(values[0]) != "1" || string(values[2]) != "3" || values[3] != nil {
+		t.Logf("unexpected values: %q\n", values)
+		t.Fail()
+	}
+	if keys := m.Keys(""); len(keys) != 4 || keys[3] != "l" {
+		t.Logf("unexpected keys: %v\n", keys)
+		t.Fail()
+	}
+}
+
+func TestMapClone(t *testing.T) {
+	m := NewMap(WithShards(8), WithOrderedIndex(), WithHistory(1))
+	defer m.Close()
+	m.Put("key", []byte("old"))
+	m.Put("key", []byte("new"))
+	m.PutWithTTL("ttl", []byte("value"), time.Hour)
+	m.RPush("list", []byte("a"), []byte("b"))
+	m.HSet("hash", map[string][]byte{"f": []byte("v")})
+	c := m.Clone()
+	defer c.Close()
+	if c.Size() != m.Size() || c.Memory() != m.Memory() || c.Shards() != m.Shards() {
+		t.Fatalf("unexpected clone: %d %d\n", c.Size(), c.Memory())
+	}
+	_, meta, _ := m.GetWithMeta("key")
+	_, cmeta, _ := c.GetWithMeta("key")
+	if meta != cmeta {
+		t.Logf("unexpected meta: %v %v\n", meta, cmeta)
+		t.Fail()
+	}
+	if value, ok := c.GetAt("key", meta.Version-1); !ok || string(value) != "old" {
+		t.Logf("expected the history cloned: %s\n", value)
+		t.Fail()
+	}
+	if c.TTL("ttl") <= 0 {
+		t.Logf("expected the ttl cloned\n")
+		t.Fail()
+	}
+	m.RPush("list", []byte("c"))
+	m.HSet("hash", map[string][]byte{"g": []byte("w")})
+	m.Delete("key")
+	if n, _ := c.LLen("list"); n != 2 {
+		t.Logf("expected the list not shared: %d\n", n)
+		t.Fail()
+	}
+	if all, _ := c.HGetAll("hash"); len(all) != 1 {
+		t.Logf("expected the hash not shared: %v\n", all)
+		t.Fail()
+	}
+	if string(c.Get("key")) != "new" {
+		t.Logf("expected the key in the clone\n")
+		t.Fail()
+	}
+	c.Put("other", []byte("value"))
+	if m.Exists("other") {
+		t.Logf("expected the clone written on its own\n")
+		t.Fail()
+	}
+	if keys := c.Scan("", "", 0); len(keys) != 5 {
+		t.Logf("expected the index cloned: %v\n", keys)
+		t.Fail()
+	}
+	if _, meta, _ := c.GetWithMeta("other"); meta.Version <= cmeta.Version {
+		t.Logf("expected the versions to go on: %d\n", meta.Version)
+		t.Fail()
+	}
+}
+
+func TestMapServerKeys(t *testing.T) {
+	m := NewMap()
+	for i := 0; i < 15; i++ {
+		m.Put(fmt.Sprintf("user:%02d", i), []byte("value"))
+		m.Put(fmt.Sprintf("item:%02d", i), []byte("value"))
+	}
+	m.SAdd("user:set", "a")
+	ms := &MapServer{m: m}
+	res, err := ms.execute([]byte("KEYS user:1?\r\n"))
+	if err != nil || res != "OK=user:10 user:11 user:12 user:13 user:14" {
+		t.Logf("unexpected keys: %s %v\n", res, err)
+		t.Fail()
+	}
+	if res, _ = ms.execute([]byte("KEYS none*\r\n")); res != "OK=" {
+		t.Logf("expected no keys: %s\n", res)
+		t.Fail()
+	}
+	if res := ms.executeRESP(nil, [][]byte{[]byte("KEYS"), []byte("user:0[12]")}); string(res) != "*2\r\n$7\r\nuser:01\r\n$7\r\nuser:02\r\n" {
+		t.Logf("unexpected RESP keys: %q\n", res)
+		t.Fail()
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	hs, err := NewHTTPMapServer("localhost", 8088, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the HTTP server: %s\n", err.Error())
+	}
+	go hs.Serve()
+	defer hs.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	res2, err := http.Get("http://localhost:8088/api/v1/map/entries?pattern=user:*&limit=10")
+	if err != nil {
+		t.Fatalf("error: unable to list the entries: %s\n", err.Error())
+	}
+	var page struct {
+		Entries []struct {
+			Key   string  `json:"key"`
+			Type  string  `json:"type"`
+			Value *string `json:"value"`
+		} `json:"entries"`
+		Truncated bool `json:"truncated"`
+	}
+	err = json.NewDecoder(res2.Body).Decode(&page)
+	res2.Body.Close()
+	if err != nil {
+		t.Fatalf("error: unable to decode: %s\n", err.Error())
+	}
+	if len(page.Entries) != 10 || !page.Truncated || page.Entries[0].Key != "user:00" || *page.Entries[0].Value != "value" {
+		t.Logf("unexpected entries: %v %v\n", page.Entries, page.Truncated)
+		t.Fail()
+	}
+	res2, err = http.Get("http://localhost:8088/api/v1/map/entries?pattern=user:s*")
+	if err != nil {
+		t.Fatalf("error: unable to list the entries: %s\n", err.Error())
+	}
+	page.Entries = nil
+	json.NewDecoder(res2.Body).Decode(&page)
+	res2.Body.Close()
+	if len(page.Entries) != 1 || page.Entries[0].Type != "set" || page.Entries[0].Value != nil || page.Truncated {
+		t.Logf("unexpected entries: %v\n", page.Entries)
+		t.Fail()
+	}
+}
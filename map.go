@@ -1,62 +1,561 @@
 package dmap
 
 import (
+	"bytes"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultShards     = 256
+	defaultExpiration = 100 * time.Millisecond
+	expireSamples     = 20
+)
+
+var (
+	ErrNotInteger = errors.New("value is not an integer or out of range")
+	ErrOverflow   = errors.New("increment or decrement would overflow")
 )
 
 type Map struct {
-	e []entry
-	s uint
+	ver  uint64
+	e    []entry
+	s    uint64
+	h    Hasher
+	kh   any // func(K) uint64 of WithKeyHasher, routing the TypedMaps
+	i    time.Duration
+	o    atomic.Value
+	ol   sync.Mutex
+	max  int64
+	ev   Eviction
+	ix   bool
+	hist int
+	ml   sync.RWMutex // fences the commands of the servers off the batches migrated
+	done chan struct{}
+	once sync.Once
+	so   sync.Once
 }
 
 type entry struct {
-	m map[string][]byte
+	m map[string]*item
+	x map[string]*item
 	l sync.RWMutex
+	p *Map
+	i int
+	u int64
+	k *skiplist
+	b map[string]*item // batch being written, never evicted
+}
+
+type Op byte
+
+const (
+	OpPut Op = iota + 1
+	OpDelete
+	OpClear
+	OpExpire
+	OpExpired
+	OpTyped
+)
+
+// Mutation describes a change applied to the Map: Expire is the expiration
+// in unix nanoseconds, zero if the key does not expire. OpTyped carries, as
+// Value, a command on a list, set or hash and its arguments, packed.
+type Mutation struct {
+	Op     Op
+	Key    string
+	Value  []byte
+	Expire int64
+}
+
+// observer is notified of every mutation, holding the lock of the shard
+// (-1 if all the shards are involved) the mutation has been applied to.
+type observer func(shard int, mu Mutation)
+
+type item struct {
+	v []byte
+	x int64
+	a int64
+	f uint32
+	t kind
+	c interface{}
+	n uint64
+	r uint64 // version of the last write of the value
+	w int64
+	h []revision
 }
 
-func NewMap() *Map {
-	m := new(Map)
-	m.e = make([]entry, 256)
-	for i := 0; i < 256; i++ {
-		m.e[i].m = make(map[string][]byte)
+func (it *item) expired(now int64) bool {
+	return it.x != 0 && it.x <= now
+}
+
+type Option func(*Map)
+
+// WithShards sets the number of shards, rounded up to the next power of two.
+func WithShards(n int) Option {
+	return func(m *Map) {
+		s := 1
+		for s < n {
+			s <<= 1
+		}
+		m.s = uint64(s - 1)
+	}
+}
+
+// WithExpiration sets how often the background sampler, started by the first
+// key given a ttl, looks for expired keys in every shard; zero disables it,
+// leaving expiration to lookups.
+func WithExpiration(interval time.Duration) Option {
+	return func(m *Map) {
+		m.i = interval
+	}
+}
+
+// WithHasher sets the hash function used to address the shards.
+func WithHasher(h Hasher) Option {
+	return func(m *Map) {
+		if h != nil {
+			m.h = h
+		}
 	}
+}
+
+func NewMap(opts ...Option) *Map {
+	m := &Map{
+		s: defaultShards - 1,
+		h: FNV1a,
+		i: defaultExpiration,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.max > 0 {
+		// a byte per shard at least, not to leave the Map unbounded
+		m.max = max(m.max/int64(m.s+1), 1)
+	}
+	m.e = make([]entry, m.s+1)
+	for i := range m.e {
+		m.e[i].m = make(map[string]*item)
+		m.e[i].x = make(map[string]*item)
+		m.e[i].p = m
+		m.e[i].i = i
+		if m.ix {
+			m.e[i].k = newSkiplist()
+		}
+	}
+	m.o.Store([]*observer{})
+	m.done = make(chan struct{})
 	return m
 }
 
-func (m *Map) Put(key string, value []byte) {
-	idx := index(key)
-	m.e[idx].l.Lock()
-	defer m.e[idx].l.Unlock()
-	m.e[idx].m[key] = value
+// expiring starts the background expiration sampler, once a key is given a
+// ttl: Maps never doing so leave no goroutine behind, closed or not.
+func (m *Map) expiring() {
+	if m.i > 0 {
+		m.so.Do(func() {
+			go m.sample()
+		})
+	}
+}
+
+// Close stops the background expiration sampler.
+func (m *Map) Close() {
+	m.once.Do(func() {
+		close(m.done)
+	})
+}
+
+// Put stores the value, failing with ErrOutOfMemory only if the Map is
+// bounded and no room can be made for it.
+func (m *Map) Put(key string, value []byte) error {
+	return m.shard(key).store(key, value)
+}
+
+func (e *entry) store(key string, value []byte) error {
+	e.l.Lock()
+	defer e.l.Unlock()
+	return e.put(key, &item{v: value})
+}
+
+// PutWithTTL stores the value for ttl, a non positive ttl expires the key
+// straight away.
+func (m *Map) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	return m.shard(key).storeWithTTL(key, value, ttl)
+}
+
+func (e *entry) storeWithTTL(key string, value []byte, ttl time.Duration) error {
+	e.l.Lock()
+	defer e.l.Unlock()
+	if ttl <= 0 {
+		e.remove(key)
+		return nil
+	}
+	return e.put(key, &item{v: value, x: time.Now().Add(ttl).UnixNano()})
 }
 
 func (m *Map) Get(key string) []byte {
-	idx := index(key)
-	m.e[idx].l.RLock()
-	defer m.e[idx].l.RUnlock()
-	return m.e[idx].m[key]
+	e := m.shard(key)
+	now := time.Now().UnixNano()
+	e.l.RLock()
+	it, ok := e.m[key]
+	if !ok || !it.expired(now) {
+		if ok && m.ev.tracks() {
+			it.touch(now)
+		}
+		e.l.RUnlock()
+		if ok {
+			return it.v
+		}
+		return nil
+	}
+	e.l.RUnlock()
+	e.l.Lock()
+	e.lookup(key, now)
+	e.l.Unlock()
+	return nil
+}
+
+// Expire sets a ttl on an existing key, returning false if the key is not
+// found; a non positive ttl expires the key straight away.
+func (m *Map) Expire(key string, ttl time.Duration) bool {
+	e := m.shard(key)
+	now := time.Now()
+	e.l.Lock()
+	defer e.l.Unlock()
+	it := e.lookup(key, now.UnixNano())
+	if it == nil {
+		return false
+	}
+	if ttl <= 0 {
+		e.remove(key)
+		return true
+	}
+	it.x = now.Add(ttl).UnixNano()
+	it.restamp(m, now.UnixNano())
+	e.x[key] = it
+	m.expiring()
+	m.notify(e.i, Mutation{Op: OpExpire, Key: key, Expire: it.x})
+	return true
+}
+
+// TTL returns the time to live of the key: -1 if the key does not expire,
+// -2 if the key is not found (as Redis does).
+func (m *Map) TTL(key string) time.Duration {
+	e := m.shard(key)
+	now := time.Now().UnixNano()
+	e.l.RLock()
+	defer e.l.RUnlock()
+	it, ok := e.m[key]
+	if !ok || it.expired(now) {
+		return -2
+	}
+	if it.x == 0 {
+		return -1
+	}
+	return time.Duration(it.x - now)
+}
+
+// Persist removes the ttl from the key, returning false if the key is not
+// found or does not expire.
+func (m *Map) Persist(key string) bool {
+	e := m.shard(key)
+	e.l.Lock()
+	defer e.l.Unlock()
+	it := e.lookup(key, time.Now().UnixNano())
+	if it == nil || it.x == 0 {
+		return false
+	}
+	it.x = 0
+	it.restamp(m, time.Now().UnixNano())
+	delete(e.x, key)
+	m.notify(e.i, Mutation{Op: OpExpire, Key: key})
+	return true
+}
+
+// PutIfAbsent stores the value only if the key is not found.
+func (m *Map) PutIfAbsent(key string, value []byte) (bool, error) {
+	return m.swap(key, func(it *item) bool {
+		return it == nil
+	}, &item{v: value})
+}
+
+// Replace stores the value only if the key is found.
+func (m *Map) Replace(key string, value []byte) (bool, error) {
+	return m.swap(key, func(it *item) bool {
+		return it != nil
+	}, &item{v: value})
+}
+
+// CompareAndSwap stores the new value only if the key holds the old one.
+func (m *Map) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	return m.swap(key, func(it *item) bool {
+		return it != nil && it.t == kindString && bytes.Equal(it.v, old)
+	}, &item{v: new})
+}
+
+// CompareAndDelete deletes the key only if it holds the old value.
+func (m *Map) CompareAndDelete(key string, old []byte) bool {
+	ok, _ := m.swap(key, func(it *item) bool {
+		return it != nil && it.t == kindString && bytes.Equal(it.v, old)
+	}, nil)
+	return ok
+}
+
+// Incr adds delta to the value of the key, read as a decimal integer (zero
+// if the key is not found), and returns the result: the ttl is kept.
+func (m *Map) Incr(key string, delta int64) (int64, error) {
+	e := m.shard(key)
+	e.l.Lock()
+	defer e.l.Unlock()
+	it, err := incr(e.lookup(key, time.Now().UnixNano()), delta)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := strconv.ParseInt(string(it.v), 10, 64)
+	return n, e.put(key, it)
 }
 
+// incr returns the item holding the value of it, nil if the key is not
+// found, plus delta: the ttl is kept.
+func incr(it *item, delta int64) (*item, error) {
+	var n, x int64
+	if it != nil {
+		if it.t != kindString {
+			return nil, ErrWrongType
+		}
+		v, err := strconv.ParseInt(string(it.v), 10, 64)
+		if err != nil {
+			return nil, ErrNotInteger
+		}
+		n, x = v, it.x
+	}
+	if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+		return nil, ErrOverflow
+	}
+	return &item{v: strconv.AppendInt(nil, n+delta, 10), x: x}, nil
+}
+
+// swap replaces the item of the key (deletes it, if nil) when cond holds on
+// the actual one, nil if the key is not found.
+func (m *Map) swap(key string, cond func(*item) bool, it *item) (bool, error) {
+	return m.shard(key).swap(key, cond, it)
+}
+
+func (e *entry) swap(key string, cond func(*item) bool, it *item) (bool, error) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	if !cond(e.lookup(key, time.Now().UnixNano())) {
+		return false, nil
+	}
+	if it == nil {
+		e.remove(key)
+		return true, nil
+	}
+	err := e.put(key, it)
+	return err == nil, err
+}
+
+// Clear holds the locks of all the shards at once, so that observers see it
+// as a single mutation.
 func (m *Map) Clear() {
-	for i := 0; i < 256; i++ {
+	for i := range m.e {
 		m.e[i].l.Lock()
-		for k := range m.e[i].m {
-			delete(m.e[i].m, k)
+	}
+	for i := range m.e {
+		m.e[i].m = make(map[string]*item)
+		m.e[i].x = make(map[string]*item)
+		m.e[i].u = 0
+		if m.ix {
+			m.e[i].k = newSkiplist()
 		}
+	}
+	m.notify(-1, Mutation{Op: OpClear})
+	for i := range m.e {
 		m.e[i].l.Unlock()
 	}
 }
 
-func (m *Map) Delete(key string) {
-	idx := index(key)
-	m.e[idx].l.Lock()
-	defer m.e[idx].l.Unlock()
-	delete(m.e[idx].m, key)
+// Delete removes the key, returning false if it is not found.
+func (m *Map) Delete(key string) bool {
+	return m.shard(key).delete(key)
+}
+
+func (e *entry) delete(key string) bool {
+	e.l.Lock()
+	defer e.l.Unlock()
+	if e.lookup(key, time.Now().UnixNano()) == nil {
+		return false
+	}
+	e.remove(key)
+	return true
+}
+
+// MGet returns the values of the keys, nil for the keys not found, reading
+// all the shards involved at once.
+func (m *Map) MGet(keys ...string) [][]byte {
+	idx := m.lockShards(keys, false)
+	defer m.unlockShards(idx, false)
+	now := time.Now().UnixNano()
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		e := m.shard(key)
+		it, ok := e.m[key]
+		if ok && !it.expired(now) {
+			if m.ev.tracks() {
+				it.touch(now)
+			}
+			values[i] = it.v
+		}
+	}
+	return values
+}
+
+// MPut stores the values atomically, holding the locks of all the shards
+// involved: with EvictNone, the writes are refused as a whole if any shard
+// is out of memory.
+func (m *Map) MPut(values map[string][]byte) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	idx := m.lockShards(keys, true)
+	defer m.unlockShards(idx, true)
+	items := make(map[string]*item, len(values))
+	for key, value := range values {
+		items[key] = &item{v: value}
+	}
+	if !m.admits(items) {
+		return ErrOutOfMemory
+	}
+	return m.putAll(items, keys)
+}
+
+// admits reports whether the shards have room to replace the items of the
+// keys (to delete them, if nil), evicting the other keys as the policy does:
+// the write locks of the shards must be held.
+func (m *Map) admits(items map[string]*item) bool {
+	if m.max <= 0 {
+		return true
+	}
+	deltas := make(map[int]int64)
+	for key, it := range items {
+		deltas[m.index(key)] += m.delta(key, it)
+	}
+	for i, delta := range deltas {
+		e := &m.e[i]
+		if delta <= 0 || e.u+delta <= m.max {
+			continue
+		}
+		if m.ev == EvictNone {
+			return false
+		}
+		candidates := e.m
+		if m.ev == EvictVolatileTTL {
+			candidates = e.x
+		}
+		room := m.max - e.u
+		for k, it := range candidates {
+			if _, ok := items[k]; !ok {
+				room += int64(len(k)) + it.size()
+			}
+			if room >= delta {
+				break
+			}
+		}
+		if room < delta {
+			return false
+		}
+	}
+	return true
+}
+
+// delta returns the bytes taken in its shard by replacing the item of the key
+// with it (deleting it, if nil).
+func (m *Map) delta(key string, it *item) int64 {
+	var delta int64
+	old, ok := m.shard(key).m[key]
+	if it != nil {
+		delta += int64(len(key)) + it.size()
+		if ok && it.h == nil {
+			delta += revisionsSize(m.history(old))
+		}
+	}
+	if ok {
+		delta -= int64(len(key)) + old.size()
+	}
+	return delta
+}
+
+// putAll writes the items of the keys, as admitted: the ones freeing room go
+// first, and eviction never picks the keys of the batch, so that either all
+// of them are written, or none. The write locks of the shards must be held.
+func (m *Map) putAll(items map[string]*item, keys []string) error {
+	deltas := make(map[string]int64, len(keys))
+	for _, key := range keys {
+		deltas[key] = m.delta(key, items[key])
+		m.shard(key).b = items
+	}
+	defer func() {
+		for _, key := range keys {
+			m.shard(key).b = nil
+		}
+	}()
+	keys = append([]string(nil), keys...)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return deltas[keys[i]] < deltas[keys[j]]
+	})
+	for _, key := range keys {
+		e := m.shard(key)
+		if it := items[key]; it != nil {
+			err := e.put(key, it)
+			if err != nil {
+				return err
+			}
+		} else {
+			e.remove(key)
+		}
+	}
+	return nil
+}
+
+// MDelete removes the keys atomically, returning how many were found.
+func (m *Map) MDelete(keys ...string) int {
+	idx := m.lockShards(keys, true)
+	defer m.unlockShards(idx, true)
+	now := time.Now().UnixNano()
+	n := 0
+	for _, key := range keys {
+		e := m.shard(key)
+		if e.lookup(key, now) != nil {
+			e.remove(key)
+			n++
+		}
+	}
+	return n
 }
 
+func (m *Map) Exists(key string) bool {
+	return m.shard(key).exists(key)
+}
+
+func (e *entry) exists(key string) bool {
+	now := time.Now().UnixNano()
+	e.l.RLock()
+	defer e.l.RUnlock()
+	it, ok := e.m[key]
+	return ok && !it.expired(now)
+}
+
+// Size returns the number of keys, the expired ones included until reclaimed
+// by a read or by the sampler.
 func (m *Map) Size() int {
 	var size int
-	for i := 0; i < 256; i++ {
+	for i := range m.e {
 		m.e[i].l.RLock()
 		size += len(m.e[i].m)
 		m.e[i].l.RUnlock()
@@ -64,8 +563,241 @@ func (m *Map) Size() int {
 	return size
 }
 
-func index(key string) uint8 {
-	// c := []byte(key)
-    // TODO try CRC
-	return key[0]
+// Memory returns the bytes taken by keys and values.
+func (m *Map) Memory() int64 {
+	var used int64
+	for i := range m.e {
+		m.e[i].l.RLock()
+		used += m.e[i].u
+		m.e[i].l.RUnlock()
+	}
+	return used
+}
+
+// next returns a version greater than all the ones given so far.
+func (m *Map) next() uint64 {
+	return atomic.AddUint64(&m.ver, 1)
+}
+
+// version returns the version of the key, stamped at every write, zero if
+// the key is not found.
+func (m *Map) version(key string) uint64 {
+	e := m.shard(key)
+	e.l.RLock()
+	defer e.l.RUnlock()
+	it, ok := e.m[key]
+	if !ok || it.expired(time.Now().UnixNano()) {
+		return 0
+	}
+	return it.n
+}
+
+func (m *Map) Shards() int {
+	return len(m.e)
+}
+
+func (m *Map) index(key string) int {
+	return int(m.h(key) & m.s)
+}
+
+func (m *Map) shard(key string) *entry {
+	return &m.e[m.index(key)]
+}
+
+// lockShards locks the shards of the keys, each one once and in ascending
+// order, so that multi-key operations do not deadlock each other (as Clear).
+func (m *Map) lockShards(keys []string, write bool) []int {
+	idx := make([]int, 0, len(keys))
+	for _, key := range keys {
+		idx = append(idx, m.index(key))
+	}
+	sort.Ints(idx)
+	n := 0
+	for i := range idx {
+		if i == 0 || idx[i] != idx[i-1] {
+			idx[n] = idx[i]
+			n++
+		}
+	}
+	idx = idx[:n]
+	for _, i := range idx {
+		if write {
+			m.e[i].l.Lock()
+		} else {
+			m.e[i].l.RLock()
+		}
+	}
+	return idx
+}
+
+func (m *Map) unlockShards(idx []int, write bool) {
+	for _, i := range idx {
+		if write {
+			m.e[i].l.Unlock()
+		} else {
+			m.e[i].l.RUnlock()
+		}
+	}
+}
+
+// observe registers the observer, returning the function to unregister it.
+func (m *Map) observe(o observer) func() {
+	p := &o
+	m.ol.Lock()
+	os := m.o.Load().([]*observer)
+	m.o.Store(append(os[:len(os):len(os)], p))
+	m.ol.Unlock()
+	return func() {
+		m.ol.Lock()
+		defer m.ol.Unlock()
+		var os []*observer
+		for _, q := range m.o.Load().([]*observer) {
+			if q != p {
+				os = append(os, q)
+			}
+		}
+		m.o.Store(os)
+	}
+}
+
+func (m *Map) notify(shard int, mu Mutation) {
+	for _, o := range m.o.Load().([]*observer) {
+		(*o)(shard, mu)
+	}
+}
+
+// apply replays a mutation, e.g. read back from the append-only log, dropping
+// the keys already expired.
+func (m *Map) apply(mu *Mutation) {
+	switch mu.Op {
+	case OpPut:
+		if mu.Expire != 0 && mu.Expire <= time.Now().UnixNano() {
+			m.Delete(mu.Key)
+			return
+		}
+		e := m.shard(mu.Key)
+		e.l.Lock()
+		e.put(mu.Key, &item{v: mu.Value, x: mu.Expire})
+		e.l.Unlock()
+	case OpDelete, OpExpired:
+		m.Delete(mu.Key)
+	case OpClear:
+		m.Clear()
+	case OpTyped:
+		m.applyTyped(mu)
+	case OpExpire:
+		if mu.Expire == 0 {
+			m.Persist(mu.Key)
+		} else {
+			m.Expire(mu.Key, time.Until(time.Unix(0, mu.Expire)))
+		}
+	}
+}
+
+// sample reclaims the expired keys, picking a few volatile keys per shard at
+// every round and going on with the shard while most of them are expired.
+func (m *Map) sample() {
+	t := time.NewTicker(m.i)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-t.C:
+			for i := range m.e {
+				expired := expireSamples
+				for expired > expireSamples/4 {
+					expired = m.e[i].sample(time.Now().UnixNano())
+				}
+			}
+		}
+	}
+}
+
+func (e *entry) sample(now int64) int {
+	e.l.Lock()
+	defer e.l.Unlock()
+	n, expired := 0, 0
+	for k, it := range e.x {
+		if n == expireSamples {
+			break
+		}
+		n++
+		if it.expired(now) {
+			e.reclaim(k)
+			expired++
+		}
+	}
+	return expired
+}
+
+func (e *entry) put(key string, it *item) error {
+	now := time.Now().UnixNano()
+	old, ok := e.m[key]
+	if ok && it.h == nil && !old.expired(now) {
+		it.h = e.p.history(old)
+	}
+	delta := int64(len(key)) + it.size()
+	if ok {
+		delta -= int64(len(key)) + old.size()
+	}
+	if delta > 0 {
+		err := e.reserve(key, delta, now)
+		if err != nil {
+			return err
+		}
+	}
+	it.a = now
+	it.f = 1
+	it.stamp(e.p, now)
+	e.u += delta
+	e.m[key] = it
+	if !ok && e.k != nil {
+		e.k.insert(key)
+	}
+	if it.x != 0 {
+		e.x[key] = it
+		e.p.expiring()
+	} else {
+		delete(e.x, key)
+	}
+	e.p.notify(e.i, it.mutation(key))
+	return nil
+}
+
+func (e *entry) remove(key string) {
+	e.drop(key, OpDelete)
+}
+
+// reclaim removes an expired key, notifying OpExpired instead of OpDelete.
+func (e *entry) reclaim(key string) {
+	e.drop(key, OpExpired)
+}
+
+func (e *entry) drop(key string, op Op) {
+	it, ok := e.m[key]
+	if !ok {
+		return
+	}
+	e.u -= int64(len(key)) + it.size()
+	delete(e.m, key)
+	delete(e.x, key)
+	if e.k != nil {
+		e.k.delete(key)
+	}
+	e.p.notify(e.i, Mutation{Op: op, Key: key})
+}
+
+// lookup returns the live item for the key, reclaiming it if expired: the
+// write lock must be held.
+func (e *entry) lookup(key string, now int64) *item {
+	it, ok := e.m[key]
+	if !ok {
+		return nil
+	}
+	if it.expired(now) {
+		e.reclaim(key)
+		return nil
+	}
+	return it
 }
@@ -2,8 +2,14 @@ package dmap
 
 import (
 	"fmt"
+	"hash/fnv"
+	"math"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMap(t *testing.T) {
@@ -57,3 +63,346 @@ func tester(id string, m *Map, t *testing.T, wg *sync.WaitGroup) {
 		}
 	}
 }
+
+func TestMapEmptyKey(t *testing.T) {
+	m := NewMap()
+	m.Put("", []byte("empty"))
+	if string(m.Get("")) != "empty" {
+		t.Logf("unexpected value for the empty key: %s\n", string(m.Get("")))
+		t.Fail()
+	}
+	m.Delete("")
+	if m.Size() != 0 {
+		t.Logf("expected size 0: %d\n", m.Size())
+		t.Fail()
+	}
+}
+
+func TestMapShards(t *testing.T) {
+	cases := map[int]int{0: 1, 1: 1, 3: 4, 16: 16, 1000: 1024}
+	for n, expected := range cases {
+		m := NewMap(WithShards(n))
+		if m.Shards() != expected {
+			t.Logf("shards %d: expected %d, got %d\n", n, expected, m.Shards())
+			t.Fail()
+		}
+	}
+	m := NewMap(WithShards(1), WithHasher(XXH64))
+	m.Put("test", []byte("Hello, World!"))
+	if string(m.Get("test")) != "Hello, World!" {
+		t.Logf("retrieved %s\n", string(m.Get("test")))
+		t.Fail()
+	}
+}
+
+func TestHashers(t *testing.T) {
+	for _, key := range []string{"", "a", "user:1", "a much longer key, above the 32 bytes of a stripe"} {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		if FNV1a(key) != h.Sum64() {
+			t.Logf("FNV1a(%q): expected %x, got %x\n", key, h.Sum64(), FNV1a(key))
+			t.Fail()
+		}
+	}
+	vectors := map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"a":   0xd24ec4f1a98c6e5b,
+		"abc": 0x44bc2cf5ad770999,
+	}
+	for key, expected := range vectors {
+		if XXH64(key) != expected {
+			t.Logf("XXH64(%q): expected %x, got %x\n", key, expected, XXH64(key))
+			t.Fail()
+		}
+	}
+}
+
+func TestMapDistribution(t *testing.T) {
+	for name, h := range map[string]Hasher{"fnv1a": FNV1a, "xxh64": XXH64} {
+		m := NewMap(WithHasher(h))
+		n := 256 * 1000
+		for i := 0; i < n; i++ {
+			m.Put(fmt.Sprintf("user:%d", i), nil)
+		}
+		mean := n / m.Shards()
+		for i := range m.e {
+			l := len(m.e[i].m)
+			if l < mean*8/10 || l > mean*12/10 {
+				t.Logf("%s: shard %d holds %d keys, mean %d\n", name, i, l, mean)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func firstByte(key string) uint64 {
+	if key == "" {
+		return 0
+	}
+	return uint64(key[0])
+}
+
+func benchmarkMapPrefix(b *testing.B, h Hasher) {
+	m := NewMap(WithHasher(h))
+	keys := make([]string, 1<<16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d", i)
+	}
+	var seq uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&seq, 7919))
+		for pb.Next() {
+			key := keys[i&(len(keys)-1)]
+			if i%4 == 0 {
+				m.Put(key, []byte(key))
+			} else {
+				m.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMapPrefixFirstByte(b *testing.B) {
+	benchmarkMapPrefix(b, firstByte)
+}
+
+func BenchmarkMapPrefixFNV1a(b *testing.B) {
+	benchmarkMapPrefix(b, FNV1a)
+}
+
+func BenchmarkMapPrefixXXH64(b *testing.B) {
+	benchmarkMapPrefix(b, XXH64)
+}
+
+func benchmarkHasher(b *testing.B, h Hasher, key string) {
+	b.SetBytes(int64(len(key)))
+	for i := 0; i < b.N; i++ {
+		h(key)
+	}
+}
+
+func BenchmarkHashFNV1aShort(b *testing.B) {
+	benchmarkHasher(b, FNV1a, "user:12345")
+}
+
+func BenchmarkHashXXH64Short(b *testing.B) {
+	benchmarkHasher(b, XXH64, "user:12345")
+}
+
+func BenchmarkHashFNV1aLong(b *testing.B) {
+	benchmarkHasher(b, FNV1a, "session:7f3c9a1e-4b2d-4e8a-9c1f-2d3e4f5a6b7c:payload")
+}
+
+func BenchmarkHashXXH64Long(b *testing.B) {
+	benchmarkHasher(b, XXH64, "session:7f3c9a1e-4b2d-4e8a-9c1f-2d3e4f5a6b7c:payload")
+}
+
+func TestMapTTL(t *testing.T) {
+	m := NewMap(WithExpiration(10 * time.Millisecond))
+	defer m.Close()
+	m.PutWithTTL("session", []byte("token"), 50*time.Millisecond)
+	m.Put("config", []byte("value"))
+	if string(m.Get("session")) != "token" {
+		t.Logf("retrieved %s\n", string(m.Get("session")))
+		t.Fail()
+	}
+	if ttl := m.TTL("session"); ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Logf("unexpected ttl: %v\n", ttl)
+		t.Fail()
+	}
+	if m.TTL("config") != -1 || m.TTL("missing") != -2 {
+		t.Logf("unexpected ttl: %v %v\n", m.TTL("config"), m.TTL("missing"))
+		t.Fail()
+	}
+	if !m.Expire("config", time.Hour) || m.Expire("missing", time.Hour) {
+		t.Logf("unexpected expire outcome\n")
+		t.Fail()
+	}
+	if !m.Persist("config") || m.Persist("config") || m.TTL("config") != -1 {
+		t.Logf("unexpected persist outcome\n")
+		t.Fail()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if m.Get("session") != nil {
+		t.Logf("expected the key to be expired\n")
+		t.Fail()
+	}
+	if m.Size() != 1 {
+		t.Logf("expected size 1: %d\n", m.Size())
+		t.Fail()
+	}
+}
+
+func TestMapExpirationSampler(t *testing.T) {
+	m := NewMap(WithShards(4), WithExpiration(10*time.Millisecond))
+	defer m.Close()
+	for i := 0; i < 1000; i++ {
+		m.PutWithTTL(fmt.Sprintf("key%d", i), nil, 20*time.Millisecond)
+	}
+	m.Put("persistent", nil)
+	time.Sleep(200 * time.Millisecond)
+	if m.Size() != 1 {
+		t.Logf("expected the expired keys to be reclaimed: %d\n", m.Size())
+		t.Fail()
+	}
+	e := NewMap(WithExpiration(10 * time.Millisecond))
+	defer e.Close()
+	e.Put("key", nil)
+	e.Expire("key", 20*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	if e.Size() != 0 {
+		t.Logf("expected the key given a ttl by Expire to be reclaimed\n")
+		t.Fail()
+	}
+}
+
+func TestMapSamplerLazy(t *testing.T) {
+	before := runtime.NumGoroutine()
+	maps := make([]*Map, 100)
+	for i := range maps {
+		maps[i] = NewMap()
+		maps[i].Put("key", nil)
+	}
+	if n := runtime.NumGoroutine() - before; n >= len(maps) {
+		t.Logf("expected no sampler without keys given a ttl: %d goroutines\n", n)
+		t.Fail()
+	}
+	for _, m := range maps {
+		m.PutWithTTL("volatile", nil, time.Hour)
+		m.PutWithTTL("other", nil, time.Hour)
+	}
+	if n := runtime.NumGoroutine() - before; n < len(maps) || n >= 2*len(maps) {
+		t.Logf("expected a sampler per map: %d goroutines\n", n)
+		t.Fail()
+	}
+	for _, m := range maps {
+		m.Close()
+	}
+}
+
+func TestMapConditional(t *testing.T) {
+	m := NewMap()
+	applied := func(ok bool, err error) bool {
+		return ok && err == nil
+	}
+	if !applied(m.PutIfAbsent("key", []byte("a"))) || applied(m.PutIfAbsent("key", []byte("b"))) {
+		t.Logf("unexpected PutIfAbsent outcome\n")
+		t.Fail()
+	}
+	if applied(m.Replace("missing", []byte("a"))) || !applied(m.Replace("key", []byte("b"))) {
+		t.Logf("unexpected Replace outcome\n")
+		t.Fail()
+	}
+	if applied(m.CompareAndSwap("key", []byte("a"), []byte("c"))) || !applied(m.CompareAndSwap("key", []byte("b"), []byte("c"))) {
+		t.Logf("unexpected CompareAndSwap outcome\n")
+		t.Fail()
+	}
+	if m.CompareAndDelete("key", []byte("b")) || !m.CompareAndDelete("key", []byte("c")) {
+		t.Logf("unexpected CompareAndDelete outcome\n")
+		t.Fail()
+	}
+	if m.Size() != 0 {
+		t.Logf("expected size 0: %d\n", m.Size())
+		t.Fail()
+	}
+}
+
+func TestMapCompareAndSwapConcurrent(t *testing.T) {
+	m := NewMap()
+	m.Put("counter", []byte("0"))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				for {
+					old := m.Get("counter")
+					n, _ := strconv.Atoi(string(old))
+					if ok, _ := m.CompareAndSwap("counter", old, []byte(strconv.Itoa(n+1))); ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if string(m.Get("counter")) != "8000" {
+		t.Logf("lost updates: %s\n", string(m.Get("counter")))
+		t.Fail()
+	}
+}
+
+func TestMapMulti(t *testing.T) {
+	m := NewMap(WithShards(4))
+	values := make(map[string][]byte)
+	keys := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		values[key] = []byte(key)
+		keys = append(keys, key)
+	}
+	err := m.MPut(values)
+	if err != nil || m.Size() != 100 {
+		t.Fatalf("unexpected MPut outcome: %d %v\n", m.Size(), err)
+	}
+	got := m.MGet(append(keys, "missing", "key0")...)
+	if len(got) != 102 || got[100] != nil || string(got[101]) != "key0" {
+		t.Fatalf("unexpected MGet outcome: %d\n", len(got))
+	}
+	for i, key := range keys {
+		if string(got[i]) != key {
+			t.Logf("unexpected value for %s: %s\n", key, string(got[i]))
+			t.Fail()
+		}
+	}
+	if n := m.MDelete("key0", "key1", "key0", "missing"); n != 2 || m.Size() != 98 {
+		t.Logf("unexpected MDelete outcome: %d %d\n", n, m.Size())
+		t.Fail()
+	}
+}
+
+func TestMapMultiOutOfMemory(t *testing.T) {
+	m := NewMap(WithShards(1), WithMaxMemory(19))
+	err := m.MPut(map[string][]byte{"a": []byte("123456789"), "b": []byte("123456789")})
+	if err != ErrOutOfMemory || m.Size() != 0 {
+		t.Logf("expected no write at all: %d %v\n", m.Size(), err)
+		t.Fail()
+	}
+}
+
+func TestMapIncr(t *testing.T) {
+	m := NewMap()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				m.Incr("counter", 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if string(m.Get("counter")) != "8000" {
+		t.Logf("unexpected counter: %s\n", string(m.Get("counter")))
+		t.Fail()
+	}
+	m.PutWithTTL("volatile", []byte("10"), time.Hour)
+	if n, err := m.Incr("volatile", -15); err != nil || n != -5 || m.TTL("volatile") <= 0 {
+		t.Logf("unexpected decrement: %d %v %v\n", n, err, m.TTL("volatile"))
+		t.Fail()
+	}
+	m.Put("text", []byte("ten"))
+	if _, err := m.Incr("text", 1); err != ErrNotInteger {
+		t.Logf("expected ErrNotInteger: %v\n", err)
+		t.Fail()
+	}
+	m.Put("max", []byte(strconv.FormatInt(math.MaxInt64, 10)))
+	if _, err := m.Incr("max", 1); err != ErrOverflow {
+		t.Logf("expected ErrOverflow: %v\n", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,215 @@
+package dmap
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	migrateBatch  = 100 // keys moved at a time by Migrate
+	migratePasses = 10
+)
+
+var errMigrateBusy = errors.New("Keys still written to the slots migrated: retry")
+
+// Importer stores the keys migrated from another Map: a Map itself, or a
+// TCPMapClient importing them into the Map of its server.
+type Importer interface {
+	Import([]Mutation) error
+}
+
+// SlotKeys returns the keys of the slots from start to end, included.
+func (m *Map) SlotKeys(start, end int) []string {
+	var keys []string
+	m.rangeItems(func(key string, it *item) bool {
+		if s := Slot(key); s >= start && s <= end {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// Import stores the keys, as dumped by Migrate, replacing their values:
+// unlike a replay, it fails with ErrOutOfMemory if there is no room for a
+// key, so that the source keeps it.
+func (m *Map) Import(mus []Mutation) error {
+	now := time.Now().UnixNano()
+	for i := range mus {
+		mu := &mus[i]
+		var it *item
+		switch mu.Op {
+		case OpPut:
+			it = &item{v: mu.Value, x: mu.Expire}
+		case OpTyped:
+			args, err := unpackList(mu.Value)
+			if err != nil || len(args) == 0 {
+				return errors.New("malformed entry: " + mu.Key)
+			}
+			command := string(args[0])
+			if command != "list" && command != "set" && command != "hash" {
+				return errors.New("malformed entry: " + mu.Key)
+			}
+			it = typedItem(command, args[1:], mu.Expire)
+		default:
+			return errors.New("malformed entry: " + mu.Key)
+		}
+		if mu.Expire != 0 && mu.Expire <= now {
+			continue
+		}
+		e := m.shard(mu.Key)
+		e.l.Lock()
+		err := e.put(mu.Key, it)
+		e.l.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrate moves the keys of the slots from start to end, included, to dst,
+// batch keys at a time, while the Map goes on serving the others: the keys
+// of a batch are held from being copied until deleted, once imported, as are
+// the commands of the servers fenced through fence. The caller is to
+// redirect the commands on the keys no longer held, as the servers of a
+// Cluster do for the slots migrating: the keys written in the meantime
+// anyway are moved by the next passes, failing once these run out. Returns
+// the number of keys moved.
+func (m *Map) Migrate(dst Importer, start, end, batch int) (int, error) {
+	if batch <= 0 {
+		batch = migrateBatch
+	}
+	moved := 0
+	for pass := 0; pass < migratePasses; pass++ {
+		keys := m.SlotKeys(start, end)
+		if len(keys) == 0 {
+			return moved, nil
+		}
+		for i := 0; i < len(keys); i += batch {
+			n, err := m.migrate(dst, keys[i:min(i+batch, len(keys))])
+			moved += n
+			if err != nil {
+				return moved, err
+			}
+		}
+	}
+	if len(m.SlotKeys(start, end)) > 0 {
+		return moved, errMigrateBusy
+	}
+	return moved, nil
+}
+
+// migrate copies the live keys to dst and deletes them once imported, the
+// shards and the fence locked all along.
+func (m *Map) migrate(dst Importer, keys []string) (int, error) {
+	m.ml.Lock()
+	defer m.ml.Unlock()
+	idx := m.lockShards(keys, true)
+	defer m.unlockShards(idx, true)
+	now := time.Now().UnixNano()
+	mus := make([]Mutation, 0, len(keys))
+	for _, key := range keys {
+		it, ok := m.shard(key).m[key]
+		if !ok || it.expired(now) {
+			continue
+		}
+		mus = append(mus, it.mutation(key))
+	}
+	if len(mus) == 0 {
+		return 0, nil
+	}
+	err := dst.Import(mus)
+	if err != nil {
+		return 0, err
+	}
+	for i := range mus {
+		m.shard(mus[i].Key).remove(mus[i].Key)
+	}
+	return len(mus), nil
+}
+
+// fence holds Migrate off the keys until the function returned is called:
+// the servers of a Cluster run a command between checking the keys are held
+// and calling it.
+func (m *Map) fence() func() {
+	m.ml.RLock()
+	return m.ml.RUnlock
+}
+
+// Move is the migration of a range of slots between two nodes.
+type Move struct {
+	Start int
+	End   int
+	From  ClusterNode
+	To    ClusterNode
+}
+
+// PlanRebalance plans the moves giving every node the same share of the slots
+// assigned, within one: the nodes owning more slots give away their highest
+// ones, to the nodes owning fewer, new ones included, in ascending order of
+// address. Nodes missing from the slot map own none.
+func PlanRebalance(slots []SlotRange, nodes []ClusterNode) []Move {
+	owned := make(map[string][]int)
+	total := 0
+	for _, sr := range slots {
+		for s := sr.Start; s <= sr.End; s++ {
+			owned[sr.Node.Addr] = append(owned[sr.Node.Addr], s)
+		}
+		total += sr.End - sr.Start + 1
+	}
+	nodes = append([]ClusterNode(nil), nodes...)
+	known := make(map[string]bool)
+	for _, n := range nodes {
+		known[n.Addr] = true
+	}
+	for _, sr := range slots {
+		if !known[sr.Node.Addr] {
+			nodes = append(nodes, sr.Node)
+			known[sr.Node.Addr] = true
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	// the nodes owning the most keep the extra slots, if any
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if len(owned[nodes[i].Addr]) != len(owned[nodes[j].Addr]) {
+			return len(owned[nodes[i].Addr]) > len(owned[nodes[j].Addr])
+		}
+		return nodes[i].Addr < nodes[j].Addr
+	})
+	share := make(map[string]int)
+	for i, n := range nodes {
+		share[n.Addr] = total / len(nodes)
+		if i < total%len(nodes) {
+			share[n.Addr]++
+		}
+	}
+	type given struct {
+		slot int
+		from ClusterNode
+	}
+	var pool []given
+	for _, n := range nodes {
+		s := owned[n.Addr]
+		for _, slot := range s[min(share[n.Addr], len(s)):] {
+			pool = append(pool, given{slot, n})
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].Addr < nodes[j].Addr })
+	var moves []Move
+	for _, n := range nodes {
+		for need := share[n.Addr] - len(owned[n.Addr]); need > 0 && len(pool) > 0; need-- {
+			g := pool[0]
+			pool = pool[1:]
+			if last := len(moves) - 1; last >= 0 && moves[last].To == n && moves[last].From == g.from && moves[last].End == g.slot-1 {
+				moves[last].End = g.slot
+				continue
+			}
+			moves = append(moves, Move{Start: g.slot, End: g.slot, From: g.from, To: n})
+		}
+	}
+	return moves
+}
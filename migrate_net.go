@@ -0,0 +1,296 @@
+package dmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// executeImport stores the keys carried by an opImport frame, records as
+// written in the append-only log.
+func (ms *MapServer) executeImport(value []byte) error {
+	r := bufio.NewReader(bytes.NewReader(value))
+	var mus []Mutation
+	for {
+		mu, _, err := readMutation(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		mus = append(mus, mu)
+	}
+	return ms.m.Import(mus)
+}
+
+// DefaultImportTimeout bounds the imports of a client, unless changed by
+// SetImportTimeout.
+const DefaultImportTimeout = 10 * time.Second
+
+// SetImportTimeout bounds the time an import waits for the server: Migrate
+// holds the keys of the batch, and the commands fenced, until then.
+func (mc *MapClient) SetImportTimeout(timeout time.Duration) {
+	mc.it = timeout
+}
+
+// Import stores the keys into the Map of the server, over the binary
+// protocol: it makes the client an Importer, for Map.Migrate. Once timed
+// out, the connection is to be closed, as the response may still come.
+func (mc *MapClient) Import(mus []Mutation) error {
+	if !mc.binary {
+		return errors.New("Import needs the binary protocol")
+	}
+	var buf []byte
+	for i := range mus {
+		buf = appendMutation(buf, &mus[i])
+	}
+	timeout := mc.it
+	if timeout <= 0 {
+		timeout = DefaultImportTimeout
+	}
+	mc.conn.SetDeadline(time.Now().Add(timeout))
+	defer mc.conn.SetDeadline(time.Time{})
+	_, err := mc.sendFrame(opImport, "", buf)
+	return err
+}
+
+// migrationHandler serves POST /api/v1/admin/cluster/<action>?slots=<ranges>,
+// the ranges as parsed by ParseSlots: importing marks the slots as migrated
+// from the node given, migrating as migrated to it, and migrate moves their
+// keys to it, once marked as migrating.
+func (hs *HTTPMapServer) migrationHandler(w http.ResponseWriter, r *http.Request) {
+	if hs.cluster == nil {
+		hs.typedError(w, http.StatusNotFound, errClusterOff)
+		return
+	}
+	if r.Method != "POST" {
+		hs.typedError(w, http.StatusMethodNotAllowed, errors.New("Bad method: only POST accepted"))
+		return
+	}
+	ranges, err := ParseSlots(r.URL.Query().Get("slots"))
+	if err != nil {
+		hs.typedError(w, http.StatusBadRequest, err)
+		return
+	}
+	rs := map[string]interface{}{"outcome": "OK"}
+	switch strings.TrimPrefix(r.URL.Path, "/api/v1/admin/cluster/") {
+	case "importing":
+		for _, sr := range ranges {
+			if err == nil {
+				err = hs.cluster.Importing(sr.Start, sr.End, sr.Node)
+			}
+		}
+	case "migrating":
+		for _, sr := range ranges {
+			if err == nil {
+				err = hs.cluster.Migrating(sr.Start, sr.End, sr.Node)
+			}
+		}
+	case "migrate":
+		batch, _ := strconv.Atoi(r.URL.Query().Get("batch"))
+		var moved int
+		moved, err = hs.migrate(ranges, batch)
+		rs["moved"] = moved
+	default:
+		hs.typedError(w, http.StatusNotFound, errors.New("Unrecognized endpoint: "+r.URL.Path))
+		return
+	}
+	if err == ErrOutOfMemory {
+		hs.outOfMemory(w, rs, err)
+		return
+	}
+	if err != nil {
+		hs.typedError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
+
+// migrate streams the keys of the ranges to their nodes, over TCP.
+func (hs *HTTPMapServer) migrate(ranges []SlotRange, batch int) (int, error) {
+	migrating, _ := hs.cluster.Migrations()
+	moved := 0
+	for _, sr := range ranges {
+		covered := false
+		for _, mr := range migrating {
+			covered = covered || mr.Node.Addr == sr.Node.Addr && mr.Start <= sr.Start && mr.End >= sr.End
+		}
+		if !covered {
+			return moved, fmt.Errorf("Bad slots %d-%d: not migrating to %s", sr.Start, sr.End, sr.Node.Addr)
+		}
+		host, p, err := net.SplitHostPort(sr.Node.Addr)
+		if err != nil {
+			return moved, err
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return moved, errors.New("Bad port: " + p)
+		}
+		tc := NewTCPMapClient(host, port)
+		tc.SetBinary(true)
+		err = tc.Dial()
+		if err != nil {
+			return moved, err
+		}
+		n, err := hs.m.Migrate(tc, sr.Start, sr.End, batch)
+		tc.Close()
+		moved += n
+		log.Printf("info: migrated %d keys of the slots %d-%d to %s\n", n, sr.Start, sr.End, sr.Node.Addr)
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// ClusterAdmin drives the nodes of a cluster through their HTTP servers, as
+// dmap-admin does.
+type ClusterAdmin struct {
+	client *http.Client
+	nodes  []ClusterNode
+}
+
+// NewClusterAdmin returns the admin of the nodes, given as the host:port of
+// their HTTP servers.
+func NewClusterAdmin(addrs ...string) (*ClusterAdmin, error) {
+	ca := &ClusterAdmin{client: &http.Client{}}
+	for _, addr := range addrs {
+		res, err := ca.call("GET", addr, "")
+		if err != nil {
+			return nil, err
+		}
+		self, _ := res["self"].(string)
+		ca.nodes = append(ca.nodes, ClusterNode{Addr: self, HTTP: addr})
+	}
+	return ca, nil
+}
+
+func (ca *ClusterAdmin) Nodes() []ClusterNode {
+	return ca.nodes
+}
+
+// Slots returns the slot map of the first node.
+func (ca *ClusterAdmin) Slots() ([]SlotRange, error) {
+	if len(ca.nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+	res, err := ca.call("GET", ca.nodes[0].HTTP, "")
+	if err != nil {
+		return nil, err
+	}
+	raw, _ := res["slots"].([]interface{})
+	var ranges []SlotRange
+	for _, r := range raw {
+		sr, _ := r.(map[string]interface{})
+		start, _ := sr["start"].(float64)
+		end, _ := sr["end"].(float64)
+		addr, _ := sr["addr"].(string)
+		web, _ := sr["http"].(string)
+		ranges = append(ranges, SlotRange{Start: int(start), End: int(end), Node: ClusterNode{Addr: addr, HTTP: web}})
+	}
+	return ranges, nil
+}
+
+// Plan returns the moves balancing the slots across the nodes.
+func (ca *ClusterAdmin) Plan() ([]Move, error) {
+	slots, err := ca.Slots()
+	if err != nil {
+		return nil, err
+	}
+	for i := range slots {
+		for _, n := range ca.nodes {
+			if slots[i].Node.Addr == n.Addr {
+				slots[i].Node = n
+			}
+		}
+	}
+	return PlanRebalance(slots, ca.nodes), nil
+}
+
+// Move migrates the slots, while the nodes serve them: the target imports
+// them, the source migrates them and streams their keys to the target, and
+// all the nodes assign them to the target. Returns the number of keys moved.
+func (ca *ClusterAdmin) Move(mv Move, batch int) (int, error) {
+	if mv.From.HTTP == "" || mv.To.HTTP == "" {
+		return 0, errors.New("Bad move: the HTTP servers of the nodes are unknown")
+	}
+	slots := fmt.Sprintf("%d-%d@", mv.Start, mv.End)
+	_, err := ca.call("POST", mv.To.HTTP, "/importing?slots="+slots+mv.From.Addr)
+	if err == nil {
+		_, err = ca.call("POST", mv.From.HTTP, "/migrating?slots="+slots+mv.To.Addr)
+	}
+	var res map[string]interface{}
+	if err == nil {
+		res, err = ca.call("POST", mv.From.HTTP, "/migrate?slots="+slots+mv.To.Addr+"&batch="+strconv.Itoa(batch))
+	}
+	if err != nil {
+		return 0, err
+	}
+	moved, _ := res["moved"].(float64)
+	done := make(map[string]bool)
+	for _, n := range append([]ClusterNode{mv.To, mv.From}, ca.nodes...) {
+		if n.HTTP == "" || done[n.HTTP] {
+			continue
+		}
+		done[n.HTTP] = true
+		_, err = ca.call("POST", n.HTTP, "?slots="+slots+mv.To.Addr+"/"+mv.To.HTTP)
+		if err != nil {
+			return int(moved), err
+		}
+	}
+	return int(moved), nil
+}
+
+// Rebalance plans the moves and executes them, in order.
+func (ca *ClusterAdmin) Rebalance(batch int) ([]Move, error) {
+	moves, err := ca.Plan()
+	if err != nil {
+		return nil, err
+	}
+	for i, mv := range moves {
+		_, err = ca.Move(mv, batch)
+		if err != nil {
+			return moves[:i], err
+		}
+	}
+	return moves, nil
+}
+
+func (ca *ClusterAdmin) call(method, addr, action string) (map[string]interface{}, error) {
+	req, err := http.NewRequest(method, "http://"+addr+"/api/v1/admin/cluster"+action, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := ca.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var j map[string]interface{}
+	err = json.Unmarshal(c, &j)
+	if err != nil {
+		return nil, errors.New("Unexpected response: " + res.Status)
+	}
+	if j["outcome"] != "OK" {
+		msg, _ := j["error"].(string)
+		return nil, fmt.Errorf("%s: %s", addr, msg)
+	}
+	return j, nil
+}
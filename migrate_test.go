@@ -0,0 +1,349 @@
+package dmap
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMigrate(t *testing.T) {
+	src, dst := NewMap(), NewMap()
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		keys = append(keys, key)
+		src.Put(key, []byte(key))
+	}
+	src.PutWithTTL("ttl", []byte("value"), time.Hour)
+	src.RPush("list", []byte("a"), []byte("b"))
+	src.HSet("hash", map[string][]byte{"f": []byte("v")})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			key := keys[i%len(keys)]
+			if Slot(key) < 8192 && src.Exists(key) {
+				src.Put(key, []byte("updated"))
+			}
+		}
+	}()
+	n, err := src.Migrate(dst, 0, 8191, 10)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("error: unable to migrate: %s\n", err.Error())
+	}
+	if len(src.SlotKeys(0, 8191)) != 0 || n != len(dst.SlotKeys(0, 8191)) || n == 0 {
+		t.Fatalf("expected the keys moved: %d %d\n", n, len(src.SlotKeys(0, 8191)))
+	}
+	for _, key := range append(keys, "ttl", "list", "hash") {
+		if Slot(key) >= 8192 {
+			if !src.Exists(key) || dst.Exists(key) {
+				t.Fatalf("expected the other keys left: %s\n", key)
+			}
+			continue
+		}
+		if src.Exists(key) || !dst.Exists(key) {
+			t.Fatalf("expected the key moved: %s\n", key)
+		}
+	}
+	if value := dst.Get(keys[0]); Slot(keys[0]) < 8192 && string(value) != keys[0] && string(value) != "updated" {
+		t.Logf("unexpected value: %s\n", value)
+		t.Fail()
+	}
+	if ttl := dst.TTL("ttl"); Slot("ttl") < 8192 && ttl <= 0 {
+		t.Logf("expected the ttl kept: %v\n", ttl)
+		t.Fail()
+	}
+	if values, _ := dst.LRange("list", 0, -1); Slot("list") < 8192 && (len(values) != 2 || string(values[1]) != "b") {
+		t.Logf("expected the list moved: %q\n", values)
+		t.Fail()
+	}
+	moving, target := NewMap(), NewMap()
+	c := NewCluster(ClusterNode{Addr: "localhost:1"})
+	c.Assign(0, ClusterSlots-1, c.Self())
+	c.Migrating(0, ClusterSlots-1, ClusterNode{Addr: "localhost:2"})
+	for _, key := range keys {
+		moving.Put(key, []byte(key))
+	}
+	replies := make([]string, len(keys))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ms := &MapServer{m: moving, cluster: c}
+		for i, key := range keys {
+			replies[i] = string(ms.executeRESP(nil, [][]byte{[]byte("DEL"), []byte(key)}))
+		}
+	}()
+	moving.Migrate(importerFunc(func(mus []Mutation) error {
+		time.Sleep(time.Millisecond)
+		return target.Import(mus)
+	}), 0, ClusterSlots-1, 10)
+	wg.Wait()
+	for i, key := range keys {
+		deleted, asked := replies[i] == ":1\r\n", strings.HasPrefix(replies[i], "-ASK ")
+		if moving.Exists(key) || !deleted && !asked || deleted && target.Exists(key) || asked && !target.Exists(key) {
+			t.Fatalf("expected the key deleted or redirected: %s %q %v\n", key, replies[i], target.Exists(key))
+		}
+	}
+	busy := NewMap(WithShards(2))
+	busy.Put("busy", []byte("value"))
+	_, err = busy.Migrate(&writingImporter{busy, 0}, 0, ClusterSlots-1, 1)
+	if err != errMigrateBusy {
+		t.Logf("expected the migration given up: %v\n", err)
+		t.Fail()
+	}
+	bounded := NewMap(WithShards(1), WithMaxMemory(10))
+	if _, err := src.Migrate(bounded, 8192, ClusterSlots-1, 10); err != ErrOutOfMemory || len(src.SlotKeys(8192, ClusterSlots-1)) == 0 {
+		t.Logf("expected the keys kept if not imported: %v\n", err)
+		t.Fail()
+	}
+}
+
+type importerFunc func([]Mutation) error
+
+func (f importerFunc) Import(mus []Mutation) error {
+	return f(mus)
+}
+
+// writingImporter writes a new key to the Map migrated at every batch, in a
+// shard not locked by the batch.
+type writingImporter struct {
+	m *Map
+	n int
+}
+
+func (wi *writingImporter) Import(mus []Mutation) error {
+	for {
+		wi.n++
+		key := fmt.Sprintf("busy%d", wi.n)
+		if wi.m.index(key) != wi.m.index(mus[0].Key) {
+			return wi.m.Put(key, []byte("value"))
+		}
+	}
+}
+
+func TestMigrateTx(t *testing.T) {
+	c := NewCluster(ClusterNode{Addr: "localhost:1"})
+	c.Assign(0, ClusterSlots-1, c.Self())
+	c.Migrating(0, ClusterSlots-1, ClusterNode{Addr: "localhost:2"})
+	m, target := NewMap(), NewMap()
+	m.Put("resp", []byte("a"))
+	m.Put("text", []byte("a"))
+	ms := &MapServer{m: m, cluster: c}
+	var rc, tc txConn
+	ms.executeRESPTx(nil, &rc, [][]byte{[]byte("MULTI")})
+	if res, _ := ms.executeRESPTx(nil, &rc, [][]byte{[]byte("SET"), []byte("resp"), []byte("b")}); string(res) != "+QUEUED\r\n" {
+		t.Fatalf("error: unexpected response: %q\n", res)
+	}
+	ms.executeTx(&tc, []byte("MULTI\r\n"))
+	if res, _ := ms.executeTx(&tc, []byte("PUT text b\r\n")); res != "OK=QUEUED" {
+		t.Fatalf("error: unexpected response: %s\n", res)
+	}
+	if _, err := m.Migrate(target, 0, ClusterSlots-1, 10); err != nil {
+		t.Fatalf("error: unable to migrate: %s\n", err.Error())
+	}
+	if res, _ := ms.executeRESPTx(nil, &rc, [][]byte{[]byte("EXEC")}); !strings.HasPrefix(string(res), "-ASK ") {
+		t.Logf("expected EXEC redirected: %q\n", res)
+		t.Fail()
+	}
+	if res, _ := ms.executeTx(&tc, []byte("EXEC\r\n")); !strings.HasPrefix(res, "KO=ASK ") {
+		t.Logf("expected EXEC redirected: %s\n", res)
+		t.Fail()
+	}
+	if m.Exists("resp") || m.Exists("text") || string(target.Get("resp")) != "a" || string(target.Get("text")) != "a" {
+		t.Logf("expected the keys migrated left untouched\n")
+		t.Fail()
+	}
+}
+
+func TestMigrateTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:12367")
+	if err != nil {
+		t.Fatalf("error: unable to listen: %s\n", err.Error())
+	}
+	defer l.Close()
+	// a target accepting the connection, never answering
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			io.Copy(io.Discard, conn)
+			conn.Close()
+		}
+	}()
+	m := NewMap()
+	for i := 0; i < 10; i++ {
+		m.Put(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+	tc := NewTCPMapClient("localhost", 12367)
+	tc.SetBinary(true)
+	tc.SetImportTimeout(100 * time.Millisecond)
+	if err := tc.Dial(); err != nil {
+		t.Fatalf("error: unable to dial in: %s\n", err.Error())
+	}
+	defer tc.Close()
+	start := time.Now()
+	moved, err := m.Migrate(tc, 0, ClusterSlots-1, 0)
+	if err == nil || moved != 0 || time.Since(start) > 5*time.Second {
+		t.Logf("expected the import timed out: %d %v %v\n", moved, err, time.Since(start))
+		t.Fail()
+	}
+	if m.Size() != 10 {
+		t.Logf("expected the keys kept: %d\n", m.Size())
+		t.Fail()
+	}
+	done := m.fence()
+	done()
+	if err := m.Put("key0", []byte("other")); err != nil || string(m.Get("key0")) != "other" {
+		t.Logf("expected the batch released: %v\n", err)
+		t.Fail()
+	}
+}
+
+func TestPlanRebalance(t *testing.T) {
+	a, b, c := ClusterNode{Addr: "a:1"}, ClusterNode{Addr: "b:1"}, ClusterNode{Addr: "c:1"}
+	slots := []SlotRange{{0, 8191, a}, {8192, ClusterSlots - 1, b}}
+	if moves := PlanRebalance(slots, []ClusterNode{a, b}); len(moves) != 0 {
+		t.Logf("expected no moves: %v\n", moves)
+		t.Fail()
+	}
+	moves := PlanRebalance(slots, []ClusterNode{a, b, c})
+	owners := make(map[int]string)
+	for _, sr := range slots {
+		for s := sr.Start; s <= sr.End; s++ {
+			owners[s] = sr.Node.Addr
+		}
+	}
+	for _, mv := range moves {
+		if mv.To != c {
+			t.Fatalf("expected the slots moved to the new node: %v\n", mv)
+		}
+		for s := mv.Start; s <= mv.End; s++ {
+			if owners[s] != mv.From.Addr {
+				t.Fatalf("expected the slots moved from their owner: %v\n", mv)
+			}
+			owners[s] = mv.To.Addr
+		}
+	}
+	counts := make(map[string]int)
+	for _, owner := range owners {
+		counts[owner]++
+	}
+	if len(moves) != 2 || counts["a:1"] != 5462 || counts["b:1"] != 5461 || counts["c:1"] != 5461 {
+		t.Logf("unexpected moves: %v %v\n", moves, counts)
+		t.Fail()
+	}
+}
+
+func TestClusterMigration(t *testing.T) {
+	nodes := []ClusterNode{{"localhost:12372", "localhost:8093"}, {"localhost:12373", "localhost:8094"}}
+	var wg sync.WaitGroup
+	var maps []*Map
+	var clusters []*Cluster
+	for i, node := range nodes {
+		m := NewMap()
+		c := NewCluster(node)
+		c.Assign(0, ClusterSlots-1, nodes[0])
+		maps, clusters = append(maps, m), append(clusters, c)
+		wg.Add(2)
+		ts, err := NewTCPMapServer("localhost", 12372+i, &wg, m, true)
+		if err != nil {
+			t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+		}
+		ts.SetCluster(c)
+		go ts.Serve()
+		defer ts.Shutdown()
+		hs, err := NewHTTPMapServer("localhost", 8093+i, &wg, m, true)
+		if err != nil {
+			t.Fatalf("error: unable to start the HTTP server: %s\n", err.Error())
+		}
+		hs.SetCluster(c)
+		go hs.Serve()
+		defer hs.Shutdown()
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 500; i++ {
+		maps[0].Put(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+	present, missing := slotKey("key", 0, 99), slotKey("none", 0, 99)
+	maps[0].Put(present, []byte("value"))
+	total := maps[0].Size()
+	clusters[1].Importing(0, 99, nodes[0])
+	clusters[0].Migrating(0, 99, nodes[1])
+	ms := &MapServer{m: maps[0], cluster: clusters[0]}
+	if res := ms.executeRESP(nil, [][]byte{[]byte("GET"), []byte(missing)}); !strings.HasPrefix(string(res), "-ASK ") {
+		t.Logf("expected an ASK redirection: %q\n", res)
+		t.Fail()
+	}
+	if res := ms.executeRESP(nil, [][]byte{[]byte("GET"), []byte(present)}); string(res) != "$5\r\nvalue\r\n" {
+		t.Logf("expected the key held served: %q\n", res)
+		t.Fail()
+	}
+	if res := ms.executeRESP(nil, [][]byte{[]byte("MGET"), []byte(present), []byte("{" + present + "}x")}); !strings.HasPrefix(string(res), "-TRYAGAIN") {
+		t.Logf("expected a retry asked: %q\n", res)
+		t.Fail()
+	}
+	target := &MapServer{m: maps[1], cluster: clusters[1]}
+	if res, err := target.execute([]byte("GET " + missing)); err == nil || !strings.HasPrefix(err.Error(), "KO=MOVED") {
+		t.Logf("expected a redirection without ASKING: %s %v\n", res, err)
+		t.Fail()
+	}
+	target.execute([]byte("ASKING"))
+	if _, err := target.execute([]byte("PUT " + missing + " new")); err != nil || !maps[1].Exists(missing) {
+		t.Logf("expected the command served after ASKING: %v\n", err)
+		t.Fail()
+	}
+	tc, hc := NewTCPMapClient("localhost", 12372), NewHTTPMapClient("localhost", 8093)
+	tc.SetBinary(true)
+	for _, c := range []Client{tc, hc} {
+		c.Dial()
+		defer c.Close()
+		if value, err := c.Get(missing); err != nil || string(value) != "new" {
+			t.Logf("expected the ASK redirection followed: %s %v\n", value, err)
+			t.Fail()
+		}
+		if value, err := c.Get(present); err != nil || string(value) != "value" {
+			t.Logf("expected the key read from the source: %s %v\n", value, err)
+			t.Fail()
+		}
+	}
+	if len(tc.slots) != 0 || len(hc.slots) != 0 {
+		t.Logf("expected the ASK redirections not cached\n")
+		t.Fail()
+	}
+	clusters[0].Assign(0, 99, nodes[0])
+	clusters[1].Assign(0, 99, nodes[0])
+	maps[1].Delete(missing)
+	ca, err := NewClusterAdmin(nodes[0].HTTP, nodes[1].HTTP)
+	if err != nil {
+		t.Fatalf("error: unable to reach the nodes: %s\n", err.Error())
+	}
+	moves, err := ca.Rebalance(50)
+	if err != nil || len(moves) != 1 || moves[0].Start != 8192 || moves[0].To != nodes[1] {
+		t.Fatalf("error: unable to rebalance: %v %v\n", moves, err)
+	}
+	if maps[0].Size()+maps[1].Size() != total || len(maps[0].SlotKeys(8192, ClusterSlots-1)) != 0 || len(maps[1].SlotKeys(0, 8191)) != 0 {
+		t.Fatalf("expected the keys of the slots moved: %d %d\n", maps[0].Size(), maps[1].Size())
+	}
+	for i, c := range clusters {
+		if slots := c.Slots(); len(slots) != 2 || slots[1].Node != nodes[1] {
+			t.Logf("expected the slots assigned on every node: %d %v\n", i, slots)
+			t.Fail()
+		}
+	}
+	moved := slotKey("key", 8192, ClusterSlots-1)
+	for _, c := range []Client{tc, hc} {
+		if value, err := c.Get(moved); err != nil || string(value) != "value" {
+			t.Logf("expected the key read from its new owner: %s %v\n", value, err)
+			t.Fail()
+		}
+	}
+	if moves, _ := ca.Plan(); len(moves) != 0 {
+		t.Logf("expected the cluster balanced: %v\n", moves)
+		t.Fail()
+	}
+}
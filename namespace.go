@@ -0,0 +1,351 @@
+package dmap
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultNamespace is the name of the Map given to NewNamespaces, the one
+// selected by connections at first.
+const DefaultNamespace = "0"
+
+// DefaultMaxNamespaces bounds the namespaces of a registry, the default one
+// included, unless changed by SetMax.
+const DefaultMaxNamespaces = 1024
+
+var (
+	ErrBadNamespace      = errors.New("Bad namespace, names are 1 to 64 letters, digits, '-', '_', '.' or ':'")
+	ErrTooManyNamespaces = errors.New("Too many namespaces")
+	errNoNamespace       = errors.New("Namespace not found: not written yet")
+	errDurableNamespace  = errors.New("Bad namespace, only the default one is served along with the snapshots and the replication")
+)
+
+// Namespaces is a registry of Maps, i.e. of keyspaces isolated from each
+// other, created by the first write with the options given: until then, a
+// namespace reads as empty.
+type Namespaces struct {
+	l     sync.RWMutex
+	m     map[string]*Map
+	opts  []Option
+	max   int
+	empty *Map
+}
+
+func NewNamespaces(m *Map, opts ...Option) *Namespaces {
+	return &Namespaces{
+		m:     map[string]*Map{DefaultNamespace: m},
+		opts:  opts,
+		max:   DefaultMaxNamespaces,
+		empty: NewMap(WithShards(1)),
+	}
+}
+
+// SetMax bounds the namespaces, the default one included: 0 lifts the bound.
+func (n *Namespaces) SetMax(max int) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	n.max = max
+}
+
+// Get returns the Map of the namespace, creating it if not found, unless the
+// namespaces are already as many as the bound.
+func (n *Namespaces) Get(name string) (*Map, error) {
+	n.l.RLock()
+	m, ok := n.m[name]
+	n.l.RUnlock()
+	if ok {
+		return m, nil
+	}
+	if !validNamespace(name) {
+		return nil, ErrBadNamespace
+	}
+	n.l.Lock()
+	defer n.l.Unlock()
+	if m, ok := n.m[name]; ok {
+		return m, nil
+	}
+	if n.max > 0 && len(n.m) >= n.max {
+		return nil, ErrTooManyNamespaces
+	}
+	m = NewMap(n.opts...)
+	n.m[name] = m
+	return m, nil
+}
+
+// lookup returns the Map of the namespace, the empty one, never written, if
+// not created yet.
+func (n *Namespaces) lookup(name string) (*Map, error) {
+	n.l.RLock()
+	m, ok := n.m[name]
+	n.l.RUnlock()
+	if ok {
+		return m, nil
+	}
+	if !validNamespace(name) {
+		return nil, ErrBadNamespace
+	}
+	return n.empty, nil
+}
+
+// Names returns the names of the namespaces, in order.
+func (n *Namespaces) Names() []string {
+	n.l.RLock()
+	defer n.l.RUnlock()
+	names := make([]string, 0, len(n.m))
+	for name := range n.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close stops the Maps created by the registry, not the default one.
+func (n *Namespaces) Close() {
+	n.l.Lock()
+	defer n.l.Unlock()
+	n.empty.Close()
+	for name, m := range n.m {
+		if name != DefaultNamespace {
+			m.Close()
+		}
+	}
+}
+
+func validNamespace(name string) bool {
+	if len(name) == 0 || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SetNamespaces enables SELECT: without a registry, only the default
+// namespace can be selected, as it is along with SetSnapshotter or
+// SetReplication, which save and copy the default Map only.
+func (ms *MapServer) SetNamespaces(n *Namespaces) {
+	ms.ns = n
+}
+
+// namespace returns the Map of the namespace, creating it if the command is
+// a write: the empty one of the registry otherwise, if not created yet.
+func (ms *MapServer) namespace(name string, write bool) (*Map, error) {
+	if ms.ns == nil {
+		if name == DefaultNamespace {
+			return ms.m, nil
+		}
+		return nil, errors.New("Bad namespace, namespaces are disabled")
+	}
+	if ms.cluster != nil && name != DefaultNamespace {
+		return nil, errClusterNamespace
+	}
+	if (ms.snap != nil || ms.repl != nil) && name != DefaultNamespace {
+		return nil, errDurableNamespace
+	}
+	if write && ms.raft != nil && name != DefaultNamespace {
+		return nil, errRaftNamespace
+	}
+	if write {
+		return ms.ns.Get(name)
+	}
+	return ms.ns.lookup(name)
+}
+
+// selectNamespace switches the server, a copy owned by a connection, to the
+// namespace, pending until created if not yet.
+func (ms *MapServer) selectNamespace(name string) error {
+	m, err := ms.namespace(name, false)
+	if err != nil {
+		return err
+	}
+	ms.m, ms.selected = m, ""
+	if ms.ns != nil && m == ms.ns.empty {
+		ms.selected = name
+	}
+	return nil
+}
+
+// resolve switches the server to the namespace selected, if pending, once
+// created: by the command itself, if a write. In consensus mode, the writes
+// are refused but on the default namespace, the one of the Raft group.
+func (ms *MapServer) resolve(write bool) error {
+	if write && ms.raft != nil && ms.selected == "" && ms.m != ms.raft.m {
+		return errRaftNamespace
+	}
+	if ms.selected == "" {
+		return nil
+	}
+	m, err := ms.namespace(ms.selected, write)
+	if err != nil {
+		return err
+	}
+	ms.m = m
+	if m != ms.ns.empty {
+		ms.selected = ""
+	}
+	return nil
+}
+
+// udpSession is the namespace selected by a client address, forgotten once
+// idle for longer than the idle timeout of the server.
+type udpSession struct {
+	m        *Map
+	selected string
+	seen     time.Time
+}
+
+// session returns the server for a datagram from the address, switched to
+// the namespace the address selected last, and the function to remember the
+// one selected by the datagram.
+func (us *UDPMapServer) session(addr *net.UDPAddr) (*MapServer, func()) {
+	s := us.MapServer
+	key := addr.String()
+	now := time.Now()
+	us.sl.Lock()
+	if now.Sub(us.swept) >= us.idle {
+		for k, ss := range us.sessions {
+			if now.Sub(ss.seen) >= us.idle {
+				delete(us.sessions, k)
+			}
+		}
+		us.swept = now
+	}
+	if ss, ok := us.sessions[key]; ok {
+		s.m, s.selected = ss.m, ss.selected
+	}
+	us.sl.Unlock()
+	return &s, func() {
+		us.sl.Lock()
+		defer us.sl.Unlock()
+		if s.m == us.m && s.selected == "" {
+			delete(us.sessions, key)
+		} else {
+			us.sessions[key] = &udpSession{m: s.m, selected: s.selected, seen: now}
+		}
+	}
+}
+
+// namespaced are the endpoints served under /api/v1/ns/<ns> as well.
+var namespaced = map[string]func(*HTTPMapServer, http.ResponseWriter, *http.Request){
+	"/map":         (*HTTPMapServer).handler,
+	"/map/batch":   (*HTTPMapServer).batchHandler,
+	"/map/watch":   (*HTTPMapServer).watchHandler,
+	"/map/keys":    (*HTTPMapServer).keysHandler,
+	"/map/entries": (*HTTPMapServer).entriesHandler,
+	"/map/type":    (*HTTPMapServer).typeHandler,
+	"/tx":          (*HTTPMapServer).txHandler,
+	"/list":        (*HTTPMapServer).listHandler,
+	"/set":         (*HTTPMapServer).setHandler,
+	"/hash":        (*HTTPMapServer).hashHandler,
+}
+
+// /api/v1/ns lists the namespaces and their sizes, /api/v1/ns/<ns>/<endpoint>
+// serves the endpoint on the namespace.
+func (hs *HTTPMapServer) namespaceHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/ns")
+	if path == "" || path == "/" {
+		hs.namespacesHandler(w, r)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	handler, ok := namespaced["/"+strings.Join(parts[1:], "")]
+	if len(parts) != 2 || !ok {
+		hs.typedError(w, http.StatusNotFound, errors.New("Unrecognized endpoint: "+r.URL.Path))
+		return
+	}
+	m, err := hs.namespace(parts[0], r.Method != "GET")
+	if err != nil {
+		hs.typedError(w, http.StatusBadRequest, err)
+		return
+	}
+	if hs.ns != nil && m == hs.ns.empty && parts[1] == "map/watch" {
+		hs.typedError(w, http.StatusNotFound, errNoNamespace)
+		return
+	}
+	ns := *hs
+	ns.m = m
+	h := func(w http.ResponseWriter, r *http.Request) {
+		handler(&ns, w, r)
+	}
+	switch parts[1] {
+	case "map/keys", "map/entries", "map/watch":
+	default:
+		h = ns.owned(h)
+	}
+	if parts[1] != "map" {
+		h = ns.local(h)
+	}
+	hs.writable(h)(w, r)
+}
+
+func (hs *HTTPMapServer) namespacesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		hs.typedError(w, http.StatusMethodNotAllowed, errors.New("Bad method: only GET accepted"))
+		return
+	}
+	sizes := map[string]int{DefaultNamespace: hs.m.Size()}
+	if hs.ns != nil {
+		for _, name := range hs.ns.Names() {
+			m, _ := hs.ns.Get(name)
+			sizes[name] = m.Size()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	buf, _ := json.Marshal(map[string]interface{}{"outcome": "OK", "namespaces": sizes})
+	w.Write(buf[:])
+}
+
+// SetNamespace makes the client work on the namespace, the default one if
+// empty: for UDP and TCP clients it must be set before Dial.
+func (mc *MapClient) SetNamespace(ns string) {
+	mc.ns = ns
+}
+
+// selectNamespace selects the namespace of the client on the connection.
+func (mc *MapClient) selectNamespace() error {
+	if mc.ns == "" {
+		return nil
+	}
+	if mc.binary {
+		_, err := mc.roundTrip(opSelect, mc.ns, nil)
+		return err
+	}
+	_, err := mc.call("SELECT " + mc.ns)
+	return err
+}
+
+// api returns the root of the endpoints of the namespace of the client.
+func (hc *HTTPMapClient) api() string {
+	if hc.ns == "" {
+		return "/api/v1"
+	}
+	return "/api/v1/ns/" + url.PathEscape(hc.ns)
+}
+
+// Namespaces returns the sizes of the namespaces of the server.
+func (hc *HTTPMapClient) Namespaces() (map[string]int, error) {
+	v, err := hc.typed("GET", "/api/v1/ns", nil, nil, "namespaces")
+	if err != nil {
+		return nil, err
+	}
+	raw, _ := v.(map[string]interface{})
+	sizes := make(map[string]int, len(raw))
+	for name, size := range raw {
+		n, _ := size.(float64)
+		sizes[name] = int(n)
+	}
+	return sizes, nil
+}
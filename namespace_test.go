@@ -0,0 +1,224 @@
+package dmap
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNamespaces(t *testing.T) {
+	m := NewMap()
+	ns := NewNamespaces(m, WithShards(1))
+	defer ns.Close()
+	if d, _ := ns.Get(DefaultNamespace); d != m {
+		t.Logf("expected the default map\n")
+		t.Fail()
+	}
+	a, err := ns.Get("team-a")
+	if err != nil {
+		t.Fatalf("unable to get the namespace: %s\n", err.Error())
+	}
+	if b, _ := ns.Get("team-a"); a != b || a.Shards() != 1 {
+		t.Logf("expected the same map, with the options given\n")
+		t.Fail()
+	}
+	for _, name := range []string{"", "with space", "slash/"} {
+		if _, err := ns.Get(name); err != ErrBadNamespace {
+			t.Logf("expected a bad namespace: %q %v\n", name, err)
+			t.Fail()
+		}
+	}
+	if names := ns.Names(); !reflect.DeepEqual(names, []string{"0", "team-a"}) {
+		t.Logf("unexpected names: %v\n", names)
+		t.Fail()
+	}
+	ns.SetMax(2)
+	if _, err := ns.Get("team-b"); err != ErrTooManyNamespaces {
+		t.Logf("expected too many namespaces: %v\n", err)
+		t.Fail()
+	}
+	if b, err := ns.Get("team-a"); err != nil || a != b {
+		t.Logf("expected the namespace created: %v\n", err)
+		t.Fail()
+	}
+}
+
+func TestNamespacesCreatedOnWrite(t *testing.T) {
+	m := NewMap()
+	ns := NewNamespaces(m)
+	defer ns.Close()
+	ms := &MapServer{m: m, ns: ns}
+	other := &MapServer{m: m, ns: ns}
+	for _, line := range []string{"SELECT team-a", "GET key", "SIZE"} {
+		ms.execute([]byte(line + "\r\n"))
+	}
+	other.execute([]byte("SELECT team-a\r\n"))
+	if names := ns.Names(); !reflect.DeepEqual(names, []string{"0"}) {
+		t.Logf("error: expected no namespace created by reads: %v\n", names)
+		t.Fail()
+	}
+	outcome, err := ms.execute([]byte("PUT key value\r\n"))
+	if err != nil || !reflect.DeepEqual(ns.Names(), []string{"0", "team-a"}) {
+		t.Logf("error: expected the namespace created by the write: %s %v %v\n", outcome, err, ns.Names())
+		t.Fail()
+	}
+	if outcome, _ := other.execute([]byte("GET key\r\n")); outcome != "OK=value" {
+		t.Logf("error: expected the key written by the other connection: %s\n", outcome)
+		t.Fail()
+	}
+	if m.Get("key") != nil {
+		t.Logf("error: expected the default namespace untouched\n")
+		t.Fail()
+	}
+	ns.SetMax(2)
+	ms.execute([]byte("SELECT team-b\r\n"))
+	if _, err := ms.execute([]byte("PUT key value\r\n")); err == nil || err.Error() != "KO="+ErrTooManyNamespaces.Error() {
+		t.Logf("error: expected too many namespaces: %v\n", err)
+		t.Fail()
+	}
+	if ns.empty.Size() != 0 {
+		t.Logf("error: expected the namespaces not created empty\n")
+		t.Fail()
+	}
+}
+
+func TestNamespacesDurable(t *testing.T) {
+	m := NewMap()
+	ns := NewNamespaces(m)
+	defer ns.Close()
+	rp := NewReplication(m)
+	defer rp.Close()
+	for _, ms := range []*MapServer{{m: m, ns: ns, repl: rp}, {m: m, ns: ns, snap: NewSnapshotter("dmap.snapshot", m)}} {
+		if _, err := ms.execute([]byte("SELECT team-a\r\n")); err == nil || err.Error() != "KO="+errDurableNamespace.Error() {
+			t.Logf("error: expected the namespace refused: %v\n", err)
+			t.Fail()
+		}
+		if outcome, err := ms.execute([]byte("SELECT 0\r\n")); err != nil {
+			t.Logf("error: expected the default namespace selected: %s %v\n", outcome, err)
+			t.Fail()
+		}
+	}
+	if names := ns.Names(); !reflect.DeepEqual(names, []string{"0"}) {
+		t.Logf("error: expected no namespace created: %v\n", names)
+		t.Fail()
+	}
+}
+
+func TestNamespaceClients(t *testing.T) {
+	m := NewMap()
+	ns := NewNamespaces(m)
+	defer ns.Close()
+	var wg sync.WaitGroup
+	wg.Add(3)
+	ts, err := NewTCPMapServer("localhost", 12357, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	ts.SetNamespaces(ns)
+	go ts.Serve()
+	defer ts.Shutdown()
+	us, err := NewUDPMapServer("localhost", 12358, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the UDP server: %s\n", err.Error())
+	}
+	us.SetNamespaces(ns)
+	go us.Serve()
+	defer us.Shutdown()
+	hs, err := NewHTTPMapServer("localhost", 8087, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the HTTP server: %s\n", err.Error())
+	}
+	hs.SetNamespaces(ns)
+	go hs.Serve()
+	defer hs.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	m.Put("key", []byte("default"))
+	tc, bc, uc := NewTCPMapClient("localhost", 12357), NewTCPMapClient("localhost", 12357), NewUDPMapClient("localhost", 12358)
+	bc.SetBinary(true)
+	hc := NewHTTPMapClient("localhost", 8087)
+	for i, c := range []interface {
+		Client
+		SetNamespace(string)
+	}{tc, bc, uc, hc} {
+		name := []string{"tcp", "binary", "udp", "http"}[i]
+		c.SetNamespace(name)
+		err = c.Dial()
+		if err != nil {
+			t.Fatalf("error: unable to dial in: %s\n", err.Error())
+		}
+		c.Put("key", []byte(name))
+		c.Put("other", []byte(name))
+		b, err := c.Get("key")
+		if err != nil || string(b) != name {
+			t.Logf("error: unexpected value in %s: %s %v\n", name, b, err)
+			t.Fail()
+		}
+		if s, _ := c.Size(); s != 2 {
+			t.Logf("error: unexpected size of %s: %d\n", name, s)
+			t.Fail()
+		}
+		err = c.Clear()
+		if err != nil {
+			t.Logf("error: unable to clear %s: %s\n", name, err.Error())
+			t.Fail()
+		}
+		c.Close()
+		if string(m.Get("key")) != "default" {
+			t.Logf("error: expected the default namespace untouched by %s\n", name)
+			t.Fail()
+		}
+	}
+	sizes, err := hc.Namespaces()
+	if err != nil || len(sizes) != 5 || sizes["0"] != 1 || sizes["udp"] != 0 {
+		t.Logf("error: unexpected namespaces: %v %v\n", sizes, err)
+		t.Fail()
+	}
+	conn, err := net.Dial("tcp", "localhost:12357")
+	if err != nil {
+		t.Fatalf("error: unable to dial in: %s\n", err.Error())
+	}
+	defer conn.Close()
+	conn.Write([]byte(respCommand("SELECT", "resp") + respCommand("SET", "key", "resp") + respCommand("SELECT", "bad name")))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{"+OK\r\n", "+OK\r\n", "-ERR " + ErrBadNamespace.Error() + "\r\n"} {
+		line, _ := r.ReadString('\n')
+		if line != expected {
+			t.Logf("error: unexpected response: %q\n", line)
+			t.Fail()
+		}
+	}
+	if n, _ := ns.Get("resp"); string(n.Get("key")) != "resp" {
+		t.Logf("error: expected the key in the namespace selected\n")
+		t.Fail()
+	}
+	hc.SetNamespace("unknown")
+	if b, err := hc.Get("key"); err != nil || string(b) != "null" {
+		t.Logf("error: expected the key not found: %s %v\n", b, err)
+		t.Fail()
+	}
+	if sizes, _ := hc.Namespaces(); len(sizes) != 6 {
+		t.Logf("error: expected no namespace created by reads: %v\n", sizes)
+		t.Fail()
+	}
+	us.sl.Lock()
+	sessions := len(us.sessions)
+	us.idle = time.Millisecond
+	us.sl.Unlock()
+	if sessions != 1 {
+		t.Logf("error: expected the session of the UDP client: %d\n", sessions)
+		t.Fail()
+	}
+	time.Sleep(10 * time.Millisecond)
+	us.session(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1})
+	us.sl.Lock()
+	sessions = len(us.sessions)
+	us.sl.Unlock()
+	if sessions != 0 {
+		t.Logf("error: expected the idle sessions forgotten: %d\n", sessions)
+		t.Fail()
+	}
+}
@@ -0,0 +1,39 @@
+package dmap
+
+import (
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		matched bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"key", "key", true},
+		{"key", "key1", false},
+		{"config:*", "config:db", true},
+		{"config:*", "conf", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hallo", false},
+		{"*:*:end", "a:b:end", true},
+		{"*:*:end", "a:end", false},
+	}
+	for _, c := range cases {
+		if match(c.pattern, c.s) != c.matched {
+			t.Logf("unexpected match of %q against %q: %v\n", c.s, c.pattern, !c.matched)
+			t.Fail()
+		}
+	}
+}
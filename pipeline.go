@@ -0,0 +1,176 @@
+package dmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Pipeline buffers commands and sends them at once on Exec, reading the
+// responses afterwards: thousands of operations cost a single round trip.
+type Pipeline struct {
+	mc  *MapClient
+	buf []byte
+	ops []byte
+	ids []uint32
+}
+
+// Result of a pipelined command: Value is the value for Get (nil if the key
+// is not found), the size for Size, the result for Incr, "1" or "0" for the
+// conditional commands.
+type Result struct {
+	Value []byte
+	Err   error
+}
+
+func (r Result) Bool() bool {
+	return string(r.Value) == "1"
+}
+
+func (r Result) Int() (int, error) {
+	return strconv.Atoi(string(r.Value))
+}
+
+func (tc *TCPMapClient) Pipeline() *Pipeline {
+	return &Pipeline{mc: &tc.MapClient}
+}
+
+func (p *Pipeline) Put(key string, value []byte) {
+	p.add(opPut, key, value, fmt.Sprintf("PUT %s %s", key, string(value)))
+}
+
+func (p *Pipeline) PutIfAbsent(key string, value []byte) {
+	p.add(opPutNX, key, value, fmt.Sprintf("PUTNX %s %s", key, string(value)))
+}
+
+func (p *Pipeline) Replace(key string, value []byte) {
+	p.add(opPutXX, key, value, fmt.Sprintf("PUTXX %s %s", key, string(value)))
+}
+
+func (p *Pipeline) CompareAndSwap(key string, old, new []byte) {
+	p.add(opCAS, key, casValue(old, new), fmt.Sprintf("CAS %s %s %s", key, string(old), string(new)))
+}
+
+func (p *Pipeline) CompareAndDelete(key string, old []byte) {
+	p.add(opCAD, key, old, fmt.Sprintf("CAD %s %s", key, string(old)))
+}
+
+func (p *Pipeline) Incr(key string, delta int64) {
+	p.add(opIncr, key, binary.BigEndian.AppendUint64(nil, uint64(delta)), fmt.Sprintf("INCRBY %s %d", key, delta))
+}
+
+func (p *Pipeline) Get(key string) {
+	p.add(opGet, key, nil, "GET "+key)
+}
+
+func (p *Pipeline) Delete(key string) {
+	p.add(opDel, key, nil, "DEL "+key)
+}
+
+func (p *Pipeline) Size() {
+	p.add(opSize, "", nil, "SIZE")
+}
+
+func (p *Pipeline) Clear() {
+	p.add(opClear, "", nil, "CLEAR")
+}
+
+func (p *Pipeline) Len() int {
+	return len(p.ops)
+}
+
+func (p *Pipeline) add(op byte, key string, value []byte, command string) {
+	if p.mc.binary {
+		p.mc.id++
+		p.buf = (&frame{op: op, id: p.mc.id, key: []byte(key), value: value}).encode(p.buf)
+		p.ids = append(p.ids, p.mc.id)
+	} else {
+		p.buf = append(p.buf, command...)
+		p.buf = append(p.buf, '\r', '\n')
+	}
+	p.ops = append(p.ops, op)
+}
+
+// Exec sends the buffered commands and returns their results in order: the
+// commands are written while the responses are read, so that neither side
+// blocks on full socket buffers. The pipeline is reset, ready to be reused.
+func (p *Pipeline) Exec() ([]Result, error) {
+	defer p.reset()
+	werr := make(chan error, 1)
+	go func() {
+		_, err := p.mc.conn.Write(p.buf)
+		werr <- err
+	}()
+	results := make([]Result, len(p.ops))
+	for i, op := range p.ops {
+		var err error
+		if p.mc.binary {
+			results[i], err = p.readFrame(op, p.ids[i])
+		} else {
+			results[i], err = p.readLine(op)
+		}
+		if err != nil {
+			if e := <-werr; e != nil {
+				return nil, e
+			}
+			return nil, err
+		}
+	}
+	return results, <-werr
+}
+
+func (p *Pipeline) reset() {
+	p.buf, p.ops, p.ids = p.buf[:0], p.ops[:0], p.ids[:0]
+}
+
+func (p *Pipeline) readLine(op byte) (Result, error) {
+	line, err := p.mc.r.ReadString('\n')
+	if err != nil {
+		return Result{}, err
+	}
+	b, err := p.mc.parse(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		if op == opGet && err.Error() == "null" {
+			return Result{}, nil
+		}
+		return Result{Err: err}, nil
+	}
+	return Result{Value: []byte(b)}, nil
+}
+
+func (p *Pipeline) readFrame(op byte, id uint32) (Result, error) {
+	res, err := readFrame(p.mc.r)
+	if err != nil {
+		return Result{}, err
+	}
+	if res.id != id {
+		return Result{}, errors.New("Unexpected response: out of order frame")
+	}
+	switch res.op {
+	case statusError:
+		return Result{Err: knownError(string(res.value))}, nil
+	case statusOOM:
+		return Result{Err: ErrOutOfMemory}, nil
+	case statusNotFound:
+		return Result{}, nil
+	case statusFalse:
+		return Result{Value: []byte("0")}, nil
+	}
+	switch op {
+	case opPutNX, opPutXX, opCAS, opCAD:
+		return Result{Value: []byte("1")}, nil
+	case opIncr:
+		if len(res.value) != 8 {
+			return Result{}, errors.New("Unexpected response: malformed value")
+		}
+		return Result{Value: []byte(strconv.FormatInt(int64(binary.BigEndian.Uint64(res.value)), 10))}, nil
+	case opSize:
+		if len(res.value) != 8 {
+			return Result{}, errors.New("Unexpected response: malformed size")
+		}
+		return Result{Value: []byte(strconv.FormatUint(binary.BigEndian.Uint64(res.value), 10))}, nil
+	}
+	return Result{Value: res.value}, nil
+}
@@ -0,0 +1,589 @@
+package dmap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const subscriberBuffer = 1024
+
+var errPubSubDisabled = errors.New("Pub/sub not enabled")
+
+// Broker fans out the messages published on channels to their subscribers:
+// channels are independent of the keyspace, and messages are not stored.
+type Broker struct {
+	l        sync.RWMutex
+	channels map[string]map[*Subscriber]struct{}
+	patterns map[string]map[*Subscriber]struct{}
+}
+
+// Message is a published message: Pattern is set if it has been received
+// through a pattern subscription.
+type Message struct {
+	Channel string
+	Pattern string
+	Payload []byte
+}
+
+// Subscriber receives the messages of the channels, and of the channels
+// matching the glob-style patterns, it is subscribed to. Messages are
+// buffered: a subscriber not keeping up is dropped, its channel being closed.
+type Subscriber struct {
+	b        *Broker
+	c        chan Message
+	l        sync.Mutex
+	closed   bool
+	channels map[string]struct{}
+	patterns map[string]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		channels: make(map[string]map[*Subscriber]struct{}),
+		patterns: make(map[string]map[*Subscriber]struct{}),
+	}
+}
+
+// Publish sends the payload to the subscribers of the channel, returning how
+// many received it.
+func (b *Broker) Publish(channel string, payload []byte) int {
+	b.l.RLock()
+	defer b.l.RUnlock()
+	n := 0
+	for s := range b.channels[channel] {
+		if s.deliver(Message{Channel: channel, Payload: payload}) {
+			n++
+		}
+	}
+	for pattern, subs := range b.patterns {
+		if !match(pattern, channel) {
+			continue
+		}
+		for s := range subs {
+			if s.deliver(Message{Channel: channel, Pattern: pattern, Payload: payload}) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Subscriber returns a subscriber with no subscription.
+func (b *Broker) Subscriber() *Subscriber {
+	return &Subscriber{
+		b:        b,
+		c:        make(chan Message, subscriberBuffer),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+}
+
+func (s *Subscriber) Messages() <-chan Message {
+	return s.c
+}
+
+func (s *Subscriber) Subscribe(channels ...string) {
+	s.b.l.Lock()
+	defer s.b.l.Unlock()
+	for _, channel := range channels {
+		s.b.add(s.b.channels, channel, s)
+		s.channels[channel] = struct{}{}
+	}
+}
+
+func (s *Subscriber) PSubscribe(patterns ...string) {
+	s.b.l.Lock()
+	defer s.b.l.Unlock()
+	for _, pattern := range patterns {
+		s.b.add(s.b.patterns, pattern, s)
+		s.patterns[pattern] = struct{}{}
+	}
+}
+
+// Unsubscribe removes the subscriptions to the channels, all of them if none
+// is given, returning the channels unsubscribed.
+func (s *Subscriber) Unsubscribe(channels ...string) []string {
+	s.b.l.Lock()
+	defer s.b.l.Unlock()
+	return s.b.remove(s.b.channels, s.channels, channels, s)
+}
+
+// PUnsubscribe removes the subscriptions to the patterns, all of them if none
+// is given, returning the patterns unsubscribed.
+func (s *Subscriber) PUnsubscribe(patterns ...string) []string {
+	s.b.l.Lock()
+	defer s.b.l.Unlock()
+	return s.b.remove(s.b.patterns, s.patterns, patterns, s)
+}
+
+// Count returns the number of channels and patterns subscribed.
+func (s *Subscriber) Count() int {
+	s.b.l.RLock()
+	defer s.b.l.RUnlock()
+	return len(s.channels) + len(s.patterns)
+}
+
+// Close removes all the subscriptions and closes the channel of messages.
+func (s *Subscriber) Close() {
+	s.Unsubscribe()
+	s.PUnsubscribe()
+	s.l.Lock()
+	defer s.l.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.c)
+	}
+}
+
+func (s *Subscriber) deliver(msg Message) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.c <- msg:
+		return true
+	default:
+		s.closed = true
+		close(s.c)
+		return false
+	}
+}
+
+func (b *Broker) add(subs map[string]map[*Subscriber]struct{}, name string, s *Subscriber) {
+	if subs[name] == nil {
+		subs[name] = make(map[*Subscriber]struct{})
+	}
+	subs[name][s] = struct{}{}
+}
+
+func (b *Broker) remove(subs map[string]map[*Subscriber]struct{}, own map[string]struct{}, names []string, s *Subscriber) []string {
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		delete(own, name)
+		delete(subs[name], s)
+		if len(subs[name]) == 0 {
+			delete(subs, name)
+		}
+	}
+	return names
+}
+
+// SetBroker enables PUBLISH and the subscriptions, through the Broker: servers
+// sharing it share the channels.
+func (ms *MapServer) SetBroker(b *Broker) {
+	ms.ps = b
+}
+
+// subscribe switches the connection to push mode, until all the subscriptions
+// are removed: it returns false if the connection is over.
+func (ts *TCPMapServer) subscribe(r *bufio.Reader, w *bufio.Writer, parts []string) bool {
+	if ts.ps == nil {
+		w.WriteString("KO=" + errPubSubDisabled.Error() + "\r\n")
+		return true
+	}
+	s := ts.ps.Subscriber()
+	defer s.Close()
+	if !ts.pubsub(s, w, parts) {
+		return true
+	}
+	if w.Flush() != nil {
+		return false
+	}
+	lines := make(chan []string)
+	next := make(chan bool)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(lines)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			select {
+			case lines <- strings.Fields(line):
+			case <-done:
+				return
+			}
+			select {
+			case more := <-next:
+				if !more {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case parts, ok := <-lines:
+			if !ok || len(parts) == 1 && strings.ToLower(parts[0]) == "close" {
+				return false
+			}
+			more := len(parts) == 0 || ts.pubsub(s, w, parts)
+			if w.Flush() != nil {
+				return false
+			}
+			next <- more
+			if !more {
+				return true
+			}
+		case msg, ok := <-s.Messages():
+			if !ok {
+				w.WriteString("KO=Subscriber dropped, not keeping up with the messages\r\n")
+				w.Flush()
+				return false
+			}
+			w.WriteString(messageLine(msg))
+			_, err := w.WriteString("\r\n")
+			if err == nil && len(s.Messages()) == 0 {
+				err = w.Flush()
+			}
+			if err != nil {
+				log.Printf("error: not able to write: %s\n", err.Error())
+				return false
+			}
+		}
+	}
+}
+
+// pubsub runs a command of the push mode, returning false once no
+// subscription is left.
+func (ts *TCPMapServer) pubsub(s *Subscriber, w *bufio.Writer, parts []string) bool {
+	command := strings.ToLower(parts[0])
+	names := parts[1:]
+	switch command {
+	case "subscribe", "psubscribe":
+		if len(names) == 0 {
+			w.WriteString(fmt.Sprintf("KO=Bad command, format: %s <name> [<name> ...]\r\n", strings.ToUpper(command)))
+			break
+		}
+		for _, name := range names {
+			if command == "subscribe" {
+				s.Subscribe(name)
+			} else {
+				s.PSubscribe(name)
+			}
+			w.WriteString(fmt.Sprintf("OK=%s %s %d\r\n", command, name, s.Count()))
+		}
+	case "unsubscribe", "punsubscribe":
+		if command == "unsubscribe" {
+			names = s.Unsubscribe(names...)
+		} else {
+			names = s.PUnsubscribe(names...)
+		}
+		for _, name := range names {
+			w.WriteString(fmt.Sprintf("OK=%s %s %d\r\n", command, name, s.Count()))
+		}
+		if len(names) == 0 {
+			w.WriteString(fmt.Sprintf("OK=%s %d\r\n", command, s.Count()))
+		}
+	case "ping":
+		w.WriteString("OK=PONG\r\n")
+	default:
+		w.WriteString("KO=Bad command, only SUBSCRIBE, PSUBSCRIBE, UNSUBSCRIBE, PUNSUBSCRIBE, PING and CLOSE allowed in push mode\r\n")
+	}
+	return s.Count() > 0
+}
+
+// messageLine formats the message as pushed over TCP: MESSAGE=<channel>
+// <payload>, or PMESSAGE=<pattern> <channel> <payload>.
+func messageLine(msg Message) string {
+	if msg.Pattern != "" {
+		return "PMESSAGE=" + msg.Pattern + " " + msg.Channel + " " + string(msg.Payload)
+	}
+	return "MESSAGE=" + msg.Channel + " " + string(msg.Payload)
+}
+
+func parseMessageLine(line string) (Message, error) {
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case strings.HasPrefix(line, "MESSAGE="):
+		parts := strings.SplitN(strings.TrimPrefix(line, "MESSAGE="), " ", 2)
+		if len(parts) == 2 {
+			return Message{Channel: parts[0], Payload: []byte(parts[1])}, nil
+		}
+	case strings.HasPrefix(line, "PMESSAGE="):
+		parts := strings.SplitN(strings.TrimPrefix(line, "PMESSAGE="), " ", 3)
+		if len(parts) == 3 {
+			return Message{Pattern: parts[0], Channel: parts[1], Payload: []byte(parts[2])}, nil
+		}
+	}
+	return Message{}, errors.New("Unexpected message: " + line)
+}
+
+// POST, body: { "channel": "<channel>", "message": "<message>" }
+func (hs *HTTPMapServer) publishHandler(w http.ResponseWriter, r *http.Request) {
+	rs := make(map[string]interface{})
+	w.Header().Add("Content-Type", "application/json")
+	var req struct {
+		Channel *string `json:"channel"`
+		Message *string `json:"message"`
+	}
+	var err error
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		err = errors.New("Bad method: only POST accepted")
+	} else if hs.ps == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		err = errPubSubDisabled
+	} else if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	} else if req.Channel == nil || req.Message == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		err = errors.New("Unrecognized JSON: no channel/message pair")
+	}
+	if err != nil {
+		rs["outcome"] = "KO"
+		rs["error"] = err.Error()
+	} else {
+		rs["outcome"] = "OK"
+		rs["receivers"] = hs.ps.Publish(*req.Channel, []byte(*req.Message))
+	}
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
+
+// ?channel=<channel>&pattern=<pattern>, both repeatable: the messages are
+// streamed as Server-Sent Events, named message and carrying { "channel":
+// <channel>, "pattern": <pattern>, "message": <message> }.
+func (hs *HTTPMapServer) subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	qs := r.URL.Query()
+	var err error
+	code := http.StatusBadRequest
+	if !ok || r.Method != "GET" {
+		err = errors.New("Bad request: only GET with streaming accepted")
+	} else if hs.ps == nil {
+		code, err = http.StatusNotImplemented, errPubSubDisabled
+	} else if len(qs["channel"]) == 0 && len(qs["pattern"]) == 0 {
+		err = errors.New("Unrecognized pattern, GET: ?channel=<channel>&pattern=<pattern> allowed")
+	}
+	if err != nil {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(code)
+		buf, _ := json.Marshal(map[string]interface{}{"outcome": "KO", "error": err.Error()})
+		w.Write(buf[:])
+		return
+	}
+	log.Printf("info: serving SUBSCRIBE %v\n", qs)
+	s := hs.ps.Subscriber()
+	defer s.Close()
+	s.Subscribe(qs["channel"]...)
+	s.PSubscribe(qs["pattern"]...)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-s.Messages():
+			if !ok {
+				return
+			}
+			data := map[string]interface{}{"channel": msg.Channel, "message": string(msg.Payload)}
+			if msg.Pattern != "" {
+				data["pattern"] = msg.Pattern
+			}
+			buf, _ := json.Marshal(data)
+			_, err := fmt.Fprintf(w, "event: message\ndata: %s\n\n", buf)
+			if err != nil {
+				return
+			}
+			if len(s.Messages()) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// Publish returns the number of subscribers which received the message.
+func (mc *MapClient) Publish(channel string, message []byte) (int, error) {
+	if mc.binary {
+		res, err := mc.roundTrip(opPublish, channel, message)
+		if err != nil {
+			return 0, err
+		}
+		if len(res.value) != 8 {
+			return 0, errors.New("Unexpected response: malformed count")
+		}
+		return int(binary.BigEndian.Uint64(res.value)), nil
+	}
+	b, err := mc.call(fmt.Sprintf("PUBLISH %s %s", channel, string(message)))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(b)
+}
+
+// Subscribe streams the messages published on the channels over a dedicated
+// connection, until ctx is done: the channel is closed then, or as soon as
+// the connection is over.
+func (tc *TCPMapClient) Subscribe(ctx context.Context, channels ...string) (<-chan Message, error) {
+	return tc.subscribe(ctx, "SUBSCRIBE", channels)
+}
+
+// PSubscribe streams the messages published on the channels matching the
+// glob-style patterns, as Subscribe does.
+func (tc *TCPMapClient) PSubscribe(ctx context.Context, patterns ...string) (<-chan Message, error) {
+	return tc.subscribe(ctx, "PSUBSCRIBE", patterns)
+}
+
+func (tc *TCPMapClient) subscribe(ctx context.Context, command string, names []string) (<-chan Message, error) {
+	if len(names) == 0 {
+		return nil, errors.New("No channel or pattern to subscribe")
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(tc.host, strconv.Itoa(tc.port)))
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	_, err = conn.Write([]byte(command + " " + strings.Join(names, " ") + "\r\n"))
+	for i := 0; i < len(names) && err == nil; i++ {
+		var line string
+		line, err = r.ReadString('\n')
+		if err == nil {
+			_, err = tc.parse(strings.TrimRight(line, "\r\n"))
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := make(chan Message, subscriberBuffer)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+	go func() {
+		defer close(c)
+		defer close(done)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			msg, err := parseMessageLine(line)
+			if err != nil {
+				log.Printf("error: %s\n", err.Error())
+				return
+			}
+			select {
+			case c <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (hc *HTTPMapClient) Publish(channel string, message []byte) (int, error) {
+	u := fmt.Sprintf("http://%s:%d/api/v1/pubsub/publish", hc.host, hc.port)
+	body, err := json.Marshal(map[string]string{"channel": channel, "message": string(message)})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", u, strings.NewReader(string(body)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	json, err := hc.parseBody(resp)
+	if err != nil {
+		return 0, err
+	}
+	if json["outcome"].(string) == "KO" {
+		return 0, errors.New(json["error"].(string))
+	}
+	return int(json["receivers"].(float64)), nil
+}
+
+// Subscribe streams the messages published on the channels, reading the
+// Server-Sent Events, until ctx is done.
+func (hc *HTTPMapClient) Subscribe(ctx context.Context, channels ...string) (<-chan Message, error) {
+	return hc.subscribe(ctx, "channel", channels)
+}
+
+func (hc *HTTPMapClient) PSubscribe(ctx context.Context, patterns ...string) (<-chan Message, error) {
+	return hc.subscribe(ctx, "pattern", patterns)
+}
+
+func (hc *HTTPMapClient) subscribe(ctx context.Context, param string, names []string) (<-chan Message, error) {
+	if len(names) == 0 {
+		return nil, errors.New("No channel or pattern to subscribe")
+	}
+	qs := url.Values{param: names}
+	u := fmt.Sprintf("http://%s:%d/api/v1/pubsub/subscribe?%s", hc.host, hc.port, qs.Encode())
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "text/event-stream")
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+	c := make(chan Message, subscriberBuffer)
+	go func() {
+		defer close(c)
+		defer resp.Body.Close()
+		r := bufio.NewReader(resp.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var data struct {
+				Channel string `json:"channel"`
+				Pattern string `json:"pattern"`
+				Message string `json:"message"`
+			}
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data) != nil {
+				return
+			}
+			select {
+			case c <- Message{Channel: data.Channel, Pattern: data.Pattern, Payload: []byte(data.Message)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c, nil
+}
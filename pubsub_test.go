@@ -0,0 +1,142 @@
+package dmap
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func nextMessage(t *testing.T, messages <-chan Message) Message {
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			t.Fatalf("unexpected end of the messages\n")
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no message received\n")
+	}
+	return Message{}
+}
+
+func TestBroker(t *testing.T) {
+	b := NewBroker()
+	s := b.Subscriber()
+	s.Subscribe("news", "sports")
+	s.PSubscribe("news.*")
+	if n := b.Publish("weather", []byte("sunny")); n != 0 {
+		t.Logf("expected no receiver: %d\n", n)
+		t.Fail()
+	}
+	if n := b.Publish("news", []byte("hello")); n != 1 {
+		t.Logf("expected a receiver: %d\n", n)
+		t.Fail()
+	}
+	if n := b.Publish("news.tech", []byte("go")); n != 1 {
+		t.Logf("expected a receiver: %d\n", n)
+		t.Fail()
+	}
+	msg := nextMessage(t, s.Messages())
+	if msg.Channel != "news" || msg.Pattern != "" || string(msg.Payload) != "hello" {
+		t.Logf("unexpected message: %v\n", msg)
+		t.Fail()
+	}
+	msg = nextMessage(t, s.Messages())
+	if msg.Channel != "news.tech" || msg.Pattern != "news.*" || string(msg.Payload) != "go" {
+		t.Logf("unexpected message: %v\n", msg)
+		t.Fail()
+	}
+	if names := s.Unsubscribe(); len(names) != 2 || s.Count() != 1 {
+		t.Logf("unexpected unsubscribe: %v %d\n", names, s.Count())
+		t.Fail()
+	}
+	s.Close()
+	if n := b.Publish("news.tech", []byte("go")); n != 0 || len(b.patterns) != 0 {
+		t.Logf("expected no receiver after close: %d\n", n)
+		t.Fail()
+	}
+}
+
+func TestMapClientsPubSub(t *testing.T) {
+	b := NewBroker()
+	var wg sync.WaitGroup
+	wg.Add(3)
+	ts, err := NewTCPMapServer("localhost", 12352, &wg, NewMap(), true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	ts.SetBroker(b)
+	go ts.Serve()
+	defer ts.Shutdown()
+	us, err := NewUDPMapServer("localhost", 12352, &wg, NewMap(), true)
+	if err != nil {
+		t.Fatalf("error: unable to start the UDP server: %s\n", err.Error())
+	}
+	us.SetBroker(b)
+	go us.Serve()
+	defer us.Shutdown()
+	hs, err := NewHTTPMapServer("localhost", 8082, &wg, NewMap(), true)
+	if err != nil {
+		t.Fatalf("error: unable to start the HTTP server: %s\n", err.Error())
+	}
+	hs.SetBroker(b)
+	go hs.Serve()
+	defer hs.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	uc := NewUDPMapClient("localhost", 12352)
+	uc.SetBinary(true)
+	err = uc.Dial()
+	if err != nil {
+		t.Fatalf("error: unable to dial in: %s\n", err.Error())
+	}
+	defer uc.Close()
+	tc := NewTCPMapClient("localhost", 12352)
+	err = tc.Dial()
+	if err != nil {
+		t.Fatalf("error: unable to dial in: %s\n", err.Error())
+	}
+	defer tc.Close()
+	hc := NewHTTPMapClient("localhost", 8082)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tm, err := tc.Subscribe(ctx, "orders")
+	if err != nil {
+		t.Fatalf("error: unable to subscribe: %s\n", err.Error())
+	}
+	hm, err := hc.PSubscribe(ctx, "order*")
+	if err != nil {
+		t.Fatalf("error: unable to subscribe: %s\n", err.Error())
+	}
+	time.Sleep(50 * time.Millisecond)
+	publishers := []interface {
+		Publish(string, []byte) (int, error)
+	}{tc, uc, hc}
+	for _, p := range publishers {
+		n, err := p.Publish("orders", []byte("order 42"))
+		if err != nil || n != 2 {
+			t.Logf("error: expected 2 receivers: %d %v\n", n, err)
+			t.Fail()
+		}
+		msg := nextMessage(t, tm)
+		if msg.Channel != "orders" || string(msg.Payload) != "order 42" {
+			t.Logf("unexpected message: %v\n", msg)
+			t.Fail()
+		}
+		msg = nextMessage(t, hm)
+		if msg.Channel != "orders" || msg.Pattern != "order*" || string(msg.Payload) != "order 42" {
+			t.Logf("unexpected message: %v\n", msg)
+			t.Fail()
+		}
+	}
+	cancel()
+	for range tm {
+	}
+	for range hm {
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n, err := tc.Publish("orders", []byte("none")); err != nil || n != 0 {
+		t.Logf("error: expected no receiver: %d %v\n", n, err)
+		t.Fail()
+	}
+}
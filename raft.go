@@ -0,0 +1,1322 @@
+package dmap
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	raftElection  = 300 * time.Millisecond
+	raftHeartbeat = 50 * time.Millisecond
+	raftSnapshot  = 1024
+	raftBatch     = 256
+	raftDial      = time.Second
+	raftCall      = 2 * time.Second
+	raftProposals = 20 // election timeouts a proposal waits for
+	raftProposal  = 30 * time.Second
+)
+
+var (
+	ErrNotLeader       = errors.New("Not the Raft leader")
+	ErrNoLeader        = errors.New("No Raft leader elected")
+	ErrRaftTimeout     = errors.New("Raft proposal timed out")
+	ErrRaftClosed      = errors.New("Raft node closed")
+	errRaftLost        = errors.New("Raft leadership lost, the outcome of the write is unknown")
+	errRaftPending     = errors.New("Raft membership change in progress")
+	errRaftUnreachable = errors.New("Raft node unreachable")
+	errRaftUnsupported = errors.New("Command not supported in consensus mode: only PUT, DEL and CLEAR are")
+	errRaftNamespace   = errors.New("Bad namespace, only the default one is written in consensus mode")
+	errRaftMalformed   = errors.New("malformed Raft command")
+	errRaftOff         = errors.New("Consensus not enabled")
+)
+
+// EntryType tells how an entry of the Raft log is applied.
+type EntryType byte
+
+const (
+	// EntryCommand carries a mutation of the Map, encoded as a record of the
+	// append-only log.
+	EntryCommand EntryType = iota
+	// EntryConfig carries the members of the group, comma separated.
+	EntryConfig
+	// EntryNoop is appended by a new leader to commit the previous entries.
+	EntryNoop
+)
+
+type LogEntry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+type VoteRequest struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type VoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendRequest struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []LogEntry
+	Commit    uint64
+}
+
+// AppendResponse carries, as Last, the index matched on success and a hint
+// of where the logs may match otherwise.
+type AppendResponse struct {
+	Term    uint64
+	Success bool
+	Last    uint64
+}
+
+// SnapshotRequest carries the whole snapshot, as written by Map.Snapshot,
+// along with the members of the group at its last entry.
+type SnapshotRequest struct {
+	Term      uint64
+	Leader    string
+	LastIndex uint64
+	LastTerm  uint64
+	Members   []string
+	Data      []byte
+}
+
+type SnapshotResponse struct {
+	Term uint64
+}
+
+// ProposeRequest asks the leader to append an entry: for EntryConfig, Data
+// is the member to add prefixed by +, or the one to remove prefixed by -.
+type ProposeRequest struct {
+	Type EntryType
+	Data []byte
+}
+
+// ProposeResponse carries the index of the entry once applied by the leader,
+// and the result: whether the key existed, for deletions.
+type ProposeResponse struct {
+	Index uint64
+	OK    bool
+	Err   string
+}
+
+// RaftHandler serves the requests a node receives from the other nodes of
+// the group: Raft implements it.
+type RaftHandler interface {
+	RequestVote(req *VoteRequest) *VoteResponse
+	AppendEntries(req *AppendRequest) *AppendResponse
+	InstallSnapshot(req *SnapshotRequest) *SnapshotResponse
+	Propose(req *ProposeRequest) *ProposeResponse
+}
+
+// Transport carries the requests between the nodes of a Raft group, the
+// nodes being known by their ids.
+type Transport interface {
+	RequestVote(to string, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(to string, req *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(to string, req *SnapshotRequest) (*SnapshotResponse, error)
+	Propose(to string, req *ProposeRequest) (*ProposeResponse, error)
+	// Serve delivers the requests sent to the node to h.
+	Serve(h RaftHandler)
+	Close() error
+}
+
+type raftState int
+
+const (
+	raftFollower raftState = iota
+	raftCandidate
+	raftLeader
+)
+
+func (s raftState) String() string {
+	return [...]string{"follower", "candidate", "leader"}[s]
+}
+
+type RaftOption func(*Raft)
+
+// WithElectionTimeout sets the time a follower waits for the leader before
+// standing for election, randomized between d and 2d.
+func WithElectionTimeout(d time.Duration) RaftOption {
+	return func(r *Raft) {
+		r.election = d
+	}
+}
+
+// WithHeartbeat sets the period of the heartbeats of the leader, to be well
+// below the election timeout.
+func WithHeartbeat(d time.Duration) RaftOption {
+	return func(r *Raft) {
+		r.heartbeat = d
+	}
+}
+
+// WithSnapshotThreshold sets the entries applied between snapshots, the log
+// being compacted up to the last snapshot.
+func WithSnapshotThreshold(n int) RaftOption {
+	return func(r *Raft) {
+		if n > 0 {
+			r.threshold = uint64(n)
+		}
+	}
+}
+
+// Raft replicates the writes to a Map, its state machine, over a group of
+// nodes: Put, Delete and Clear are forwarded to the leader, appended to its
+// log and applied by every node, returning once committed by a majority of
+// the group and applied by the node they were called on. Reads are served
+// by the Map, as the node has applied the log so far. Members are added and
+// removed one at a time, and the log is compacted into snapshots of the Map.
+// Started by NewRaft, the node holds its state in memory only: restarting,
+// it has to be removed and added back, as a new member. Started by OpenRaft,
+// it persists the state and recovers it.
+type Raft struct {
+	id        string
+	t         Transport
+	m         *Map
+	store     *raftStore
+	election  time.Duration
+	heartbeat time.Duration
+	threshold uint64
+
+	l           sync.Mutex
+	al          sync.Mutex // serializes applying entries and installing snapshots
+	state       raftState
+	term        uint64
+	vote        string
+	leader      string
+	log         []LogEntry // log[0] holds the index and term of the snapshot
+	snap        []byte
+	snapMembers []string
+	members     []string
+	config      uint64 // index of the latest configuration
+	commit      uint64
+	applied     uint64
+	next        map[string]uint64
+	match       map[string]uint64
+	busy        map[string]bool
+	again       map[string]bool
+	waiters     map[uint64]*proposal
+	contact     time.Time
+	timeout     time.Duration
+	advanced    chan struct{}
+	applyC      chan struct{}
+	done        chan struct{}
+	once        sync.Once
+}
+
+type proposal struct {
+	term uint64
+	c    chan raftResult
+}
+
+type raftResult struct {
+	ok  bool
+	err error
+}
+
+// RaftStatus is the state of a node, as seen by the node itself.
+type RaftStatus struct {
+	ID        string
+	State     string
+	Term      uint64
+	Leader    string
+	Members   []string
+	LastIndex uint64
+	Commit    uint64
+	Applied   uint64
+	Snapshot  uint64
+}
+
+// NewRaft starts the node id of a group, serving the requests carried by t
+// and applying the log to m, to be empty. The nodes bootstrapping the group
+// are given the same members; a node joining it later is given none, and is
+// added through AddMember.
+func NewRaft(id string, t Transport, m *Map, members []string, opts ...RaftOption) *Raft {
+	r := newRaft(id, t, m, members, opts...)
+	r.start()
+	return r
+}
+
+// OpenRaft starts the node as NewRaft does, persisting its term, vote, log
+// and snapshots in dir: restarted, the node recovers them, and replays the
+// log to m, to be empty, the members given being ignored.
+func OpenRaft(dir, id string, t Transport, m *Map, members []string, opts ...RaftOption) (*Raft, error) {
+	if m.Size() > 0 {
+		return nil, errors.New("the Map of a Raft node has to be empty")
+	}
+	s, err := openRaftStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	rp, err := s.load()
+	if err == nil && rp == nil {
+		err = s.saveSnapshot(LogEntry{}, members, nil)
+	}
+	if err == nil && rp != nil && len(rp.snap) > 0 {
+		err = m.Restore(bytes.NewReader(rp.snap))
+	}
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	r := newRaft(id, t, m, members, opts...)
+	r.store = s
+	if rp != nil {
+		r.term, r.vote = rp.term, rp.vote
+		r.log = append([]LogEntry{rp.base}, rp.entries...)
+		r.snap, r.snapMembers = rp.snap, rp.members
+		r.commit, r.applied = rp.base.Index, rp.base.Index
+		r.reconfigure()
+		log.Printf("info: raft %s recovered term %d, the snapshot up to %d and %d entries\n", id, r.term, rp.base.Index, len(rp.entries))
+	}
+	r.start()
+	return r, nil
+}
+
+func newRaft(id string, t Transport, m *Map, members []string, opts ...RaftOption) *Raft {
+	r := &Raft{
+		id:          id,
+		t:           t,
+		m:           m,
+		election:    raftElection,
+		heartbeat:   raftHeartbeat,
+		threshold:   raftSnapshot,
+		log:         []LogEntry{{}},
+		snapMembers: append([]string(nil), members...),
+		next:        make(map[string]uint64),
+		match:       make(map[string]uint64),
+		busy:        make(map[string]bool),
+		again:       make(map[string]bool),
+		waiters:     make(map[uint64]*proposal),
+		advanced:    make(chan struct{}),
+		applyC:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.members = r.snapMembers
+	return r
+}
+
+func (r *Raft) start() {
+	r.reset()
+	r.t.Serve(r)
+	go r.run()
+	go r.apply()
+}
+
+// Close stops the node, failing the writes in progress.
+func (r *Raft) Close() {
+	r.once.Do(func() {
+		close(r.done)
+		r.t.Close()
+		r.l.Lock()
+		defer r.l.Unlock()
+		if r.store != nil {
+			r.store.close()
+		}
+	})
+}
+
+// Put stores the value once committed.
+func (r *Raft) Put(key string, value []byte) error {
+	_, err := r.propose(&ProposeRequest{Type: EntryCommand, Data: appendMutation(nil, &Mutation{Op: OpPut, Key: key, Value: value})})
+	return err
+}
+
+// PutWithTTL stores the value for ttl once committed: the expiration is
+// fixed by the node proposing the write.
+func (r *Raft) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	mu := &Mutation{Op: OpPut, Key: key, Value: value, Expire: time.Now().Add(ttl).UnixNano()}
+	if ttl <= 0 {
+		mu = &Mutation{Op: OpDelete, Key: key}
+	}
+	_, err := r.propose(&ProposeRequest{Type: EntryCommand, Data: appendMutation(nil, mu)})
+	return err
+}
+
+// Delete removes the key once committed, reporting whether it existed.
+func (r *Raft) Delete(key string) (bool, error) {
+	return r.propose(&ProposeRequest{Type: EntryCommand, Data: appendMutation(nil, &Mutation{Op: OpDelete, Key: key})})
+}
+
+// Clear removes all the keys once committed.
+func (r *Raft) Clear() error {
+	_, err := r.propose(&ProposeRequest{Type: EntryCommand, Data: appendMutation(nil, &Mutation{Op: OpClear})})
+	return err
+}
+
+// AddMember adds the node id to the group, which is brought up to date by
+// the leader: a single change at a time is allowed.
+func (r *Raft) AddMember(id string) error {
+	_, err := r.propose(&ProposeRequest{Type: EntryConfig, Data: []byte("+" + id)})
+	return err
+}
+
+// RemoveMember removes the node id from the group, the leader stepping down
+// if removing itself.
+func (r *Raft) RemoveMember(id string) error {
+	_, err := r.propose(&ProposeRequest{Type: EntryConfig, Data: []byte("-" + id)})
+	return err
+}
+
+// Leader returns the id of the leader, if known.
+func (r *Raft) Leader() string {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.leader
+}
+
+func (r *Raft) Status() RaftStatus {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return RaftStatus{
+		ID:        r.id,
+		State:     r.state.String(),
+		Term:      r.term,
+		Leader:    r.leader,
+		Members:   append([]string(nil), r.members...),
+		LastIndex: r.last().Index,
+		Commit:    r.commit,
+		Applied:   r.applied,
+		Snapshot:  r.log[0].Index,
+	}
+}
+
+// propose has the request appended by the leader, retrying while none is
+// known, and waits for the entry to be applied by this node.
+func (r *Raft) propose(req *ProposeRequest) (bool, error) {
+	deadline := time.Now().Add(raftProposals * r.election)
+	for {
+		r.l.Lock()
+		leader, local := r.leader, r.state == raftLeader
+		r.l.Unlock()
+		var res *ProposeResponse
+		err := ErrNoLeader
+		if local {
+			res, err = r.Propose(req), nil
+		} else if leader != "" {
+			res, err = r.t.Propose(leader, req)
+		}
+		if err == nil && res.Err != ErrNotLeader.Error() {
+			if res.Err != "" {
+				return false, raftError(res.Err)
+			}
+			return res.OK, r.wait(res.Index, deadline)
+		}
+		if time.Now().After(deadline) {
+			return false, ErrNoLeader
+		}
+		select {
+		case <-r.done:
+			return false, ErrRaftClosed
+		case <-time.After(r.heartbeat):
+		}
+	}
+}
+
+func raftError(msg string) error {
+	for _, err := range []error{ErrNoLeader, ErrRaftTimeout, ErrRaftClosed, errRaftLost, errRaftPending} {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return knownError(msg)
+}
+
+// wait waits for the entry at index to be applied.
+func (r *Raft) wait(index uint64, deadline time.Time) error {
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	for {
+		r.l.Lock()
+		applied, c := r.applied, r.advanced
+		r.l.Unlock()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-c:
+		case <-t.C:
+			return ErrRaftTimeout
+		case <-r.done:
+			return ErrRaftClosed
+		}
+	}
+}
+
+// Propose appends the entry, if the node is the leader, and answers once the
+// entry is applied.
+func (r *Raft) Propose(req *ProposeRequest) *ProposeResponse {
+	r.l.Lock()
+	if r.state != raftLeader {
+		r.l.Unlock()
+		return &ProposeResponse{Err: ErrNotLeader.Error()}
+	}
+	data := req.Data
+	if req.Type == EntryConfig {
+		if r.config > r.commit {
+			r.l.Unlock()
+			return &ProposeResponse{Err: errRaftPending.Error()}
+		}
+		members, changed := changeMembers(r.members, string(data))
+		if !changed {
+			r.l.Unlock()
+			return &ProposeResponse{Index: r.config}
+		}
+		data = []byte(strings.Join(members, ","))
+	}
+	w := &proposal{term: r.term, c: make(chan raftResult, 1)}
+	index := r.append(req.Type, data)
+	r.waiters[index] = w
+	r.l.Unlock()
+	r.broadcast()
+	t := time.NewTimer(raftProposals * r.election)
+	defer t.Stop()
+	select {
+	case res := <-w.c:
+		if res.err != nil {
+			return &ProposeResponse{Index: index, Err: res.err.Error()}
+		}
+		return &ProposeResponse{Index: index, OK: res.ok}
+	case <-t.C:
+		r.l.Lock()
+		delete(r.waiters, index)
+		r.l.Unlock()
+		return &ProposeResponse{Err: ErrRaftTimeout.Error()}
+	case <-r.done:
+		return &ProposeResponse{Err: ErrRaftClosed.Error()}
+	}
+}
+
+// changeMembers applies a change, +id or -id, to the members.
+func changeMembers(members []string, change string) ([]string, bool) {
+	if len(change) < 2 {
+		return members, false
+	}
+	id, add := change[1:], change[0] == '+'
+	var next []string
+	found := false
+	for _, m := range members {
+		if m == id {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		next = append(next, m)
+	}
+	if found == add {
+		return members, false
+	}
+	if add {
+		next = append(next, id)
+	}
+	return next, true
+}
+
+func splitMembers(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(string(data), ",")
+}
+
+// RequestVote grants the vote to a candidate whose log is at least as up to
+// date, unless a leader is known to be alive, so that removed members can't
+// disrupt the group.
+func (r *Raft) RequestVote(req *VoteRequest) *VoteResponse {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if req.Term < r.term {
+		return &VoteResponse{Term: r.term}
+	}
+	if req.Term > r.term && (r.state == raftLeader || r.leader != "" && time.Since(r.contact) < r.election) {
+		return &VoteResponse{Term: r.term}
+	}
+	if req.Term > r.term {
+		r.follow(req.Term)
+	}
+	last := r.last()
+	upToDate := req.LastTerm > last.Term || req.LastTerm == last.Term && req.LastIndex >= last.Index
+	granted := (r.vote == "" || r.vote == req.Candidate) && upToDate
+	if granted {
+		r.vote = req.Candidate
+		r.reset()
+	}
+	if !r.durable(r.saveState()) {
+		return &VoteResponse{Term: r.term}
+	}
+	return &VoteResponse{Term: r.term, Granted: granted}
+}
+
+// AppendEntries appends the entries sent by the leader, once the previous
+// entry matches, replacing the conflicting ones.
+func (r *Raft) AppendEntries(req *AppendRequest) *AppendResponse {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if req.Term < r.term {
+		return &AppendResponse{Term: r.term}
+	}
+	if req.Term > r.term || r.state != raftFollower {
+		r.follow(req.Term)
+	}
+	r.leader = req.Leader
+	r.reset()
+	if !r.durable(r.saveState()) {
+		return &AppendResponse{Term: r.term}
+	}
+	entries, prev, prevTerm := req.Entries, req.PrevIndex, req.PrevTerm
+	if base := r.log[0]; prev < base.Index {
+		// the entries up to the snapshot are committed, thus matching
+		skip := base.Index - prev
+		if uint64(len(entries)) <= skip {
+			return &AppendResponse{Term: r.term, Success: true, Last: base.Index}
+		}
+		entries, prev, prevTerm = entries[skip:], base.Index, base.Term
+	}
+	if last := r.last(); prev > last.Index {
+		return &AppendResponse{Term: r.term, Last: last.Index}
+	}
+	if e := r.entry(prev); e.Term != prevTerm {
+		// skips the whole conflicting term
+		hint := prev - 1
+		for hint > r.log[0].Index && r.entry(hint).Term == e.Term {
+			hint--
+		}
+		return &AppendResponse{Term: r.term, Last: hint}
+	}
+	for i, e := range entries {
+		if e.Index <= r.last().Index {
+			if r.entry(e.Index).Term == e.Term {
+				continue
+			}
+			r.log = r.log[:e.Index-r.log[0].Index]
+		}
+		r.log = append(r.log, entries[i:]...)
+		r.reconfigure()
+		if !r.durable(r.saveEntries(entries[i:])) {
+			return &AppendResponse{Term: r.term}
+		}
+		break
+	}
+	match := prev + uint64(len(entries))
+	// a stale request, e.g. resent by a leader backing up, matches less than
+	// committed already: the commit index never goes back
+	if commit := min(req.Commit, match); commit > r.commit {
+		r.commit = commit
+		r.notifyApply()
+	}
+	return &AppendResponse{Term: r.term, Success: true, Last: match}
+}
+
+// InstallSnapshot replaces the contents of the Map with the snapshot sent by
+// the leader, discarding the log unless it goes on past the snapshot.
+func (r *Raft) InstallSnapshot(req *SnapshotRequest) *SnapshotResponse {
+	r.l.Lock()
+	if req.Term < r.term {
+		defer r.l.Unlock()
+		return &SnapshotResponse{Term: r.term}
+	}
+	if req.Term > r.term || r.state != raftFollower {
+		r.follow(req.Term)
+	}
+	r.leader = req.Leader
+	r.reset()
+	res := &SnapshotResponse{Term: r.term}
+	stale := req.LastIndex <= r.commit || !r.durable(r.saveState())
+	r.l.Unlock()
+	if stale {
+		return res
+	}
+	r.al.Lock()
+	defer r.al.Unlock()
+	r.l.Lock()
+	stale = req.LastIndex <= r.applied
+	r.l.Unlock()
+	if stale {
+		return res
+	}
+	err := r.m.Restore(bytes.NewReader(req.Data))
+	if err != nil {
+		log.Printf("error: raft %s unable to install the snapshot: %s\n", r.id, err.Error())
+		return res
+	}
+	base := LogEntry{Index: req.LastIndex, Term: req.LastTerm}
+	if !r.durable(r.saveSnapshot(base, req.Members, req.Data)) {
+		return res
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	if e := r.entry(req.LastIndex); e != nil && e.Term == req.LastTerm {
+		r.log = append([]LogEntry{base}, r.log[req.LastIndex-r.log[0].Index+1:]...)
+	} else {
+		r.log = []LogEntry{base}
+	}
+	r.snap, r.snapMembers = req.Data, req.Members
+	r.reconfigure()
+	r.durable(r.saveLog())
+	r.commit = max(r.commit, req.LastIndex)
+	r.advance(req.LastIndex, nil, nil)
+	log.Printf("info: raft %s installed the snapshot up to %d\n", r.id, req.LastIndex)
+	return res
+}
+
+// run stands for election once the leader is silent for the election
+// timeout, and sends the heartbeats while leading.
+func (r *Raft) run() {
+	t := time.NewTicker(r.heartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-t.C:
+		}
+		r.l.Lock()
+		switch {
+		case r.state == raftLeader:
+			r.l.Unlock()
+			r.broadcast()
+		case time.Since(r.contact) >= r.timeout && r.member(r.id):
+			r.campaign()
+		default:
+			r.l.Unlock()
+		}
+	}
+}
+
+// campaign stands for election in the next term, called holding the lock
+// and releasing it.
+func (r *Raft) campaign() {
+	r.term++
+	r.state, r.vote, r.leader = raftCandidate, r.id, ""
+	r.reset()
+	if !r.durable(r.saveState()) {
+		r.l.Unlock()
+		return
+	}
+	last := r.last()
+	req := &VoteRequest{Term: r.term, Candidate: r.id, LastIndex: last.Index, LastTerm: last.Term}
+	votes := 1
+	if votes*2 > len(r.members) {
+		r.lead()
+	}
+	peers := r.peers()
+	r.l.Unlock()
+	for _, p := range peers {
+		go func(p string) {
+			res, err := r.t.RequestVote(p, req)
+			if err != nil {
+				return
+			}
+			r.l.Lock()
+			defer r.l.Unlock()
+			if res.Term > r.term {
+				r.follow(res.Term)
+				return
+			}
+			if r.state != raftCandidate || r.term != req.Term || !res.Granted {
+				return
+			}
+			votes++
+			if votes*2 > len(r.members) {
+				r.lead()
+			}
+		}(p)
+	}
+}
+
+// lead makes the node the leader, appending an entry of the new term so that
+// the entries of the previous terms get committed.
+func (r *Raft) lead() {
+	log.Printf("info: raft %s elected leader for term %d\n", r.id, r.term)
+	r.state, r.leader = raftLeader, r.id
+	last := r.last().Index
+	for _, id := range r.members {
+		r.next[id], r.match[id] = last+1, 0
+	}
+	r.append(EntryNoop, nil)
+	go r.broadcast()
+}
+
+// follow steps down, moving to the term if newer.
+func (r *Raft) follow(term uint64) {
+	if term > r.term {
+		r.term, r.vote, r.leader = term, "", ""
+	}
+	if r.state == raftLeader {
+		log.Printf("info: raft %s stepping down in term %d\n", r.id, r.term)
+	}
+	r.state = raftFollower
+}
+
+// reset restarts the election timeout.
+func (r *Raft) reset() {
+	r.contact = time.Now()
+	r.timeout = r.election + time.Duration(rand.Int63n(int64(r.election)))
+}
+
+// append appends an entry of the current term to the log of the leader, a
+// configuration taking effect straight away.
+func (r *Raft) append(typ EntryType, data []byte) uint64 {
+	e := LogEntry{Index: r.last().Index + 1, Term: r.term, Type: typ, Data: data}
+	r.log = append(r.log, e)
+	if !r.durable(r.saveEntries([]LogEntry{e})) {
+		r.state, r.leader = raftFollower, ""
+		return e.Index
+	}
+	if typ == EntryConfig {
+		r.members, r.config = splitMembers(data), e.Index
+		for _, id := range r.members {
+			if _, ok := r.next[id]; !ok {
+				r.next[id], r.match[id] = e.Index, 0
+			}
+		}
+	}
+	r.commitMajority()
+	return e.Index
+}
+
+// broadcast replicates the log to all the other members.
+func (r *Raft) broadcast() {
+	r.l.Lock()
+	peers := r.peers()
+	leading := r.state == raftLeader
+	r.l.Unlock()
+	if !leading {
+		return
+	}
+	for _, p := range peers {
+		go r.replicate(p)
+	}
+}
+
+// replicate sends the missing entries to the peer, or the snapshot if they
+// are compacted, until the peer is up to date: a single replication per peer
+// is in progress, the others asking it to go on.
+func (r *Raft) replicate(p string) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.busy[p] {
+		r.again[p] = true
+		return
+	}
+	r.busy[p] = true
+	defer delete(r.busy, p)
+	for r.state == raftLeader {
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+		term, next := r.term, max(r.next[p], 1)
+		r.again[p] = false
+		if base := r.log[0]; next <= base.Index {
+			req := &SnapshotRequest{Term: term, Leader: r.id, LastIndex: base.Index, LastTerm: base.Term, Members: r.snapMembers, Data: r.snap}
+			r.l.Unlock()
+			res, err := r.t.InstallSnapshot(p, req)
+			r.l.Lock()
+			if err != nil || r.stale(res.Term, term) {
+				return
+			}
+			r.match[p] = max(r.match[p], req.LastIndex)
+			r.next[p] = r.match[p] + 1
+		} else {
+			end := min(r.last().Index+1, next+raftBatch)
+			req := &AppendRequest{
+				Term:      term,
+				Leader:    r.id,
+				PrevIndex: next - 1,
+				PrevTerm:  r.entry(next - 1).Term,
+				Entries:   append([]LogEntry(nil), r.log[next-base.Index:end-base.Index]...),
+				Commit:    r.commit,
+			}
+			r.l.Unlock()
+			res, err := r.t.AppendEntries(p, req)
+			r.l.Lock()
+			if err != nil || r.stale(res.Term, term) {
+				return
+			}
+			if res.Success {
+				r.match[p] = max(r.match[p], res.Last)
+				r.next[p] = r.match[p] + 1
+				r.commitMajority()
+			} else {
+				r.next[p] = max(1, min(next-1, res.Last+1))
+			}
+		}
+		if !r.again[p] && r.next[p] > r.last().Index {
+			return
+		}
+	}
+}
+
+// stale reports whether the response of a request sent in term is to be
+// ignored, stepping down if the peer is in a newer term.
+func (r *Raft) stale(peer, term uint64) bool {
+	if peer > r.term {
+		r.follow(peer)
+	}
+	return r.state != raftLeader || r.term != term
+}
+
+// commitMajority commits the entries of the current term stored by a
+// majority of the members, the leader counting only if a member.
+func (r *Raft) commitMajority() {
+	for n := r.last().Index; n > r.commit && r.entry(n).Term == r.term; n-- {
+		count := 0
+		for _, id := range r.members {
+			if id == r.id || r.match[id] >= n {
+				count++
+			}
+		}
+		if count*2 > len(r.members) {
+			r.commit = n
+			r.notifyApply()
+			go r.broadcast()
+			break
+		}
+	}
+	if r.state == raftLeader && !r.member(r.id) && r.commit >= r.config {
+		log.Printf("info: raft %s removed from the group, stepping down\n", r.id)
+		r.state, r.leader = raftFollower, ""
+	}
+}
+
+func (r *Raft) notifyApply() {
+	select {
+	case r.applyC <- struct{}{}:
+	default:
+	}
+}
+
+// apply applies the committed entries to the Map, in order, compacting the
+// log once the threshold is reached.
+func (r *Raft) apply() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.applyC:
+		}
+		r.al.Lock()
+		r.l.Lock()
+		base := r.log[0].Index
+		entries := append([]LogEntry(nil), r.log[r.applied+1-base:r.commit+1-base]...)
+		r.l.Unlock()
+		results := make([]raftResult, len(entries))
+		for i, e := range entries {
+			if e.Type == EntryCommand {
+				results[i] = r.exec(e.Data)
+			}
+		}
+		r.l.Lock()
+		if len(entries) > 0 {
+			r.advance(entries[len(entries)-1].Index, entries, results)
+		}
+		compact := r.applied-r.log[0].Index >= r.threshold
+		r.l.Unlock()
+		if compact {
+			r.compact()
+		}
+		r.al.Unlock()
+	}
+}
+
+// advance moves the index applied up to index, answering the proposals of
+// the entries applied: the others, lost or in the snapshot, are failed.
+func (r *Raft) advance(index uint64, entries []LogEntry, results []raftResult) {
+	for i, e := range entries {
+		if w := r.waiters[e.Index]; w != nil {
+			delete(r.waiters, e.Index)
+			if w.term != e.Term {
+				w.c <- raftResult{err: errRaftLost}
+			} else {
+				w.c <- results[i]
+			}
+		}
+	}
+	for i, w := range r.waiters {
+		if i <= index {
+			delete(r.waiters, i)
+			w.c <- raftResult{err: errRaftLost}
+		}
+	}
+	r.applied = index
+	close(r.advanced)
+	r.advanced = make(chan struct{})
+	if r.commit > r.applied {
+		r.notifyApply()
+	}
+}
+
+// exec applies a command to the Map.
+func (r *Raft) exec(data []byte) raftResult {
+	var mu Mutation
+	if len(data) < 8 || decodeMutation(data[8:], &mu) != nil {
+		return raftResult{err: errRaftMalformed}
+	}
+	switch mu.Op {
+	case OpPut:
+		if mu.Expire != 0 {
+			return raftResult{ok: true, err: r.m.PutWithTTL(mu.Key, mu.Value, time.Until(time.Unix(0, mu.Expire)))}
+		}
+		return raftResult{ok: true, err: r.m.Put(mu.Key, mu.Value)}
+	case OpDelete:
+		return raftResult{ok: r.m.Delete(mu.Key)}
+	case OpClear:
+		r.m.Clear()
+		return raftResult{ok: true}
+	}
+	return raftResult{err: errRaftMalformed}
+}
+
+// compact snapshots the Map, as of the last entry applied, dropping the
+// entries up to it: called while applying, so that the Map doesn't change.
+func (r *Raft) compact() {
+	var buf bytes.Buffer
+	err := r.m.Snapshot(&buf)
+	if err != nil {
+		log.Printf("error: raft %s unable to snapshot: %s\n", r.id, err.Error())
+		return
+	}
+	r.l.Lock()
+	index, base := r.applied, r.log[0].Index
+	members := r.snapMembers
+	for i := index; i > base; i-- {
+		if e := r.entry(i); e.Type == EntryConfig {
+			members = splitMembers(e.Data)
+			break
+		}
+	}
+	snap := LogEntry{Index: index, Term: r.entry(index).Term}
+	r.l.Unlock()
+	if !r.durable(r.saveSnapshot(snap, members, buf.Bytes())) {
+		return
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.log = append([]LogEntry{snap}, r.log[index-base+1:]...)
+	r.snap, r.snapMembers = buf.Bytes(), members
+	r.durable(r.saveLog())
+	log.Printf("info: raft %s compacted the log up to %d\n", r.id, index)
+}
+
+// saveState persists the term and the vote, if the node is durable: the
+// save functions are called holding the lock, but saveSnapshot.
+func (r *Raft) saveState() error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.saveState(r.term, r.vote)
+}
+
+func (r *Raft) saveEntries(entries []LogEntry) error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.append(entries)
+}
+
+// saveSnapshot persists the snapshot: the log saved still holds the entries
+// up to it until saveLog, a restarted node skipping them.
+func (r *Raft) saveSnapshot(base LogEntry, members []string, data []byte) error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.saveSnapshot(base, members, data)
+}
+
+// saveLog replaces the log saved with the entries past the snapshot.
+func (r *Raft) saveLog() error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.rewrite(r.log[1:])
+}
+
+// durable reports whether the state was persisted, given the error saving
+// it: the node is stopped otherwise, as it couldn't recover what it answers.
+func (r *Raft) durable(err error) bool {
+	if err == nil {
+		return true
+	}
+	if err != ErrRaftClosed {
+		log.Printf("error: raft %s unable to persist its state, stopping: %s\n", r.id, err.Error())
+		go r.Close()
+	}
+	return false
+}
+
+// reconfigure takes the members from the latest configuration in the log,
+// or from the snapshot.
+func (r *Raft) reconfigure() {
+	for i := len(r.log) - 1; i > 0; i-- {
+		if r.log[i].Type == EntryConfig {
+			r.members, r.config = splitMembers(r.log[i].Data), r.log[i].Index
+			return
+		}
+	}
+	r.members, r.config = r.snapMembers, r.log[0].Index
+}
+
+func (r *Raft) last() LogEntry {
+	return r.log[len(r.log)-1]
+}
+
+// entry returns the entry at index, nil if compacted or not in the log yet:
+// the first one only carries the index and term of the snapshot.
+func (r *Raft) entry(index uint64) *LogEntry {
+	base := r.log[0].Index
+	if index < base || index > r.last().Index {
+		return nil
+	}
+	return &r.log[index-base]
+}
+
+func (r *Raft) member(id string) bool {
+	for _, m := range r.members {
+		if m == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Raft) peers() []string {
+	var peers []string
+	for _, m := range r.members {
+		if m != r.id {
+			peers = append(peers, m)
+		}
+	}
+	return peers
+}
+
+// MemNetwork connects the nodes of a group in memory, for tests: nodes can
+// be disconnected, to simulate failures and partitions.
+type MemNetwork struct {
+	l     sync.RWMutex
+	nodes map[string]RaftHandler
+	cut   map[string]bool
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{nodes: make(map[string]RaftHandler), cut: make(map[string]bool)}
+}
+
+// Transport returns the transport of the node id.
+func (n *MemNetwork) Transport(id string) Transport {
+	return &memTransport{n: n, id: id}
+}
+
+// Disconnect drops the requests sent to and by the node id.
+func (n *MemNetwork) Disconnect(id string) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	n.cut[id] = true
+}
+
+func (n *MemNetwork) Reconnect(id string) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	delete(n.cut, id)
+}
+
+type memTransport struct {
+	n  *MemNetwork
+	id string
+}
+
+func (mt *memTransport) handler(to string) (RaftHandler, error) {
+	mt.n.l.RLock()
+	defer mt.n.l.RUnlock()
+	h := mt.n.nodes[to]
+	if h == nil || mt.n.cut[to] || mt.n.cut[mt.id] {
+		return nil, errRaftUnreachable
+	}
+	return h, nil
+}
+
+func (mt *memTransport) RequestVote(to string, req *VoteRequest) (*VoteResponse, error) {
+	h, err := mt.handler(to)
+	if err != nil {
+		return nil, err
+	}
+	return h.RequestVote(req), nil
+}
+
+func (mt *memTransport) AppendEntries(to string, req *AppendRequest) (*AppendResponse, error) {
+	h, err := mt.handler(to)
+	if err != nil {
+		return nil, err
+	}
+	return h.AppendEntries(req), nil
+}
+
+func (mt *memTransport) InstallSnapshot(to string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	h, err := mt.handler(to)
+	if err != nil {
+		return nil, err
+	}
+	return h.InstallSnapshot(req), nil
+}
+
+func (mt *memTransport) Propose(to string, req *ProposeRequest) (*ProposeResponse, error) {
+	h, err := mt.handler(to)
+	if err != nil {
+		return nil, err
+	}
+	return h.Propose(req), nil
+}
+
+func (mt *memTransport) Serve(h RaftHandler) {
+	mt.n.l.Lock()
+	defer mt.n.l.Unlock()
+	mt.n.nodes[mt.id] = h
+}
+
+func (mt *memTransport) Close() error {
+	mt.n.l.Lock()
+	defer mt.n.l.Unlock()
+	delete(mt.n.nodes, mt.id)
+	return nil
+}
+
+// RPCTransport carries the requests over TCP with net/rpc, the ids of the
+// nodes being the host:port they listen on.
+type RPCTransport struct {
+	ln      net.Listener
+	l       sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+// NewRPCTransport listens on addr, the id of the node.
+func NewRPCTransport(addr string) (*RPCTransport, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &RPCTransport{ln: ln, clients: make(map[string]*rpc.Client)}, nil
+}
+
+// raftService exposes a RaftHandler to net/rpc.
+type raftService struct {
+	h RaftHandler
+}
+
+func (s *raftService) RequestVote(req *VoteRequest, res *VoteResponse) error {
+	*res = *s.h.RequestVote(req)
+	return nil
+}
+
+func (s *raftService) AppendEntries(req *AppendRequest, res *AppendResponse) error {
+	*res = *s.h.AppendEntries(req)
+	return nil
+}
+
+func (s *raftService) InstallSnapshot(req *SnapshotRequest, res *SnapshotResponse) error {
+	*res = *s.h.InstallSnapshot(req)
+	return nil
+}
+
+func (s *raftService) Propose(req *ProposeRequest, res *ProposeResponse) error {
+	*res = *s.h.Propose(req)
+	return nil
+}
+
+func (rt *RPCTransport) Serve(h RaftHandler) {
+	s := rpc.NewServer()
+	s.RegisterName("Raft", &raftService{h: h})
+	go s.Accept(rt.ln)
+}
+
+func (rt *RPCTransport) Close() error {
+	rt.l.Lock()
+	defer rt.l.Unlock()
+	for to, c := range rt.clients {
+		c.Close()
+		delete(rt.clients, to)
+	}
+	return rt.ln.Close()
+}
+
+// call calls the method on the node, dropping the connection on failure.
+func (rt *RPCTransport) call(to, method string, req, res interface{}, timeout time.Duration) error {
+	rt.l.Lock()
+	c := rt.clients[to]
+	rt.l.Unlock()
+	if c == nil {
+		conn, err := net.DialTimeout("tcp", to, raftDial)
+		if err != nil {
+			return err
+		}
+		c = rpc.NewClient(conn)
+		rt.l.Lock()
+		if old := rt.clients[to]; old != nil {
+			c.Close()
+			c = old
+		} else {
+			rt.clients[to] = c
+		}
+		rt.l.Unlock()
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	call := c.Go("Raft."+method, req, res, make(chan *rpc.Call, 1))
+	var err error
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-t.C:
+		err = errRaftUnreachable
+	}
+	if err != nil {
+		rt.l.Lock()
+		if rt.clients[to] == c {
+			delete(rt.clients, to)
+		}
+		rt.l.Unlock()
+		c.Close()
+	}
+	return err
+}
+
+func (rt *RPCTransport) RequestVote(to string, req *VoteRequest) (*VoteResponse, error) {
+	res := &VoteResponse{}
+	return res, rt.call(to, "RequestVote", req, res, raftCall)
+}
+
+func (rt *RPCTransport) AppendEntries(to string, req *AppendRequest) (*AppendResponse, error) {
+	res := &AppendResponse{}
+	return res, rt.call(to, "AppendEntries", req, res, raftCall)
+}
+
+func (rt *RPCTransport) InstallSnapshot(to string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	res := &SnapshotResponse{}
+	return res, rt.call(to, "InstallSnapshot", req, res, raftCall)
+}
+
+func (rt *RPCTransport) Propose(to string, req *ProposeRequest) (*ProposeResponse, error) {
+	res := &ProposeResponse{}
+	return res, rt.call(to, "Propose", req, res, raftProposal+raftCall)
+}
@@ -0,0 +1,215 @@
+package dmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SetRaft makes the default namespace the state machine of the Raft group:
+// PUT, DEL and CLEAR are proposed to the leader and answered once committed,
+// the other writes to it, and all the writes to the other namespaces, are
+// refused.
+func (ms *MapServer) SetRaft(r *Raft) {
+	ms.raft = r
+}
+
+// consensus reports whether the command, a text or RESP one, is a write to
+// be proposed to the Raft group.
+func (ms *MapServer) consensus(command string) bool {
+	return writeCommands[command] && ms.raft != nil && ms.m == ms.raft.m
+}
+
+// executeRaft runs PUT, DEL and CLEAR through the Raft group.
+func (ms *MapServer) executeRaft(command string, parts []string) (string, error) {
+	var err error
+	switch command {
+	case "put":
+		if len(parts) == 5 && strings.ToLower(parts[3]) == "ex" {
+			seconds, perr := strconv.Atoi(parts[4])
+			if perr != nil || seconds <= 0 {
+				return "", errors.New("KO=Bad command, EX expects a positive number of seconds")
+			}
+			err = ms.raft.PutWithTTL(parts[1], []byte(parts[2]), time.Duration(seconds)*time.Second)
+		} else if len(parts) != 3 {
+			return "", errors.New("KO=Bad command, format: PUT <key> <value> [EX <seconds>]")
+		} else {
+			err = ms.raft.Put(parts[1], []byte(parts[2]))
+		}
+		if err != nil {
+			return "", errors.New("KO=" + err.Error())
+		}
+		return fmt.Sprintf("OK=%d", len(parts[2])), nil
+	case "del":
+		if len(parts) != 2 {
+			return "", errors.New("KO=Bad command, format: DEL <key>")
+		}
+		_, err = ms.raft.Delete(parts[1])
+		if err != nil {
+			return "", errors.New("KO=" + err.Error())
+		}
+		return fmt.Sprintf("OK=%s", parts[1]), nil
+	case "clear":
+		if len(parts) != 1 {
+			return "", errors.New("KO=Bad command, format: CLEAR")
+		}
+		err = ms.raft.Clear()
+		if err != nil {
+			return "", errors.New("KO=" + err.Error())
+		}
+		return fmt.Sprintf("OK=%d", ms.m.Size()), nil
+	}
+	return "", errors.New("KO=" + errRaftUnsupported.Error())
+}
+
+// executeRESPRaft runs SET (with EX and PX), DEL and FLUSHDB through the Raft
+// group.
+func (ms *MapServer) executeRESPRaft(buf []byte, args [][]byte) []byte {
+	command := strings.ToLower(string(args[0]))
+	switch command {
+	case "set":
+		var ttl time.Duration
+		if len(args) == 5 && (strings.ToLower(string(args[3])) == "ex" || strings.ToLower(string(args[3])) == "px") {
+			n, err := strconv.Atoi(string(args[4]))
+			if err != nil || n <= 0 {
+				return appendRESPError(buf, "ERR invalid expire time in 'set' command")
+			}
+			ttl = time.Duration(n) * time.Second
+			if strings.ToLower(string(args[3])) == "px" {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+		} else if len(args) != 3 {
+			return appendRESPError(buf, "ERR "+errRaftUnsupported.Error())
+		}
+		var err error
+		if ttl > 0 {
+			err = ms.raft.PutWithTTL(string(args[1]), args[2], ttl)
+		} else {
+			err = ms.raft.Put(string(args[1]), args[2])
+		}
+		if err != nil {
+			return appendRESPError(buf, "ERR "+err.Error())
+		}
+		return appendRESPSimple(buf, "OK")
+	case "del":
+		if len(args) < 2 {
+			return appendRESPArity(buf, command)
+		}
+		var n int64
+		for _, key := range args[1:] {
+			ok, err := ms.raft.Delete(string(key))
+			if err != nil {
+				return appendRESPError(buf, "ERR "+err.Error())
+			}
+			if ok {
+				n++
+			}
+		}
+		return appendRESPInt(buf, n)
+	case "flushdb", "flushall":
+		err := ms.raft.Clear()
+		if err != nil {
+			return appendRESPError(buf, "ERR "+err.Error())
+		}
+		return appendRESPSimple(buf, "OK")
+	}
+	return appendRESPError(buf, "ERR "+errRaftUnsupported.Error())
+}
+
+// executeRaftFrame runs the writes carried by binary frames through the Raft
+// group.
+func (ms *MapServer) executeRaftFrame(req *frame) *frame {
+	res := &frame{op: statusOK, id: req.id}
+	var err error
+	switch req.op {
+	case opPut:
+		err = ms.raft.Put(string(req.key), req.value)
+		res.value = []byte(strconv.Itoa(len(req.value)))
+	case opDel:
+		_, err = ms.raft.Delete(string(req.key))
+	case opClear:
+		err = ms.raft.Clear()
+	default:
+		err = errRaftUnsupported
+	}
+	if err == ErrOutOfMemory {
+		return &frame{op: statusOOM, id: req.id, value: []byte(err.Error())}
+	}
+	if err != nil {
+		return &frame{op: statusError, id: req.id, value: []byte(err.Error())}
+	}
+	return res
+}
+
+// local refuses, with 501 Not Implemented, the writes not proposed to the
+// Raft group: batches, transactions, increments and typed values.
+func (hs *HTTPMapServer) local(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && hs.consensus("put") {
+			hs.typedError(w, http.StatusNotImplemented, errRaftUnsupported)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// raftError answers with 507 Insufficient Storage if out of memory, with 503
+// Service Unavailable if the write could not be committed.
+func (hs *HTTPMapServer) raftError(w http.ResponseWriter, rs map[string]interface{}, err error) {
+	if err == ErrOutOfMemory {
+		hs.outOfMemory(w, rs, err)
+		return
+	}
+	hs.typedError(w, http.StatusServiceUnavailable, err)
+}
+
+// GET answers with the state of the node, POST ?member=<id> adds a member
+// and DELETE ?member=<id> removes it.
+func (hs *HTTPMapServer) raftHandler(w http.ResponseWriter, r *http.Request) {
+	if hs.raft == nil {
+		hs.typedError(w, http.StatusNotFound, errRaftOff)
+		return
+	}
+	member := r.URL.Query().Get("member")
+	var err error
+	switch r.Method {
+	case "GET":
+	case "POST", "DELETE":
+		if member == "" {
+			hs.typedError(w, http.StatusBadRequest, errors.New("Unrecognized pattern: ?member=<id> expected"))
+			return
+		}
+		if r.Method == "POST" {
+			err = hs.raft.AddMember(member)
+		} else {
+			err = hs.raft.RemoveMember(member)
+		}
+	default:
+		hs.typedError(w, http.StatusMethodNotAllowed, errors.New("Bad method: only GET, POST, DELETE accepted"))
+		return
+	}
+	if err != nil {
+		hs.raftError(w, nil, err)
+		return
+	}
+	st := hs.raft.Status()
+	rs := map[string]interface{}{
+		"outcome":  "OK",
+		"id":       st.ID,
+		"state":    st.State,
+		"term":     st.Term,
+		"leader":   st.Leader,
+		"members":  st.Members,
+		"last":     st.LastIndex,
+		"commit":   st.Commit,
+		"applied":  st.Applied,
+		"snapshot": st.Snapshot,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
@@ -0,0 +1,273 @@
+package dmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	raftStateFile    = "raft.state"
+	raftSnapshotFile = "raft.snapshot"
+	raftLogFile      = "raft.log"
+)
+
+// raftStore keeps the state of a Raft node in a directory, so that it
+// survives restarts: the term and the vote in raft.state, the last snapshot
+// in raft.snapshot and the entries appended since in raft.log, all synced to
+// disk before the node answers.
+type raftStore struct {
+	dir  string
+	f    *os.File
+	term uint64
+	vote string
+}
+
+// raftPersisted is the state loaded from a raftStore.
+type raftPersisted struct {
+	term    uint64
+	vote    string
+	base    LogEntry
+	members []string
+	snap    []byte
+	entries []LogEntry
+}
+
+func openRaftStore(dir string) (*raftStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, raftLogFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &raftStore{dir: dir, f: f}, nil
+}
+
+// load reads the state stored, nil if the node never started: the snapshot
+// is written when bootstrapping.
+func (s *raftStore) load() (*raftPersisted, error) {
+	buf, err := os.ReadFile(filepath.Join(s.dir, raftSnapshotFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rp := &raftPersisted{}
+	r := bufio.NewReader(bytes.NewReader(buf))
+	header, _, err := readRecord(r)
+	if err != nil {
+		return nil, errors.New("malformed Raft snapshot: " + err.Error())
+	}
+	p := header
+	rp.base.Index, p = readUvarint(p)
+	rp.base.Term, p = readUvarint(p)
+	rp.members = splitMembers(p)
+	rp.snap, _ = io.ReadAll(r)
+	state, err := os.ReadFile(filepath.Join(s.dir, raftStateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(state) > 0 {
+		payload, _, err := readRecord(bufio.NewReader(bytes.NewReader(state)))
+		if err != nil {
+			return nil, errors.New("malformed Raft state: " + err.Error())
+		}
+		rp.term, payload = readUvarint(payload)
+		rp.vote = string(payload)
+	}
+	s.term, s.vote = rp.term, rp.vote
+	entries, err := s.replay()
+	if err != nil {
+		return nil, err
+	}
+	// the log may predate the snapshot, if the node stopped in between
+	for _, e := range entries {
+		last := rp.base.Index + uint64(len(rp.entries))
+		if e.Index == rp.base.Index && e.Term != rp.base.Term || e.Index > last+1 {
+			break
+		}
+		if e.Index > rp.base.Index {
+			rp.entries = append(rp.entries, e)
+		}
+	}
+	return rp, nil
+}
+
+// replay reads the entries of the log, an entry replacing the ones from its
+// index on: a torn record at the end, e.g. after a crash, is truncated away.
+func (s *raftStore) replay() ([]LogEntry, error) {
+	var entries []LogEntry
+	var size int64
+	r := bufio.NewReader(s.f)
+	for {
+		payload, n, err := readRecord(r)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			log.Printf("error: truncating the Raft log %s at %d: %s\n", s.f.Name(), size, err.Error())
+			return entries, s.f.Truncate(size)
+		}
+		size += int64(n)
+		var e LogEntry
+		e.Index, payload = readUvarint(payload)
+		e.Term, payload = readUvarint(payload)
+		if len(payload) < 1 {
+			return nil, errRaftMalformed
+		}
+		e.Type, e.Data = EntryType(payload[0]), append([]byte(nil), payload[1:]...)
+		for len(entries) > 0 && entries[len(entries)-1].Index >= e.Index {
+			entries = entries[:len(entries)-1]
+		}
+		entries = append(entries, e)
+	}
+}
+
+// saveState persists the term and the vote, if changed.
+func (s *raftStore) saveState(term uint64, vote string) error {
+	if term == s.term && vote == s.vote {
+		return nil
+	}
+	payload := binary.AppendUvarint(nil, term)
+	payload = append(payload, vote...)
+	err := writeFileSync(filepath.Join(s.dir, raftStateFile), appendRecord(nil, payload))
+	if err != nil {
+		return err
+	}
+	s.term, s.vote = term, vote
+	return nil
+}
+
+// saveSnapshot replaces the snapshot, base carrying its last index and term.
+func (s *raftStore) saveSnapshot(base LogEntry, members []string, data []byte) error {
+	header := binary.AppendUvarint(nil, base.Index)
+	header = binary.AppendUvarint(header, base.Term)
+	header = append(header, strings.Join(members, ",")...)
+	return writeFileSync(filepath.Join(s.dir, raftSnapshotFile), append(appendRecord(nil, header), data...))
+}
+
+// append appends the entries to the log.
+func (s *raftStore) append(entries []LogEntry) error {
+	if s.f == nil {
+		return ErrRaftClosed
+	}
+	_, err := s.f.Write(appendEntries(nil, entries))
+	if err == nil {
+		err = s.f.Sync()
+	}
+	return err
+}
+
+// rewrite replaces the log with the entries, once compacted.
+func (s *raftStore) rewrite(entries []LogEntry) error {
+	if s.f == nil {
+		return ErrRaftClosed
+	}
+	path := filepath.Join(s.dir, raftLogFile)
+	err := writeFileSync(path, appendEntries(nil, entries))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f = f
+	return nil
+}
+
+func (s *raftStore) close() {
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+}
+
+func appendEntries(buf []byte, entries []LogEntry) []byte {
+	var payload []byte
+	for _, e := range entries {
+		payload = binary.AppendUvarint(payload[:0], e.Index)
+		payload = binary.AppendUvarint(payload, e.Term)
+		payload = append(payload, byte(e.Type))
+		payload = append(payload, e.Data...)
+		buf = appendRecord(buf, payload)
+	}
+	return buf
+}
+
+// appendRecord frames the payload as the records of the append-only log:
+// length and CRC32 of the payload, followed by the payload itself.
+func appendRecord(buf, payload []byte) []byte {
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	return append(append(buf, header[:]...), payload...)
+}
+
+// readRecord reads a record, returning the number of bytes read: io.EOF only
+// if no byte at all is left.
+func readRecord(r *bufio.Reader) ([]byte, int, error) {
+	var header [8]byte
+	_, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	l := binary.LittleEndian.Uint32(header[:])
+	if l > aofMaxRecord {
+		return nil, 0, errors.New("record too large")
+	}
+	payload := make([]byte, l)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	return payload, len(header) + len(payload), nil
+}
+
+func readUvarint(p []byte) (uint64, []byte) {
+	v, n := binary.Uvarint(p)
+	if n <= 0 {
+		return 0, nil
+	}
+	return v, p[n:]
+}
+
+// writeFileSync writes the file to a temporary one, renamed over the actual
+// one once synced to disk.
+func writeFileSync(path string, buf []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".save-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
@@ -0,0 +1,442 @@
+package dmap
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var raftOpts = []RaftOption{WithElectionTimeout(100 * time.Millisecond), WithHeartbeat(20 * time.Millisecond)}
+
+func newRaftGroup(n *MemNetwork, ids []string, opts ...RaftOption) ([]*Raft, []*Map) {
+	rafts, maps := make([]*Raft, len(ids)), make([]*Map, len(ids))
+	for i, id := range ids {
+		maps[i] = NewMap()
+		rafts[i] = NewRaft(id, n.Transport(id), maps[i], ids, append(raftOpts, opts...)...)
+	}
+	return rafts, maps
+}
+
+// electedLeader waits for a single leader among the nodes, returning its index.
+func electedLeader(rafts []*Raft) int {
+	leader := -1
+	eventually(func() bool {
+		leader = -1
+		for i, r := range rafts {
+			if r.Status().State == "leader" {
+				if leader >= 0 {
+					return false
+				}
+				leader = i
+			}
+		}
+		return leader >= 0
+	})
+	return leader
+}
+
+func TestRaftReplication(t *testing.T) {
+	n := NewMemNetwork()
+	rafts, maps := newRaftGroup(n, []string{"a", "b", "c"})
+	for _, r := range rafts {
+		defer r.Close()
+	}
+	leader := electedLeader(rafts)
+	if leader < 0 {
+		t.Fatalf("expected a leader elected\n")
+	}
+	follower := (leader + 1) % 3
+	for i := 0; i < 50; i++ {
+		if err := rafts[follower].Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatalf("error: unable to put through a follower: %s\n", err.Error())
+		}
+	}
+	if string(maps[follower].Get("key49")) != "value" {
+		t.Logf("expected the write applied once acknowledged\n")
+		t.Fail()
+	}
+	if ok, err := rafts[leader].Delete("key0"); !ok || err != nil {
+		t.Logf("expected the key deleted: %v %v\n", ok, err)
+		t.Fail()
+	}
+	if ok, _ := rafts[follower].Delete("key0"); ok {
+		t.Logf("expected the key gone\n")
+		t.Fail()
+	}
+	rafts[follower].PutWithTTL("ttl", []byte("value"), time.Hour)
+	if !eventually(func() bool { return sameContents(maps[0], maps[1]) && sameContents(maps[1], maps[2]) }) {
+		t.Fatalf("expected the nodes in sync: %d %d %d\n", maps[0].Size(), maps[1].Size(), maps[2].Size())
+	}
+	if maps[leader].TTL("ttl") <= 0 {
+		t.Logf("expected the ttl replicated\n")
+		t.Fail()
+	}
+	old := rafts[leader].Status()
+	n.Disconnect(rafts[leader].id)
+	rest := []*Raft{rafts[(leader+1)%3], rafts[(leader+2)%3]}
+	next := electedLeader(rest)
+	if next < 0 || rest[next].Status().Term <= old.Term {
+		t.Fatalf("expected a new leader elected\n")
+	}
+	if err := rest[(next+1)%2].Put("after", []byte("failover")); err != nil {
+		t.Fatalf("error: unable to put after the failover: %s\n", err.Error())
+	}
+	n.Reconnect(rafts[leader].id)
+	if !eventually(func() bool {
+		return string(maps[leader].Get("after")) == "failover" && rafts[leader].Status().State == "follower"
+	}) {
+		t.Logf("expected the old leader to follow and catch up: %v\n", rafts[leader].Status())
+		t.Fail()
+	}
+	if err := rafts[leader].Clear(); err != nil {
+		t.Fatalf("error: unable to clear: %s\n", err.Error())
+	}
+	if !eventually(func() bool { return maps[0].Size()+maps[1].Size()+maps[2].Size() == 0 }) {
+		t.Logf("expected the nodes cleared\n")
+		t.Fail()
+	}
+}
+
+func TestRaftNoQuorum(t *testing.T) {
+	n := NewMemNetwork()
+	rafts, maps := newRaftGroup(n, []string{"a", "b", "c"})
+	for _, r := range rafts {
+		defer r.Close()
+	}
+	leader := electedLeader(rafts)
+	if leader < 0 {
+		t.Fatalf("expected a leader elected\n")
+	}
+	for i, r := range rafts {
+		if i != leader {
+			n.Disconnect(r.id)
+		}
+	}
+	res := rafts[leader].Propose(&ProposeRequest{Type: EntryCommand, Data: appendMutation(nil, &Mutation{Op: OpPut, Key: "key", Value: []byte("value")})})
+	if res.Err != ErrRaftTimeout.Error() && res.Err != errRaftLost.Error() {
+		t.Logf("expected the write not committed: %v\n", res)
+		t.Fail()
+	}
+	if maps[leader].Exists("key") {
+		t.Logf("expected the write not applied\n")
+		t.Fail()
+	}
+	ms := &MapServer{m: maps[leader], raft: rafts[leader]}
+	if res, err := ms.execute([]byte("PUT key value EX 10\r\n")); err == nil || !strings.HasPrefix(err.Error(), "KO=") || maps[leader].Exists("key") {
+		t.Logf("expected the write with a ttl refused: %s %v\n", res, err)
+		t.Fail()
+	}
+}
+
+func TestRaftStaleAppend(t *testing.T) {
+	n := NewMemNetwork()
+	rafts, maps := newRaftGroup(n, []string{"a", "b", "c"})
+	for _, r := range rafts {
+		defer r.Close()
+	}
+	leader := electedLeader(rafts)
+	if leader < 0 {
+		t.Fatalf("expected a leader elected\n")
+	}
+	for i := 0; i < 50; i++ {
+		if err := rafts[leader].Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatalf("error: unable to put: %s\n", err.Error())
+		}
+	}
+	follower := rafts[(leader+1)%3]
+	if !eventually(func() bool { return sameContents(maps[leader], maps[(leader+1)%3]) }) {
+		t.Fatalf("expected the follower in sync\n")
+	}
+	// the leader backing up resends the first entries only, along with its
+	// commit index
+	follower.l.Lock()
+	base := follower.log[0]
+	req := &AppendRequest{
+		Term:      follower.term,
+		Leader:    follower.leader,
+		PrevIndex: base.Index,
+		PrevTerm:  base.Term,
+		Entries:   append([]LogEntry(nil), follower.log[1:11]...),
+		Commit:    follower.commit + 1,
+	}
+	commit := follower.commit
+	follower.l.Unlock()
+	if res := follower.AppendEntries(req); !res.Success {
+		t.Fatalf("expected the entries matched: %v\n", res)
+	}
+	follower.l.Lock()
+	after := follower.commit
+	follower.l.Unlock()
+	if after != commit {
+		t.Logf("expected the commit index kept: %d %d\n", after, commit)
+		t.Fail()
+	}
+	if err := rafts[leader].Put("last", []byte("value")); err != nil {
+		t.Fatalf("error: unable to put: %s\n", err.Error())
+	}
+	if !eventually(func() bool { return maps[(leader+1)%3].Exists("last") }) {
+		t.Logf("expected the follower applying the next entries\n")
+		t.Fail()
+	}
+}
+
+func TestRaftSnapshot(t *testing.T) {
+	n := NewMemNetwork()
+	rafts, maps := newRaftGroup(n, []string{"a", "b", "c"}, WithSnapshotThreshold(10))
+	for _, r := range rafts {
+		defer r.Close()
+	}
+	leader := electedLeader(rafts)
+	if leader < 0 {
+		t.Fatalf("expected a leader elected\n")
+	}
+	lagging := (leader + 1) % 3
+	n.Disconnect(rafts[lagging].id)
+	for i := 0; i < 100; i++ {
+		rafts[leader].Put(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	rafts[leader].Delete("key7")
+	if st := rafts[leader].Status(); st.Snapshot < 90 || st.LastIndex-st.Snapshot > 20 {
+		t.Logf("expected the log compacted: %v\n", st)
+		t.Fail()
+	}
+	n.Reconnect(rafts[lagging].id)
+	if !eventually(func() bool { return sameContents(maps[leader], maps[lagging]) }) {
+		t.Fatalf("expected the snapshot installed: %d\n", maps[lagging].Size())
+	}
+	if st := rafts[lagging].Status(); st.Snapshot == 0 || len(st.Members) != 3 {
+		t.Logf("unexpected state: %v\n", st)
+		t.Fail()
+	}
+	rafts[leader].Put("after", []byte("snapshot"))
+	if !eventually(func() bool { return string(maps[lagging].Get("after")) == "snapshot" }) {
+		t.Logf("expected the log replicated past the snapshot\n")
+		t.Fail()
+	}
+}
+
+func TestRaftRestart(t *testing.T) {
+	n := NewMemNetwork()
+	ids := []string{"a", "b", "c"}
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	rafts, maps := make([]*Raft, 3), make([]*Map, 3)
+	for i, id := range ids {
+		maps[i] = NewMap()
+		r, err := OpenRaft(dirs[i], id, n.Transport(id), maps[i], ids, append(raftOpts, WithSnapshotThreshold(10))...)
+		if err != nil {
+			t.Fatalf("error: unable to open the node: %s\n", err.Error())
+		}
+		rafts[i] = r
+		defer func(i int) { rafts[i].Close() }(i)
+	}
+	leader := electedLeader(rafts)
+	if leader < 0 {
+		t.Fatalf("expected a leader elected\n")
+	}
+	for i := 0; i < 25; i++ {
+		rafts[leader].Put(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+	follower := (leader + 1) % 3
+	if !eventually(func() bool { return sameContents(maps[leader], maps[follower]) }) {
+		t.Fatalf("expected the follower in sync\n")
+	}
+	old := rafts[follower].Status()
+	rafts[follower].Close()
+	rafts[leader].Delete("key0")
+	if _, err := OpenRaft(dirs[follower], ids[follower], n.Transport(ids[follower]), maps[leader], ids, raftOpts...); err == nil {
+		t.Logf("expected a Map not empty refused\n")
+		t.Fail()
+	}
+	maps[follower] = NewMap()
+	r, err := OpenRaft(dirs[follower], ids[follower], n.Transport(ids[follower]), maps[follower], nil, append(raftOpts, WithSnapshotThreshold(10))...)
+	if err != nil {
+		t.Fatalf("error: unable to reopen the node: %s\n", err.Error())
+	}
+	rafts[follower] = r
+	if st := r.Status(); st.Term < old.Term || st.Snapshot != old.Snapshot || st.LastIndex < old.Applied || len(st.Members) != 3 || maps[follower].Size() == 0 {
+		t.Fatalf("expected the state recovered: %v %v\n", old, st)
+	}
+	if !eventually(func() bool { return sameContents(maps[leader], maps[follower]) && !maps[follower].Exists("key0") }) {
+		t.Logf("expected the restarted node to catch up: %d\n", maps[follower].Size())
+		t.Fail()
+	}
+	single := t.TempDir()
+	r, _ = OpenRaft(single, "x", n.Transport("x"), NewMap(), []string{"x"}, raftOpts...)
+	if err := r.Put("key", []byte("value")); err != nil {
+		t.Fatalf("error: unable to put: %s\n", err.Error())
+	}
+	term := r.Status().Term
+	r.Close()
+	m := NewMap()
+	r, _ = OpenRaft(single, "x", n.Transport("x"), m, nil, raftOpts...)
+	defer r.Close()
+	if res := r.RequestVote(&VoteRequest{Term: term, Candidate: "y", LastIndex: 10, LastTerm: term}); res.Granted {
+		t.Logf("expected the vote of the term kept\n")
+		t.Fail()
+	}
+	if !eventually(func() bool { return string(m.Get("key")) == "value" }) {
+		t.Logf("expected the log replayed\n")
+		t.Fail()
+	}
+}
+
+func TestRaftMembership(t *testing.T) {
+	n := NewMemNetwork()
+	rafts, maps := newRaftGroup(n, []string{"a", "b", "c"}, WithSnapshotThreshold(20))
+	for _, r := range rafts {
+		defer r.Close()
+	}
+	leader := electedLeader(rafts)
+	if leader < 0 {
+		t.Fatalf("expected a leader elected\n")
+	}
+	for i := 0; i < 50; i++ {
+		rafts[leader].Put(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+	dm := NewMap()
+	d := NewRaft("d", n.Transport("d"), dm, nil, raftOpts...)
+	defer d.Close()
+	if err := rafts[(leader+1)%3].AddMember("d"); err != nil {
+		t.Fatalf("error: unable to add a member: %s\n", err.Error())
+	}
+	if !eventually(func() bool { return sameContents(maps[leader], dm) && len(d.Status().Members) == 4 }) {
+		t.Fatalf("expected the new member up to date: %d %v\n", dm.Size(), d.Status())
+	}
+	if err := d.Put("from", []byte("d")); err != nil || string(maps[leader].Get("from")) != "d" {
+		t.Logf("expected the new member to forward writes: %v\n", err)
+		t.Fail()
+	}
+	if err := d.RemoveMember(rafts[leader].id); err != nil {
+		t.Fatalf("error: unable to remove the leader: %s\n", err.Error())
+	}
+	rest := []*Raft{d}
+	for i, r := range rafts {
+		if i != leader {
+			rest = append(rest, r)
+		}
+	}
+	next := electedLeader(rest)
+	if next < 0 || rafts[leader].Status().State == "leader" {
+		t.Fatalf("expected the removed leader to step down\n")
+	}
+	if members := rest[next].Status().Members; len(members) != 3 || strings.Contains(strings.Join(members, ","), rafts[leader].id) {
+		t.Logf("unexpected members: %v\n", members)
+		t.Fail()
+	}
+	if err := rest[next].Put("after", []byte("removal")); err != nil {
+		t.Logf("expected the group to go on: %s\n", err.Error())
+		t.Fail()
+	}
+	time.Sleep(300 * time.Millisecond)
+	if st := rest[next].Status(); st.State != "leader" {
+		t.Logf("expected the removed member not to disrupt the group: %v\n", st)
+		t.Fail()
+	}
+}
+
+func TestRaftServed(t *testing.T) {
+	ids := []string{"localhost:12364", "localhost:12365"}
+	var rafts []*Raft
+	var maps []*Map
+	for _, id := range ids {
+		tr, err := NewRPCTransport(id)
+		if err != nil {
+			t.Fatalf("error: unable to listen: %s\n", err.Error())
+		}
+		m := NewMap()
+		r := NewRaft(id, tr, m, ids, raftOpts...)
+		defer r.Close()
+		rafts, maps = append(rafts, r), append(maps, m)
+	}
+	leader := electedLeader(rafts)
+	if leader < 0 {
+		t.Fatalf("expected a leader elected\n")
+	}
+	follower := 1 - leader
+	var wg sync.WaitGroup
+	wg.Add(2)
+	ts, err := NewTCPMapServer("localhost", 12362, &wg, maps[follower], true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	ts.SetRaft(rafts[follower])
+	go ts.Serve()
+	defer ts.Shutdown()
+	hs, err := NewHTTPMapServer("localhost", 8090, &wg, maps[follower], true)
+	if err != nil {
+		t.Fatalf("error: unable to start the HTTP server: %s\n", err.Error())
+	}
+	hs.SetRaft(rafts[follower])
+	go hs.Serve()
+	defer hs.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	tc, bc, hc := NewTCPMapClient("localhost", 12362), NewTCPMapClient("localhost", 12362), NewHTTPMapClient("localhost", 8090)
+	bc.SetBinary(true)
+	for i, c := range []Client{tc, bc, hc} {
+		if err := c.Dial(); err != nil {
+			t.Fatalf("error: unable to dial in: %s\n", err.Error())
+		}
+		key := fmt.Sprintf("key%d", i)
+		if err := c.Put(key, []byte("value")); err != nil {
+			t.Logf("unexpected error: %s\n", err.Error())
+			t.Fail()
+		}
+		if string(maps[leader].Get(key)) != "value" {
+			t.Logf("expected the write committed by the leader: %s\n", key)
+			t.Fail()
+		}
+		if value, err := c.Get(key); err != nil || string(value) != "value" {
+			t.Logf("expected the write read back: %s %v\n", value, err)
+			t.Fail()
+		}
+		if err := c.Delete(key); err != nil || maps[leader].Exists(key) {
+			t.Logf("expected the key deleted: %v\n", err)
+			t.Fail()
+		}
+		c.Close()
+	}
+	if _, err := tc.LPush("list", []byte("a")); err == nil || maps[follower].Exists("list") {
+		t.Logf("expected the push refused\n")
+		t.Fail()
+	}
+	ms := &MapServer{m: maps[follower], raft: rafts[follower]}
+	if res := ms.executeRESP(nil, [][]byte{[]byte("SET"), []byte("k"), []byte("v"), []byte("EX"), []byte("10")}); string(res) != "+OK\r\n" || maps[leader].TTL("k") <= 0 {
+		t.Logf("unexpected response to SET: %q\n", res)
+		t.Fail()
+	}
+	if res := ms.executeRESP(nil, [][]byte{[]byte("INCR"), []byte("n")}); !strings.HasPrefix(string(res), "-ERR Command not supported") {
+		t.Logf("expected INCR refused: %q\n", res)
+		t.Fail()
+	}
+	if res, _ := ms.execute([]byte("CLEAR\r\n")); res != "OK=0" || maps[leader].Size() != 0 {
+		t.Logf("unexpected response to CLEAR: %s\n", res)
+		t.Fail()
+	}
+	ns := NewNamespaces(maps[follower])
+	defer ns.Close()
+	existing, _ := ns.Get("existing")
+	ms.SetNamespaces(ns)
+	for _, name := range []string{"other", "existing"} {
+		ms.execute([]byte("SELECT " + name + "\r\n"))
+		for _, line := range []string{"PUT key value", "DEL key", "CLEAR"} {
+			if _, err := ms.execute([]byte(line + "\r\n")); err == nil || err.Error() != "KO="+errRaftNamespace.Error() {
+				t.Logf("expected %s refused on %s: %v\n", line, name, err)
+				t.Fail()
+			}
+		}
+		if res := ms.executeFrame(&frame{op: opPut, key: []byte("key"), value: []byte("value")}); res.op != statusError {
+			t.Logf("expected the binary PUT refused on %s\n", name)
+			t.Fail()
+		}
+		if res, err := ms.execute([]byte("GET key\r\n")); err != nil {
+			t.Logf("expected the reads served on %s: %s %v\n", name, res, err)
+			t.Fail()
+		}
+	}
+	if len(ns.Names()) != 2 || existing.Size() != 0 {
+		t.Logf("expected no write to the other namespaces: %v\n", ns.Names())
+		t.Fail()
+	}
+}
@@ -0,0 +1,576 @@
+package dmap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	replBuffer    = 65536
+	replHeartbeat = time.Second
+	replTimeout   = 5 * replHeartbeat
+	replRetry     = time.Second
+)
+
+var (
+	ErrReadOnly         = errors.New("READONLY You can't write against a read only replica")
+	errReplicationOff   = errors.New("Replication not enabled")
+	errReplicationAbort = errors.New("replication stopped")
+)
+
+// opSynced ends the full sync of a replica and opHeartbeat keeps the link
+// alive: both carry the offset of the primary as Value, and are not applied.
+const (
+	opSynced Op = 0x80 + iota
+	opHeartbeat
+)
+
+// writeCommands are the text and RESP commands refused by read-only replicas.
+var writeCommands = map[string]bool{
+	"put": true, "putnx": true, "putxx": true, "cas": true, "cad": true, "set": true,
+	"incr": true, "decr": true, "incrby": true, "decrby": true,
+	"del": true, "mset": true, "mdel": true, "clear": true, "flushdb": true, "flushall": true,
+	"expire": true, "persist": true,
+	"lpush": true, "rpush": true, "lpop": true, "rpop": true,
+	"sadd": true, "srem": true, "hset": true, "hdel": true,
+}
+
+// Replication streams the mutations of a Map to the replicas connected to it
+// and, once ReplicaOf is called, makes the Map a read-only replica of another
+// server. The stream is made of append-only log records: a full sync, i.e. a
+// Clear followed by the contents of the Map, then the mutations as they are
+// applied. The offset counts the bytes of the records streamed since the
+// first replica connected.
+type Replication struct {
+	m        *Map
+	l        sync.Mutex
+	offset   int64
+	replicas map[*replica]struct{}
+	detach   func()
+	primary  string
+	state    string
+	applied  int64
+	lastIO   time.Time
+	stop     chan struct{}
+	conn     net.Conn
+}
+
+// replica is a replica connected to the primary: records are queued on c,
+// and the mutations of the shards not dumped yet are left to the full sync.
+type replica struct {
+	addr    string
+	c       chan []byte
+	dumped  []bool
+	synced  bool
+	dropped bool
+	ack     int64
+	acked   time.Time
+}
+
+// ReplicationStatus reports the role of the server: Primary, State, Offset
+// and LastIO are those of the link with the primary, for replicas only.
+type ReplicationStatus struct {
+	Role     string
+	Offset   int64
+	Primary  string
+	State    string
+	LastIO   time.Time
+	Replicas []ReplicaStatus
+}
+
+// ReplicaStatus reports a replica connected: Offset is the last one it has
+// acknowledged, and Lag the bytes it is behind.
+type ReplicaStatus struct {
+	Addr    string
+	State   string
+	Offset  int64
+	Lag     int64
+	LastAck time.Time
+}
+
+func NewReplication(m *Map) *Replication {
+	rp := &Replication{m: m, replicas: make(map[*replica]struct{})}
+	rp.detach = m.observe(rp.observe)
+	return rp
+}
+
+// Close stops streaming to the replicas, and following the primary.
+func (rp *Replication) Close() {
+	rp.ReplicaOf("")
+	rp.detach()
+	rp.l.Lock()
+	defer rp.l.Unlock()
+	for r := range rp.replicas {
+		r.drop()
+	}
+}
+
+func (rp *Replication) observe(shard int, mu Mutation) {
+	rp.l.Lock()
+	defer rp.l.Unlock()
+	if len(rp.replicas) == 0 {
+		return
+	}
+	rec := appendMutation(nil, &mu)
+	rp.offset += int64(len(rec))
+	for r := range rp.replicas {
+		if !r.synced {
+			if shard < 0 {
+				for i := range r.dumped {
+					r.dumped[i] = true
+				}
+			} else if !r.dumped[shard] {
+				continue
+			}
+		}
+		r.send(rec)
+	}
+}
+
+// send queues the record, dropping the replica if it is not keeping up: it
+// will sync from scratch once reconnected. The lock must be held.
+func (r *replica) send(rec []byte) {
+	if r.dropped {
+		return
+	}
+	select {
+	case r.c <- rec:
+	default:
+		r.drop()
+	}
+}
+
+func (r *replica) drop() {
+	if !r.dropped {
+		r.dropped = true
+		close(r.c)
+	}
+}
+
+// marker returns the record of the internal op, carrying the offset: the lock
+// must be held.
+func (rp *Replication) marker(op Op) []byte {
+	return appendMutation(nil, &Mutation{Op: op, Value: []byte(strconv.FormatInt(rp.offset, 10))})
+}
+
+// serve streams the Map to the replica connected, answering SYNC, until it is
+// gone or dropped: shards are dumped one at a time, under their read lock, as
+// the append-only log does when rewritten, and the mutations applied to the
+// shards already dumped are queued meanwhile.
+func (rp *Replication) serve(conn net.Conn, r *bufio.Reader, w *bufio.Writer) {
+	rep := &replica{
+		addr:   conn.RemoteAddr().String(),
+		c:      make(chan []byte, replBuffer),
+		dumped: make([]bool, len(rp.m.e)),
+		acked:  time.Now(),
+	}
+	rp.l.Lock()
+	rp.replicas[rep] = struct{}{}
+	rp.l.Unlock()
+	defer func() {
+		rp.l.Lock()
+		delete(rp.replicas, rep)
+		rp.l.Unlock()
+	}()
+	log.Printf("info: replica %s connected, starting the full sync\n", rep.addr)
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			parts := strings.Fields(line)
+			if len(parts) != 2 || strings.ToLower(parts[0]) != "ack" {
+				continue
+			}
+			n, err := strconv.ParseInt(parts[1], 10, 64)
+			if err == nil {
+				rp.l.Lock()
+				rep.ack, rep.acked = n, time.Now()
+				rp.l.Unlock()
+			}
+		}
+	}()
+	w.WriteString("OK=SYNC\r\n")
+	rec := appendMutation(nil, &Mutation{Op: OpClear})
+	w.Write(rec)
+	for i := range rp.m.e {
+		var mus []Mutation
+		e := &rp.m.e[i]
+		now := time.Now().UnixNano()
+		e.l.RLock()
+		rp.l.Lock()
+		dumped := rep.dumped[i]
+		rep.dumped[i] = true
+		rp.l.Unlock()
+		if !dumped {
+			for k, it := range e.m {
+				if !it.expired(now) {
+					mus = append(mus, it.mutation(k))
+				}
+			}
+		}
+		e.l.RUnlock()
+		for j := range mus {
+			rec = appendMutation(rec[:0], &mus[j])
+			_, err := w.Write(rec)
+			if err != nil {
+				log.Printf("error: not able to sync the replica %s: %s\n", rep.addr, err.Error())
+				return
+			}
+		}
+	}
+	rp.l.Lock()
+	rep.synced = true
+	rep.send(rp.marker(opSynced))
+	rp.l.Unlock()
+	t := time.NewTicker(replHeartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-gone:
+			log.Printf("info: replica %s disconnected\n", rep.addr)
+			return
+		case rec, ok := <-rep.c:
+			if !ok {
+				log.Printf("error: replica %s dropped, not keeping up with the stream\n", rep.addr)
+				return
+			}
+			_, err := w.Write(rec)
+			if err == nil && len(rep.c) == 0 {
+				err = w.Flush()
+			}
+			if err != nil {
+				log.Printf("error: not able to write to the replica %s: %s\n", rep.addr, err.Error())
+				return
+			}
+		case <-t.C:
+			rp.l.Lock()
+			rep.send(rp.marker(opHeartbeat))
+			rp.l.Unlock()
+		}
+	}
+}
+
+// ReplicaOf makes the Map a replica of the primary at addr, host:port: its
+// contents are replaced by those of the primary, and then kept in line with
+// them, reconnecting if the link goes down. An empty addr stops following the
+// primary, leaving the Map as it is, and writable again.
+func (rp *Replication) ReplicaOf(addr string) {
+	rp.l.Lock()
+	defer rp.l.Unlock()
+	if rp.stop != nil {
+		close(rp.stop)
+		rp.stop = nil
+		if rp.conn != nil {
+			rp.conn.Close()
+			rp.conn = nil
+		}
+	}
+	rp.primary, rp.state, rp.applied = addr, "", 0
+	if addr == "" {
+		return
+	}
+	rp.stop = make(chan struct{})
+	rp.state = "connecting"
+	go rp.follow(addr, rp.stop)
+}
+
+// ReadOnly reports whether the Map is a replica.
+func (rp *Replication) ReadOnly() bool {
+	rp.l.Lock()
+	defer rp.l.Unlock()
+	return rp.primary != ""
+}
+
+func (rp *Replication) Status() ReplicationStatus {
+	rp.l.Lock()
+	defer rp.l.Unlock()
+	st := ReplicationStatus{Role: "primary", Offset: rp.offset}
+	if rp.primary != "" {
+		st = ReplicationStatus{Role: "replica", Offset: rp.applied, Primary: rp.primary, State: rp.state, LastIO: rp.lastIO}
+	}
+	for r := range rp.replicas {
+		state := "sync"
+		if r.synced {
+			state = "online"
+		}
+		st.Replicas = append(st.Replicas, ReplicaStatus{
+			Addr:    r.addr,
+			State:   state,
+			Offset:  r.ack,
+			Lag:     rp.offset - r.ack,
+			LastAck: r.acked,
+		})
+	}
+	return st
+}
+
+func (rp *Replication) follow(addr string, stop chan struct{}) {
+	for {
+		err := rp.sync(addr, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Printf("error: replication link with %s down: %s\n", addr, err.Error())
+		rp.l.Lock()
+		if rp.stop == stop {
+			rp.state = "connecting"
+		}
+		rp.l.Unlock()
+		select {
+		case <-stop:
+			return
+		case <-time.After(replRetry):
+		}
+	}
+}
+
+// sync asks the primary for the stream and applies it, acknowledging the
+// offset applied every heartbeat, until the link goes down.
+func (rp *Replication) sync(addr string, stop chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", addr, replTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rp.l.Lock()
+	if rp.stop != stop {
+		rp.l.Unlock()
+		return errReplicationAbort
+	}
+	rp.conn = conn
+	rp.state = "sync"
+	rp.l.Unlock()
+	_, err = conn.Write([]byte("SYNC\r\n"))
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(conn, 65536)
+	conn.SetReadDeadline(time.Now().Add(replTimeout))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line = strings.TrimSpace(line); line != "OK=SYNC" {
+		return errors.New("unexpected response to SYNC: " + line)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go rp.ack(conn, done)
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		mu, l, err := readMutation(r)
+		if err == io.EOF {
+			return errors.New("connection closed by the primary")
+		}
+		if err != nil {
+			return err
+		}
+		rp.l.Lock()
+		if rp.stop != stop {
+			rp.l.Unlock()
+			return errReplicationAbort
+		}
+		rp.lastIO = time.Now()
+		rp.l.Unlock()
+		switch mu.Op {
+		case opSynced, opHeartbeat:
+			n, _ := strconv.ParseInt(string(mu.Value), 10, 64)
+			rp.l.Lock()
+			if mu.Op == opSynced {
+				rp.state = "connected"
+				log.Printf("info: synced with the primary %s: %d keys\n", addr, rp.m.Size())
+			}
+			rp.applied = n
+			rp.l.Unlock()
+		default:
+			rp.m.apply(&mu)
+			rp.l.Lock()
+			if rp.state == "connected" {
+				rp.applied += int64(l)
+			}
+			rp.l.Unlock()
+		}
+	}
+}
+
+func (rp *Replication) ack(conn net.Conn, done chan struct{}) {
+	t := time.NewTicker(replHeartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			rp.l.Lock()
+			offset := rp.applied
+			rp.l.Unlock()
+			_, err := conn.Write([]byte(fmt.Sprintf("ACK %d\r\n", offset)))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// SetReplication enables REPLICAOF and ROLE, and the replicas to SYNC over
+// TCP: writes are refused while the server is a replica.
+func (ms *MapServer) SetReplication(rp *Replication) {
+	ms.repl = rp
+}
+
+// readOnly reports whether the command, a text or RESP one, is refused.
+func (ms *MapServer) readOnly(command string) bool {
+	return writeCommands[command] && ms.repl != nil && ms.repl.ReadOnly()
+}
+
+// REPLICAOF <host> <port> | REPLICAOF NO ONE
+func (ms *MapServer) executeReplicaOf(parts []string) (string, error) {
+	if len(parts) != 3 {
+		return "", errors.New("KO=Bad command, format: REPLICAOF <host> <port> | REPLICAOF NO ONE")
+	}
+	if ms.repl == nil {
+		return "", errors.New("KO=" + errReplicationOff.Error())
+	}
+	if strings.ToLower(parts[1]) == "no" && strings.ToLower(parts[2]) == "one" {
+		ms.repl.ReplicaOf("")
+		return "OK=NO ONE", nil
+	}
+	port, err := strconv.Atoi(parts[2])
+	if err != nil || port <= 0 || port > 65535 {
+		return "", errors.New("KO=Bad command, REPLICAOF expects a port")
+	}
+	addr := net.JoinHostPort(parts[1], strconv.Itoa(port))
+	ms.repl.ReplicaOf(addr)
+	return "OK=" + addr, nil
+}
+
+// ROLE, answered by OK=primary <offset> <n> followed by a line per replica,
+// OK=<addr> <state> <offset> <lag>, or by OK=replica <primary> <state>
+// <offset> <seconds since the last record>
+func (ms *MapServer) executeRole(parts []string) (string, error) {
+	if len(parts) != 1 {
+		return "", errors.New("KO=Bad command, format: ROLE")
+	}
+	if ms.repl == nil {
+		return "", errors.New("KO=" + errReplicationOff.Error())
+	}
+	st := ms.repl.Status()
+	if st.Role == "replica" {
+		idle := int64(-1)
+		if !st.LastIO.IsZero() {
+			idle = int64(time.Since(st.LastIO) / time.Second)
+		}
+		return fmt.Sprintf("OK=replica %s %s %d %d", st.Primary, st.State, st.Offset, idle), nil
+	}
+	lines := []string{fmt.Sprintf("OK=primary %d %d", st.Offset, len(st.Replicas))}
+	for _, r := range st.Replicas {
+		lines = append(lines, fmt.Sprintf("OK=%s %s %d %d", r.Addr, r.State, r.Offset, r.Lag))
+	}
+	return strings.Join(lines, "\r\n"), nil
+}
+
+// executeRESPReplication runs REPLICAOF (SLAVEOF) and ROLE, answering ROLE
+// as Redis does.
+func (ms *MapServer) executeRESPReplication(buf []byte, args [][]byte) []byte {
+	command := strings.ToLower(string(args[0]))
+	if ms.repl == nil {
+		return appendRESPError(buf, "ERR "+errReplicationOff.Error())
+	}
+	if command != "role" {
+		if len(args) != 3 {
+			return appendRESPArity(buf, command)
+		}
+		_, err := ms.executeReplicaOf(respKeys(args))
+		if err != nil {
+			return appendRESPError(buf, "ERR "+strings.TrimPrefix(err.Error(), "KO=Bad command, "))
+		}
+		return appendRESPSimple(buf, "OK")
+	}
+	st := ms.repl.Status()
+	if st.Role == "replica" {
+		host, port, _ := net.SplitHostPort(st.Primary)
+		p, _ := strconv.Atoi(port)
+		buf = appendRESPArray(buf, 5)
+		buf = appendRESPBulk(buf, []byte("slave"))
+		buf = appendRESPBulk(buf, []byte(host))
+		buf = appendRESPInt(buf, int64(p))
+		buf = appendRESPBulk(buf, []byte(st.State))
+		return appendRESPInt(buf, st.Offset)
+	}
+	buf = appendRESPArray(buf, 3)
+	buf = appendRESPBulk(buf, []byte("master"))
+	buf = appendRESPInt(buf, st.Offset)
+	buf = appendRESPArray(buf, len(st.Replicas))
+	for _, r := range st.Replicas {
+		host, port, _ := net.SplitHostPort(r.Addr)
+		buf = appendRESPArray(buf, 3)
+		buf = appendRESPBulk(buf, []byte(host))
+		buf = appendRESPBulk(buf, []byte(port))
+		buf = appendRESPBulk(buf, []byte(strconv.FormatInt(r.Offset, 10)))
+	}
+	return buf
+}
+
+// writable refuses all the requests but GETs while the server is a replica,
+// with 403 Forbidden.
+func (hs *HTTPMapServer) writable(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && hs.repl != nil && hs.repl.ReadOnly() {
+			hs.typedError(w, http.StatusForbidden, ErrReadOnly)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// replicationHandler answers with the role of the server, the offset and the
+// replicas connected, or the link with the primary.
+func (hs *HTTPMapServer) replicationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		hs.typedError(w, http.StatusMethodNotAllowed, errors.New("Bad method: only GET accepted"))
+		return
+	}
+	if hs.repl == nil {
+		hs.typedError(w, http.StatusNotFound, errReplicationOff)
+		return
+	}
+	st := hs.repl.Status()
+	rs := map[string]interface{}{"outcome": "OK", "role": st.Role, "offset": st.Offset}
+	if st.Role == "replica" {
+		rs["primary"] = st.Primary
+		rs["state"] = st.State
+		if !st.LastIO.IsZero() {
+			rs["idle"] = time.Since(st.LastIO).Seconds()
+		}
+	}
+	replicas := []map[string]interface{}{}
+	for _, r := range st.Replicas {
+		replicas = append(replicas, map[string]interface{}{
+			"addr":   r.Addr,
+			"state":  r.State,
+			"offset": r.Offset,
+			"lag":    r.Lag,
+			"idle":   time.Since(r.LastAck).Seconds(),
+		})
+	}
+	rs["replicas"] = replicas
+	w.Header().Set("Content-Type", "application/json")
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
@@ -0,0 +1,206 @@
+package dmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventually polls cond for up to 5 seconds.
+func eventually(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func sameContents(a, b *Map) bool {
+	if !reflect.DeepEqual(a.Keys(""), b.Keys("")) || !reflect.DeepEqual(a.Values(), b.Values()) {
+		return false
+	}
+	for _, key := range a.Keys("") {
+		if a.Type(key) == "list" {
+			la, _ := a.LRange(key, 0, -1)
+			lb, _ := b.LRange(key, 0, -1)
+			if !reflect.DeepEqual(la, lb) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestReplication(t *testing.T) {
+	primary, follower := NewMap(WithShards(16)), NewMap()
+	for i := 0; i < 5000; i++ {
+		primary.Put(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	primary.RPush("list", []byte("a"))
+	primary.PutWithTTL("ttl", []byte("value"), time.Hour)
+	follower.Put("stale", []byte("value"))
+	rp, rc := NewReplication(primary), NewReplication(follower)
+	defer rp.Close()
+	defer rc.Close()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	ps, err := NewTCPMapServer("localhost", 12359, &wg, primary, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	ps.SetReplication(rp)
+	go ps.Serve()
+	defer ps.Shutdown()
+	cs, err := NewTCPMapServer("localhost", 12360, &wg, follower, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	cs.SetReplication(rc)
+	go cs.Serve()
+	defer cs.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	writes := make(chan struct{})
+	go func() {
+		defer close(writes)
+		for i := 0; i < 1000; i++ {
+			primary.Put(fmt.Sprintf("key%d", i*5), []byte("updated"))
+			primary.RPush("list", []byte(fmt.Sprintf("%d", i)))
+			primary.Delete(fmt.Sprintf("key%d", i*5+1))
+		}
+	}()
+	ms := &MapServer{m: follower, repl: rc}
+	if res, err := ms.execute([]byte("REPLICAOF localhost 12359\r\n")); err != nil || res != "OK=localhost:12359" {
+		t.Fatalf("unexpected response to REPLICAOF: %s %v\n", res, err)
+	}
+	<-writes
+	if !eventually(func() bool { return rc.Status().State == "connected" && sameContents(primary, follower) }) {
+		t.Fatalf("expected the replica in sync: %v %d %d\n", rc.Status(), primary.Size(), follower.Size())
+	}
+	if follower.Exists("stale") || follower.TTL("ttl") <= 0 {
+		t.Logf("expected the contents replaced\n")
+		t.Fail()
+	}
+	primary.SAdd("set", "a", "b")
+	primary.Expire("key2", time.Hour)
+	primary.Clear()
+	primary.Put("after", []byte("clear"))
+	if !eventually(func() bool { return sameContents(primary, follower) }) {
+		t.Logf("expected the mutations streamed: %v\n", follower.Keys(""))
+		t.Fail()
+	}
+	if !eventually(func() bool {
+		st := rp.Status()
+		return len(st.Replicas) == 1 && st.Replicas[0].State == "online" && st.Replicas[0].Lag == 0 &&
+			rc.Status().Offset == st.Offset && st.Offset > 0
+	}) {
+		t.Logf("expected the offsets acknowledged: %v %v\n", rp.Status(), rc.Status())
+		t.Fail()
+	}
+	res, _ := ms.execute([]byte("ROLE\r\n"))
+	if !strings.HasPrefix(res, "OK=replica localhost:12359 connected ") {
+		t.Logf("unexpected role: %s\n", res)
+		t.Fail()
+	}
+	res, _ = (&MapServer{m: primary, repl: rp}).execute([]byte("ROLE\r\n"))
+	if lines := strings.Split(res, "\r\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "OK=primary ") || !strings.HasSuffix(lines[1], " online "+strings.Fields(lines[0])[1]+" 0") {
+		t.Logf("unexpected role: %q\n", res)
+		t.Fail()
+	}
+	if res, _ := ms.execute([]byte("REPLICAOF no one\r\n")); res != "OK=NO ONE" || rc.ReadOnly() {
+		t.Logf("unexpected response to REPLICAOF NO ONE: %s\n", res)
+		t.Fail()
+	}
+	primary.Put("later", []byte("value"))
+	time.Sleep(100 * time.Millisecond)
+	if follower.Exists("later") || follower.Get("after") == nil {
+		t.Logf("expected the replica detached, keeping its contents\n")
+		t.Fail()
+	}
+	if !eventually(func() bool { return len(rp.Status().Replicas) == 0 }) {
+		t.Logf("expected the replica gone\n")
+		t.Fail()
+	}
+}
+
+func TestReplicaReadOnly(t *testing.T) {
+	m := NewMap()
+	m.Put("key", []byte("value"))
+	rp := NewReplication(m)
+	defer rp.Close()
+	rp.ReplicaOf("localhost:1")
+	var wg sync.WaitGroup
+	wg.Add(2)
+	ts, err := NewTCPMapServer("localhost", 12361, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	ts.SetReplication(rp)
+	go ts.Serve()
+	defer ts.Shutdown()
+	hs, err := NewHTTPMapServer("localhost", 8089, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the HTTP server: %s\n", err.Error())
+	}
+	hs.SetReplication(rp)
+	go hs.Serve()
+	defer hs.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	tc, bc := NewTCPMapClient("localhost", 12361), NewTCPMapClient("localhost", 12361)
+	bc.SetBinary(true)
+	hc := NewHTTPMapClient("localhost", 8089)
+	for _, c := range []Client{tc, bc, hc} {
+		if err := c.Dial(); err != nil {
+			t.Fatalf("error: unable to dial in: %s\n", err.Error())
+		}
+		if err := c.Put("key", []byte("other")); err != ErrReadOnly {
+			t.Logf("expected the put refused: %v\n", err)
+			t.Fail()
+		}
+		if value, err := c.Get("key"); err != nil || string(value) != "value" {
+			t.Logf("unexpected value: %s %v\n", value, err)
+			t.Fail()
+		}
+		c.Close()
+	}
+	if _, err := tc.LPush("list", []byte("a")); err == nil {
+		t.Logf("expected the push refused\n")
+		t.Fail()
+	}
+	ms := &MapServer{m: m, repl: rp}
+	if res := ms.executeRESP(nil, [][]byte{[]byte("SET"), []byte("key"), []byte("other")}); !strings.HasPrefix(string(res), "-READONLY") {
+		t.Logf("expected the SET refused: %q\n", res)
+		t.Fail()
+	}
+	var tc2 txConn
+	ms.executeTx(&tc2, []byte("MULTI\r\n"))
+	if res, _ := ms.executeTx(&tc2, []byte("PUT key other\r\n")); !strings.HasPrefix(res, "KO=READONLY") {
+		t.Logf("expected the queued PUT refused: %s\n", res)
+		t.Fail()
+	}
+	res, err := http.Get("http://localhost:8089/api/v1/admin/replication")
+	if err != nil {
+		t.Fatalf("error: unable to get the replication status: %s\n", err.Error())
+	}
+	var st struct {
+		Role    string `json:"role"`
+		Primary string `json:"primary"`
+		State   string `json:"state"`
+	}
+	json.NewDecoder(res.Body).Decode(&st)
+	res.Body.Close()
+	if st.Role != "replica" || st.Primary != "localhost:1" || st.State != "connecting" {
+		t.Logf("unexpected status: %v\n", st)
+		t.Fail()
+	}
+	if string(m.Get("key")) != "value" {
+		t.Logf("expected the value untouched\n")
+		t.Fail()
+	}
+}
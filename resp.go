@@ -0,0 +1,365 @@
+package dmap
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RESP (REdis Serialization Protocol) is spoken by TCP connections starting
+// with an array, i.e. '*', as redis-cli and the Redis client libraries do.
+const (
+	respArrayMax = 1 << 20
+)
+
+var errRESPProtocol = errors.New("Protocol error")
+
+// readRESP reads a command, i.e. an array of bulk strings.
+func readRESP(r *bufio.Reader) ([][]byte, error) {
+	n, err := readRESPLength(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > respArrayMax {
+		return nil, errRESPProtocol
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		l, err := readRESPLength(r, '$')
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if l < 0 || l > frameMaxLen {
+			return nil, errRESPProtocol
+		}
+		args[i] = make([]byte, l+2)
+		_, err = io.ReadFull(r, args[i])
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if args[i][l] != '\r' || args[i][l+1] != '\n' {
+			return nil, errRESPProtocol
+		}
+		args[i] = args[i][:l]
+	}
+	return args, nil
+}
+
+func readRESPLength(r *bufio.Reader, prefix byte) (int, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return 0, errRESPProtocol
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 3 || line[0] != prefix || line[len(line)-2] != '\r' {
+		return 0, errRESPProtocol
+	}
+	n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+	if err != nil {
+		return 0, errRESPProtocol
+	}
+	return n, nil
+}
+
+func appendRESPSimple(buf []byte, s string) []byte {
+	buf = append(buf, '+')
+	buf = append(buf, s...)
+	return append(buf, '\r', '\n')
+}
+
+func appendRESPError(buf []byte, s string) []byte {
+	buf = append(buf, '-')
+	buf = append(buf, s...)
+	return append(buf, '\r', '\n')
+}
+
+func appendRESPInt(buf []byte, n int64) []byte {
+	buf = append(buf, ':')
+	buf = strconv.AppendInt(buf, n, 10)
+	return append(buf, '\r', '\n')
+}
+
+// appendRESPBulk appends a nil bulk string if b is nil.
+func appendRESPBulk(buf []byte, b []byte) []byte {
+	if b == nil {
+		return append(buf, "$-1\r\n"...)
+	}
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(b)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, b...)
+	return append(buf, '\r', '\n')
+}
+
+func appendRESPArray(buf []byte, n int) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	return append(buf, '\r', '\n')
+}
+
+// serveRESP executes the commands as they come, flushing the responses as
+// soon as no more command is buffered, so that pipelines are answered with
+// as few writes as possible.
+func (ts *TCPMapServer) serveRESP(conn *net.TCPConn, r *bufio.Reader) {
+	w := bufio.NewWriterSize(conn, 65536)
+	var buf []byte
+	var tc txConn
+	for {
+		args, err := readRESP(r)
+		if err == errRESPProtocol {
+			w.Write(appendRESPError(nil, "ERR Protocol error"))
+			w.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("error: not able to read: %s\n", err.Error())
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := strings.ToLower(string(args[0])) == "quit"
+		var ok bool
+		if buf, ok = ts.executeRESPTx(buf[:0], &tc, args); !ok {
+			buf = ts.executeRESP(buf[:0], args)
+		}
+		_, err = w.Write(buf)
+		if err == nil && (quit || r.Buffered() == 0) {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Printf("error: not able to write: %s\n", err.Error())
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+func (ms *MapServer) executeRESP(buf []byte, args [][]byte) []byte {
+	command := strings.ToLower(string(args[0]))
+	arity := func(min int, even bool) bool {
+		return len(args) >= min && (!even || len(args)%2 == 1)
+	}
+	if ms.readOnly(command) {
+		return appendRESPError(buf, ErrReadOnly.Error())
+	}
+	if err := ms.resolve(writeCommands[command]); err != nil {
+		return appendRESPError(buf, "ERR "+err.Error())
+	}
+	if command == "asking" && len(args) == 1 {
+		ms.asking = true
+		return appendRESPSimple(buf, "OK")
+	}
+	done, err := ms.moved(commandKeys(command, respKeys(args)))
+	if err != nil {
+		return appendRESPError(buf, err.Error())
+	}
+	defer done()
+	if ms.consensus(command) {
+		return ms.executeRESPRaft(buf, args)
+	}
+	switch command {
+	case "get":
+		if len(args) != 2 {
+			return appendRESPArity(buf, command)
+		}
+		value := ms.m.Get(string(args[1]))
+		if value == nil && ms.m.typedKey(string(args[1])) {
+			return appendRESPError(buf, ErrWrongType.Error())
+		}
+		return appendRESPBulk(buf, value)
+	case "set":
+		if len(args) < 3 {
+			return appendRESPArity(buf, command)
+		}
+		return ms.executeRESPSet(buf, args)
+	case "del":
+		if !arity(2, false) {
+			return appendRESPArity(buf, command)
+		}
+		return appendRESPInt(buf, int64(ms.m.MDelete(respKeys(args[1:])...)))
+	case "exists":
+		if !arity(2, false) {
+			return appendRESPArity(buf, command)
+		}
+		var n int64
+		for _, key := range args[1:] {
+			if ms.m.Exists(string(key)) {
+				n++
+			}
+		}
+		return appendRESPInt(buf, n)
+	case "keys":
+		if len(args) != 2 {
+			return appendRESPArity(buf, command)
+		}
+		keys := ms.m.matchKeys(string(args[1]))
+		buf = appendRESPArray(buf, len(keys))
+		for _, key := range keys {
+			buf = appendRESPBulk(buf, []byte(key))
+		}
+		return buf
+	case "mget":
+		if !arity(2, false) {
+			return appendRESPArity(buf, command)
+		}
+		values := ms.m.MGet(respKeys(args[1:])...)
+		buf = appendRESPArray(buf, len(values))
+		for _, value := range values {
+			buf = appendRESPBulk(buf, value)
+		}
+		return buf
+	case "mset":
+		if !arity(3, true) {
+			return appendRESPArity(buf, command)
+		}
+		values := make(map[string][]byte, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			values[string(args[i])] = args[i+1]
+		}
+		err := ms.m.MPut(values)
+		if err != nil {
+			return appendRESPError(buf, err.Error())
+		}
+		return appendRESPSimple(buf, "OK")
+	case "incr", "decr", "incrby", "decrby":
+		by := strings.HasSuffix(command, "by")
+		if by && len(args) != 3 || !by && len(args) != 2 {
+			return appendRESPArity(buf, command)
+		}
+		delta := int64(1)
+		if by {
+			d, err := strconv.ParseInt(string(args[2]), 10, 64)
+			if err != nil {
+				return appendRESPError(buf, "ERR "+ErrNotInteger.Error())
+			}
+			delta = d
+		}
+		if strings.HasPrefix(command, "decr") {
+			if delta == math.MinInt64 {
+				return appendRESPError(buf, "ERR "+ErrOverflow.Error())
+			}
+			delta = -delta
+		}
+		n, err := ms.m.Incr(string(args[1]), delta)
+		if err == ErrOutOfMemory || err == ErrWrongType {
+			return appendRESPError(buf, err.Error())
+		}
+		if err != nil {
+			return appendRESPError(buf, "ERR "+err.Error())
+		}
+		return appendRESPInt(buf, n)
+	case "dbsize":
+		return appendRESPInt(buf, int64(ms.m.Size()))
+	case "flushdb", "flushall":
+		ms.m.Clear()
+		return appendRESPSimple(buf, "OK")
+	case "ping":
+		if len(args) > 1 {
+			return appendRESPBulk(buf, args[1])
+		}
+		return appendRESPSimple(buf, "PONG")
+	case "echo":
+		if len(args) != 2 {
+			return appendRESPArity(buf, command)
+		}
+		return appendRESPBulk(buf, args[1])
+	case "select":
+		if len(args) != 2 {
+			return appendRESPArity(buf, command)
+		}
+		err := ms.selectNamespace(string(args[1]))
+		if err != nil {
+			return appendRESPError(buf, "ERR "+err.Error())
+		}
+		return appendRESPSimple(buf, "OK")
+	case "replicaof", "slaveof", "role":
+		return ms.executeRESPReplication(buf, args)
+	case "quit", "client":
+		return appendRESPSimple(buf, "OK")
+	case "command":
+		return appendRESPArray(buf, 0)
+	}
+	if r, ok, err := ms.executeTyped(args); ok {
+		switch {
+		case err == ErrOutOfMemory || err == ErrWrongType:
+			return appendRESPError(buf, err.Error())
+		case err != nil:
+			return appendRESPError(buf, "ERR "+err.Error())
+		}
+		return r.appendRESP(buf)
+	}
+	return appendRESPError(buf, "ERR unknown command '"+string(args[0])+"'")
+}
+
+// SET key value [EX seconds|PX milliseconds] [NX|XX]
+func (ms *MapServer) executeRESPSet(buf []byte, args [][]byte) []byte {
+	key, value := string(args[1]), args[2]
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 3; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ex", "px":
+			if i+1 == len(args) {
+				return appendRESPError(buf, "ERR syntax error")
+			}
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n <= 0 {
+				return appendRESPError(buf, "ERR invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if strings.ToLower(string(args[i])) == "px" {
+				unit = time.Millisecond
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		default:
+			return appendRESPError(buf, "ERR syntax error")
+		}
+	}
+	if nx && xx {
+		return appendRESPError(buf, "ERR syntax error")
+	}
+	it := &item{v: value}
+	if ttl > 0 {
+		it.x = time.Now().Add(ttl).UnixNano()
+	}
+	ok, err := ms.m.swap(key, func(old *item) bool {
+		return (!nx || old == nil) && (!xx || old != nil)
+	}, it)
+	if err != nil {
+		return appendRESPError(buf, err.Error())
+	}
+	if !ok {
+		return appendRESPBulk(buf, nil)
+	}
+	return appendRESPSimple(buf, "OK")
+}
+
+func respKeys(args [][]byte) []string {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = string(arg)
+	}
+	return keys
+}
+
+func appendRESPArity(buf []byte, command string) []byte {
+	return appendRESPError(buf, "ERR wrong number of arguments for '"+command+"' command")
+}
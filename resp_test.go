@@ -0,0 +1,88 @@
+package dmap
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func respCommand(args ...string) string {
+	command := string(appendRESPArray(nil, len(args)))
+	for _, arg := range args {
+		command += string(appendRESPBulk(nil, []byte(arg)))
+	}
+	return command
+}
+
+func TestTCPMapServerRESP(t *testing.T) {
+	m := NewMap()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ts, err := NewTCPMapServer("localhost", 12349, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	go ts.Serve()
+	defer ts.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.Dial("tcp", "localhost:12349")
+	if err != nil {
+		t.Fatalf("error: unable to dial in: %s\n", err.Error())
+	}
+	defer conn.Close()
+	commands := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"SET", "key", "a value\r\nwith newlines"}, "+OK\r\n"},
+		{[]string{"GET", "key"}, "$22\r\na value\r\nwith newlines\r\n"},
+		{[]string{"GET", "missing"}, "$-1\r\n"},
+		{[]string{"SET", "key", "other", "NX"}, "$-1\r\n"},
+		{[]string{"SET", "session", "token", "EX", "10", "NX"}, "+OK\r\n"},
+		{[]string{"MSET", "a", "1", "b", "2"}, "+OK\r\n"},
+		{[]string{"MGET", "a", "missing", "b"}, "*3\r\n$1\r\n1\r\n$-1\r\n$1\r\n2\r\n"},
+		{[]string{"EXISTS", "a", "b", "missing"}, ":2\r\n"},
+		{[]string{"DBSIZE"}, ":4\r\n"},
+		{[]string{"DEL", "a", "missing"}, ":1\r\n"},
+		{[]string{"RPUSH", "list", "x", "y"}, ":2\r\n"},
+		{[]string{"LRANGE", "list", "0", "-1"}, "*2\r\n$1\r\nx\r\n$1\r\ny\r\n"},
+		{[]string{"GET", "list"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"HSET", "hash", "f", "v"}, ":1\r\n"},
+		{[]string{"HGET", "hash", "f"}, "$1\r\nv\r\n"},
+		{[]string{"TYPE", "hash"}, "$4\r\nhash\r\n"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command\r\n"},
+		{[]string{"UNKNOWN"}, "-ERR unknown command 'UNKNOWN'\r\n"},
+		{[]string{"FLUSHDB"}, "+OK\r\n"},
+		{[]string{"DBSIZE"}, ":0\r\n"},
+	}
+	var pipeline, expected string
+	for _, c := range commands {
+		pipeline += respCommand(c.args...)
+		expected += c.expected
+	}
+	_, err = conn.Write([]byte(pipeline))
+	if err != nil {
+		t.Fatalf("error: unable to write: %s\n", err.Error())
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res := make([]byte, len(expected))
+	_, err = io.ReadFull(bufio.NewReader(conn), res)
+	if err != nil {
+		t.Fatalf("error: unable to read: %s\n", err.Error())
+	}
+	if string(res) != expected {
+		t.Logf("error: unexpected responses:\n%q\nexpected:\n%q\n", string(res), expected)
+		t.Fail()
+	}
+	conn.Write([]byte("*1\r\n$3\r\nGET\r\n*x\r\n"))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if !strings.HasPrefix(line, "-ERR wrong number") {
+		t.Logf("error: unexpected response: %q\n", line)
+		t.Fail()
+	}
+}
@@ -0,0 +1,237 @@
+package dmap
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scanCount    = 10
+	keysLimit    = 100
+	keysMaxLimit = 10000
+)
+
+// WithOrderedIndex keeps the keys of every shard sorted in a skiplist, so
+// that Scan and Keys walk the range only instead of the whole Map, at the
+// cost of slower writes.
+func WithOrderedIndex() Option {
+	return func(m *Map) {
+		m.ix = true
+	}
+}
+
+// Scan returns, in ascending order, up to limit keys (all of them if limit is
+// not positive) in [start, end): an empty end means no upper bound. Shards
+// are scanned one at a time and merged, so concurrent writes to other shards
+// may or may not be seen.
+func (m *Map) Scan(start, end string, limit int) []string {
+	var keys []string
+	for i := range m.e {
+		keys = append(keys, m.e[i].scan(start, end, limit)...)
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// Keys returns the keys starting with prefix, all of them if empty, in
+// ascending order. Unlike Scan, all the shards are read locked at once, so
+// the keys are those held by the Map at a point in time.
+func (m *Map) Keys(prefix string) []string {
+	unlock := m.lockAll(false)
+	defer unlock()
+	now := time.Now().UnixNano()
+	var keys []string
+	for i := range m.e {
+		keys = append(keys, m.e[i].keys(prefix, prefixEnd(prefix), 0, now)...)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e *entry) scan(start, end string, limit int) []string {
+	now := time.Now().UnixNano()
+	e.l.RLock()
+	defer e.l.RUnlock()
+	return e.keys(start, end, limit, now)
+}
+
+// keys returns up to limit keys of the shard in [start, end), in ascending
+// order: the read lock must be held.
+func (e *entry) keys(start, end string, limit int, now int64) []string {
+	var keys []string
+	if e.k != nil {
+		for n := e.k.seek(start); n != nil && (end == "" || n.key < end); n = n.next[0] {
+			if limit > 0 && len(keys) == limit {
+				break
+			}
+			if !e.m[n.key].expired(now) {
+				keys = append(keys, n.key)
+			}
+		}
+		return keys
+	}
+	for k, it := range e.m {
+		if k >= start && (end == "" || k < end) && !it.expired(now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// prefixEnd returns the lowest key greater than all the keys starting with
+// prefix, empty if there is none.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// literalPrefix returns the prefix of the glob-style pattern free of special
+// characters, which all the matching keys share.
+func literalPrefix(pattern string) string {
+	i := strings.IndexAny(pattern, "*?[\\")
+	if i < 0 {
+		return pattern
+	}
+	return pattern[:i]
+}
+
+// scanPage returns up to count keys from the cursor, those matching the
+// pattern, and the cursor to go on with: "0" starts and ends the iteration,
+// any other cursor is the next key to scan, hex encoded.
+func (m *Map) scanPage(cursor, pattern string, count int) ([]string, string, error) {
+	start := ""
+	if cursor != "0" && cursor != "" {
+		b, err := hex.DecodeString(cursor)
+		if err != nil {
+			return nil, "", errors.New("invalid cursor")
+		}
+		start = string(b)
+	}
+	end := ""
+	if prefix := literalPrefix(pattern); prefix != "" {
+		if start < prefix {
+			start = prefix
+		}
+		end = prefixEnd(prefix)
+	}
+	keys := m.Scan(start, end, count+1)
+	next := "0"
+	if len(keys) > count {
+		next = hex.EncodeToString([]byte(keys[count]))
+		keys = keys[:count]
+	}
+	matched := keys[:0]
+	for _, key := range keys {
+		if match(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+	return matched, next, nil
+}
+
+// SCAN <cursor> [MATCH <pattern>] [COUNT <n>]
+func (ms *MapServer) executeScan(parts []string) (string, error) {
+	bad := errors.New("KO=Bad command, format: SCAN <cursor> [MATCH <pattern>] [COUNT <n>]")
+	if len(parts) < 2 || len(parts)%2 != 0 {
+		return "", bad
+	}
+	pattern, count := "*", scanCount
+	for i := 2; i < len(parts); i += 2 {
+		switch strings.ToLower(parts[i]) {
+		case "match":
+			pattern = parts[i+1]
+		case "count":
+			n, err := strconv.Atoi(parts[i+1])
+			if err != nil || n <= 0 {
+				return "", errors.New("KO=Bad command, COUNT expects a positive number")
+			}
+			count = n
+		default:
+			return "", bad
+		}
+	}
+	keys, next, err := ms.m.scanPage(parts[1], pattern, count)
+	if err != nil {
+		return "", errors.New("KO=" + err.Error())
+	}
+	return "OK=" + strings.Join(append([]string{next}, keys...), " "), nil
+}
+
+// ?prefix=<prefix>&cursor=<cursor>&limit=<n>, answering with the keys and
+// the cursor of the next page, empty after the last one
+func (hs *HTTPMapServer) keysHandler(w http.ResponseWriter, r *http.Request) {
+	rs := make(map[string]interface{})
+	w.Header().Add("Content-Type", "application/json")
+	qs := r.URL.Query()
+	log.Printf("info: serving GET keys %v\n", qs)
+	limit := keysLimit
+	var err error
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		err = errors.New("Bad method: only GET accepted")
+	} else if qs.Get("limit") != "" {
+		limit, err = strconv.Atoi(qs.Get("limit"))
+		if err != nil || limit <= 0 || limit > keysMaxLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			err = fmt.Errorf("Bad limit: a number in [1, %d] expected", keysMaxLimit)
+		}
+	}
+	var keys []string
+	var next string
+	if err == nil {
+		keys, next, err = hs.m.scanPage(qs.Get("cursor"), literalPattern(qs.Get("prefix"))+"*", limit)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+	if err != nil {
+		rs["outcome"] = "KO"
+		rs["error"] = err.Error()
+	} else {
+		if next == "0" {
+			next = ""
+		}
+		if keys == nil {
+			keys = []string{}
+		}
+		rs["outcome"] = "OK"
+		rs["keys"] = keys
+		rs["cursor"] = next
+	}
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
+
+// literalPattern escapes the special characters of s, so that it matches
+// itself only as a glob-style pattern.
+func literalPattern(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte("*?[\\", s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,109 @@
+package dmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMapScan(t *testing.T) {
+	for _, m := range []*Map{NewMap(WithShards(4)), NewMap(WithShards(4), WithOrderedIndex())} {
+		for i := 0; i < 100; i++ {
+			m.Put(fmt.Sprintf("key%02d", i), []byte("value"))
+		}
+		m.Put("other", []byte("value"))
+		m.PutWithTTL("key100", []byte("value"), time.Nanosecond)
+		m.Delete("key50")
+		keys := m.Scan("key10", "key20", 0)
+		if len(keys) != 10 || keys[0] != "key10" || keys[9] != "key19" {
+			t.Logf("unexpected scan: %v\n", keys)
+			t.Fail()
+		}
+		keys = m.Scan("key45", "", 10)
+		if len(keys) != 10 || keys[4] != "key49" || keys[5] != "key51" {
+			t.Logf("unexpected scan: %v\n", keys)
+			t.Fail()
+		}
+		if keys = m.Keys("key"); len(keys) != 99 {
+			t.Logf("unexpected keys: %d\n", len(keys))
+			t.Fail()
+		}
+		if keys = m.Keys(""); len(keys) != 100 || keys[99] != "other" {
+			t.Logf("unexpected keys: %d\n", len(keys))
+			t.Fail()
+		}
+		m.Clear()
+		if keys = m.Keys(""); len(keys) != 0 {
+			t.Logf("unexpected keys after clear: %d\n", len(keys))
+			t.Fail()
+		}
+	}
+}
+
+func TestMapServerScan(t *testing.T) {
+	m := NewMap(WithOrderedIndex())
+	for i := 0; i < 25; i++ {
+		m.Put(fmt.Sprintf("user:%02d", i), []byte("value"))
+		m.Put(fmt.Sprintf("item:%02d", i), []byte("value"))
+	}
+	ms := &MapServer{m: m}
+	var keys []string
+	cursor := "0"
+	for {
+		res, err := ms.execute([]byte("SCAN " + cursor + " MATCH user:1* COUNT 4\r\n"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s\n", err.Error())
+		}
+		parts := strings.Split(strings.TrimPrefix(res, "OK="), " ")
+		cursor = parts[0]
+		keys = append(keys, parts[1:]...)
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(keys) != 10 || keys[0] != "user:10" || keys[9] != "user:19" {
+		t.Logf("unexpected keys: %v\n", keys)
+		t.Fail()
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	hs, err := NewHTTPMapServer("localhost", 8083, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the HTTP server: %s\n", err.Error())
+	}
+	go hs.Serve()
+	defer hs.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	keys = nil
+	cursor = ""
+	pages := 0
+	for {
+		res, err := http.Get("http://localhost:8083/api/v1/map/keys?prefix=item:&limit=10&cursor=" + cursor)
+		if err != nil {
+			t.Fatalf("error: unable to list the keys: %s\n", err.Error())
+		}
+		var page struct {
+			Keys   []string `json:"keys"`
+			Cursor string   `json:"cursor"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("error: unable to decode: %s\n", err.Error())
+		}
+		keys = append(keys, page.Keys...)
+		pages++
+		if page.Cursor == "" {
+			break
+		}
+		cursor = page.Cursor
+	}
+	if len(keys) != 25 || pages != 3 || keys[0] != "item:00" || keys[24] != "item:24" {
+		t.Logf("unexpected keys: %d in %d pages\n", len(keys), pages)
+		t.Fail()
+	}
+}
@@ -1,14 +1,19 @@
 package dmap
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Server interface {
@@ -17,41 +22,259 @@ type Server interface {
 }
 
 type MapServer struct {
-	wg   *sync.WaitGroup
-	m    *Map
-	ack  bool
-	up   bool
-	host string
-	port int
+	wg       *sync.WaitGroup
+	m        *Map
+	ack      bool
+	up       bool
+	host     string
+	port     int
+	snap     *Snapshotter
+	ps       *Broker
+	ns       *Namespaces
+	selected string // namespace selected, until created
+	repl     *Replication
+	raft     *Raft
+	cluster  *Cluster
+	asking   bool
+}
+
+// SetSnapshotter enables SAVE and BGSAVE, writing through the Snapshotter.
+func (ms *MapServer) SetSnapshotter(s *Snapshotter) {
+	ms.snap = s
 }
 
 func (ms *MapServer) execute(buf []byte) (string, error) {
-	line := string(buf[:]) // TODO: termination character
-	line = strings.Replace(line, "\r\n", "", 1)
+	line := strings.TrimRight(string(buf[:]), "\r\n")
 	parts := strings.Split(line, " ")
 	command := strings.ToLower(parts[0])
+	if ms.readOnly(command) {
+		return "", errors.New("KO=" + ErrReadOnly.Error())
+	}
+	err := ms.resolve(writeCommands[command])
+	if err != nil {
+		return "", errors.New("KO=" + err.Error())
+	}
+	if command == "asking" && len(parts) == 1 {
+		ms.asking = true
+		return "OK=ASKING", nil
+	}
+	done, err := ms.moved(commandKeys(command, parts))
+	if err != nil {
+		return "", errors.New("KO=" + err.Error())
+	}
+	defer done()
+	if ms.consensus(command) {
+		return ms.executeRaft(command, parts)
+	}
 	switch command {
 	case "put":
+		if len(parts) == 5 && strings.ToLower(parts[3]) == "ex" {
+			seconds, err := strconv.Atoi(parts[4])
+			if err != nil || seconds <= 0 {
+				return "", errors.New("KO=Bad command, EX expects a positive number of seconds")
+			}
+			err = ms.m.PutWithTTL(parts[1], []byte(parts[2]), time.Duration(seconds)*time.Second)
+			if err != nil {
+				return "", errors.New("KO=" + err.Error())
+			}
+			return fmt.Sprintf("OK=%d", len(parts[2])), nil
+		}
 		if len(parts) != 3 {
-			return "", errors.New("KO=Bad command, format: PUT <key> <value>")
+			return "", errors.New("KO=Bad command, format: PUT <key> <value> [EX <seconds>]")
+		}
+		err := ms.m.Put(parts[1], []byte(parts[2]))
+		if err != nil {
+			return "", errors.New("KO=" + err.Error())
 		}
-		ms.m.Put(parts[1], []byte(parts[2]))
 		return fmt.Sprintf("OK=%d", len(parts[2])), nil
+	case "putnx", "putxx":
+		if len(parts) != 3 {
+			return "", fmt.Errorf("KO=Bad command, format: %s <key> <value>", strings.ToUpper(command))
+		}
+		var stored bool
+		var err error
+		if command == "putnx" {
+			stored, err = ms.m.PutIfAbsent(parts[1], []byte(parts[2]))
+		} else {
+			stored, err = ms.m.Replace(parts[1], []byte(parts[2]))
+		}
+		if err != nil {
+			return "", errors.New("KO=" + err.Error())
+		}
+		if stored {
+			return "OK=1", nil
+		}
+		return "OK=0", nil
+	case "cas":
+		if len(parts) != 4 {
+			return "", errors.New("KO=Bad command, format: CAS <key> <old> <new>")
+		}
+		swapped, err := ms.m.CompareAndSwap(parts[1], []byte(parts[2]), []byte(parts[3]))
+		if err != nil {
+			return "", errors.New("KO=" + err.Error())
+		}
+		if swapped {
+			return "OK=1", nil
+		}
+		return "OK=0", nil
+	case "cad":
+		if len(parts) != 3 {
+			return "", errors.New("KO=Bad command, format: CAD <key> <old>")
+		}
+		if ms.m.CompareAndDelete(parts[1], []byte(parts[2])) {
+			return "OK=1", nil
+		}
+		return "OK=0", nil
+	case "incr", "decr", "incrby", "decrby":
+		delta, err := textDelta(command, parts)
+		if err != nil {
+			return "", errors.New("KO=" + err.Error())
+		}
+		n, err := ms.m.Incr(parts[1], delta)
+		if err != nil {
+			return "", errors.New("KO=" + err.Error())
+		}
+		return fmt.Sprintf("OK=%d", n), nil
 	case "get":
+		if len(parts) == 4 && strings.ToLower(parts[2]) == "at" {
+			version, err := strconv.ParseUint(parts[3], 10, 64)
+			if err != nil {
+				return "", errors.New("KO=Bad command, AT expects a version")
+			}
+			value, ok := ms.m.GetAt(parts[1], version)
+			if !ok {
+				return "KO=null", nil
+			}
+			return fmt.Sprintf("OK=%s", string(value)), nil
+		}
 		if len(parts) != 2 {
-			return "", errors.New("KO=Bad command, format: GET <key>")
+			return "", errors.New("KO=Bad command, format: GET <key> [AT <version>]")
 		}
 		value := ms.m.Get(parts[1])
 		if value != nil {
 			return fmt.Sprintf("OK=%s", string(value)), nil
 		}
+		if ms.m.typedKey(parts[1]) {
+			return "", errors.New("KO=" + ErrWrongType.Error())
+		}
 		return "KO=null", nil
+	case "getv":
+		if len(parts) != 2 {
+			return "", errors.New("KO=Bad command, format: GETV <key>")
+		}
+		value, meta, ok := ms.m.GetWithMeta(parts[1])
+		if !ok {
+			return "KO=null", nil
+		}
+		if value == nil && ms.m.typedKey(parts[1]) {
+			return "", errors.New("KO=" + ErrWrongType.Error())
+		}
+		return fmt.Sprintf("OK=%d %d %s", meta.Version, meta.Modified.UnixNano()/int64(time.Millisecond), string(value)), nil
+	case "select":
+		if len(parts) != 2 {
+			return "", errors.New("KO=Bad command, format: SELECT <namespace>")
+		}
+		err := ms.selectNamespace(parts[1])
+		if err != nil {
+			return "", errors.New("KO=" + err.Error())
+		}
+		return "OK=" + parts[1], nil
 	case "del":
 		if len(parts) != 2 {
 			return "", errors.New("KO=Bad command, format: DEL <key>")
 		}
 		ms.m.Delete(parts[1])
 		return fmt.Sprintf("OK=%s", parts[1]), nil
+	case "mget":
+		if len(parts) < 2 {
+			return "", errors.New("KO=Bad command, format: MGET <key> [<key> ...]")
+		}
+		values := ms.m.MGet(parts[1:]...)
+		lines := make([]string, 0, len(values)+1)
+		lines = append(lines, fmt.Sprintf("OK=%d", len(values)))
+		for _, value := range values {
+			if value == nil {
+				lines = append(lines, "KO=null")
+			} else {
+				lines = append(lines, "OK="+string(value))
+			}
+		}
+		return strings.Join(lines, "\r\n"), nil
+	case "mset":
+		if len(parts) < 3 || len(parts)%2 != 1 {
+			return "", errors.New("KO=Bad command, format: MSET <key> <value> [<key> <value> ...]")
+		}
+		values := make(map[string][]byte, len(parts)/2)
+		for i := 1; i < len(parts); i += 2 {
+			values[parts[i]] = []byte(parts[i+1])
+		}
+		err := ms.m.MPut(values)
+		if err != nil {
+			return "", errors.New("KO=" + err.Error())
+		}
+		return fmt.Sprintf("OK=%d", len(parts)/2), nil
+	case "mdel":
+		if len(parts) < 2 {
+			return "", errors.New("KO=Bad command, format: MDEL <key> [<key> ...]")
+		}
+		return fmt.Sprintf("OK=%d", ms.m.MDelete(parts[1:]...)), nil
+	case "scan":
+		return ms.executeScan(parts)
+	case "keys":
+		return ms.executeKeys(parts)
+	case "replicaof":
+		return ms.executeReplicaOf(parts)
+	case "role":
+		return ms.executeRole(parts)
+	case "sync":
+		if ms.repl == nil {
+			return "", errors.New("KO=" + errReplicationOff.Error())
+		}
+		return "", errors.New("KO=Bad command, SYNC is supported on TCP connections only")
+	case "publish":
+		if len(parts) < 3 {
+			return "", errors.New("KO=Bad command, format: PUBLISH <channel> <message>")
+		}
+		if ms.ps == nil {
+			return "", errors.New("KO=" + errPubSubDisabled.Error())
+		}
+		message := strings.Join(parts[2:], " ")
+		return fmt.Sprintf("OK=%d", ms.ps.Publish(parts[1], []byte(message))), nil
+	case "subscribe", "psubscribe", "unsubscribe", "punsubscribe":
+		return "", fmt.Errorf("KO=Bad command, %s is supported on TCP connections only", strings.ToUpper(command))
+	case "watch", "unwatch":
+		return "", errors.New("KO=Bad command, WATCH <pattern> is supported on TCP connections only")
+	case "multi", "exec", "discard", "txwatch", "txunwatch":
+		return "", fmt.Errorf("KO=Bad command, %s is supported on TCP connections only", strings.ToUpper(command))
+	case "expire":
+		if len(parts) != 3 {
+			return "", errors.New("KO=Bad command, format: EXPIRE <key> <seconds>")
+		}
+		seconds, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return "", errors.New("KO=Bad command, EXPIRE expects a number of seconds")
+		}
+		if ms.m.Expire(parts[1], time.Duration(seconds)*time.Second) {
+			return "OK=1", nil
+		}
+		return "OK=0", nil
+	case "ttl":
+		if len(parts) != 2 {
+			return "", errors.New("KO=Bad command, format: TTL <key>")
+		}
+		ttl := ms.m.TTL(parts[1])
+		if ttl > 0 {
+			ttl = (ttl + time.Second - 1) / time.Second
+		}
+		return fmt.Sprintf("OK=%d", ttl), nil
+	case "persist":
+		if len(parts) != 2 {
+			return "", errors.New("KO=Bad command, format: PERSIST <key>")
+		}
+		if ms.m.Persist(parts[1]) {
+			return "OK=1", nil
+		}
+		return "OK=0", nil
 	case "size":
 		if len(parts) != 1 {
 			return "", errors.New("KO=Bad command, format: SIZE")
@@ -63,8 +286,36 @@ func (ms *MapServer) execute(buf []byte) (string, error) {
 		}
 		ms.m.Clear()
 		return fmt.Sprintf("OK=%d", ms.m.Size()), nil
+	case "save", "bgsave", "lastsave":
+		if len(parts) != 1 {
+			return "", fmt.Errorf("KO=Bad command, format: %s", strings.ToUpper(command))
+		}
+		if ms.snap == nil {
+			return "", errors.New("KO=Snapshots not enabled")
+		}
+		switch command {
+		case "save":
+			n, err := ms.snap.Save()
+			if err != nil {
+				return "", errors.New("KO=" + err.Error())
+			}
+			return fmt.Sprintf("OK=%d", n), nil
+		case "bgsave":
+			err := ms.snap.BgSave()
+			if err != nil {
+				return "", errors.New("KO=" + err.Error())
+			}
+			return "OK=Background saving started", nil
+		}
+		return fmt.Sprintf("OK=%d", ms.snap.LastSave().Unix()), nil
 	default:
-		return "", errors.New("KO=Unrecognized command: <PUT|GET|SIZE|DEL|CLEAR> [<key> [value]]")
+		if r, ok, err := ms.executeTyped(stringArgs(parts)); ok {
+			if err != nil {
+				return "", errors.New("KO=" + err.Error())
+			}
+			return r.text(), nil
+		}
+		return "", errors.New("KO=Unrecognized command: <PUT|PUTNX|PUTXX|CAS|CAD|INCR|DECR|INCRBY|DECRBY|MULTI|EXEC|DISCARD|TXWATCH|TXUNWATCH|GET|GETV|SELECT|TYPE|LPUSH|RPUSH|LPOP|RPOP|LRANGE|LLEN|SADD|SREM|SMEMBERS|SISMEMBER|HSET|HGET|HDEL|HGETALL|SIZE|DEL|MGET|MSET|MDEL|SCAN|KEYS|REPLICAOF|ROLE|SYNC|WATCH|PUBLISH|SUBSCRIBE|PSUBSCRIBE|CLEAR|EXPIRE|TTL|PERSIST|SAVE|BGSAVE|LASTSAVE> [<key> [value]]")
 	}
 }
 
@@ -76,9 +327,17 @@ func (ms *MapServer) rewind(buf []byte) {
 
 type UDPMapServer struct {
 	MapServer
-	conn *net.UDPConn
+	conn     *net.UDPConn
+	sl       sync.Mutex
+	sessions map[string]*udpSession
+	idle     time.Duration
+	swept    time.Time
 }
 
+// udpSessionIdle is the time after which a client address idle is forgotten,
+// along with the namespace it selected.
+const udpSessionIdle = 10 * time.Minute
+
 func NewUDPMapServer(host string, port int, wg *sync.WaitGroup, m *Map, ack bool) (*UDPMapServer, error) {
 	addr := net.UDPAddr{
 		Port: port,
@@ -89,7 +348,9 @@ func NewUDPMapServer(host string, port int, wg *sync.WaitGroup, m *Map, ack bool
 		return nil, err
 	}
 	us := UDPMapServer{
-		conn: conn,
+		conn:     conn,
+		sessions: make(map[string]*udpSession),
+		idle:     udpSessionIdle,
 		MapServer: MapServer{
 			wg:   wg,
 			m:    m,
@@ -106,20 +367,31 @@ func (us *UDPMapServer) Serve() {
 	log.Printf("info: bootstrapping the UDP Server loop: %s:%d\n", us.host, us.port)
 	defer us.wg.Done()
 	defer us.conn.Close()
-	var buf [1024]byte
+	var buf [65535]byte
 	for us.up {
 		l, r, err := us.conn.ReadFromUDP(buf[:])
 		if err != nil {
 			continue
 		}
-		log.Printf("info: received %d: %s from: %v", l, string(buf[:]), r)
-		outcome, err := us.execute(buf[:l])
+		s, done := us.session(r)
+		if l > 0 && buf[0] == frameMagic {
+			req, err := parseFrame(buf[:l])
+			if err != nil {
+				log.Printf("error: malformed frame from %v: %s\n", r, err.Error())
+				continue
+			}
+			us.conn.WriteToUDP(s.executeFrame(req).encode(nil), r)
+			done()
+			continue
+		}
+		log.Printf("info: received %d: %s from: %v", l, string(buf[:l]), r)
+		outcome, err := s.execute(buf[:l])
 		if err != nil {
-			us.conn.WriteToUDP([]byte(err.Error()), r)
-		} else {
-			us.conn.WriteToUDP([]byte(outcome), r)
+			outcome = err.Error()
 		}
-		us.rewind(buf[:])
+		done()
+		us.conn.WriteToUDP([]byte(outcome+"\r\n"), r)
+		us.rewind(buf[:l])
 	}
 	log.Println("info: shutting down the UDP Server...")
 }
@@ -167,38 +439,153 @@ func (ts *TCPMapServer) Serve() {
 			log.Printf("error: accepting connection: %s", err.Error())
 			continue
 		}
-		go func(conn *net.TCPConn, m *Map, ack bool) {
-			var buf [65535]byte
-			for {
-				l, err := conn.Read(buf[:])
-				if err != nil {
-					log.Printf("error: not able to read: %s\n", err.Error())
+		go ts.serve(conn)
+	}
+}
+
+// serve speaks the binary protocol if the connection starts with the frame
+// magic byte, RESP if it starts with an array, the text one otherwise: the
+// connection is served by a copy of the server, switched by SELECT.
+func (ts *TCPMapServer) serve(conn *net.TCPConn) {
+	defer conn.Close()
+	cs := *ts
+	ts = &cs
+	r := bufio.NewReaderSize(conn, 65536)
+	b, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	switch b[0] {
+	case frameMagic:
+		ts.serveFrames(conn, r)
+	case '*':
+		ts.serveRESP(conn, r)
+	default:
+		ts.serveLines(conn, r)
+	}
+}
+
+// serveLines executes newline terminated commands, answering with newline
+// terminated responses: responses are flushed as soon as no more command is
+// buffered, so that pipelined commands are answered with few writes.
+func (ts *TCPMapServer) serveLines(conn *net.TCPConn, r *bufio.Reader) {
+	w := bufio.NewWriterSize(conn, 65536)
+	defer w.Flush()
+	var tc txConn
+	lines := false
+	for {
+		line, err := readLine(conn, r, !lines)
+		lines = lines || bytes.HasSuffix(line, []byte("\n"))
+		if err == bufio.ErrBufferFull {
+			w.WriteString("KO=Line too long\r\n")
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("error: not able to read: %s\n", err.Error())
+			}
+			return
+		}
+		log.Printf("info: received %d: %s", len(line), string(line))
+		if ts.checkExit(line) {
+			return
+		}
+		if parts := strings.Fields(string(line)); len(parts) > 0 && !tc.multi {
+			switch command := strings.ToLower(parts[0]); {
+			case command == "watch" && len(parts) == 2:
+				if w.Flush() != nil || !ts.watch(r, w, parts[1]) {
+					return
+				}
+				continue
+			case command == "sync" && len(parts) == 1 && ts.repl != nil:
+				ts.repl.serve(conn, r, w)
+				return
+			case command == "subscribe" || command == "psubscribe":
+				if !ts.subscribe(r, w, parts) {
 					return
 				}
-				log.Printf("info: received %d: %s", l, string(buf[:]))
-				if ts.checkExit(buf[:l]) {
-					conn.Close()
+				if w.Flush() != nil {
 					return
 				}
-				outcome, err := ts.execute(buf[:l])
+				continue
+			}
+		}
+		if len(strings.TrimSpace(string(line))) != 0 {
+			outcome, ok := ts.executeTx(&tc, line)
+			if !ok {
+				outcome, err = ts.execute(line)
 				if err != nil {
-					conn.Write([]byte(err.Error()))
-				} else {
-					conn.Write([]byte(outcome))
+					outcome = err.Error()
 				}
+			}
+			w.WriteString(outcome)
+			_, err = w.WriteString("\r\n")
+			if err != nil {
+				log.Printf("error: not able to write: %s\n", err.Error())
+				return
+			}
+		}
+		if r.Buffered() == 0 {
+			err = w.Flush()
+			if err != nil {
+				log.Printf("error: not able to write: %s\n", err.Error())
+				return
+			}
+		}
+	}
+}
+
+// lineIdle is how long a command with no newline waits for the rest of it,
+// before being taken as it is.
+const lineIdle = 50 * time.Millisecond
 
-				ts.rewind(buf[:])
+// readLine reads a newline terminated command or, if idle is set, for the
+// clients writing a command at a time with no newline, the bytes received
+// before the connection goes idle for lineIdle, or is closed: a connection
+// having sent a newline is read a line at a time, however slow.
+func readLine(conn *net.TCPConn, r *bufio.Reader, idle bool) ([]byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	b, _ = r.Peek(r.Buffered())
+	if !idle || bytes.IndexByte(b, '\n') >= 0 {
+		return r.ReadSlice('\n')
+	}
+	conn.SetReadDeadline(time.Now().Add(lineIdle))
+	line, err := r.ReadSlice('\n')
+	conn.SetReadDeadline(time.Time{})
+	if ne, ok := err.(net.Error); ok && ne.Timeout() || err == io.EOF {
+		return line, nil
+	}
+	return line, err
+}
+
+func (ts *TCPMapServer) serveFrames(conn *net.TCPConn, r *bufio.Reader) {
+	w := bufio.NewWriterSize(conn, 65536)
+	var buf []byte
+	for {
+		req, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("error: not able to read the frame: %s\n", err.Error())
 			}
-		}(conn, ts.m, ts.ack)
+			return
+		}
+		buf = ts.executeFrame(req).encode(buf[:0])
+		_, err = w.Write(buf)
+		if err == nil && r.Buffered() == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Printf("error: not able to write: %s\n", err.Error())
+			return
+		}
 	}
 }
 
 func (ts *TCPMapServer) checkExit(buf []byte) bool {
-	command := string(buf[:])
-	if strings.Contains(strings.ToLower(command), "close") {
-		return true
-	}
-	return false
+	return strings.ToLower(strings.TrimSpace(string(buf))) == "close"
 }
 
 func (ts *TCPMapServer) Shutdown() {
@@ -214,7 +601,8 @@ type HTTPMapServer struct {
 func NewHTTPMapServer(host string, port int, wg *sync.WaitGroup, m *Map, ack bool) (*HTTPMapServer, error) {
 	addr := fmt.Sprintf("%s:%d", host, port)
 	s := http.Server{
-		Addr: addr,
+		Addr:    addr,
+		Handler: http.NewServeMux(),
 	}
 	hs := HTTPMapServer{
 		s: &s,
@@ -232,8 +620,35 @@ func NewHTTPMapServer(host string, port int, wg *sync.WaitGroup, m *Map, ack boo
 func (hs *HTTPMapServer) Serve() {
 	log.Printf("info: bootstrapping the HTTP Server loop: %s:%d\n", hs.host, hs.port)
 	defer hs.wg.Done()
-	http.HandleFunc("/api/v1/map", hs.handler)
-	http.ListenAndServe(fmt.Sprintf("%s:%d", hs.host, hs.port), nil)
+	mux := hs.s.Handler.(*http.ServeMux)
+	mux.HandleFunc("/api/v1/map", hs.writable(hs.owned(hs.handler)))
+	mux.HandleFunc("/api/v1/map/batch", hs.writable(hs.local(hs.owned(hs.batchHandler))))
+	mux.HandleFunc("/api/v1/tx", hs.writable(hs.local(hs.owned(hs.txHandler))))
+	mux.HandleFunc("/api/v1/map/watch", hs.watchHandler)
+	mux.HandleFunc("/api/v1/map/keys", hs.keysHandler)
+	mux.HandleFunc("/api/v1/map/entries", hs.entriesHandler)
+	mux.HandleFunc("/api/v1/map/type", hs.owned(hs.typeHandler))
+	mux.HandleFunc("/api/v1/list", hs.writable(hs.local(hs.owned(hs.listHandler))))
+	mux.HandleFunc("/api/v1/set", hs.writable(hs.local(hs.owned(hs.setHandler))))
+	mux.HandleFunc("/api/v1/hash", hs.writable(hs.local(hs.owned(hs.hashHandler))))
+	mux.HandleFunc("/api/v1/pubsub/publish", hs.publishHandler)
+	mux.HandleFunc("/api/v1/pubsub/subscribe", hs.subscribeHandler)
+	mux.HandleFunc("/api/v1/admin/save", hs.saveHandler)
+	mux.HandleFunc("/api/v1/admin/replication", hs.replicationHandler)
+	mux.HandleFunc("/api/v1/admin/raft", hs.raftHandler)
+	mux.HandleFunc("/api/v1/admin/cluster", hs.clusterHandler)
+	mux.HandleFunc("/api/v1/admin/cluster/", hs.migrationHandler)
+	mux.HandleFunc("/api/v1/ns", hs.namespaceHandler)
+	mux.HandleFunc("/api/v1/ns/", hs.namespaceHandler)
+	err := hs.s.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("error: serving HTTP: %s\n", err.Error())
+	}
+	log.Println("info: shutting down the HTTP Server...")
+}
+
+func (hs *HTTPMapServer) Shutdown() {
+	hs.s.Close()
 }
 
 func (hs *HTTPMapServer) handler(w http.ResponseWriter, r *http.Request) {
@@ -252,16 +667,55 @@ func (hs *HTTPMapServer) handler(w http.ResponseWriter, r *http.Request) {
 		hs.getHandler(w, r, res)
 	case "DELETE":
 		hs.deleteHandler(w, r, res)
+	case "PATCH":
+		hs.patchHandler(w, r, res)
 	default:
 		w.Header().Add("Status-Code", "400")
 		w.Header().Add("Reason-Phrase", "Unrecognized service request")
-		res["error"] = "Bad method: only POST, GET, DELETE accepted"
+		res["error"] = "Bad method: only POST, GET, DELETE, PATCH accepted"
 		buf, _ := json.Marshal(res)
 		w.Write(buf[:])
 		return
 	}
 }
 
+// POST, ?background=true to save in background
+func (hs *HTTPMapServer) saveHandler(w http.ResponseWriter, r *http.Request) {
+	rs := make(map[string]interface{})
+	w.Header().Add("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		rs["outcome"] = "KO"
+		rs["error"] = "Bad method: only POST accepted"
+	} else if hs.snap == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		rs["outcome"] = "KO"
+		rs["error"] = "Snapshots not enabled"
+	} else if r.URL.Query().Get("background") == "true" {
+		err := hs.snap.BgSave()
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			rs["outcome"] = "KO"
+			rs["error"] = err.Error()
+		} else {
+			rs["outcome"] = "OK"
+		}
+	} else {
+		n, err := hs.snap.Save()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			rs["outcome"] = "KO"
+			rs["error"] = err.Error()
+		} else {
+			rs["outcome"] = "OK"
+			rs["saved"] = n
+			rs["lastsave"] = hs.snap.LastSave().Unix()
+		}
+	}
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
+
 // ?key=* (size), or ?key=<key>
 func (hs *HTTPMapServer) getHandler(w http.ResponseWriter, r *http.Request, rs map[string]interface{}) {
 	qs := r.URL.Query()
@@ -270,14 +724,35 @@ func (hs *HTTPMapServer) getHandler(w http.ResponseWriter, r *http.Request, rs m
 	if qs.Get("key") == "*" {
 		rs["outcome"] = "OK"
 		rs["size"] = hs.m.Size()
+	} else if qs.Get("key") != "" && qs.Get("version") != "" {
+		version, err := strconv.ParseUint(qs.Get("version"), 10, 64)
+		value, ok := hs.m.GetAt(qs.Get("key"), version)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			rs["outcome"] = "KO"
+			rs["error"] = "Unrecognized version: " + qs.Get("version")
+		} else if !ok {
+			rs["outcome"] = "OK"
+			rs["value"] = "null"
+		} else {
+			rs["outcome"] = "OK"
+			rs["value"] = string(value)
+		}
 	} else if qs.Get("key") != "" {
-		value := hs.m.Get(qs.Get("key"))
-		if value == nil {
+		value, meta, ok := hs.m.GetWithMeta(qs.Get("key"))
+		if value == nil && hs.m.typedKey(qs.Get("key")) {
+			w.WriteHeader(http.StatusConflict)
+			rs["outcome"] = "KO"
+			rs["error"] = ErrWrongType.Error()
+		} else if !ok {
 			rs["outcome"] = "OK"
 			rs["value"] = "null"
 		} else {
+			w.Header().Set("ETag", versionTag(meta.Version))
+			w.Header().Set("Last-Modified", meta.Modified.UTC().Format(http.TimeFormat))
 			rs["outcome"] = "OK"
 			rs["value"] = string(value)
+			rs["version"] = meta.Version
 		}
 
 	} else {
@@ -301,35 +776,154 @@ func (hs *HTTPMapServer) postHandler(w http.ResponseWriter, r *http.Request, rs
 		return
 	}
 	log.Printf("info: serving POST  %v\n", req)
-	key := req["key"].(string)
-	value := []byte(req["value"].(string))
-	if req["key"] == nil || req["value"] == nil {
+	key, kok := req["key"].(string)
+	v, vok := req["value"].(string)
+	if !kok || !vok {
 		rs["outcome"] = "KO"
 		rs["error"] = "Unrecognized JSON: no key/value pair"
 		buf, _ := json.Marshal(rs)
 		w.Write(buf[:])
 		return
 	}
-	hs.m.Put(key, value)
+	value := []byte(v)
+	var ttl time.Duration
+	if req["ttl"] != nil {
+		seconds, ok := req["ttl"].(float64)
+		if !ok || seconds <= 0 {
+			rs["outcome"] = "KO"
+			rs["error"] = "Unrecognized JSON: ttl must be a positive number of seconds"
+			buf, _ := json.Marshal(rs)
+			w.Write(buf[:])
+			return
+		}
+		ttl = time.Duration(seconds * float64(time.Second))
+	}
+	if cond := precondition(r); cond != nil && hs.consensus("put") {
+		hs.typedError(w, http.StatusNotImplemented, errRaftUnsupported)
+		return
+	} else if hs.consensus("put") {
+		if ttl > 0 {
+			err = hs.raft.PutWithTTL(key, value, ttl)
+		} else {
+			err = hs.raft.Put(key, value)
+		}
+		if err != nil {
+			hs.raftError(w, rs, err)
+			return
+		}
+	} else if cond != nil {
+		it := &item{v: value}
+		if ttl > 0 {
+			it.x = time.Now().Add(ttl).UnixNano()
+		}
+		ok, err := hs.m.swap(key, cond, it)
+		if err != nil {
+			hs.outOfMemory(w, rs, err)
+			return
+		}
+		if !ok {
+			hs.preconditionFailed(w, rs)
+			return
+		}
+	} else if ttl > 0 {
+		err = hs.m.PutWithTTL(key, value, ttl)
+	} else {
+		err = hs.m.Put(key, value)
+	}
+	if err != nil {
+		hs.outOfMemory(w, rs, err)
+		return
+	}
 	rs["outcome"] = "OK"
 	rs["wrote"] = len(value)
 	buf, _ := json.Marshal(rs)
 	w.Write(buf[:])
 }
 
+// body: { "key": "<key>", "delta": <delta> }, incrementing the value of the
+// key by delta (1 if missing)
+func (hs *HTTPMapServer) patchHandler(w http.ResponseWriter, r *http.Request, rs map[string]interface{}) {
+	if hs.consensus("incr") {
+		hs.typedError(w, http.StatusNotImplemented, errRaftUnsupported)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	d := json.NewDecoder(r.Body)
+	d.UseNumber()
+	defer r.Body.Close()
+	var req map[string]interface{}
+	err := d.Decode(&req)
+	if err != nil {
+		log.Printf("error: not able to read: %s\n", err.Error())
+		return
+	}
+	log.Printf("info: serving PATCH %v\n", req)
+	key, ok := req["key"].(string)
+	delta := int64(1)
+	if n, isNumber := req["delta"].(json.Number); isNumber {
+		delta, err = n.Int64()
+	} else if req["delta"] != nil {
+		err = ErrNotInteger
+	}
+	if !ok || err != nil {
+		rs["outcome"] = "KO"
+		rs["error"] = "Unrecognized JSON: no key, or delta not an integer"
+		buf, _ := json.Marshal(rs)
+		w.Write(buf[:])
+		return
+	}
+	n, err := hs.m.Incr(key, delta)
+	if err == ErrOutOfMemory {
+		hs.outOfMemory(w, rs, err)
+		return
+	}
+	if err != nil {
+		rs["outcome"] = "KO"
+		rs["error"] = err.Error()
+	} else {
+		rs["outcome"] = "OK"
+		rs["value"] = n
+	}
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
+
 // ?key=* (delete all), or ?key=<key>
 func (hs *HTTPMapServer) deleteHandler(w http.ResponseWriter, r *http.Request, rs map[string]interface{}) {
 	qs := r.URL.Query()
 	log.Printf("info: serving DELETE %v\n", qs)
 	w.Header().Add("Content-Type", "application/json")
+	if hs.consensus("del") && (qs.Get("key") != "" && precondition(r) != nil) {
+		hs.typedError(w, http.StatusNotImplemented, errRaftUnsupported)
+		return
+	}
 	if qs.Get("key") == "*" {
-		hs.m.Clear()
+		if hs.consensus("clear") {
+			if err := hs.raft.Clear(); err != nil {
+				hs.raftError(w, rs, err)
+				return
+			}
+		} else {
+			hs.m.Clear()
+		}
 		rs["outcome"] = "OK"
 		rs["size"] = hs.m.Size()
 	} else if qs.Get("key") != "" {
+		if hs.consensus("del") {
+			if _, err := hs.raft.Delete(qs.Get("key")); err != nil {
+				hs.raftError(w, rs, err)
+				return
+			}
+		} else if cond := precondition(r); cond != nil {
+			if ok, _ := hs.m.swap(qs.Get("key"), cond, nil); !ok {
+				hs.preconditionFailed(w, rs)
+				return
+			}
+		} else {
+			hs.m.Delete(qs.Get("key"))
+		}
 		rs["outcome"] = "OK"
 		rs["key"] = qs.Get("key")
-		hs.m.Delete(qs.Get("key"))
 	} else {
 		w.Header().Add("Status-Code", "400")
 		w.Header().Add("Reason-Phrase", "Unrecognized service request")
@@ -339,3 +933,128 @@ func (hs *HTTPMapServer) deleteHandler(w http.ResponseWriter, r *http.Request, r
 	buf, _ := json.Marshal(rs)
 	w.Write(buf[:])
 }
+
+// POST, body: { "get": [<key>, ...] }, { "put": { <key>: <value>, ... } } or
+// { "delete": [<key>, ...] }, each applied atomically
+func (hs *HTTPMapServer) batchHandler(w http.ResponseWriter, r *http.Request) {
+	rs := make(map[string]interface{})
+	w.Header().Add("Content-Type", "application/json")
+	var req struct {
+		Get    []string          `json:"get"`
+		Put    map[string]string `json:"put"`
+		Delete []string          `json:"delete"`
+	}
+	var err error
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		err = errors.New("Bad method: only POST accepted")
+	} else if r.Header.Get("Accept") != "application/json" ||
+		r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		err = errors.New("Bad content type: only JSON supported")
+	} else if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	} else if batchOps(req.Get != nil, req.Put != nil, req.Delete != nil) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		err = errors.New("Unrecognized JSON: exactly one of get, put and delete allowed")
+	}
+	if err != nil {
+		rs["outcome"] = "KO"
+		rs["error"] = err.Error()
+		buf, _ := json.Marshal(rs)
+		w.Write(buf[:])
+		return
+	}
+	log.Printf("info: serving POST batch %v\n", req)
+	switch {
+	case req.Get != nil:
+		values := make([]interface{}, len(req.Get))
+		for i, value := range hs.m.MGet(req.Get...) {
+			if value != nil {
+				values[i] = string(value)
+			}
+		}
+		rs["values"] = values
+	case req.Put != nil:
+		values := make(map[string][]byte, len(req.Put))
+		for key, value := range req.Put {
+			values[key] = []byte(value)
+		}
+		err := hs.m.MPut(values)
+		if err != nil {
+			hs.outOfMemory(w, rs, err)
+			return
+		}
+		rs["wrote"] = len(values)
+	default:
+		rs["deleted"] = hs.m.MDelete(req.Delete...)
+	}
+	rs["outcome"] = "OK"
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
+
+func batchOps(ops ...bool) int {
+	n := 0
+	for _, op := range ops {
+		if op {
+			n++
+		}
+	}
+	return n
+}
+
+func (hs *HTTPMapServer) outOfMemory(w http.ResponseWriter, rs map[string]interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInsufficientStorage)
+	rs["outcome"] = "KO"
+	rs["error"] = err.Error()
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
+
+func (hs *HTTPMapServer) preconditionFailed(w http.ResponseWriter, rs map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPreconditionFailed)
+	rs["outcome"] = "KO"
+	rs["error"] = "Precondition failed"
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
+
+// precondition turns If-Match and If-None-Match into a condition on the
+// actual item, nil if none of them is set: "*" matches any existing item.
+func precondition(r *http.Request) func(*item) bool {
+	if h := r.Header.Get("If-Match"); h != "" {
+		return func(it *item) bool {
+			return it != nil && matchETag(h, it)
+		}
+	}
+	if h := r.Header.Get("If-None-Match"); h != "" {
+		return func(it *item) bool {
+			return it == nil || !matchETag(h, it)
+		}
+	}
+	return nil
+}
+
+// matchETag matches the ETag of the version of the item, as returned by GET,
+// or the one of its value, which clients compute for compare and swap.
+func matchETag(header string, it *item) bool {
+	version, value := versionTag(it.n), etag(it.v)
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || t == version || t == value {
+			return true
+		}
+	}
+	return false
+}
+
+func versionTag(version uint64) string {
+	return fmt.Sprintf("\"v%d\"", version)
+}
+
+func etag(value []byte) string {
+	return fmt.Sprintf("\"%016x\"", XXH64(string(value)))
+}
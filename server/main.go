@@ -2,33 +2,178 @@ package main
 
 import (
 	"dmap"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 func main() {
-	m := dmap.NewMap()
+	aof := flag.String("aof", "", "append-only log file, persistence disabled if empty")
+	fsync := flag.String("fsync", "everysec", "append-only log fsync policy: always, everysec or no")
+	snapshot := flag.String("snapshot", "", "snapshot file, loaded on boot if the append-only log is disabled")
+	interval := flag.Duration("snapshot-interval", 0, "period between snapshots, disabled if zero")
+	maxmemory := flag.Int64("maxmemory", 0, "bytes taken by keys and values at most, unbounded if zero")
+	eviction := flag.String("eviction", "noeviction", "eviction policy: noeviction, lru, lfu, random or volatile-ttl")
+	namespaces := flag.Int("max-namespaces", 1, "namespaces at most, the default one included, unbounded if zero: other than 1, it excludes -aof, -snapshot, -replicaof and the replicas")
+	history := flag.Int("history", 0, "past values retained per key for reads at a version, none if zero")
+	replicaof := flag.String("replicaof", "", "host:port of the primary to replicate, none if empty")
+	raft := flag.String("raft", "", "host:port of the Raft transport, consensus disabled if empty")
+	peers := flag.String("raft-peers", "", "comma separated host:port of the Raft members bootstrapping the group, this node included: none to join it later")
+	raftDir := flag.String("raft-dir", "", "directory of the Raft state, recovered on restart: required along with -raft")
+	slots := flag.String("cluster-slots", "", "comma separated <start>-<end>@<tcp host:port>[/<http host:port>] owners of the hash slots, this node included: cluster disabled if empty")
+	udp := flag.Int("udp", 12345, "port of the UDP server")
+	tcp := flag.Int("tcp", 12346, "port of the TCP server")
+	web := flag.Int("http", 8080, "port of the HTTP server")
+	flag.Parse()
+	policy, err := dmap.ParseEviction(*eviction)
+	if err != nil {
+		log.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if *raft != "" && *raftDir == "" {
+		log.Printf("error: -raft needs -raft-dir, to recover the Raft state on restart\n")
+		os.Exit(1)
+	}
+	if *raft != "" && (*aof != "" || *snapshot != "" || *maxmemory > 0 || policy != dmap.EvictNone) {
+		log.Printf("error: -raft excludes -aof, -snapshot, -maxmemory and -eviction: the Raft log persists the map, and the writes have to apply alike on every member\n")
+		os.Exit(1)
+	}
+	if *namespaces != 1 && (*aof != "" || *snapshot != "" || *replicaof != "") {
+		log.Printf("error: -max-namespaces excludes -aof, -snapshot and -replicaof: only the default namespace is persisted and replicated\n")
+		os.Exit(1)
+	}
+	opts := []dmap.Option{dmap.WithMaxMemory(*maxmemory), dmap.WithEviction(policy), dmap.WithHistory(*history)}
+	m := dmap.NewMap(opts...)
+	var sn *dmap.Snapshotter
+	if *snapshot != "" {
+		sn = dmap.NewSnapshotter(*snapshot, m)
+		if *aof == "" {
+			err := sn.Load()
+			if err != nil {
+				log.Printf("error: unable to load the snapshot: %s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+		if *interval > 0 {
+			sn.Schedule(*interval)
+		}
+	}
+	var a *dmap.AOF
+	if *aof != "" {
+		policy, err := dmap.ParseFsync(*fsync)
+		if err != nil {
+			log.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		a, err = dmap.NewAOF(*aof, m, policy)
+		if err != nil {
+			log.Printf("error: unable to open the append-only log: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		if a != nil {
+			log.Println("info: closing the append-only log...")
+			a.Close()
+		}
+		if sn != nil {
+			log.Println("info: saving the snapshot...")
+			sn.Close()
+			_, err := sn.Save()
+			if err != nil {
+				log.Printf("error: unable to save the snapshot: %s\n", err.Error())
+			}
+		}
+		os.Exit(0)
+	}()
+	var rp *dmap.Replication
+	if *namespaces == 1 {
+		rp = dmap.NewReplication(m)
+	}
+	if *replicaof != "" {
+		rp.ReplicaOf(*replicaof)
+	}
+	var rf *dmap.Raft
+	if *raft != "" {
+		t, err := dmap.NewRPCTransport(*raft)
+		if err != nil {
+			log.Printf("error: unable to start the Raft transport: %s\n", err.Error())
+			os.Exit(1)
+		}
+		var members []string
+		if *peers != "" {
+			members = strings.Split(*peers, ",")
+		}
+		rf, err = dmap.OpenRaft(*raftDir, *raft, t, m, members)
+		if err != nil {
+			log.Printf("error: unable to recover the Raft state: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	var cl *dmap.Cluster
+	if *slots != "" {
+		ranges, err := dmap.ParseSlots(*slots)
+		if err != nil {
+			log.Printf("error: unable to parse the slots: %s\n", err.Error())
+			os.Exit(1)
+		}
+		cl = dmap.NewCluster(dmap.ClusterNode{Addr: fmt.Sprintf("localhost:%d", *tcp), HTTP: fmt.Sprintf("localhost:%d", *web)})
+		for _, r := range ranges {
+			cl.Assign(r.Start, r.End, r.Node)
+		}
+	}
+	b := dmap.NewBroker()
+	var ns *dmap.Namespaces
+	if *namespaces != 1 {
+		ns = dmap.NewNamespaces(m, opts...)
+		ns.SetMax(*namespaces)
+	}
 	var wg sync.WaitGroup
 	wg.Add(3)
-	us, err := dmap.NewUDPMapServer("localhost", 12345, &wg, m, true)
+	us, err := dmap.NewUDPMapServer("localhost", *udp, &wg, m, true)
 	if err != nil {
 		log.Printf("error: unable to start the UDP server: %s\n", err.Error())
 		os.Exit(1)
 	}
+	us.SetSnapshotter(sn)
+	us.SetBroker(b)
+	us.SetNamespaces(ns)
+	us.SetReplication(rp)
+	us.SetRaft(rf)
+	us.SetCluster(cl)
 	go us.Serve()
-	ts, err := dmap.NewTCPMapServer("localhost", 12346, &wg, m, true)
+	ts, err := dmap.NewTCPMapServer("localhost", *tcp, &wg, m, true)
 	if err != nil {
 		log.Printf("error: unable to start the TCP server: %s\n", err.Error())
 		os.Exit(1)
 	}
+	ts.SetSnapshotter(sn)
+	ts.SetBroker(b)
+	ts.SetNamespaces(ns)
+	ts.SetReplication(rp)
+	ts.SetRaft(rf)
+	ts.SetCluster(cl)
 	go ts.Serve()
-	hs, err := dmap.NewHTTPMapServer("localhost", 8080, &wg, m, true)
+	hs, err := dmap.NewHTTPMapServer("localhost", *web, &wg, m, true)
 	if err != nil {
 		log.Printf("error: unable to start the HTTP server: %s\n", err.Error())
 		os.Exit(1)
 	}
+	hs.SetSnapshotter(sn)
+	hs.SetBroker(b)
+	hs.SetNamespaces(ns)
+	hs.SetReplication(rp)
+	hs.SetRaft(rf)
+	hs.SetCluster(cl)
 	go hs.Serve()
 	time.Sleep(1 * time.Second)
 	wg.Wait()
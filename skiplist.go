@@ -0,0 +1,95 @@
+package dmap
+
+const (
+	skipMaxLevel = 16
+	skipP        = 4
+)
+
+// skiplist keeps the keys of a shard sorted, for range and prefix scans: the
+// shard lock protects it.
+type skiplist struct {
+	head  skipnode
+	level int
+	n     int
+	r     uint64
+}
+
+type skipnode struct {
+	key  string
+	next []*skipnode
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  skipnode{next: make([]*skipnode, skipMaxLevel)},
+		level: 1,
+		r:     0x9e3779b97f4a7c15,
+	}
+}
+
+// randomLevel draws a level with probability 1/skipP of going up, using a
+// xorshift generator.
+func (s *skiplist) randomLevel() int {
+	s.r ^= s.r << 13
+	s.r ^= s.r >> 7
+	s.r ^= s.r << 17
+	level, r := 1, s.r
+	for level < skipMaxLevel && r%skipP == 0 {
+		level++
+		r /= skipP
+	}
+	return level
+}
+
+// path returns, for every level, the last node preceding the key.
+func (s *skiplist) path(key string) [skipMaxLevel]*skipnode {
+	var update [skipMaxLevel]*skipnode
+	x := &s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	return update
+}
+
+func (s *skiplist) insert(key string) {
+	update := s.path(key)
+	if n := update[0].next[0]; n != nil && n.key == key {
+		return
+	}
+	level := s.randomLevel()
+	for i := s.level; i < level; i++ {
+		update[i] = &s.head
+	}
+	if level > s.level {
+		s.level = level
+	}
+	n := &skipnode{key: key, next: make([]*skipnode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	s.n++
+}
+
+func (s *skiplist) delete(key string) {
+	update := s.path(key)
+	n := update[0].next[0]
+	if n == nil || n.key != key {
+		return
+	}
+	for i := 0; i < len(n.next); i++ {
+		update[i].next[i] = n.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.n--
+}
+
+// seek returns the first node holding a key not lower than key.
+func (s *skiplist) seek(key string) *skipnode {
+	return s.path(key)[0].next[0]
+}
@@ -0,0 +1,44 @@
+package dmap
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	s := newSkiplist()
+	keys := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		key := strconv.Itoa(rand.Intn(5000))
+		if rand.Intn(3) == 0 {
+			s.delete(key)
+			delete(keys, key)
+		} else {
+			s.insert(key)
+			keys[key] = true
+		}
+	}
+	expected := make([]string, 0, len(keys))
+	for key := range keys {
+		expected = append(expected, key)
+	}
+	sort.Strings(expected)
+	if s.n != len(expected) {
+		t.Fatalf("unexpected length: %d, expected: %d\n", s.n, len(expected))
+	}
+	i := 0
+	for n := s.seek(""); n != nil; n = n.next[0] {
+		if n.key != expected[i] {
+			t.Fatalf("unexpected key: %s, expected: %s\n", n.key, expected[i])
+		}
+		i++
+	}
+	j := sort.SearchStrings(expected, "25")
+	n := s.seek("25")
+	if j == len(expected) && n != nil || j < len(expected) && (n == nil || n.key != expected[j]) {
+		t.Logf("unexpected seek outcome\n")
+		t.Fail()
+	}
+}
@@ -0,0 +1,340 @@
+package dmap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ClusterSlots is the number of hash slots the keys are spread over.
+const ClusterSlots = 16384
+
+var (
+	ErrClusterDown = errors.New("CLUSTERDOWN Hash slot not served")
+	ErrCrossSlot   = errors.New("CROSSSLOT Keys in request don't hash to the same node")
+	ErrTryAgain    = errors.New("TRYAGAIN Multiple keys request during the migration of the slot")
+)
+
+// Slot returns the hash slot of the key, the CRC16 of the key modulo
+// ClusterSlots: if the key holds a hash tag, i.e. a non empty part between
+// the first { and the following }, only the tag is hashed, so that related
+// keys like {user1}.name and {user1}.mail share the slot.
+func Slot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key)) % ClusterSlots
+}
+
+// crc16 is the CRC16-CCITT (XModem) checksum.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// ClusterNode is a node of the cluster, known by the host:port of its TCP
+// server, the address of the redirections, and serving HTTP at HTTP, if not
+// empty.
+type ClusterNode struct {
+	Addr string
+	HTTP string
+}
+
+// SlotRange is a range of slots, bounds included, owned by a node.
+type SlotRange struct {
+	Start int
+	End   int
+	Node  ClusterNode
+}
+
+// ParseSlots parses a slot map, comma separated ranges as
+// <start>-<end>@<host:port>[/<http host:port>], e.g.
+// 0-8191@localhost:12346/localhost:8080: a single slot can be given as
+// <slot>@<host:port>.
+func ParseSlots(spec string) ([]SlotRange, error) {
+	var ranges []SlotRange
+	for _, part := range strings.Split(spec, ",") {
+		bounds, node, ok := strings.Cut(strings.TrimSpace(part), "@")
+		if !ok || node == "" {
+			return nil, errors.New("Bad slot range, format: <start>-<end>@<host:port>[/<http host:port>]: " + part)
+		}
+		var r SlotRange
+		r.Node.Addr, r.Node.HTTP, _ = strings.Cut(node, "/")
+		start, end, ranged := strings.Cut(bounds, "-")
+		var err error
+		r.Start, err = strconv.Atoi(start)
+		if err == nil && ranged {
+			r.End, err = strconv.Atoi(end)
+		} else {
+			r.End = r.Start
+		}
+		if err != nil || r.Start < 0 || r.End >= ClusterSlots || r.Start > r.End {
+			return nil, errors.New("Bad slot range: " + bounds)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// redirect answers a command on keys not served by the node, with the node
+// to ask instead: for good if MOVED, for the command only if ASK, the slot
+// being migrated.
+type redirect struct {
+	ask  bool
+	slot int
+	node ClusterNode
+}
+
+func (r *redirect) Error() string {
+	if r.ask {
+		return fmt.Sprintf("ASK %d %s", r.slot, r.node.Addr)
+	}
+	return fmt.Sprintf("MOVED %d %s", r.slot, r.node.Addr)
+}
+
+// parseRedirect returns the slot and the address carried by a redirection,
+// and whether it is an ASK one.
+func parseRedirect(err error) (int, string, bool, bool) {
+	if err == nil {
+		return 0, "", false, false
+	}
+	fields := strings.Fields(err.Error())
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return 0, "", false, false
+	}
+	slot, e := strconv.Atoi(fields[1])
+	if e != nil {
+		return 0, "", false, false
+	}
+	return slot, fields[2], fields[0] == "ASK", true
+}
+
+// Cluster is the slot map of a node: the nodes owning the slots, the node
+// itself included, so that the servers answer the commands on the keys of
+// the slots owned by other nodes with a redirection. A node starts owning
+// no slot. While a slot is migrated, the source node redirects with ASK the
+// commands on the keys it no longer holds to the target node, which serves
+// them only if preceded by ASKING.
+type Cluster struct {
+	self      ClusterNode
+	l         sync.RWMutex
+	owners    [ClusterSlots]*ClusterNode
+	migrating [ClusterSlots]*ClusterNode
+	importing [ClusterSlots]*ClusterNode
+}
+
+func NewCluster(self ClusterNode) *Cluster {
+	return &Cluster{self: self}
+}
+
+func (c *Cluster) Self() ClusterNode {
+	return c.self
+}
+
+// Assign makes the node the owner of the slots from start to end, included,
+// ending their migrations, if any.
+func (c *Cluster) Assign(start, end int, node ClusterNode) error {
+	if start < 0 || end >= ClusterSlots || start > end {
+		return fmt.Errorf("Bad slot range: %d-%d", start, end)
+	}
+	if node.Addr == c.self.Addr {
+		node = c.self
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	for s := start; s <= end; s++ {
+		c.owners[s] = &node
+		c.migrating[s] = nil
+		c.importing[s] = nil
+	}
+	return nil
+}
+
+// Migrating marks the slots from start to end, owned by the node, as being
+// migrated to the target node.
+func (c *Cluster) Migrating(start, end int, to ClusterNode) error {
+	return c.migrate(start, end, to, true)
+}
+
+// Importing marks the slots from start to end, owned by another node, as
+// being migrated from it to the node.
+func (c *Cluster) Importing(start, end int, from ClusterNode) error {
+	return c.migrate(start, end, from, false)
+}
+
+func (c *Cluster) migrate(start, end int, node ClusterNode, out bool) error {
+	if start < 0 || end >= ClusterSlots || start > end {
+		return fmt.Errorf("Bad slot range: %d-%d", start, end)
+	}
+	if node.Addr == c.self.Addr {
+		return errors.New("Bad node: the migration is between two nodes")
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	for s := start; s <= end; s++ {
+		if owned := c.owners[s] != nil && c.owners[s].Addr == c.self.Addr; owned != out {
+			return fmt.Errorf("Bad slot %d: the source node must own it", s)
+		}
+	}
+	for s := start; s <= end; s++ {
+		if out {
+			c.migrating[s] = &node
+		} else {
+			c.importing[s] = &node
+		}
+	}
+	return nil
+}
+
+// Owner returns the node owning the slot, false if none.
+func (c *Cluster) Owner(slot int) (ClusterNode, bool) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	if n := c.owners[slot]; n != nil {
+		return *n, true
+	}
+	return ClusterNode{}, false
+}
+
+// Slots returns the ranges of the slots owned, in ascending order.
+func (c *Cluster) Slots() []SlotRange {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	return slotRanges(c.owners[:])
+}
+
+// Migrations returns the ranges of the slots being migrated to other nodes,
+// and the ones being imported from them.
+func (c *Cluster) Migrations() ([]SlotRange, []SlotRange) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	return slotRanges(c.migrating[:]), slotRanges(c.importing[:])
+}
+
+// slotRanges groups the consecutive slots of the same node.
+func slotRanges(nodes []*ClusterNode) []SlotRange {
+	var ranges []SlotRange
+	for s, n := range nodes {
+		if n == nil {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last].End == s-1 && ranges[last].Node == *n {
+			ranges[last].End = s
+			continue
+		}
+		ranges = append(ranges, SlotRange{Start: s, End: s, Node: *n})
+	}
+	return ranges
+}
+
+// check returns nil if the keys are served by the node, a redirection if
+// they are all owned by another node: asking tells if the command follows
+// ASKING, exists if a key is held by the node.
+func (c *Cluster) check(keys []string, asking bool, exists func(key string) bool) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	c.l.RLock()
+	defer c.l.RUnlock()
+	var owner *ClusterNode
+	slot := -1
+	for _, key := range keys {
+		s := Slot(key)
+		n := c.owners[s]
+		if n == nil {
+			return ErrClusterDown
+		}
+		if owner != nil && (*n != *owner || s != slot && (c.moving(s) || c.moving(slot))) {
+			return ErrCrossSlot
+		}
+		owner, slot = n, s
+	}
+	if owner.Addr != c.self.Addr {
+		if asking && c.importing[slot] != nil {
+			return nil
+		}
+		return &redirect{slot: slot, node: *owner}
+	}
+	if to := c.migrating[slot]; to != nil {
+		found := 0
+		for _, key := range keys {
+			if exists(key) {
+				found++
+			}
+		}
+		switch found {
+		case len(keys):
+		case 0:
+			return &redirect{ask: true, slot: slot, node: *to}
+		default:
+			return ErrTryAgain
+		}
+	}
+	return nil
+}
+
+// moving reports whether the slot is being migrated or imported.
+func (c *Cluster) moving(slot int) bool {
+	return c.migrating[slot] != nil || c.importing[slot] != nil
+}
+
+// commandKeys returns the keys of a text or RESP command, the command first.
+func commandKeys(command string, args []string) []string {
+	switch command {
+	case "mget", "mdel", "del", "exists", "txwatch":
+		return args[1:]
+	case "mset":
+		var keys []string
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case "get", "getv", "put", "putnx", "putxx", "cas", "cad", "set",
+		"incr", "decr", "incrby", "decrby", "expire", "ttl", "persist", "type",
+		"lpush", "rpush", "lpop", "rpop", "lrange", "llen",
+		"sadd", "srem", "smembers", "sismember", "hset", "hget", "hdel", "hgetall":
+		if len(args) > 1 {
+			return args[1:2]
+		}
+	}
+	return nil
+}
+
+// frameKeys returns the keys of the command carried by a frame.
+func frameKeys(op byte, key, value []byte) []string {
+	switch op {
+	case opPut, opGet, opGetV, opDel, opPutNX, opPutXX, opCAS, opCAD, opIncr:
+		return []string{string(key)}
+	case opMGet, opMDel, opMSet, opTyped:
+		items, err := unpackList(value)
+		if err != nil || len(items) == 0 {
+			return nil
+		}
+		args := make([]string, len(items)+1)
+		for i, it := range items {
+			args[i+1] = string(it)
+		}
+		switch op {
+		case opMGet, opMDel:
+			return args[1:]
+		case opMSet:
+			return commandKeys("mset", args)
+		}
+		return commandKeys(strings.ToLower(args[1]), args[1:])
+	}
+	return nil
+}
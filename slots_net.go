@@ -0,0 +1,328 @@
+package dmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxRedirects is the number of redirections followed by the clients.
+const maxRedirects = 5
+
+var (
+	errClusterOff       = errors.New("Cluster not enabled")
+	errClusterNamespace = errors.New("Bad namespace, only the default one is served in cluster mode")
+)
+
+// SetCluster makes the server answer the commands on keys owned by other
+// nodes with a redirection, MOVED <slot> <host:port>: the other namespaces,
+// not migrated along with the slots, are refused.
+func (ms *MapServer) SetCluster(c *Cluster) {
+	ms.cluster = c
+}
+
+// moved returns nil if the keys are served by the node, the redirection to
+// their owner otherwise: served, they are fenced off a migration until done
+// is called, once the command is run.
+func (ms *MapServer) moved(keys []string) (done func(), err error) {
+	asking := ms.asking
+	ms.asking = false
+	if ms.cluster == nil || len(keys) == 0 {
+		return func() {}, nil
+	}
+	done = ms.m.fence()
+	err = ms.cluster.check(keys, asking, ms.m.Exists)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	return done, nil
+}
+
+// owned redirects, with 307 Temporary Redirect to the HTTP server of the
+// owner, the requests on keys owned by other nodes: the keys are taken from
+// the key parameter and from the JSON body.
+func (hs *HTTPMapServer) owned(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if hs.cluster == nil {
+			h(w, r)
+			return
+		}
+		var keys []string
+		if key := r.URL.Query().Get("key"); key != "" && key != "*" {
+			keys = append(keys, key)
+		}
+		if r.Body != nil && r.Method != "GET" {
+			buf, err := io.ReadAll(r.Body)
+			if err != nil {
+				hs.typedError(w, http.StatusBadRequest, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(buf))
+			keys = append(keys, bodyKeys(buf)...)
+		}
+		done := hs.m.fence()
+		defer done()
+		err := hs.cluster.check(keys, r.Header.Get("Dmap-Asking") != "", hs.m.Exists)
+		if rd, ok := err.(*redirect); ok {
+			if rd.node.HTTP == "" {
+				hs.typedError(w, http.StatusMisdirectedRequest, err)
+				return
+			}
+			if rd.ask {
+				w.Header().Set("Dmap-Ask", "1")
+			}
+			w.Header().Set("Dmap-Slot", strconv.Itoa(rd.slot))
+			w.Header().Set("Location", "http://"+rd.node.HTTP+r.URL.RequestURI())
+			hs.typedError(w, http.StatusTemporaryRedirect, err)
+			return
+		}
+		if err == ErrClusterDown || err == ErrTryAgain {
+			hs.typedError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		if err != nil {
+			hs.typedError(w, http.StatusBadRequest, err)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// bodyKeys returns the keys of a JSON body: the key, the keys to get, put
+// and delete in batches, the keys of the transaction ops and preconditions.
+func bodyKeys(buf []byte) []string {
+	var body struct {
+		Key    string            `json:"key"`
+		Get    []string          `json:"get"`
+		Put    map[string]string `json:"put"`
+		Delete []string          `json:"delete"`
+		Ops    []struct {
+			Key string `json:"key"`
+		} `json:"ops"`
+		IfMatch     map[string]string `json:"if_match"`
+		IfNoneMatch map[string]string `json:"if_none_match"`
+	}
+	if json.Unmarshal(buf, &body) != nil {
+		return nil
+	}
+	var keys []string
+	if body.Key != "" {
+		keys = append(keys, body.Key)
+	}
+	keys = append(keys, body.Get...)
+	keys = append(keys, body.Delete...)
+	for _, op := range body.Ops {
+		keys = append(keys, op.Key)
+	}
+	for _, m := range []map[string]string{body.Put, body.IfMatch, body.IfNoneMatch} {
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// GET answers with the slot map, POST ?slots=<ranges> assigns the slots, as
+// parsed by ParseSlots.
+func (hs *HTTPMapServer) clusterHandler(w http.ResponseWriter, r *http.Request) {
+	if hs.cluster == nil {
+		hs.typedError(w, http.StatusNotFound, errClusterOff)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		ranges, err := ParseSlots(r.URL.Query().Get("slots"))
+		if err != nil {
+			hs.typedError(w, http.StatusBadRequest, err)
+			return
+		}
+		for _, sr := range ranges {
+			hs.cluster.Assign(sr.Start, sr.End, sr.Node)
+		}
+	default:
+		hs.typedError(w, http.StatusMethodNotAllowed, errors.New("Bad method: only GET, POST accepted"))
+		return
+	}
+	migrating, importing := hs.cluster.Migrations()
+	rs := map[string]interface{}{
+		"outcome":   "OK",
+		"self":      hs.cluster.Self().Addr,
+		"slots":     jsonRanges(hs.cluster.Slots()),
+		"migrating": jsonRanges(migrating),
+		"importing": jsonRanges(importing),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
+
+func jsonRanges(ranges []SlotRange) []map[string]interface{} {
+	slots := []map[string]interface{}{}
+	for _, sr := range ranges {
+		slots = append(slots, map[string]interface{}{"start": sr.Start, "end": sr.End, "addr": sr.Node.Addr, "http": sr.Node.HTTP})
+	}
+	return slots
+}
+
+// exchange sends the text command to the node owning its key, following the
+// redirections, and returns the client of the node which answered.
+func (mc *MapClient) exchange(command string) (*MapClient, string, error) {
+	var key string
+	args := strings.Split(command, " ")
+	args[0] = strings.ToLower(args[0])
+	if keys := commandKeys(args[0], args); len(keys) > 0 {
+		key = keys[0]
+	}
+	c := mc.route(key)
+	asking := false
+	for hops := 0; ; hops++ {
+		var res string
+		var err error
+		if asking {
+			_, err = c.send("ASKING")
+		}
+		if err == nil {
+			res, err = c.send(command)
+		}
+		slot, addr, ask, ok := parseRedirect(err)
+		if !ok || hops == maxRedirects {
+			return c, res, err
+		}
+		c, err = mc.follow(slot, addr, ask)
+		if err != nil {
+			return c, "", err
+		}
+		asking = ask
+	}
+}
+
+// roundTrip sends the frame to the node owning its key, following the
+// redirections.
+func (mc *MapClient) roundTrip(op byte, key string, value []byte) (*frame, error) {
+	var routed string
+	if keys := frameKeys(op, []byte(key), value); len(keys) > 0 {
+		routed = keys[0]
+	}
+	c := mc.route(routed)
+	asking := false
+	for hops := 0; ; hops++ {
+		var res *frame
+		var err error
+		if asking {
+			_, err = c.sendFrame(opAsking, "", nil)
+		}
+		if err == nil {
+			res, err = c.sendFrame(op, key, value)
+		}
+		slot, addr, ask, ok := parseRedirect(err)
+		if !ok || hops == maxRedirects {
+			return res, err
+		}
+		c, err = mc.follow(slot, addr, ask)
+		if err != nil {
+			return nil, err
+		}
+		asking = ask
+	}
+}
+
+// route returns the client of the node owning the key, as cached from the
+// redirections, this one if unknown.
+func (mc *MapClient) route(key string) *MapClient {
+	if key == "" || mc.slots == nil {
+		return mc
+	}
+	addr, ok := mc.slots[Slot(key)]
+	if !ok {
+		return mc
+	}
+	c, err := mc.node(addr)
+	if err != nil {
+		return mc
+	}
+	return c
+}
+
+// follow caches the owner of the slot, unless asked to the node for the
+// command only, and returns its client.
+func (mc *MapClient) follow(slot int, addr string, ask bool) (*MapClient, error) {
+	if ask {
+		return mc.node(addr)
+	}
+	if mc.slots == nil {
+		mc.slots = make(map[int]string)
+	}
+	mc.slots[slot] = addr
+	return mc.node(addr)
+}
+
+// node returns the client of the node, dialing it in over TCP the first
+// time.
+func (mc *MapClient) node(addr string) (*MapClient, error) {
+	if addr == net.JoinHostPort(mc.host, strconv.Itoa(mc.port)) {
+		return mc, nil
+	}
+	if c := mc.nodes[addr]; c != nil {
+		return c, nil
+	}
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return mc, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return mc, errors.New("Bad port: " + p)
+	}
+	c := &MapClient{host: host, port: port, binary: mc.binary, ns: mc.ns}
+	err = c.dial("tcp")
+	if err != nil {
+		return mc, err
+	}
+	if mc.nodes == nil {
+		mc.nodes = make(map[string]*MapClient)
+	}
+	mc.nodes[addr] = c
+	return c, nil
+}
+
+// redirected caches the owners of the slots from the MOVED redirections
+// followed, and asks the node of an ASK one to serve the request.
+func (hc *HTTPMapClient) redirected(req *http.Request, via []*http.Request) error {
+	if len(via) > maxRedirects {
+		return fmt.Errorf("Stopped after %d redirects", maxRedirects)
+	}
+	if req.Response.Header.Get("Dmap-Ask") != "" {
+		req.Header.Set("Dmap-Asking", "1")
+		return nil
+	}
+	req.Header.Del("Dmap-Asking")
+	slot, err := strconv.Atoi(req.Response.Header.Get("Dmap-Slot"))
+	if err == nil {
+		hc.sl.Lock()
+		if hc.slots == nil {
+			hc.slots = make(map[int]string)
+		}
+		hc.slots[slot] = req.URL.Host
+		hc.sl.Unlock()
+	}
+	return nil
+}
+
+// node returns the host:port of the HTTP server owning the key, as cached
+// from the redirections.
+func (hc *HTTPMapClient) node(key string) string {
+	hc.sl.Lock()
+	defer hc.sl.Unlock()
+	if addr, ok := hc.slots[Slot(key)]; ok {
+		return addr
+	}
+	return net.JoinHostPort(hc.host, strconv.Itoa(hc.port))
+}
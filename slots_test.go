@@ -0,0 +1,182 @@
+package dmap
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlot(t *testing.T) {
+	if crc16("123456789") != 0x31c3 {
+		t.Fatalf("unexpected checksum: %x\n", crc16("123456789"))
+	}
+	for key, slot := range map[string]int{"foo": 12182, "bar": 5061, "": 0, "{user1000}.following": Slot("user1000"), "{}x": Slot("{}x"), "a{b}{c}": Slot("b")} {
+		if Slot(key) != slot {
+			t.Logf("unexpected slot of %q: %d\n", key, Slot(key))
+			t.Fail()
+		}
+	}
+	if Slot("{user1000}.following") != Slot("{user1000}.followers") {
+		t.Logf("expected the keys with the same tag in the same slot\n")
+		t.Fail()
+	}
+	ranges, err := ParseSlots("0-8191@localhost:1/localhost:2, 8192@localhost:3")
+	if err != nil || len(ranges) != 2 || ranges[0].End != 8191 || ranges[0].Node.HTTP != "localhost:2" || ranges[1].Start != 8192 || ranges[1].End != 8192 {
+		t.Logf("unexpected ranges: %v %v\n", ranges, err)
+		t.Fail()
+	}
+	for _, spec := range []string{"", "0-10", "10-0@a:1", "0-16384@a:1", "x@a:1"} {
+		if _, err := ParseSlots(spec); err == nil {
+			t.Logf("expected a bad slot map refused: %s\n", spec)
+			t.Fail()
+		}
+	}
+}
+
+// slotKey returns a key hashing to a slot in [start, end].
+func slotKey(prefix string, start, end int) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("%s%d", prefix, i)
+		if s := Slot(key); s >= start && s <= end {
+			return key
+		}
+	}
+}
+
+func TestCluster(t *testing.T) {
+	a, b := ClusterNode{"localhost:12370", "localhost:8091"}, ClusterNode{"localhost:12371", "localhost:8092"}
+	c := NewCluster(a)
+	if c.check([]string{"foo"}, false, nil) != ErrClusterDown {
+		t.Logf("expected the slots not served\n")
+		t.Fail()
+	}
+	c.Assign(0, 8191, a)
+	c.Assign(8192, ClusterSlots-1, b)
+	if err := c.Assign(10, 5, a); err == nil {
+		t.Logf("expected a bad range refused\n")
+		t.Fail()
+	}
+	local, remote := slotKey("a", 0, 8191), slotKey("b", 8192, ClusterSlots-1)
+	if err := c.check([]string{local}, false, nil); err != nil {
+		t.Logf("unexpected error: %s\n", err.Error())
+		t.Fail()
+	}
+	if err := c.check([]string{remote}, false, nil); err == nil || err.Error() != fmt.Sprintf("MOVED %d %s", Slot(remote), b.Addr) {
+		t.Logf("expected a redirection: %v\n", err)
+		t.Fail()
+	}
+	if c.check([]string{local, remote}, false, nil) != ErrCrossSlot {
+		t.Logf("expected the keys refused across the nodes\n")
+		t.Fail()
+	}
+	if slots := c.Slots(); len(slots) != 2 || slots[0].End != 8191 || slots[1].Node != b {
+		t.Logf("unexpected slots: %v\n", slots)
+		t.Fail()
+	}
+	keys := commandKeys("mset", strings.Split("mset k1 v1 k2 v2", " "))
+	if len(keys) != 2 || keys[1] != "k2" {
+		t.Logf("unexpected keys: %v\n", keys)
+		t.Fail()
+	}
+	if keys := frameKeys(opTyped, nil, packList([][]byte{[]byte("LPUSH"), []byte("list"), []byte("a")})); len(keys) != 1 || keys[0] != "list" {
+		t.Logf("unexpected keys: %v\n", keys)
+		t.Fail()
+	}
+	m := NewMap()
+	ns := NewNamespaces(m)
+	defer ns.Close()
+	ms := &MapServer{m: m, ns: ns, cluster: c}
+	if _, err := ms.execute([]byte("SELECT other\r\n")); err == nil || err.Error() != "KO="+errClusterNamespace.Error() {
+		t.Logf("expected the other namespaces refused: %v\n", err)
+		t.Fail()
+	}
+	if res, err := ms.execute([]byte("SELECT 0\r\n")); err != nil || ms.m != m {
+		t.Logf("expected the default namespace selected: %s %v\n", res, err)
+		t.Fail()
+	}
+}
+
+func TestClusterRedirect(t *testing.T) {
+	nodes := []ClusterNode{{"localhost:12370", "localhost:8091"}, {"localhost:12371", "localhost:8092"}}
+	var wg sync.WaitGroup
+	var maps []*Map
+	for i, node := range nodes {
+		m := NewMap()
+		maps = append(maps, m)
+		c := NewCluster(node)
+		c.Assign(0, 8191, nodes[0])
+		c.Assign(8192, ClusterSlots-1, nodes[1])
+		wg.Add(2)
+		ts, err := NewTCPMapServer("localhost", 12370+i, &wg, m, true)
+		if err != nil {
+			t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+		}
+		ts.SetCluster(c)
+		go ts.Serve()
+		defer ts.Shutdown()
+		hs, err := NewHTTPMapServer("localhost", 8091+i, &wg, m, true)
+		if err != nil {
+			t.Fatalf("error: unable to start the HTTP server: %s\n", err.Error())
+		}
+		hs.SetCluster(c)
+		go hs.Serve()
+		defer hs.Shutdown()
+	}
+	time.Sleep(100 * time.Millisecond)
+	tc, bc, hc := NewTCPMapClient("localhost", 12370), NewTCPMapClient("localhost", 12370), NewHTTPMapClient("localhost", 8091)
+	bc.SetBinary(true)
+	for i, c := range []Client{tc, bc, hc} {
+		if err := c.Dial(); err != nil {
+			t.Fatalf("error: unable to dial in: %s\n", err.Error())
+		}
+		local, remote := slotKey(fmt.Sprintf("a%d-", i), 0, 8191), slotKey(fmt.Sprintf("b%d-", i), 8192, ClusterSlots-1)
+		for _, key := range []string{local, remote} {
+			if err := c.Put(key, []byte("value")); err != nil {
+				t.Fatalf("error: unable to put: %s\n", err.Error())
+			}
+		}
+		if !maps[0].Exists(local) || !maps[1].Exists(remote) || maps[0].Exists(remote) {
+			t.Logf("expected the keys on their owners: %d\n", i)
+			t.Fail()
+		}
+		if value, err := c.Get(remote); err != nil || string(value) != "value" {
+			t.Logf("expected the key read from its owner: %s %v\n", value, err)
+			t.Fail()
+		}
+		other := slotKey(remote, 8192, ClusterSlots-1)
+		c.Put("{"+remote+"}x", []byte("x"))
+		if values, err := c.MGet(remote, "{"+remote+"}x", other); err != nil || string(values[0]) != "value" || string(values[1]) != "x" || values[2] != nil {
+			t.Logf("unexpected values: %q %v\n", values, err)
+			t.Fail()
+		}
+		if _, err := c.MGet(local, remote); err == nil {
+			t.Logf("expected the keys refused across the nodes\n")
+			t.Fail()
+		}
+		if err := c.Delete(remote); err != nil || maps[1].Exists(remote) {
+			t.Logf("expected the key deleted on its owner: %v\n", err)
+			t.Fail()
+		}
+		c.Close()
+	}
+	if tc.slots[Slot(slotKey("b0-", 8192, ClusterSlots-1))] != nodes[1].Addr || len(tc.nodes) != 0 {
+		t.Logf("expected the slot map cached: %v\n", tc.slots)
+		t.Fail()
+	}
+	if len(hc.slots) == 0 {
+		t.Logf("expected the redirections cached\n")
+		t.Fail()
+	}
+	ms := &MapServer{m: maps[0], cluster: NewCluster(nodes[0])}
+	ms.cluster.Assign(0, ClusterSlots-1, nodes[1])
+	if res := ms.executeRESP(nil, [][]byte{[]byte("GET"), []byte("foo")}); string(res) != "-MOVED 12182 localhost:12371\r\n" {
+		t.Logf("unexpected response: %q\n", res)
+		t.Fail()
+	}
+	if res, err := ms.execute([]byte("SIZE\r\n")); err != nil || res != "OK=3" {
+		t.Logf("expected the commands without keys served: %s %v\n", res, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,323 @@
+package dmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotMagic = "DMAPSNP1"
+	snapshotEntry = 0x01
+	snapshotTyped = 0x02
+	snapshotEOF   = 0xff
+)
+
+// Snapshot dumps the Map contents shard by shard: every shard is copied under
+// its read lock, so writers are stopped for one shard at a time only and the
+// dump is consistent per shard. A CRC32 of the whole dump is appended.
+func (m *Map) Snapshot(w io.Writer) error {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	_, err := bw.WriteString(snapshotMagic)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	var count uint64
+	for i := range m.e {
+		for _, mu := range m.e[i].dump(time.Now().UnixNano()) {
+			t := byte(snapshotEntry)
+			if mu.Op == OpTyped {
+				t = snapshotTyped
+			}
+			buf = append(buf[:0], t)
+			buf = binary.AppendUvarint(buf, uint64(len(mu.Key)))
+			buf = append(buf, mu.Key...)
+			buf = binary.AppendUvarint(buf, uint64(len(mu.Value)))
+			buf = append(buf, mu.Value...)
+			buf = binary.AppendVarint(buf, mu.Expire)
+			_, err = bw.Write(buf)
+			if err != nil {
+				return err
+			}
+			count++
+		}
+	}
+	buf = append(buf[:0], snapshotEOF)
+	buf = binary.AppendUvarint(buf, count)
+	_, err = bw.Write(buf)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc.Sum32())
+	_, err = w.Write(sum[:])
+	return err
+}
+
+// Restore replaces the Map contents with a dump taken by Snapshot, once it
+// has been read and verified as a whole; expired keys are dropped.
+func (m *Map) Restore(r io.Reader) error {
+	cr := &crcReader{r: bufio.NewReader(r), h: crc32.NewIEEE()}
+	magic := make([]byte, len(snapshotMagic))
+	_, err := io.ReadFull(cr, magic)
+	if err != nil || string(magic) != snapshotMagic {
+		return errors.New("not a snapshot")
+	}
+	var mus []Mutation
+	for {
+		t, err := cr.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		if t == snapshotEOF {
+			break
+		}
+		if t != snapshotEntry && t != snapshotTyped {
+			return errors.New("malformed snapshot: unknown entry type")
+		}
+		mu := Mutation{Op: OpPut}
+		if t == snapshotTyped {
+			mu.Op = OpTyped
+		}
+		key, err := readBytes(cr)
+		if err != nil {
+			return err
+		}
+		mu.Key = string(key)
+		mu.Value, err = readBytes(cr)
+		if err != nil {
+			return err
+		}
+		mu.Expire, err = binary.ReadVarint(cr)
+		if err != nil {
+			return unexpected(err)
+		}
+		mus = append(mus, mu)
+	}
+	count, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return unexpected(err)
+	}
+	expected := cr.h.Sum32()
+	var sum [4]byte
+	_, err = io.ReadFull(cr.r, sum[:])
+	if err != nil {
+		return unexpected(err)
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != expected {
+		return errors.New("malformed snapshot: checksum mismatch")
+	}
+	if count != uint64(len(mus)) {
+		return errors.New("malformed snapshot: entries count mismatch")
+	}
+	m.Clear()
+	for i := range mus {
+		m.apply(&mus[i])
+	}
+	return nil
+}
+
+// dump copies the live items of the shard under its read lock.
+func (e *entry) dump(now int64) []Mutation {
+	e.l.RLock()
+	defer e.l.RUnlock()
+	mus := make([]Mutation, 0, len(e.m))
+	for k, it := range e.m {
+		if !it.expired(now) {
+			mus = append(mus, it.mutation(k))
+		}
+	}
+	return mus
+}
+
+type crcReader struct {
+	r *bufio.Reader
+	h hash.Hash32
+}
+
+func (cr *crcReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.h.Write(p[:n])
+	return n, err
+}
+
+func (cr *crcReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+func readBytes(cr *crcReader) ([]byte, error) {
+	l, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	if l > aofMaxRecord {
+		return nil, errors.New("malformed snapshot: entry too large")
+	}
+	b := make([]byte, l)
+	_, err = io.ReadFull(cr, b)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	return b, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Snapshotter saves the Map to a file, on demand (SAVE and BGSAVE) or
+// periodically, and loads it back on boot.
+type Snapshotter struct {
+	path string
+	m    *Map
+	mu   sync.Mutex
+	busy bool
+	last time.Time
+	done chan struct{}
+	once sync.Once
+}
+
+func NewSnapshotter(path string, m *Map) *Snapshotter {
+	return &Snapshotter{
+		path: path,
+		m:    m,
+		done: make(chan struct{}),
+	}
+}
+
+// Load restores the snapshot file, if any.
+func (s *Snapshotter) Load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = s.m.Restore(f)
+	if err != nil {
+		return err
+	}
+	log.Printf("info: restored %d keys from %s\n", s.m.Size(), s.path)
+	return nil
+}
+
+// Save writes the snapshot to a temporary file, renamed over the actual one
+// once synced to disk.
+func (s *Snapshotter) Save() (int64, error) {
+	s.mu.Lock()
+	if s.busy {
+		s.mu.Unlock()
+		return 0, errors.New("snapshot already in progress")
+	}
+	s.busy = true
+	s.mu.Unlock()
+	n, err := s.save()
+	s.mu.Lock()
+	s.busy = false
+	if err == nil {
+		s.last = time.Now()
+	}
+	s.mu.Unlock()
+	return n, err
+}
+
+// BgSave runs Save in background, logging its outcome.
+func (s *Snapshotter) BgSave() error {
+	s.mu.Lock()
+	busy := s.busy
+	s.mu.Unlock()
+	if busy {
+		return errors.New("snapshot already in progress")
+	}
+	go func() {
+		n, err := s.Save()
+		if err != nil {
+			log.Printf("error: unable to save the snapshot: %s\n", err.Error())
+			return
+		}
+		log.Printf("info: saved the snapshot %s: %d bytes\n", s.path, n)
+	}()
+	return nil
+}
+
+func (s *Snapshotter) LastSave() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// Schedule saves the snapshot every interval, until Close.
+func (s *Snapshotter) Schedule(interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-t.C:
+				err := s.BgSave()
+				if err != nil {
+					log.Printf("error: unable to schedule the snapshot: %s\n", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+func (s *Snapshotter) Close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *Snapshotter) save() (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".save-*")
+	if err != nil {
+		return 0, err
+	}
+	err = s.m.Snapshot(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	var n int64
+	if err == nil {
+		var st os.FileInfo
+		st, err = tmp.Stat()
+		if err == nil {
+			n = st.Size()
+		}
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	syncDir(filepath.Dir(s.path))
+	return n, nil
+}
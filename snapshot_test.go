@@ -0,0 +1,95 @@
+package dmap
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMapSnapshot(t *testing.T) {
+	m := NewMap()
+	for i := 0; i < 1000; i++ {
+		m.Put(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	m.PutWithTTL("session", []byte("token"), time.Hour)
+	m.PutWithTTL("expired", []byte("token"), 10*time.Millisecond)
+	var buf bytes.Buffer
+	err := m.Snapshot(&buf)
+	if err != nil {
+		t.Fatalf("unable to take the snapshot: %s\n", err.Error())
+	}
+	time.Sleep(20 * time.Millisecond)
+	r := NewMap()
+	r.Put("stale", []byte("value"))
+	err = r.Restore(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("unable to restore the snapshot: %s\n", err.Error())
+	}
+	if r.Size() != 1001 || r.Get("stale") != nil || r.Get("expired") != nil {
+		t.Logf("expected size 1001: %d\n", r.Size())
+		t.Fail()
+	}
+	if string(r.Get("key42")) != "value42" || r.TTL("session") <= 0 {
+		t.Logf("unexpected contents after the restore\n")
+		t.Fail()
+	}
+}
+
+func TestMapSnapshotCorrupted(t *testing.T) {
+	m := NewMap()
+	m.Put("key", []byte("value"))
+	var buf bytes.Buffer
+	m.Snapshot(&buf)
+	b := buf.Bytes()
+	b[len(snapshotMagic)+3] ^= 0xff
+	r := NewMap()
+	r.Put("untouched", []byte("value"))
+	if r.Restore(bytes.NewReader(b)) == nil {
+		t.Logf("expected the checksum to mismatch\n")
+		t.Fail()
+	}
+	if r.Restore(bytes.NewReader(b[:len(b)-2])) == nil {
+		t.Logf("expected a truncated snapshot to be refused\n")
+		t.Fail()
+	}
+	if string(r.Get("untouched")) != "value" {
+		t.Logf("expected the map to be left untouched\n")
+		t.Fail()
+	}
+}
+
+func TestSnapshotter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dmap.snapshot")
+	m := NewMap()
+	m.Put("key", []byte("value"))
+	s := NewSnapshotter(path, m)
+	defer s.Close()
+	n, err := s.Save()
+	if err != nil || n == 0 {
+		t.Fatalf("unable to save the snapshot: %v\n", err)
+	}
+	m.Put("background", []byte("value"))
+	ms := MapServer{m: m, snap: s}
+	outcome, err := ms.execute([]byte("BGSAVE"))
+	if err != nil || outcome != "OK=Background saving started" {
+		t.Logf("unexpected BGSAVE outcome: %s %v\n", outcome, err)
+		t.Fail()
+	}
+	time.Sleep(100 * time.Millisecond)
+	r := NewMap()
+	err = NewSnapshotter(path, r).Load()
+	if err != nil {
+		t.Fatalf("unable to load the snapshot: %s\n", err.Error())
+	}
+	if r.Size() != 2 || string(r.Get("background")) != "value" {
+		t.Logf("expected size 2: %d\n", r.Size())
+		t.Fail()
+	}
+	err = NewSnapshotter(filepath.Join(t.TempDir(), "missing"), r).Load()
+	if err != nil || r.Size() != 2 {
+		t.Logf("expected a missing snapshot to be ignored: %v\n", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,184 @@
+package dmap
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrTxAborted = errors.New("Transaction aborted, a watched key has changed")
+
+type txOp struct {
+	op    byte
+	key   string
+	value []byte
+	ttl   time.Duration
+	delta int64
+}
+
+// Tx buffers operations on the Map, applied by Exec atomically: either all
+// of them are applied, or none.
+type Tx struct {
+	m     *Map
+	ops   []txOp
+	watch map[string]uint64
+	conds map[string]func(*item) bool
+}
+
+func (m *Map) Tx() *Tx {
+	return &Tx{m: m}
+}
+
+// Watch records the versions of the keys: Exec fails with ErrTxAborted if
+// any of them is written, deleted or expires in the meantime.
+func (tx *Tx) Watch(keys ...string) {
+	if tx.watch == nil {
+		tx.watch = make(map[string]uint64)
+	}
+	for _, key := range keys {
+		if _, ok := tx.watch[key]; !ok {
+			tx.watch[key] = tx.m.version(key)
+		}
+	}
+}
+
+func (tx *Tx) Unwatch() {
+	tx.watch = nil
+}
+
+// when makes Exec fail with ErrTxAborted unless cond holds on the item of
+// the key, nil if not found.
+func (tx *Tx) when(key string, cond func(*item) bool) {
+	if tx.conds == nil {
+		tx.conds = make(map[string]func(*item) bool)
+	}
+	tx.conds[key] = cond
+}
+
+func (tx *Tx) Put(key string, value []byte) {
+	tx.ops = append(tx.ops, txOp{op: opPut, key: key, value: value})
+}
+
+// PutWithTTL stores the value for ttl, a non positive ttl deletes the key.
+func (tx *Tx) PutWithTTL(key string, value []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		tx.Delete(key)
+		return
+	}
+	tx.ops = append(tx.ops, txOp{op: opPut, key: key, value: value, ttl: ttl})
+}
+
+func (tx *Tx) Get(key string) {
+	tx.ops = append(tx.ops, txOp{op: opGet, key: key})
+}
+
+func (tx *Tx) Delete(key string) {
+	tx.ops = append(tx.ops, txOp{op: opDel, key: key})
+}
+
+func (tx *Tx) Incr(key string, delta int64) {
+	tx.ops = append(tx.ops, txOp{op: opIncr, key: key, delta: delta})
+}
+
+func (tx *Tx) Len() int {
+	return len(tx.ops)
+}
+
+// keys returns the keys of the operations, watched and checked.
+func (tx *Tx) keys() []string {
+	keys := make([]string, 0, len(tx.ops)+len(tx.watch)+len(tx.conds))
+	for _, o := range tx.ops {
+		keys = append(keys, o.key)
+	}
+	for key := range tx.watch {
+		keys = append(keys, key)
+	}
+	for key := range tx.conds {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Discard drops the operations and the watched keys, so that the Tx can be
+// reused.
+func (tx *Tx) Discard() {
+	tx.ops, tx.watch, tx.conds = tx.ops[:0], nil, nil
+}
+
+// Exec applies the operations holding the locks of all the shards involved,
+// and returns their results in order: the value for Get (nil if the key is
+// not found, Err set to ErrWrongType if not a string), "1" or "0" for Delete,
+// the result for Incr. Writes are staged first, so that a failing one (e.g.
+// an Incr on a value which is not an integer) aborts the whole Tx, as does
+// ErrOutOfMemory if the policy can't make room for all of them, without
+// evicting the keys of the Tx. The Tx is discarded, ready to be reused.
+func (tx *Tx) Exec() ([]Result, error) {
+	defer tx.Discard()
+	m := tx.m
+	idx := m.lockShards(tx.keys(), true)
+	defer m.unlockShards(idx, true)
+	now := time.Now()
+	for key, version := range tx.watch {
+		it := m.shard(key).lookup(key, now.UnixNano())
+		if it == nil && version != 0 || it != nil && it.n != version {
+			return nil, ErrTxAborted
+		}
+	}
+	for key, cond := range tx.conds {
+		if !cond(m.shard(key).lookup(key, now.UnixNano())) {
+			return nil, ErrTxAborted
+		}
+	}
+	staged := make(map[string]*item)
+	var order []string
+	lookup := func(key string) *item {
+		if it, ok := staged[key]; ok {
+			return it
+		}
+		return m.shard(key).lookup(key, now.UnixNano())
+	}
+	stage := func(key string, it *item) {
+		if _, ok := staged[key]; !ok {
+			order = append(order, key)
+		}
+		staged[key] = it
+	}
+	results := make([]Result, len(tx.ops))
+	for i, o := range tx.ops {
+		it := lookup(o.key)
+		switch o.op {
+		case opGet:
+			if it != nil && it.t != kindString {
+				results[i].Err = ErrWrongType
+			} else if it != nil {
+				results[i].Value = it.v
+			}
+		case opPut:
+			it = &item{v: o.value}
+			if o.ttl > 0 {
+				it.x = now.Add(o.ttl).UnixNano()
+			}
+			stage(o.key, it)
+		case opDel:
+			results[i].Value = []byte("0")
+			if it != nil {
+				results[i].Value = []byte("1")
+				stage(o.key, nil)
+			}
+		case opIncr:
+			it, err := incr(it, o.delta)
+			if err != nil {
+				return nil, err
+			}
+			results[i].Value = it.v
+			stage(o.key, it)
+		}
+	}
+	if !m.admits(staged) {
+		return nil, ErrOutOfMemory
+	}
+	err := m.putAll(staged, order)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,509 @@
+package dmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// txConn is the transaction state of a connection: commands are queued
+// after MULTI, and run by EXEC; format appends the response of each queued
+// command, given the results of its n operations.
+type txConn struct {
+	tx     *Tx
+	multi  bool
+	dirty  bool
+	n      []int
+	format []func(buf []byte, rs []Result) []byte
+}
+
+func (c *txConn) queue(n int, format func(buf []byte, rs []Result) []byte) {
+	c.n = append(c.n, n)
+	c.format = append(c.format, format)
+}
+
+func (c *txConn) reset() {
+	c.tx.Discard()
+	c.multi, c.dirty = false, false
+	c.n, c.format = c.n[:0], c.format[:0]
+}
+
+// exec runs the queued commands, appending their responses with sep in
+// between.
+func (c *txConn) exec(buf []byte, sep string) ([]byte, error) {
+	defer c.reset()
+	rs, err := c.tx.Exec()
+	if err != nil {
+		return buf, err
+	}
+	for i, format := range c.format {
+		if i > 0 {
+			buf = append(buf, sep...)
+		}
+		buf = format(buf, rs[:c.n[i]])
+		rs = rs[c.n[i]:]
+	}
+	return buf, nil
+}
+
+// executeTx runs the transaction commands over TCP, and queues the commands
+// following MULTI: it returns false if the line is not for it.
+func (ms *MapServer) executeTx(c *txConn, line []byte) (string, bool) {
+	command := string(line)
+	if i := strings.IndexAny(command, " \r\n"); i >= 0 {
+		command = command[:i]
+	}
+	command = strings.ToLower(command)
+	switch {
+	case c.multi:
+	case command != "multi" && command != "discard" && command != "exec" && command != "txwatch" && command != "txunwatch":
+		return "", false
+	}
+	parts := strings.Split(strings.TrimRight(string(line), "\r\n"), " ")
+	switch {
+	case c.multi, command == "multi", command == "txwatch":
+		if err := ms.resolve(true); err != nil {
+			return "KO=" + err.Error(), true
+		}
+	}
+	if c.tx == nil || c.tx.m != ms.m {
+		c.tx = ms.m.Tx()
+	}
+	switch command {
+	case "multi":
+		if c.multi {
+			return "KO=Bad command, MULTI calls can not be nested", true
+		}
+		c.multi = true
+		return "OK=MULTI", true
+	case "discard":
+		if !c.multi {
+			return "KO=Bad command, DISCARD without MULTI", true
+		}
+		c.reset()
+		return "OK=DISCARD", true
+	case "exec":
+		if !c.multi {
+			return "KO=Bad command, EXEC without MULTI", true
+		}
+		if c.dirty {
+			c.reset()
+			return "KO=EXECABORT Transaction discarded because of previous errors", true
+		}
+		// the keys queued may have migrated since: checked again, and fenced
+		// off the migration until written
+		done, err := ms.moved(c.tx.keys())
+		if err != nil {
+			c.reset()
+			return "KO=" + err.Error(), true
+		}
+		defer done()
+		n := len(c.format)
+		buf, err := c.exec([]byte(fmt.Sprintf("OK=%d\r\n", n)), "\r\n")
+		if err != nil {
+			return "KO=" + err.Error(), true
+		}
+		return strings.TrimSuffix(string(buf), "\r\n"), true
+	case "txwatch", "txunwatch":
+		if c.multi {
+			return fmt.Sprintf("KO=Bad command, %s inside MULTI is not allowed", strings.ToUpper(command)), true
+		}
+		if command == "txunwatch" {
+			c.tx.Unwatch()
+			return "OK=TXUNWATCH", true
+		}
+		if len(parts) < 2 {
+			return "KO=Bad command, format: TXWATCH <key> [<key> ...]", true
+		}
+		c.tx.Watch(parts[1:]...)
+		return fmt.Sprintf("OK=%d", len(parts)-1), true
+	}
+	if ms.readOnly(command) {
+		c.dirty = true
+		return "KO=" + ErrReadOnly.Error(), true
+	}
+	done, err := ms.moved(commandKeys(command, parts))
+	if err != nil {
+		c.dirty = true
+		return "KO=" + err.Error(), true
+	}
+	done()
+	if ms.consensus(command) {
+		c.dirty = true
+		return "KO=" + errRaftUnsupported.Error(), true
+	}
+	err = queueText(c, parts)
+	if err != nil {
+		c.dirty = true
+		return "KO=" + err.Error(), true
+	}
+	return "OK=QUEUED", true
+}
+
+// queueText queues PUT, GET, DEL and the increments, answered as they are
+// out of a transaction.
+func queueText(c *txConn, parts []string) error {
+	command := strings.ToLower(parts[0])
+	switch command {
+	case "put":
+		var ttl time.Duration
+		if len(parts) == 5 && strings.ToLower(parts[3]) == "ex" {
+			seconds, err := strconv.Atoi(parts[4])
+			if err != nil || seconds <= 0 {
+				return errors.New("Bad command, EX expects a positive number of seconds")
+			}
+			ttl = time.Duration(seconds) * time.Second
+		} else if len(parts) != 3 {
+			return errors.New("Bad command, format: PUT <key> <value> [EX <seconds>]")
+		}
+		if ttl > 0 {
+			c.tx.PutWithTTL(parts[1], []byte(parts[2]), ttl)
+		} else {
+			c.tx.Put(parts[1], []byte(parts[2]))
+		}
+		n := len(parts[2])
+		c.queue(1, func(buf []byte, rs []Result) []byte {
+			return append(buf, fmt.Sprintf("OK=%d", n)...)
+		})
+	case "get":
+		if len(parts) != 2 {
+			return errors.New("Bad command, format: GET <key>")
+		}
+		c.tx.Get(parts[1])
+		c.queue(1, func(buf []byte, rs []Result) []byte {
+			switch {
+			case rs[0].Err != nil:
+				return append(buf, "KO="+rs[0].Err.Error()...)
+			case rs[0].Value == nil:
+				return append(buf, "KO=null"...)
+			}
+			return append(append(buf, "OK="...), rs[0].Value...)
+		})
+	case "del":
+		if len(parts) != 2 {
+			return errors.New("Bad command, format: DEL <key>")
+		}
+		c.tx.Delete(parts[1])
+		key := parts[1]
+		c.queue(1, func(buf []byte, rs []Result) []byte {
+			return append(buf, "OK="+key...)
+		})
+	case "incr", "decr", "incrby", "decrby":
+		delta, err := textDelta(command, parts)
+		if err != nil {
+			return err
+		}
+		c.tx.Incr(parts[1], delta)
+		c.queue(1, func(buf []byte, rs []Result) []byte {
+			return append(append(buf, "OK="...), rs[0].Value...)
+		})
+	default:
+		return errors.New("Bad command, " + strings.ToUpper(command) + " is not allowed inside MULTI, only PUT, GET, DEL, INCR, DECR, INCRBY and DECRBY are")
+	}
+	return nil
+}
+
+// textDelta parses the delta of INCR, DECR, INCRBY and DECRBY.
+func textDelta(command string, parts []string) (int64, error) {
+	delta := int64(1)
+	if strings.HasSuffix(command, "by") {
+		if len(parts) != 3 {
+			return 0, fmt.Errorf("Bad command, format: %s <key> <delta>", strings.ToUpper(command))
+		}
+		d, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+		delta = d
+	} else if len(parts) != 2 {
+		return 0, fmt.Errorf("Bad command, format: %s <key>", strings.ToUpper(command))
+	}
+	if strings.HasPrefix(command, "decr") {
+		if delta == math.MinInt64 {
+			return 0, ErrOverflow
+		}
+		delta = -delta
+	}
+	return delta, nil
+}
+
+// executeRESPTx runs MULTI, EXEC, DISCARD, WATCH and UNWATCH, and queues the
+// commands following MULTI: it returns false if the command is not for it.
+func (ms *MapServer) executeRESPTx(buf []byte, c *txConn, args [][]byte) ([]byte, bool) {
+	command := strings.ToLower(string(args[0]))
+	switch {
+	case c.multi, command == "multi", command == "watch":
+		if err := ms.resolve(true); err != nil {
+			return appendRESPError(buf, "ERR "+err.Error()), true
+		}
+	}
+	if c.tx == nil || c.tx.m != ms.m {
+		c.tx = ms.m.Tx()
+	}
+	switch command {
+	case "multi":
+		if c.multi {
+			return appendRESPError(buf, "ERR MULTI calls can not be nested"), true
+		}
+		c.multi = true
+		return appendRESPSimple(buf, "OK"), true
+	case "discard":
+		if !c.multi {
+			return appendRESPError(buf, "ERR DISCARD without MULTI"), true
+		}
+		c.reset()
+		return appendRESPSimple(buf, "OK"), true
+	case "exec":
+		if !c.multi {
+			return appendRESPError(buf, "ERR EXEC without MULTI"), true
+		}
+		if c.dirty {
+			c.reset()
+			return appendRESPError(buf, "EXECABORT Transaction discarded because of previous errors."), true
+		}
+		done, err := ms.moved(c.tx.keys())
+		if err != nil {
+			c.reset()
+			return appendRESPError(buf, err.Error()), true
+		}
+		defer done()
+		n := len(c.format)
+		res, err := c.exec(appendRESPArray(buf, n), "")
+		switch {
+		case err == ErrTxAborted:
+			return append(buf, "*-1\r\n"...), true
+		case err == ErrOutOfMemory || err == ErrWrongType:
+			return appendRESPError(buf, err.Error()), true
+		case err != nil:
+			return appendRESPError(buf, "ERR "+err.Error()), true
+		}
+		return res, true
+	case "watch", "unwatch":
+		if c.multi {
+			return appendRESPError(buf, "ERR "+strings.ToUpper(command)+" inside MULTI is not allowed"), true
+		}
+		if command == "unwatch" {
+			c.tx.Unwatch()
+			return appendRESPSimple(buf, "OK"), true
+		}
+		if len(args) < 2 {
+			return appendRESPArity(buf, command), true
+		}
+		c.tx.Watch(respKeys(args[1:])...)
+		return appendRESPSimple(buf, "OK"), true
+	}
+	if !c.multi {
+		return buf, false
+	}
+	if ms.readOnly(command) {
+		c.dirty = true
+		return appendRESPError(buf, ErrReadOnly.Error()), true
+	}
+	done, err := ms.moved(commandKeys(command, respKeys(args)))
+	if err != nil {
+		c.dirty = true
+		return appendRESPError(buf, err.Error()), true
+	}
+	done()
+	if ms.consensus(command) {
+		c.dirty = true
+		return appendRESPError(buf, "ERR "+errRaftUnsupported.Error()), true
+	}
+	err = queueRESP(c, args)
+	if err != nil {
+		c.dirty = true
+		return appendRESPError(buf, err.Error()), true
+	}
+	return appendRESPSimple(buf, "QUEUED"), true
+}
+
+// queueRESP queues SET (with EX and PX), GET, DEL and the increments.
+func queueRESP(c *txConn, args [][]byte) error {
+	command := strings.ToLower(string(args[0]))
+	arity := fmt.Errorf("ERR wrong number of arguments for '%s' command", command)
+	switch command {
+	case "set":
+		if len(args) != 3 && len(args) != 5 {
+			return errors.New("ERR syntax error, only SET <key> <value> [EX|PX <ttl>] is allowed inside MULTI")
+		}
+		if len(args) == 3 {
+			c.tx.Put(string(args[1]), args[2])
+		} else {
+			n, err := strconv.Atoi(string(args[4]))
+			unit := strings.ToLower(string(args[3]))
+			if err != nil || n <= 0 || unit != "ex" && unit != "px" {
+				return errors.New("ERR syntax error")
+			}
+			ttl := time.Duration(n) * time.Second
+			if unit == "px" {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+			c.tx.PutWithTTL(string(args[1]), args[2], ttl)
+		}
+		c.queue(1, func(buf []byte, rs []Result) []byte {
+			return appendRESPSimple(buf, "OK")
+		})
+	case "get":
+		if len(args) != 2 {
+			return arity
+		}
+		c.tx.Get(string(args[1]))
+		c.queue(1, func(buf []byte, rs []Result) []byte {
+			if rs[0].Err != nil {
+				return appendRESPError(buf, rs[0].Err.Error())
+			}
+			return appendRESPBulk(buf, rs[0].Value)
+		})
+	case "del":
+		if len(args) < 2 {
+			return arity
+		}
+		for _, key := range args[1:] {
+			c.tx.Delete(string(key))
+		}
+		c.queue(len(args)-1, func(buf []byte, rs []Result) []byte {
+			var n int64
+			for _, r := range rs {
+				if r.Bool() {
+					n++
+				}
+			}
+			return appendRESPInt(buf, n)
+		})
+	case "incr", "decr", "incrby", "decrby":
+		delta, err := textDelta(command, respKeys(args))
+		if err == ErrNotInteger || err == ErrOverflow {
+			return errors.New("ERR " + err.Error())
+		}
+		if err != nil {
+			return arity
+		}
+		c.tx.Incr(string(args[1]), delta)
+		c.queue(1, func(buf []byte, rs []Result) []byte {
+			n, _ := rs[0].Int()
+			return appendRESPInt(buf, int64(n))
+		})
+	default:
+		return errors.New("ERR " + strings.ToUpper(command) + " is not allowed inside MULTI")
+	}
+	return nil
+}
+
+// POST { "ops": [ { "op": "get|put|delete|incr", "key": <key>, "value":
+// <value>, "ttl": <seconds>, "delta": <delta> }, ... ], "if_match": { <key>:
+// <etag>, ... }, "if_none_match": { <key>: <etag>, ... } }
+func (hs *HTTPMapServer) txHandler(w http.ResponseWriter, r *http.Request) {
+	rs := make(map[string]interface{})
+	w.Header().Add("Content-Type", "application/json")
+	var req struct {
+		Ops []struct {
+			Op    string `json:"op"`
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			TTL   int    `json:"ttl"`
+			Delta int64  `json:"delta"`
+		} `json:"ops"`
+		IfMatch     map[string]string `json:"if_match"`
+		IfNoneMatch map[string]string `json:"if_none_match"`
+	}
+	var err error
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		err = errors.New("Bad method: only POST accepted")
+	} else if r.Header.Get("Accept") != "application/json" ||
+		r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		err = errors.New("Bad content type: only JSON supported")
+	} else if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	tx := hs.m.Tx()
+	for i := 0; err == nil && i < len(req.Ops); i++ {
+		o := req.Ops[i]
+		switch {
+		case o.Key == "":
+			err = fmt.Errorf("Unrecognized JSON: no key in op %d", i)
+		case o.Op == "get":
+			tx.Get(o.Key)
+		case o.Op == "put" && o.TTL > 0:
+			tx.PutWithTTL(o.Key, []byte(o.Value), time.Duration(o.TTL)*time.Second)
+		case o.Op == "put":
+			tx.Put(o.Key, []byte(o.Value))
+		case o.Op == "delete":
+			tx.Delete(o.Key)
+		case o.Op == "incr":
+			tx.Incr(o.Key, o.Delta)
+		default:
+			err = fmt.Errorf("Unrecognized JSON: op %d, only get, put, delete and incr allowed", i)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+	if err != nil {
+		rs["outcome"] = "KO"
+		rs["error"] = err.Error()
+		buf, _ := json.Marshal(rs)
+		w.Write(buf[:])
+		return
+	}
+	for key, h := range req.IfMatch {
+		h := h
+		tx.when(key, func(it *item) bool {
+			return it != nil && matchETag(h, it)
+		})
+	}
+	for key, h := range req.IfNoneMatch {
+		h := h
+		tx.when(key, func(it *item) bool {
+			return it == nil || !matchETag(h, it)
+		})
+	}
+	log.Printf("info: serving POST tx %v\n", req)
+	results, err := tx.Exec()
+	switch err {
+	case nil:
+	case ErrTxAborted:
+		hs.preconditionFailed(w, rs)
+		return
+	case ErrOutOfMemory:
+		hs.outOfMemory(w, rs, err)
+		return
+	default:
+		if err == ErrWrongType {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		rs["outcome"] = "KO"
+		rs["error"] = err.Error()
+		buf, _ := json.Marshal(rs)
+		w.Write(buf[:])
+		return
+	}
+	values := make([]interface{}, len(results))
+	for i, res := range results {
+		switch req.Ops[i].Op {
+		case "get":
+			if res.Value != nil {
+				values[i] = string(res.Value)
+			}
+		case "put":
+			values[i] = true
+		case "delete":
+			values[i] = res.Bool()
+		case "incr":
+			values[i], _ = strconv.ParseInt(string(res.Value), 10, 64)
+		}
+	}
+	rs["outcome"] = "OK"
+	rs["results"] = values
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
@@ -0,0 +1,306 @@
+package dmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMapTx(t *testing.T) {
+	m := NewMap()
+	m.Put("alice", []byte("100"))
+	tx := m.Tx()
+	tx.Incr("alice", -30)
+	tx.Incr("bob", 30)
+	tx.Get("bob")
+	tx.Delete("missing")
+	tx.PutWithTTL("session", []byte("token"), time.Hour)
+	rs, err := tx.Exec()
+	if err != nil {
+		t.Fatalf("unable to exec: %s\n", err.Error())
+	}
+	if string(rs[0].Value) != "70" || string(rs[1].Value) != "30" || string(rs[2].Value) != "30" || rs[3].Bool() {
+		t.Logf("unexpected results: %v\n", rs)
+		t.Fail()
+	}
+	if string(m.Get("alice")) != "70" || string(m.Get("bob")) != "30" || m.TTL("session") <= 0 {
+		t.Logf("unexpected contents after the exec\n")
+		t.Fail()
+	}
+	if tx.Len() != 0 {
+		t.Logf("expected the tx to be discarded: %d\n", tx.Len())
+		t.Fail()
+	}
+}
+
+func TestMapTxAbort(t *testing.T) {
+	m := NewMap()
+	m.Put("alice", []byte("100"))
+	m.Put("bob", []byte("not a number"))
+	tx := m.Tx()
+	tx.Incr("alice", -30)
+	tx.Incr("bob", 30)
+	if _, err := tx.Exec(); err != ErrNotInteger {
+		t.Logf("expected not an integer: %v\n", err)
+		t.Fail()
+	}
+	if string(m.Get("alice")) != "100" {
+		t.Logf("expected nothing applied: %s\n", m.Get("alice"))
+		t.Fail()
+	}
+	m = NewMap(WithShards(1), WithMaxMemory(20))
+	m.Put("key", []byte("value"))
+	tx = m.Tx()
+	tx.Delete("key")
+	tx.Put("other", []byte("0123456789012345"))
+	if _, err := tx.Exec(); err != ErrOutOfMemory || m.Get("key") == nil {
+		t.Logf("expected out of memory: %v\n", err)
+		t.Fail()
+	}
+}
+
+func TestMapTxEviction(t *testing.T) {
+	m := NewMap(WithShards(1), WithMaxMemory(30), WithEviction(EvictVolatileTTL))
+	for i := 0; i < 3; i++ {
+		m.PutWithTTL(fmt.Sprintf("key%d", i), []byte("value"), time.Hour)
+	}
+	tx := m.Tx()
+	for i := 0; i < 3; i++ {
+		tx.PutWithTTL(fmt.Sprintf("tx%d", i), []byte("value"), time.Minute)
+	}
+	if _, err := tx.Exec(); err != nil {
+		t.Fatalf("error: unable to execute: %s\n", err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		if m.Get(fmt.Sprintf("tx%d", i)) == nil {
+			t.Logf("expected the keys of the transaction kept: tx%d\n", i)
+			t.Fail()
+		}
+	}
+	m = NewMap(WithShards(1), WithMaxMemory(30), WithEviction(EvictVolatileTTL))
+	m.Put("key0", []byte("value"))
+	m.PutWithTTL("key1", []byte("value"), time.Hour)
+	tx = m.Tx()
+	for i := 0; i < 3; i++ {
+		tx.PutWithTTL(fmt.Sprintf("tx%d", i), []byte("value"), time.Minute)
+	}
+	if _, err := tx.Exec(); err != ErrOutOfMemory {
+		t.Logf("expected out of memory: %v\n", err)
+		t.Fail()
+	}
+	if m.Size() != 2 || m.Get("key1") == nil {
+		t.Logf("expected nothing applied: %d\n", m.Size())
+		t.Fail()
+	}
+}
+
+func TestMapTxWatch(t *testing.T) {
+	m := NewMap()
+	m.Put("watched", []byte("1"))
+	m.RPush("list", []byte("a"))
+	tx := m.Tx()
+	tx.Watch("watched", "absent", "list")
+	tx.Put("watched", []byte("2"))
+	if _, err := tx.Exec(); err != nil {
+		t.Logf("unexpected error: %s\n", err.Error())
+		t.Fail()
+	}
+	for _, write := range []func(){
+		func() { m.Put("watched", []byte("3")) },
+		func() { m.Delete("watched") },
+		func() { m.Put("absent", []byte("1")) },
+		func() { m.RPush("list", []byte("b")) },
+		func() { m.Expire("list", time.Hour) },
+	} {
+		tx.Watch("watched", "absent", "list")
+		write()
+		tx.Put("written", []byte("1"))
+		if _, err := tx.Exec(); err != ErrTxAborted {
+			t.Logf("expected an abort: %v\n", err)
+			t.Fail()
+		}
+	}
+	if m.Get("written") != nil {
+		t.Logf("expected nothing applied\n")
+		t.Fail()
+	}
+}
+
+func TestMapTxConcurrent(t *testing.T) {
+	m := NewMap()
+	m.Put("a", []byte("1000"))
+	m.Put("b", []byte("1000"))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			from, to := "a", "b"
+			if i%2 == 0 {
+				from, to = to, from
+			}
+			tx := m.Tx()
+			for j := 0; j < 100; j++ {
+				for {
+					tx.Watch(from)
+					n, _ := strconv.Atoi(string(m.Get(from)))
+					if n < 10 {
+						tx.Unwatch()
+						break
+					}
+					tx.Put(from, []byte(strconv.Itoa(n-10)))
+					tx.Incr(to, 10)
+					if _, err := tx.Exec(); err == nil {
+						break
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	a, _ := strconv.Atoi(string(m.Get("a")))
+	b, _ := strconv.Atoi(string(m.Get("b")))
+	if a+b != 2000 {
+		t.Logf("expected the total to be kept: %d + %d\n", a, b)
+		t.Fail()
+	}
+}
+
+func TestTCPMapServerTx(t *testing.T) {
+	m := NewMap()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ts, err := NewTCPMapServer("localhost", 12355, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	go ts.Serve()
+	defer ts.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.Dial("tcp", "localhost:12355")
+	if err != nil {
+		t.Fatalf("error: unable to dial in: %s\n", err.Error())
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	commands := []struct {
+		line     string
+		expected string
+	}{
+		{"PUT alice 100", "OK=3"},
+		{"TXWATCH alice", "OK=1"},
+		{"MULTI", "OK=MULTI"},
+		{"DECRBY alice 30", "OK=QUEUED"},
+		{"INCRBY bob 30", "OK=QUEUED"},
+		{"GET bob", "OK=QUEUED"},
+		{"EXEC", "OK=3\r\nOK=70\r\nOK=30\r\nOK=30"},
+		{"TXWATCH alice", "OK=1"},
+		{"PUT alice 0", "OK=1"},
+		{"MULTI", "OK=MULTI"},
+		{"DEL bob", "OK=QUEUED"},
+		{"EXEC", "KO=" + ErrTxAborted.Error()},
+		{"MULTI", "OK=MULTI"},
+		{"SIZE", "KO=Bad command, SIZE is not allowed inside MULTI, only PUT, GET, DEL, INCR, DECR, INCRBY and DECRBY are"},
+		{"EXEC", "KO=EXECABORT Transaction discarded because of previous errors"},
+		{"MULTI", "OK=MULTI"},
+		{"DEL bob", "OK=QUEUED"},
+		{"DISCARD", "OK=DISCARD"},
+		{"GET bob", "OK=30"},
+	}
+	for _, c := range commands {
+		conn.Write([]byte(c.line + "\r\n"))
+		var res []string
+		for range strings.Split(c.expected, "\r\n") {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("error: unable to read: %s\n", err.Error())
+			}
+			res = append(res, strings.TrimRight(line, "\r\n"))
+		}
+		if strings.Join(res, "\r\n") != c.expected {
+			t.Logf("error: unexpected response to %s: %q\n", c.line, res)
+			t.Fail()
+		}
+	}
+	resp, err := net.Dial("tcp", "localhost:12355")
+	if err != nil {
+		t.Fatalf("error: unable to dial in: %s\n", err.Error())
+	}
+	defer resp.Close()
+	pipeline := respCommand("WATCH", "alice") + respCommand("MULTI") + respCommand("SET", "alice", "5") +
+		respCommand("DEL", "bob", "missing") + respCommand("INCR", "carol") + respCommand("EXEC")
+	expected := "+OK\r\n+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n+OK\r\n:1\r\n:1\r\n"
+	resp.Write([]byte(pipeline))
+	resp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rr := bufio.NewReader(resp)
+	res := make([]byte, len(expected))
+	_, err = io.ReadFull(rr, res)
+	if err != nil || string(res) != expected {
+		t.Logf("error: unexpected responses: %q %v\n", string(res), err)
+		t.Fail()
+	}
+	resp.Write([]byte(respCommand("WATCH", "alice") + respCommand("MULTI") + respCommand("GET", "alice")))
+	res = make([]byte, len("+OK\r\n+OK\r\n+QUEUED\r\n"))
+	io.ReadFull(rr, res)
+	m.Put("alice", []byte("6"))
+	resp.Write([]byte(respCommand("EXEC")))
+	line, _ := rr.ReadString('\n')
+	if line != "*-1\r\n" {
+		t.Logf("error: expected a null reply: %q\n", line)
+		t.Fail()
+	}
+}
+
+func TestHTTPMapServerTx(t *testing.T) {
+	m := NewMap()
+	m.Put("alice", []byte("100"))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	hs, err := NewHTTPMapServer("localhost", 8085, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the HTTP server: %s\n", err.Error())
+	}
+	go hs.Serve()
+	defer hs.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	post := func(body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", "http://localhost:8085/api/v1/tx", bytes.NewBufferString(body))
+		req.Header.Add("Accept", "application/json")
+		req.Header.Add("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error: unable to post: %s\n", err.Error())
+		}
+		defer res.Body.Close()
+		var rs map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&rs)
+		return res.StatusCode, rs
+	}
+	code, rs := post(`{ "ops": [ { "op": "incr", "key": "alice", "delta": -30 }, { "op": "incr", "key": "bob", "delta": 30 },
+		{ "op": "get", "key": "bob" } ], "if_match": { "alice": ` + strconv.Quote(etag([]byte("100"))) + ` } }`)
+	results, _ := rs["results"].([]interface{})
+	if code != http.StatusOK || len(results) != 3 || results[0] != 70.0 || results[2] != "30" {
+		t.Logf("error: unexpected response: %d %v\n", code, rs)
+		t.Fail()
+	}
+	code, _ = post(`{ "ops": [ { "op": "delete", "key": "bob" } ], "if_match": { "alice": ` + strconv.Quote(etag([]byte("100"))) + ` } }`)
+	if code != http.StatusPreconditionFailed || m.Get("bob") == nil {
+		t.Logf("error: expected a failed precondition: %d\n", code)
+		t.Fail()
+	}
+	code, _ = post(`{ "ops": [ { "op": "incr", "key": "alice", "delta": 1 }, { "op": "rename", "key": "bob" } ] }`)
+	if code != http.StatusBadRequest || string(m.Get("alice")) != "70" {
+		t.Logf("error: expected a bad request: %d\n", code)
+		t.Fail()
+	}
+}
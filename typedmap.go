@@ -0,0 +1,197 @@
+package dmap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"time"
+)
+
+// Codec encodes values of type T into the bytes held by a Map, and back.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(b []byte) (T, error)
+}
+
+// JSONCodec encodes values as JSON, readable by any client.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// GobCodec encodes values with encoding/gob, for Go clients only.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
+
+// BytesCodec stores raw bytes as they are.
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+func (BytesCodec) Decode(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+// StringCodec stores strings as their bytes, the natural codec of keys.
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Decode(b []byte) (string, error) {
+	return string(b), nil
+}
+
+// WithKeyHasher addresses the shards hashing the keys K: a TypedMap hashes
+// them before encoding, while the keys of the Map, e.g. written by network
+// clients, are decoded by the codec, so that they land on the same shards.
+// Keys not decoded are hashed by the Hasher set before, FNV1a by default.
+func WithKeyHasher[K any](keys Codec[K], h func(key K) uint64) Option {
+	return func(m *Map) {
+		m.kh = h
+		fallback := m.h
+		m.h = func(key string) uint64 {
+			k, err := keys.Decode([]byte(key))
+			if err != nil {
+				return fallback(key)
+			}
+			return h(k)
+		}
+	}
+}
+
+// TypedMap is a Map of keys K to values V: keys and values are stored
+// encoded by their codecs, the same ones network clients read and write, and
+// the shards are addressed by the Hasher of the Map over the encoded keys,
+// unless WithKeyHasher hashes the keys K instead.
+type TypedMap[K comparable, V any] struct {
+	m *Map
+	k Codec[K]
+	v Codec[V]
+	h func(key K) uint64
+}
+
+// NewTypedMap returns a TypedMap backed by a new Map with the options given.
+func NewTypedMap[K comparable, V any](keys Codec[K], values Codec[V], opts ...Option) *TypedMap[K, V] {
+	return Typed(NewMap(opts...), keys, values)
+}
+
+// Typed returns a TypedMap backed by m, e.g. the Map given to a server.
+func Typed[K comparable, V any](m *Map, keys Codec[K], values Codec[V]) *TypedMap[K, V] {
+	h, _ := m.kh.(func(key K) uint64)
+	return &TypedMap[K, V]{m: m, k: keys, v: values, h: h}
+}
+
+// Map returns the backing Map, to be served by the network servers.
+func (t *TypedMap[K, V]) Map() *Map {
+	return t.m
+}
+
+func (t *TypedMap[K, V]) Close() {
+	t.m.Close()
+}
+
+// key encodes the key, and returns it along with its shard, addressed by
+// the hasher of the keys K if set, so that they are never decoded.
+func (t *TypedMap[K, V]) key(key K) (string, *entry, error) {
+	b, err := t.k.Encode(key)
+	if err != nil {
+		return "", nil, err
+	}
+	if t.h == nil {
+		return string(b), t.m.shard(string(b)), nil
+	}
+	return string(b), &t.m.e[t.h(key)&t.m.s], nil
+}
+
+func (t *TypedMap[K, V]) Put(key K, value V) error {
+	return t.PutWithTTL(key, value, 0)
+}
+
+// PutWithTTL stores the value for ttl, zero meaning no expiration.
+func (t *TypedMap[K, V]) PutWithTTL(key K, value V, ttl time.Duration) error {
+	k, e, err := t.key(key)
+	if err != nil {
+		return err
+	}
+	v, err := t.v.Encode(value)
+	if err != nil {
+		return err
+	}
+	if ttl == 0 {
+		return e.store(k, v)
+	}
+	return e.storeWithTTL(k, v, ttl)
+}
+
+// PutIfAbsent stores the value only if the key is not found.
+func (t *TypedMap[K, V]) PutIfAbsent(key K, value V) (bool, error) {
+	k, e, err := t.key(key)
+	if err != nil {
+		return false, err
+	}
+	v, err := t.v.Encode(value)
+	if err != nil {
+		return false, err
+	}
+	return e.swap(k, func(it *item) bool {
+		return it == nil
+	}, &item{v: v})
+}
+
+// Get returns the value of the key and whether it has been found, empty
+// values included, failing if the stored bytes cannot be decoded, or are a
+// list, a set or a hash.
+func (t *TypedMap[K, V]) Get(key K) (V, bool, error) {
+	var value V
+	k, e, err := t.key(key)
+	if err != nil {
+		return value, false, err
+	}
+	b, _, ok := e.getWithMeta(k)
+	if !ok {
+		return value, false, nil
+	}
+	if b == nil && e.typedKey(k) {
+		return value, false, ErrWrongType
+	}
+	value, err = t.v.Decode(b)
+	return value, err == nil, err
+}
+
+func (t *TypedMap[K, V]) Delete(key K) bool {
+	k, e, err := t.key(key)
+	return err == nil && e.delete(k)
+}
+
+func (t *TypedMap[K, V]) Exists(key K) bool {
+	k, e, err := t.key(key)
+	return err == nil && e.exists(k)
+}
+
+func (t *TypedMap[K, V]) Size() int {
+	return t.m.Size()
+}
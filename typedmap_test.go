@@ -0,0 +1,152 @@
+package dmap
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type point struct {
+	X, Y int
+}
+
+func TestTypedMap(t *testing.T) {
+	m := NewTypedMap[int, point](JSONCodec[int]{}, GobCodec[point]{})
+	defer m.Close()
+	for i := 0; i < 100; i++ {
+		if err := m.Put(i, point{i, -i}); err != nil {
+			t.Fatalf("error: unable to put: %s\n", err.Error())
+		}
+	}
+	if m.Size() != 100 {
+		t.Logf("unexpected size: %d\n", m.Size())
+		t.Fail()
+	}
+	if p, ok, err := m.Get(42); !ok || err != nil || p != (point{42, -42}) {
+		t.Logf("unexpected value: %v %v %v\n", p, ok, err)
+		t.Fail()
+	}
+	if ok, _ := m.PutIfAbsent(42, point{}); ok {
+		t.Logf("expected the key to be found\n")
+		t.Fail()
+	}
+	if !m.Delete(42) || m.Exists(42) {
+		t.Logf("expected the key to be deleted\n")
+		t.Fail()
+	}
+	if _, ok, err := m.Get(42); ok || err != nil {
+		t.Logf("expected no value: %v %v\n", ok, err)
+		t.Fail()
+	}
+	m.PutWithTTL(1, point{}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if m.Exists(1) {
+		t.Logf("expected the key to expire\n")
+		t.Fail()
+	}
+	m.Map().Put("2", []byte("not gob"))
+	if _, ok, err := m.Get(2); ok || err == nil {
+		t.Logf("expected a decoding error\n")
+		t.Fail()
+	}
+}
+
+func TestTypedMapEmptyValues(t *testing.T) {
+	m := NewTypedMap[string, []byte](StringCodec{}, BytesCodec{})
+	defer m.Close()
+	m.Put("nil", nil)
+	m.Put("empty", []byte{})
+	for _, key := range []string{"nil", "empty"} {
+		if b, ok, err := m.Get(key); !ok || err != nil || len(b) != 0 {
+			t.Logf("expected the empty value of %s: %q %v %v\n", key, b, ok, err)
+			t.Fail()
+		}
+	}
+	if _, ok, err := m.Get("missing"); ok || err != nil {
+		t.Logf("expected no value: %v %v\n", ok, err)
+		t.Fail()
+	}
+	m.Map().LPush("list", []byte("a"))
+	if _, ok, err := m.Get("list"); ok || err != ErrWrongType {
+		t.Logf("expected a wrong type: %v %v\n", ok, err)
+		t.Fail()
+	}
+}
+
+// countingCodec counts the keys decoded.
+type countingCodec struct {
+	JSONCodec[int]
+	n *int
+}
+
+func (c countingCodec) Decode(b []byte) (int, error) {
+	*c.n++
+	return c.JSONCodec.Decode(b)
+}
+
+func TestTypedMapKeyHasher(t *testing.T) {
+	var decoded int
+	keys := countingCodec{n: &decoded}
+	m := NewTypedMap[int, point](keys, JSONCodec[point]{}, WithShards(4), WithKeyHasher(keys, func(k int) uint64 {
+		return uint64(k)
+	}))
+	defer m.Close()
+	for i := 0; i < 100; i++ {
+		m.Put(i, point{i, i})
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := m.Map().e[i%4].m[strconv.Itoa(i)]; !ok {
+			t.Logf("expected the key %d in the shard %d\n", i, i%4)
+			t.Fail()
+		}
+	}
+	for i := 0; i < 100; i++ {
+		m.Get(i)
+		m.Exists(i)
+	}
+	if decoded != 0 {
+		t.Logf("expected the keys hashed before encoding, not decoded: %d\n", decoded)
+		t.Fail()
+	}
+	if m.Map().Get("42") == nil || decoded != 1 {
+		t.Logf("expected the key read by the Map decoded, on the same shard: %d\n", decoded)
+		t.Fail()
+	}
+	m.Map().Put("not json", nil)
+	if !m.Map().Exists("not json") {
+		t.Logf("expected the key not decoded hashed anyway\n")
+		t.Fail()
+	}
+}
+
+func TestTypedMapServed(t *testing.T) {
+	m := NewTypedMap[string, point](StringCodec{}, JSONCodec[point]{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ts, err := NewTCPMapServer("localhost", 12359, &wg, m.Map(), true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	go ts.Serve()
+	defer ts.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	m.Put("p", point{1, 2})
+	c := NewTCPMapClient("localhost", 12359)
+	if err := c.Dial(); err != nil {
+		t.Fatalf("error: unable to dial in: %s\n", err.Error())
+	}
+	defer c.Close()
+	value, err := c.Get("p")
+	var p point
+	if err != nil || json.Unmarshal(value, &p) != nil || p != (point{1, 2}) {
+		t.Logf("error: unexpected value: %s %v\n", value, err)
+		t.Fail()
+	}
+	c.Put("q", []byte(`{"X":3,"Y":4}`))
+	if p, ok, _ := m.Get("q"); !ok || p != (point{3, 4}) {
+		t.Logf("error: unexpected value: %v %v\n", p, ok)
+		t.Fail()
+	}
+}
@@ -0,0 +1,597 @@
+package dmap
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+type kind byte
+
+const (
+	kindString kind = iota
+	kindList
+	kindSet
+	kindHash
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindList:
+		return "list"
+	case kindSet:
+		return "set"
+	case kindHash:
+		return "hash"
+	}
+	return "string"
+}
+
+// listValue is a deque of elements, e[h:], growing at both ends in amortized
+// constant time; n is the number of bytes of the elements.
+type listValue struct {
+	e [][]byte
+	h int
+	n int64
+}
+
+type setValue struct {
+	m map[string]struct{}
+	n int64
+}
+
+type hashValue struct {
+	m map[string][]byte
+	n int64
+}
+
+func (l *listValue) len() int {
+	return len(l.e) - l.h
+}
+
+func (l *listValue) push(left bool, v []byte) {
+	l.n += int64(len(v))
+	if !left {
+		l.e = append(l.e, v)
+		return
+	}
+	if l.h == 0 {
+		grown := make([][]byte, 2*len(l.e)+4)
+		h := len(grown) - len(l.e)
+		copy(grown[h:], l.e)
+		l.e, l.h = grown, h
+	}
+	l.h--
+	l.e[l.h] = v
+}
+
+func (l *listValue) pop(left bool) []byte {
+	var v []byte
+	if left {
+		v = l.e[l.h]
+		l.e[l.h] = nil
+		l.h++
+	} else {
+		v = l.e[len(l.e)-1]
+		l.e[len(l.e)-1] = nil
+		l.e = l.e[:len(l.e)-1]
+	}
+	l.n -= int64(len(v))
+	if l.len() == 0 {
+		l.e, l.h = nil, 0
+	}
+	return v
+}
+
+// size returns the bytes taken by the value of the item, and by its past
+// values retained by WithHistory.
+func (it *item) size() int64 {
+	switch c := it.c.(type) {
+	case *listValue:
+		return c.n
+	case *setValue:
+		return c.n
+	case *hashValue:
+		return c.n
+	}
+	return int64(len(it.v)) + revisionsSize(it.h)
+}
+
+// mutation returns the mutation setting the whole item: OpPut for strings,
+// OpTyped for the other types.
+func (it *item) mutation(key string) Mutation {
+	var args [][]byte
+	switch c := it.c.(type) {
+	case *listValue:
+		args = append([][]byte{[]byte("list")}, c.e[c.h:]...)
+	case *setValue:
+		args = [][]byte{[]byte("set")}
+		for member := range c.m {
+			args = append(args, []byte(member))
+		}
+	case *hashValue:
+		args = [][]byte{[]byte("hash")}
+		for field, value := range c.m {
+			args = append(args, []byte(field), value)
+		}
+	default:
+		return Mutation{Op: OpPut, Key: key, Value: it.v, Expire: it.x}
+	}
+	return Mutation{Op: OpTyped, Key: key, Value: packList(args), Expire: it.x}
+}
+
+func newItem(k kind) *item {
+	it := &item{t: k}
+	switch k {
+	case kindList:
+		it.c = &listValue{}
+	case kindSet:
+		it.c = &setValue{m: make(map[string]struct{})}
+	case kindHash:
+		it.c = &hashValue{m: make(map[string][]byte)}
+	}
+	return it
+}
+
+// typedKey reports whether the key holds a list, a set or a hash.
+func (m *Map) typedKey(key string) bool {
+	return m.shard(key).typedKey(key)
+}
+
+func (e *entry) typedKey(key string) bool {
+	t := e.kind(key)
+	return t != "none" && t != "string"
+}
+
+// Type returns the type of the value of the key: string, list, set or hash,
+// none if the key is not found.
+func (m *Map) Type(key string) string {
+	return m.shard(key).kind(key)
+}
+
+func (e *entry) kind(key string) string {
+	e.l.RLock()
+	defer e.l.RUnlock()
+	it, ok := e.m[key]
+	if !ok || it.expired(time.Now().UnixNano()) {
+		return "none"
+	}
+	return it.t.String()
+}
+
+// LPush prepends the values to the list, creating it if the key is not
+// found, and returns its length.
+func (m *Map) LPush(key string, values ...[]byte) (int, error) {
+	return m.push(key, true, values)
+}
+
+// RPush appends the values to the list, creating it if the key is not found,
+// and returns its length.
+func (m *Map) RPush(key string, values ...[]byte) (int, error) {
+	return m.push(key, false, values)
+}
+
+// LPop removes and returns the first element of the list, nil if the key is
+// not found: the key is removed with the last element.
+func (m *Map) LPop(key string) ([]byte, error) {
+	return m.pop(key, true)
+}
+
+// RPop removes and returns the last element of the list, as LPop does.
+func (m *Map) RPop(key string) ([]byte, error) {
+	return m.pop(key, false)
+}
+
+// LRange returns the elements from start to stop, both included: negative
+// indexes count from the end, -1 being the last element.
+func (m *Map) LRange(key string, start, stop int) ([][]byte, error) {
+	var values [][]byte
+	err := m.view(key, kindList, func(it *item) {
+		l := it.c.(*listValue)
+		n := l.len()
+		if start < 0 {
+			start += n
+		}
+		if stop < 0 {
+			stop += n
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= n {
+			stop = n - 1
+		}
+		if start <= stop {
+			values = append(values, l.e[l.h+start:l.h+stop+1]...)
+		}
+	})
+	return values, err
+}
+
+func (m *Map) LLen(key string) (int, error) {
+	n := 0
+	err := m.view(key, kindList, func(it *item) {
+		n = it.c.(*listValue).len()
+	})
+	return n, err
+}
+
+// SAdd adds the members to the set, creating it if the key is not found, and
+// returns the number of members added.
+func (m *Map) SAdd(key string, members ...string) (int, error) {
+	e, unlock := m.lock(key)
+	defer unlock()
+	now := time.Now().UnixNano()
+	it := e.lookup(key, now)
+	if it != nil && it.t != kindSet {
+		return 0, ErrWrongType
+	}
+	var added []string
+	var delta int64
+	fresh := make(map[string]struct{})
+	for _, member := range members {
+		_, seen := fresh[member]
+		if it != nil {
+			_, exists := it.c.(*setValue).m[member]
+			seen = seen || exists
+		}
+		if !seen {
+			fresh[member] = struct{}{}
+			added = append(added, member)
+			delta += int64(len(member))
+		}
+	}
+	if len(added) == 0 {
+		return 0, nil
+	}
+	it, err := e.grow(key, it, kindSet, delta, now)
+	if err != nil {
+		return 0, err
+	}
+	s := it.c.(*setValue)
+	for _, member := range added {
+		s.m[member] = struct{}{}
+	}
+	s.n += delta
+	e.typed(key, "sadd", stringArgs(added)...)
+	return len(added), nil
+}
+
+// SRem removes the members from the set, returning how many were found: the
+// key is removed with the last member.
+func (m *Map) SRem(key string, members ...string) (int, error) {
+	e, unlock := m.lock(key)
+	defer unlock()
+	it := e.lookup(key, time.Now().UnixNano())
+	if it == nil {
+		return 0, nil
+	}
+	if it.t != kindSet {
+		return 0, ErrWrongType
+	}
+	s := it.c.(*setValue)
+	var removed []string
+	for _, member := range members {
+		if _, ok := s.m[member]; ok {
+			delete(s.m, member)
+			removed = append(removed, member)
+			s.n -= int64(len(member))
+			e.u -= int64(len(member))
+		}
+	}
+	if len(removed) > 0 {
+		e.typed(key, "srem", stringArgs(removed)...)
+	}
+	if len(s.m) == 0 {
+		e.remove(key)
+	}
+	return len(removed), nil
+}
+
+// SMembers returns the members of the set, in ascending order.
+func (m *Map) SMembers(key string) ([]string, error) {
+	var members []string
+	err := m.view(key, kindSet, func(it *item) {
+		for member := range it.c.(*setValue).m {
+			members = append(members, member)
+		}
+	})
+	sort.Strings(members)
+	return members, err
+}
+
+func (m *Map) SIsMember(key string, member string) (bool, error) {
+	ok := false
+	err := m.view(key, kindSet, func(it *item) {
+		_, ok = it.c.(*setValue).m[member]
+	})
+	return ok, err
+}
+
+// HSet sets the fields of the hash, creating it if the key is not found, and
+// returns the number of fields added.
+func (m *Map) HSet(key string, fields map[string][]byte) (int, error) {
+	e, unlock := m.lock(key)
+	defer unlock()
+	now := time.Now().UnixNano()
+	it := e.lookup(key, now)
+	if it != nil && it.t != kindHash {
+		return 0, ErrWrongType
+	}
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	var delta int64
+	added := 0
+	args := make([][]byte, 0, 2*len(fields))
+	for field, value := range fields {
+		delta += int64(len(value))
+		old, exists := []byte(nil), false
+		if it != nil {
+			old, exists = it.c.(*hashValue).m[field]
+		}
+		if exists {
+			delta -= int64(len(old))
+		} else {
+			delta += int64(len(field))
+			added++
+		}
+		args = append(args, []byte(field), value)
+	}
+	it, err := e.grow(key, it, kindHash, delta, now)
+	if err != nil {
+		return 0, err
+	}
+	h := it.c.(*hashValue)
+	for field, value := range fields {
+		h.m[field] = value
+	}
+	h.n += delta
+	e.typed(key, "hset", args...)
+	return added, nil
+}
+
+// HGet returns the value of the field, nil if the key or the field is not
+// found.
+func (m *Map) HGet(key, field string) ([]byte, error) {
+	var value []byte
+	err := m.view(key, kindHash, func(it *item) {
+		value = it.c.(*hashValue).m[field]
+	})
+	return value, err
+}
+
+// HDel removes the fields from the hash, returning how many were found: the
+// key is removed with the last field.
+func (m *Map) HDel(key string, fields ...string) (int, error) {
+	e, unlock := m.lock(key)
+	defer unlock()
+	it := e.lookup(key, time.Now().UnixNano())
+	if it == nil {
+		return 0, nil
+	}
+	if it.t != kindHash {
+		return 0, ErrWrongType
+	}
+	h := it.c.(*hashValue)
+	var removed []string
+	for _, field := range fields {
+		if value, ok := h.m[field]; ok {
+			delete(h.m, field)
+			removed = append(removed, field)
+			h.n -= int64(len(field) + len(value))
+			e.u -= int64(len(field) + len(value))
+		}
+	}
+	if len(removed) > 0 {
+		e.typed(key, "hdel", stringArgs(removed)...)
+	}
+	if len(h.m) == 0 {
+		e.remove(key)
+	}
+	return len(removed), nil
+}
+
+// HGetAll returns a copy of the hash, empty if the key is not found.
+func (m *Map) HGetAll(key string) (map[string][]byte, error) {
+	fields := make(map[string][]byte)
+	err := m.view(key, kindHash, func(it *item) {
+		for field, value := range it.c.(*hashValue).m {
+			fields[field] = value
+		}
+	})
+	return fields, err
+}
+
+func (m *Map) push(key string, left bool, values [][]byte) (int, error) {
+	e, unlock := m.lock(key)
+	defer unlock()
+	now := time.Now().UnixNano()
+	it := e.lookup(key, now)
+	if it != nil && it.t != kindList {
+		return 0, ErrWrongType
+	}
+	if len(values) == 0 {
+		if it == nil {
+			return 0, nil
+		}
+		return it.c.(*listValue).len(), nil
+	}
+	var delta int64
+	for _, v := range values {
+		delta += int64(len(v))
+	}
+	it, err := e.grow(key, it, kindList, delta, now)
+	if err != nil {
+		return 0, err
+	}
+	l := it.c.(*listValue)
+	for _, v := range values {
+		l.push(left, v)
+	}
+	command := "rpush"
+	if left {
+		command = "lpush"
+	}
+	e.typed(key, command, values...)
+	return l.len(), nil
+}
+
+func (m *Map) pop(key string, left bool) ([]byte, error) {
+	e, unlock := m.lock(key)
+	defer unlock()
+	it := e.lookup(key, time.Now().UnixNano())
+	if it == nil {
+		return nil, nil
+	}
+	if it.t != kindList {
+		return nil, ErrWrongType
+	}
+	l := it.c.(*listValue)
+	v := l.pop(left)
+	e.u -= int64(len(v))
+	command := "rpop"
+	if left {
+		command = "lpop"
+	}
+	e.typed(key, command)
+	if l.len() == 0 {
+		e.remove(key)
+	}
+	return v, nil
+}
+
+func (m *Map) lock(key string) (*entry, func()) {
+	e := m.shard(key)
+	e.l.Lock()
+	return e, e.l.Unlock
+}
+
+// view runs f on the item of the key under the read lock, if the key is
+// found and holds a value of the kind.
+func (m *Map) view(key string, k kind, f func(*item)) error {
+	e := m.shard(key)
+	e.l.RLock()
+	defer e.l.RUnlock()
+	it, ok := e.m[key]
+	if !ok || it.expired(time.Now().UnixNano()) {
+		return nil
+	}
+	if it.t != k {
+		return ErrWrongType
+	}
+	f(it)
+	return nil
+}
+
+// grow makes room for delta more bytes for the item, creating it if nil: the
+// write lock must be held.
+func (e *entry) grow(key string, it *item, k kind, delta int64, now int64) (*item, error) {
+	if it == nil {
+		delta += int64(len(key))
+	}
+	if delta > 0 {
+		err := e.reserve(key, delta, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e.u += delta
+	if it == nil {
+		it = newItem(k)
+		it.a, it.f = now, 1
+		e.m[key] = it
+		if e.k != nil {
+			e.k.insert(key)
+		}
+	}
+	return it, nil
+}
+
+// typed stamps a new version on the typed value and notifies the command
+// applied to it, as an OpTyped mutation carrying the command and its arguments.
+func (e *entry) typed(key string, command string, args ...[]byte) {
+	if it, ok := e.m[key]; ok {
+		it.stamp(e.p, time.Now().UnixNano())
+	}
+	e.p.notify(e.i, Mutation{Op: OpTyped, Key: key, Value: packList(append([][]byte{[]byte(command)}, args...))})
+}
+
+// typedItem makes the list, set or hash holding the elements, as dumped by
+// item.mutation.
+func typedItem(command string, args [][]byte, expire int64) *item {
+	it := newItem(map[string]kind{"list": kindList, "set": kindSet, "hash": kindHash}[command])
+	it.x = expire
+	switch c := it.c.(type) {
+	case *listValue:
+		for _, v := range args {
+			c.push(false, v)
+		}
+	case *setValue:
+		for _, member := range args {
+			c.m[string(member)] = struct{}{}
+			c.n += int64(len(member))
+		}
+	case *hashValue:
+		for i := 0; i+1 < len(args); i += 2 {
+			c.m[string(args[i])] = args[i+1]
+			c.n += int64(len(args[i]) + len(args[i+1]))
+		}
+	}
+	return it
+}
+
+// applyTyped replays an OpTyped mutation.
+func (m *Map) applyTyped(mu *Mutation) {
+	args, err := unpackList(mu.Value)
+	if err != nil || len(args) == 0 {
+		return
+	}
+	command, args := string(args[0]), args[1:]
+	switch command {
+	case "list", "set", "hash":
+		if mu.Expire != 0 && mu.Expire <= time.Now().UnixNano() {
+			m.Delete(mu.Key)
+			return
+		}
+		it := typedItem(command, args, mu.Expire)
+		e := m.shard(mu.Key)
+		e.l.Lock()
+		e.put(mu.Key, it)
+		e.l.Unlock()
+	case "lpush", "rpush":
+		m.push(mu.Key, command == "lpush", args)
+	case "lpop", "rpop":
+		m.pop(mu.Key, command == "lpop")
+	case "sadd":
+		m.SAdd(mu.Key, byteStrings(args)...)
+	case "srem":
+		m.SRem(mu.Key, byteStrings(args)...)
+	case "hset":
+		fields := make(map[string][]byte, len(args)/2)
+		for i := 0; i+1 < len(args); i += 2 {
+			fields[string(args[i])] = args[i+1]
+		}
+		m.HSet(mu.Key, fields)
+	case "hdel":
+		m.HDel(mu.Key, byteStrings(args)...)
+	}
+}
+
+func stringArgs(s []string) [][]byte {
+	args := make([][]byte, len(s))
+	for i := range s {
+		args[i] = []byte(s[i])
+	}
+	return args
+}
+
+func byteStrings(args [][]byte) []string {
+	s := make([]string, len(args))
+	for i := range args {
+		s[i] = string(args[i])
+	}
+	return s
+}
@@ -0,0 +1,681 @@
+package dmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	replyInt   = 'i'
+	replyBulk  = 'b'
+	replyArray = 'a'
+)
+
+// reply of a command on a typed value: an integer, a bulk (nil if not
+// found) or an array of bulks.
+type reply struct {
+	t byte
+	n int64
+	b []byte
+	a [][]byte
+}
+
+// executeTyped runs the commands on typed values, shared by all the
+// protocols: it returns false if the command is not one of them.
+func (ms *MapServer) executeTyped(args [][]byte) (reply, bool, error) {
+	command := strings.ToLower(string(args[0]))
+	n := len(args)
+	arity := func(ok bool, format string) error {
+		if ok {
+			return nil
+		}
+		return fmt.Errorf("Bad command, format: %s %s", strings.ToUpper(command), format)
+	}
+	var r reply
+	var err error
+	switch command {
+	case "type":
+		if err = arity(n == 2, "<key>"); err == nil {
+			r = reply{t: replyBulk, b: []byte(ms.m.Type(string(args[1])))}
+		}
+	case "lpush", "rpush":
+		if err = arity(n >= 3, "<key> <value> [<value> ...]"); err == nil {
+			var l int
+			if command == "lpush" {
+				l, err = ms.m.LPush(string(args[1]), args[2:]...)
+			} else {
+				l, err = ms.m.RPush(string(args[1]), args[2:]...)
+			}
+			r = reply{t: replyInt, n: int64(l)}
+		}
+	case "lpop", "rpop":
+		if err = arity(n == 2, "<key>"); err == nil {
+			r.t = replyBulk
+			if command == "lpop" {
+				r.b, err = ms.m.LPop(string(args[1]))
+			} else {
+				r.b, err = ms.m.RPop(string(args[1]))
+			}
+		}
+	case "lrange":
+		if err = arity(n == 4, "<key> <start> <stop>"); err == nil {
+			start, e1 := strconv.Atoi(string(args[2]))
+			stop, e2 := strconv.Atoi(string(args[3]))
+			if e1 != nil || e2 != nil {
+				return r, true, errors.New("Bad command, LRANGE expects integer indexes")
+			}
+			r.t = replyArray
+			r.a, err = ms.m.LRange(string(args[1]), start, stop)
+		}
+	case "llen":
+		if err = arity(n == 2, "<key>"); err == nil {
+			var l int
+			l, err = ms.m.LLen(string(args[1]))
+			r = reply{t: replyInt, n: int64(l)}
+		}
+	case "sadd", "srem":
+		if err = arity(n >= 3, "<key> <member> [<member> ...]"); err == nil {
+			var c int
+			if command == "sadd" {
+				c, err = ms.m.SAdd(string(args[1]), byteStrings(args[2:])...)
+			} else {
+				c, err = ms.m.SRem(string(args[1]), byteStrings(args[2:])...)
+			}
+			r = reply{t: replyInt, n: int64(c)}
+		}
+	case "smembers":
+		if err = arity(n == 2, "<key>"); err == nil {
+			var members []string
+			members, err = ms.m.SMembers(string(args[1]))
+			r = reply{t: replyArray, a: stringArgs(members)}
+		}
+	case "sismember":
+		if err = arity(n == 3, "<key> <member>"); err == nil {
+			var ok bool
+			ok, err = ms.m.SIsMember(string(args[1]), string(args[2]))
+			r.t = replyInt
+			if ok {
+				r.n = 1
+			}
+		}
+	case "hset":
+		if err = arity(n >= 4 && n%2 == 0, "<key> <field> <value> [<field> <value> ...]"); err == nil {
+			fields := make(map[string][]byte, (n-2)/2)
+			for i := 2; i < n; i += 2 {
+				fields[string(args[i])] = args[i+1]
+			}
+			var c int
+			c, err = ms.m.HSet(string(args[1]), fields)
+			r = reply{t: replyInt, n: int64(c)}
+		}
+	case "hget":
+		if err = arity(n == 3, "<key> <field>"); err == nil {
+			r.t = replyBulk
+			r.b, err = ms.m.HGet(string(args[1]), string(args[2]))
+		}
+	case "hdel":
+		if err = arity(n >= 3, "<key> <field> [<field> ...]"); err == nil {
+			var c int
+			c, err = ms.m.HDel(string(args[1]), byteStrings(args[2:])...)
+			r = reply{t: replyInt, n: int64(c)}
+		}
+	case "hgetall":
+		if err = arity(n == 2, "<key>"); err == nil {
+			var fields map[string][]byte
+			fields, err = ms.m.HGetAll(string(args[1]))
+			r.t = replyArray
+			for _, field := range sortedFields(fields) {
+				r.a = append(r.a, []byte(field), fields[field])
+			}
+		}
+	default:
+		return r, false, nil
+	}
+	return r, true, err
+}
+
+// text formats the reply as the text protocol does: arrays are answered by
+// OK=<n> followed by a line per element.
+func (r reply) text() string {
+	switch r.t {
+	case replyInt:
+		return fmt.Sprintf("OK=%d", r.n)
+	case replyBulk:
+		if r.b == nil {
+			return "KO=null"
+		}
+		return "OK=" + string(r.b)
+	}
+	lines := make([]string, 0, len(r.a)+1)
+	lines = append(lines, fmt.Sprintf("OK=%d", len(r.a)))
+	for _, b := range r.a {
+		lines = append(lines, "OK="+string(b))
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+func (r reply) appendRESP(buf []byte) []byte {
+	switch r.t {
+	case replyInt:
+		return appendRESPInt(buf, r.n)
+	case replyBulk:
+		return appendRESPBulk(buf, r.b)
+	}
+	buf = appendRESPArray(buf, len(r.a))
+	for _, b := range r.a {
+		buf = appendRESPBulk(buf, b)
+	}
+	return buf
+}
+
+// frame encodes the reply as a response frame, the type of the reply being
+// the key: integers take 8 bytes, arrays are packed lists.
+func (r reply) frame(id uint32) *frame {
+	f := &frame{op: statusOK, id: id, key: []byte{r.t}}
+	switch r.t {
+	case replyInt:
+		f.value = binary.BigEndian.AppendUint64(nil, uint64(r.n))
+	case replyBulk:
+		f.value = r.b
+		if r.b == nil {
+			f.op = statusNotFound
+		}
+	default:
+		f.value = packList(r.a)
+	}
+	return f
+}
+
+func sortedFields(fields map[string][]byte) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GET ?key=<key>&start=<start>&stop=<stop> (range), POST { "key": <key>,
+// "values": [...], "side": "left|right" } (push), DELETE ?key=<key>&side=<side> (pop)
+func (hs *HTTPMapServer) listHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	var body struct {
+		Key    string   `json:"key"`
+		Values []string `json:"values"`
+		Side   string   `json:"side"`
+	}
+	switch r.Method {
+	case "GET":
+		start, stop := qs.Get("start"), qs.Get("stop")
+		if start == "" {
+			start = "0"
+		}
+		if stop == "" {
+			stop = "-1"
+		}
+		hs.typed(w, "values", "lrange", qs.Get("key"), start, stop)
+	case "POST":
+		if !hs.decode(w, r, &body) {
+			return
+		}
+		command := "rpush"
+		if body.Side == "left" {
+			command = "lpush"
+		}
+		hs.typed(w, "length", append([]string{command, body.Key}, body.Values...)...)
+	case "DELETE":
+		command := "rpop"
+		if qs.Get("side") == "left" {
+			command = "lpop"
+		}
+		hs.typed(w, "value", command, qs.Get("key"))
+	default:
+		hs.typedError(w, http.StatusMethodNotAllowed, errors.New("Bad method: only GET, POST, DELETE accepted"))
+	}
+}
+
+// GET ?key=<key> (members) or ?key=<key>&member=<member>, POST { "key": <key>,
+// "members": [...] }, DELETE ?key=<key>&member=<member>...
+func (hs *HTTPMapServer) setHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	var body struct {
+		Key     string   `json:"key"`
+		Members []string `json:"members"`
+	}
+	switch r.Method {
+	case "GET":
+		if qs.Get("member") != "" {
+			hs.typed(w, "member", "sismember", qs.Get("key"), qs.Get("member"))
+		} else {
+			hs.typed(w, "members", "smembers", qs.Get("key"))
+		}
+	case "POST":
+		if !hs.decode(w, r, &body) {
+			return
+		}
+		hs.typed(w, "added", append([]string{"sadd", body.Key}, body.Members...)...)
+	case "DELETE":
+		hs.typed(w, "removed", append([]string{"srem", qs.Get("key")}, qs["member"]...)...)
+	default:
+		hs.typedError(w, http.StatusMethodNotAllowed, errors.New("Bad method: only GET, POST, DELETE accepted"))
+	}
+}
+
+// GET ?key=<key> (all the fields) or ?key=<key>&field=<field>, POST { "key":
+// <key>, "fields": { <field>: <value>, ... } }, DELETE ?key=<key>&field=<field>...
+func (hs *HTTPMapServer) hashHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	var body struct {
+		Key    string            `json:"key"`
+		Fields map[string]string `json:"fields"`
+	}
+	switch r.Method {
+	case "GET":
+		if qs.Get("field") != "" {
+			hs.typed(w, "value", "hget", qs.Get("key"), qs.Get("field"))
+		} else {
+			hs.typed(w, "fields", "hgetall", qs.Get("key"))
+		}
+	case "POST":
+		if !hs.decode(w, r, &body) {
+			return
+		}
+		args := []string{"hset", body.Key}
+		for field, value := range body.Fields {
+			args = append(args, field, value)
+		}
+		hs.typed(w, "added", args...)
+	case "DELETE":
+		hs.typed(w, "removed", append([]string{"hdel", qs.Get("key")}, qs["field"]...)...)
+	default:
+		hs.typedError(w, http.StatusMethodNotAllowed, errors.New("Bad method: only GET, POST, DELETE accepted"))
+	}
+}
+
+// ?key=<key>
+func (hs *HTTPMapServer) typeHandler(w http.ResponseWriter, r *http.Request) {
+	hs.typed(w, "type", "type", r.URL.Query().Get("key"))
+}
+
+func (hs *HTTPMapServer) decode(w http.ResponseWriter, r *http.Request, body interface{}) bool {
+	defer r.Body.Close()
+	err := json.NewDecoder(r.Body).Decode(body)
+	if err != nil {
+		hs.typedError(w, http.StatusBadRequest, errors.New("Unrecognized JSON: "+err.Error()))
+		return false
+	}
+	return true
+}
+
+// typed runs the command, answering with its reply as the name field:
+// arrays of alternating fields and values (HGETALL) as an object.
+func (hs *HTTPMapServer) typed(w http.ResponseWriter, name string, args ...string) {
+	log.Printf("info: serving %v\n", args)
+	if len(args) < 2 || args[1] == "" {
+		hs.typedError(w, http.StatusBadRequest, errors.New("Unrecognized request: no key"))
+		return
+	}
+	res, _, err := hs.executeTyped(stringArgs(args))
+	switch err {
+	case nil:
+	case ErrWrongType:
+		hs.typedError(w, http.StatusConflict, err)
+		return
+	case ErrOutOfMemory:
+		hs.typedError(w, http.StatusInsufficientStorage, err)
+		return
+	default:
+		hs.typedError(w, http.StatusBadRequest, err)
+		return
+	}
+	rs := map[string]interface{}{"outcome": "OK"}
+	switch {
+	case args[0] == "sismember":
+		rs[name] = res.n == 1
+	case res.t == replyInt:
+		rs[name] = res.n
+	case res.t == replyBulk && res.b == nil:
+		rs[name] = nil
+	case res.t == replyBulk:
+		rs[name] = string(res.b)
+	case args[0] == "hgetall":
+		fields := make(map[string]string, len(res.a)/2)
+		for i := 0; i+1 < len(res.a); i += 2 {
+			fields[string(res.a[i])] = string(res.a[i+1])
+		}
+		rs[name] = fields
+	default:
+		values := make([]string, len(res.a))
+		for i, b := range res.a {
+			values[i] = string(b)
+		}
+		rs[name] = values
+	}
+	w.Header().Set("Content-Type", "application/json")
+	buf, _ := json.Marshal(rs)
+	w.Write(buf[:])
+}
+
+func (hs *HTTPMapServer) typedError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	buf, _ := json.Marshal(map[string]interface{}{"outcome": "KO", "error": err.Error()})
+	w.Write(buf[:])
+}
+
+// typed runs a command on a typed value, expecting a reply of type t.
+func (mc *MapClient) typed(t byte, args ...[]byte) (reply, error) {
+	if mc.binary {
+		res, err := mc.roundTrip(opTyped, "", packList(args))
+		if err != nil {
+			return reply{}, err
+		}
+		if res.op == statusNotFound {
+			return reply{t: replyBulk}, nil
+		}
+		if len(res.key) != 1 || res.key[0] != t {
+			return reply{}, errors.New("Unexpected response: mismatched reply type")
+		}
+		r := reply{t: t}
+		switch t {
+		case replyInt:
+			if len(res.value) != 8 {
+				return reply{}, errors.New("Unexpected response: malformed integer")
+			}
+			r.n = int64(binary.BigEndian.Uint64(res.value))
+		case replyBulk:
+			r.b = res.value
+		default:
+			r.a, err = unpackList(res.value)
+		}
+		return r, err
+	}
+	c, b, err := mc.exchange(string(bytes.Join(args, []byte(" "))))
+	r := reply{t: t}
+	if t == replyBulk && err != nil && err.Error() == "null" {
+		return r, nil
+	}
+	if err != nil {
+		return reply{}, err
+	}
+	switch t {
+	case replyInt:
+		r.n, err = strconv.ParseInt(b, 10, 64)
+	case replyBulk:
+		r.b = []byte(b)
+	default:
+		var n int
+		n, err = strconv.Atoi(b)
+		if err == nil {
+			r.a, err = c.readValues(n)
+		}
+	}
+	return r, err
+}
+
+// Type returns the type of the value of the key: string, list, set or hash,
+// none if the key is not found.
+func (mc *MapClient) Type(key string) (string, error) {
+	r, err := mc.typed(replyBulk, []byte("TYPE"), []byte(key))
+	return string(r.b), err
+}
+
+func (mc *MapClient) LPush(key string, values ...[]byte) (int, error) {
+	r, err := mc.typed(replyInt, append([][]byte{[]byte("LPUSH"), []byte(key)}, values...)...)
+	return int(r.n), err
+}
+
+func (mc *MapClient) RPush(key string, values ...[]byte) (int, error) {
+	r, err := mc.typed(replyInt, append([][]byte{[]byte("RPUSH"), []byte(key)}, values...)...)
+	return int(r.n), err
+}
+
+// LPop returns a nil value, and no error, if the key is not found.
+func (mc *MapClient) LPop(key string) ([]byte, error) {
+	r, err := mc.typed(replyBulk, []byte("LPOP"), []byte(key))
+	return r.b, err
+}
+
+func (mc *MapClient) RPop(key string) ([]byte, error) {
+	r, err := mc.typed(replyBulk, []byte("RPOP"), []byte(key))
+	return r.b, err
+}
+
+func (mc *MapClient) LRange(key string, start, stop int) ([][]byte, error) {
+	r, err := mc.typed(replyArray, []byte("LRANGE"), []byte(key), []byte(strconv.Itoa(start)), []byte(strconv.Itoa(stop)))
+	return r.a, err
+}
+
+func (mc *MapClient) LLen(key string) (int, error) {
+	r, err := mc.typed(replyInt, []byte("LLEN"), []byte(key))
+	return int(r.n), err
+}
+
+func (mc *MapClient) SAdd(key string, members ...string) (int, error) {
+	r, err := mc.typed(replyInt, append([][]byte{[]byte("SADD"), []byte(key)}, stringArgs(members)...)...)
+	return int(r.n), err
+}
+
+func (mc *MapClient) SRem(key string, members ...string) (int, error) {
+	r, err := mc.typed(replyInt, append([][]byte{[]byte("SREM"), []byte(key)}, stringArgs(members)...)...)
+	return int(r.n), err
+}
+
+func (mc *MapClient) SMembers(key string) ([]string, error) {
+	r, err := mc.typed(replyArray, []byte("SMEMBERS"), []byte(key))
+	return byteStrings(r.a), err
+}
+
+func (mc *MapClient) SIsMember(key string, member string) (bool, error) {
+	r, err := mc.typed(replyInt, []byte("SISMEMBER"), []byte(key), []byte(member))
+	return r.n == 1, err
+}
+
+func (mc *MapClient) HSet(key string, fields map[string][]byte) (int, error) {
+	args := [][]byte{[]byte("HSET"), []byte(key)}
+	for field, value := range fields {
+		args = append(args, []byte(field), value)
+	}
+	r, err := mc.typed(replyInt, args...)
+	return int(r.n), err
+}
+
+// HGet returns a nil value, and no error, if the key or the field is not
+// found.
+func (mc *MapClient) HGet(key, field string) ([]byte, error) {
+	r, err := mc.typed(replyBulk, []byte("HGET"), []byte(key), []byte(field))
+	return r.b, err
+}
+
+func (mc *MapClient) HDel(key string, fields ...string) (int, error) {
+	r, err := mc.typed(replyInt, append([][]byte{[]byte("HDEL"), []byte(key)}, stringArgs(fields)...)...)
+	return int(r.n), err
+}
+
+func (mc *MapClient) HGetAll(key string) (map[string][]byte, error) {
+	r, err := mc.typed(replyArray, []byte("HGETALL"), []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string][]byte, len(r.a)/2)
+	for i := 0; i+1 < len(r.a); i += 2 {
+		fields[string(r.a[i])] = r.a[i+1]
+	}
+	return fields, nil
+}
+
+// typed sends a request to the endpoint of a typed value, returning the
+// named field of the response.
+func (hc *HTTPMapClient) typed(method, path string, qs url.Values, body interface{}, name string) (interface{}, error) {
+	u := fmt.Sprintf("http://%s:%d%s", hc.host, hc.port, path)
+	if qs != nil {
+		u += "?" + qs.Encode()
+	}
+	var buf []byte
+	if body != nil {
+		var err error
+		buf, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, u, bytes.NewBuffer(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var rs map[string]interface{}
+	err = json.Unmarshal(c, &rs)
+	if err != nil {
+		return nil, errors.New(resp.Status)
+	}
+	if rs["outcome"] != "OK" {
+		msg, _ := rs["error"].(string)
+		return nil, knownError(msg)
+	}
+	return rs[name], nil
+}
+
+func (hc *HTTPMapClient) Type(key string) (string, error) {
+	v, err := hc.typed("GET", hc.api()+"/map/type", url.Values{"key": {key}}, nil, "type")
+	s, _ := v.(string)
+	return s, err
+}
+
+func (hc *HTTPMapClient) LPush(key string, values ...[]byte) (int, error) {
+	return hc.push(key, "left", values)
+}
+
+func (hc *HTTPMapClient) RPush(key string, values ...[]byte) (int, error) {
+	return hc.push(key, "right", values)
+}
+
+func (hc *HTTPMapClient) push(key, side string, values [][]byte) (int, error) {
+	body := map[string]interface{}{"key": key, "values": byteStrings(values), "side": side}
+	v, err := hc.typed("POST", hc.api()+"/list", nil, body, "length")
+	n, _ := v.(float64)
+	return int(n), err
+}
+
+func (hc *HTTPMapClient) LPop(key string) ([]byte, error) {
+	return hc.pop(key, "left")
+}
+
+func (hc *HTTPMapClient) RPop(key string) ([]byte, error) {
+	return hc.pop(key, "right")
+}
+
+func (hc *HTTPMapClient) pop(key, side string) ([]byte, error) {
+	v, err := hc.typed("DELETE", hc.api()+"/list", url.Values{"key": {key}, "side": {side}}, nil, "value")
+	if s, ok := v.(string); ok {
+		return []byte(s), err
+	}
+	return nil, err
+}
+
+func (hc *HTTPMapClient) LRange(key string, start, stop int) ([][]byte, error) {
+	qs := url.Values{"key": {key}, "start": {strconv.Itoa(start)}, "stop": {strconv.Itoa(stop)}}
+	v, err := hc.typed("GET", hc.api()+"/list", qs, nil, "values")
+	return jsonBytes(v), err
+}
+
+func (hc *HTTPMapClient) LLen(key string) (int, error) {
+	values, err := hc.LRange(key, 0, -1)
+	return len(values), err
+}
+
+func (hc *HTTPMapClient) SAdd(key string, members ...string) (int, error) {
+	v, err := hc.typed("POST", hc.api()+"/set", nil, map[string]interface{}{"key": key, "members": members}, "added")
+	n, _ := v.(float64)
+	return int(n), err
+}
+
+func (hc *HTTPMapClient) SRem(key string, members ...string) (int, error) {
+	v, err := hc.typed("DELETE", hc.api()+"/set", url.Values{"key": {key}, "member": members}, nil, "removed")
+	n, _ := v.(float64)
+	return int(n), err
+}
+
+func (hc *HTTPMapClient) SMembers(key string) ([]string, error) {
+	v, err := hc.typed("GET", hc.api()+"/set", url.Values{"key": {key}}, nil, "members")
+	return byteStrings(jsonBytes(v)), err
+}
+
+func (hc *HTTPMapClient) SIsMember(key string, member string) (bool, error) {
+	v, err := hc.typed("GET", hc.api()+"/set", url.Values{"key": {key}, "member": {member}}, nil, "member")
+	ok, _ := v.(bool)
+	return ok, err
+}
+
+func (hc *HTTPMapClient) HSet(key string, fields map[string][]byte) (int, error) {
+	body := map[string]interface{}{"key": key, "fields": stringFields(fields)}
+	v, err := hc.typed("POST", hc.api()+"/hash", nil, body, "added")
+	n, _ := v.(float64)
+	return int(n), err
+}
+
+func (hc *HTTPMapClient) HGet(key, field string) ([]byte, error) {
+	v, err := hc.typed("GET", hc.api()+"/hash", url.Values{"key": {key}, "field": {field}}, nil, "value")
+	if s, ok := v.(string); ok {
+		return []byte(s), err
+	}
+	return nil, err
+}
+
+func (hc *HTTPMapClient) HDel(key string, fields ...string) (int, error) {
+	v, err := hc.typed("DELETE", hc.api()+"/hash", url.Values{"key": {key}, "field": fields}, nil, "removed")
+	n, _ := v.(float64)
+	return int(n), err
+}
+
+func (hc *HTTPMapClient) HGetAll(key string) (map[string][]byte, error) {
+	v, err := hc.typed("GET", hc.api()+"/hash", url.Values{"key": {key}}, nil, "fields")
+	if err != nil {
+		return nil, err
+	}
+	raw, _ := v.(map[string]interface{})
+	fields := make(map[string][]byte, len(raw))
+	for field, value := range raw {
+		s, _ := value.(string)
+		fields[field] = []byte(s)
+	}
+	return fields, nil
+}
+
+func jsonBytes(v interface{}) [][]byte {
+	raw, _ := v.([]interface{})
+	values := make([][]byte, len(raw))
+	for i := range raw {
+		s, _ := raw[i].(string)
+		values[i] = []byte(s)
+	}
+	return values
+}
+
+func stringFields(fields map[string][]byte) map[string]string {
+	s := make(map[string]string, len(fields))
+	for field, value := range fields {
+		s[field] = string(value)
+	}
+	return s
+}
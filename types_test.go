@@ -0,0 +1,349 @@
+package dmap
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMapList(t *testing.T) {
+	m := NewMap()
+	n, err := m.RPush("list", []byte("b"), []byte("c"))
+	if err != nil || n != 2 {
+		t.Fatalf("unexpected push: %d %v\n", n, err)
+	}
+	n, _ = m.LPush("list", []byte("a"))
+	if n != 3 || m.Type("list") != "list" {
+		t.Logf("unexpected length: %d %s\n", n, m.Type("list"))
+		t.Fail()
+	}
+	values, _ := m.LRange("list", 0, -1)
+	if len(values) != 3 || string(values[0]) != "a" || string(values[2]) != "c" {
+		t.Logf("unexpected range: %q\n", values)
+		t.Fail()
+	}
+	values, _ = m.LRange("list", -2, 10)
+	if len(values) != 2 || string(values[0]) != "b" {
+		t.Logf("unexpected range: %q\n", values)
+		t.Fail()
+	}
+	b, _ := m.LPop("list")
+	c, _ := m.RPop("list")
+	if string(b) != "a" || string(c) != "c" {
+		t.Logf("unexpected pops: %s %s\n", b, c)
+		t.Fail()
+	}
+	m.LPop("list")
+	b, err = m.LPop("list")
+	if b != nil || err != nil || m.Exists("list") || m.Memory() != 0 {
+		t.Logf("expected the empty list to be removed: %d\n", m.Memory())
+		t.Fail()
+	}
+}
+
+func TestMapSet(t *testing.T) {
+	m := NewMap()
+	n, _ := m.SAdd("set", "b", "a", "b")
+	if n != 2 {
+		t.Logf("expected 2 members added: %d\n", n)
+		t.Fail()
+	}
+	members, _ := m.SMembers("set")
+	if !reflect.DeepEqual(members, []string{"a", "b"}) {
+		t.Logf("unexpected members: %v\n", members)
+		t.Fail()
+	}
+	if ok, _ := m.SIsMember("set", "a"); !ok {
+		t.Logf("expected a member\n")
+		t.Fail()
+	}
+	n, _ = m.SRem("set", "a", "c")
+	if ok, _ := m.SIsMember("set", "a"); ok || n != 1 {
+		t.Logf("expected a removed member: %d\n", n)
+		t.Fail()
+	}
+	m.SRem("set", "b")
+	if m.Type("set") != "none" {
+		t.Logf("expected the empty set to be removed\n")
+		t.Fail()
+	}
+}
+
+func TestMapHash(t *testing.T) {
+	m := NewMap()
+	n, _ := m.HSet("hash", map[string][]byte{"f1": []byte("v1"), "f2": []byte("v2")})
+	if n != 2 {
+		t.Logf("expected 2 fields added: %d\n", n)
+		t.Fail()
+	}
+	n, _ = m.HSet("hash", map[string][]byte{"f1": []byte("v3")})
+	if b, _ := m.HGet("hash", "f1"); n != 0 || string(b) != "v3" {
+		t.Logf("unexpected overwrite: %d %s\n", n, b)
+		t.Fail()
+	}
+	fields, _ := m.HGetAll("hash")
+	if len(fields) != 2 || string(fields["f2"]) != "v2" {
+		t.Logf("unexpected fields: %q\n", fields)
+		t.Fail()
+	}
+	n, _ = m.HDel("hash", "f1", "f2", "f3")
+	if n != 2 || m.Exists("hash") {
+		t.Logf("expected the empty hash to be removed: %d\n", n)
+		t.Fail()
+	}
+}
+
+func TestMapWrongType(t *testing.T) {
+	m := NewMap()
+	m.Put("string", []byte("value"))
+	m.SAdd("set", "a")
+	if _, err := m.LPush("string", []byte("a")); err != ErrWrongType {
+		t.Logf("expected a wrong type: %v\n", err)
+		t.Fail()
+	}
+	if _, err := m.HGet("set", "a"); err != ErrWrongType {
+		t.Logf("expected a wrong type: %v\n", err)
+		t.Fail()
+	}
+	if _, err := m.Incr("set", 1); err != ErrWrongType {
+		t.Logf("expected a wrong type: %v\n", err)
+		t.Fail()
+	}
+	if m.Get("set") != nil {
+		t.Logf("expected no string value\n")
+		t.Fail()
+	}
+	m.Put("set", []byte("value"))
+	if m.Type("set") != "string" {
+		t.Logf("expected the put to overwrite: %s\n", m.Type("set"))
+		t.Fail()
+	}
+}
+
+func TestMapTypedOutOfMemory(t *testing.T) {
+	m := NewMap(WithShards(1), WithMaxMemory(16))
+	_, err := m.RPush("list", []byte("0123456789"))
+	if err != nil {
+		t.Fatalf("unable to push: %s\n", err.Error())
+	}
+	_, err = m.RPush("list", []byte("0123456789"))
+	if err != ErrOutOfMemory {
+		t.Logf("expected out of memory: %v\n", err)
+		t.Fail()
+	}
+	if n, _ := m.LLen("list"); n != 1 {
+		t.Logf("expected a single element: %d\n", n)
+		t.Fail()
+	}
+}
+
+func populateTyped(m *Map) {
+	m.RPush("list", []byte("a"), []byte("b"), []byte("c"))
+	m.LPop("list")
+	m.SAdd("set", "x", "y")
+	m.SRem("set", "x")
+	m.HSet("hash", map[string][]byte{"f1": []byte("v1"), "f2": []byte("v2")})
+	m.HDel("hash", "f2")
+	m.Expire("hash", time.Hour)
+}
+
+func checkTyped(t *testing.T, m *Map) {
+	values, _ := m.LRange("list", 0, -1)
+	members, _ := m.SMembers("set")
+	fields, _ := m.HGetAll("hash")
+	if len(values) != 2 || string(values[0]) != "b" || !reflect.DeepEqual(members, []string{"y"}) {
+		t.Logf("unexpected list or set: %q %v\n", values, members)
+		t.Fail()
+	}
+	if len(fields) != 1 || string(fields["f1"]) != "v1" || m.TTL("hash") <= 0 {
+		t.Logf("unexpected hash: %q\n", fields)
+		t.Fail()
+	}
+}
+
+func TestTypedSnapshot(t *testing.T) {
+	m := NewMap()
+	populateTyped(m)
+	var buf bytes.Buffer
+	err := m.Snapshot(&buf)
+	if err != nil {
+		t.Fatalf("unable to take the snapshot: %s\n", err.Error())
+	}
+	r := NewMap()
+	err = r.Restore(&buf)
+	if err != nil {
+		t.Fatalf("unable to restore the snapshot: %s\n", err.Error())
+	}
+	checkTyped(t, r)
+	if r.Memory() != m.Memory() {
+		t.Logf("unexpected memory: %d %d\n", r.Memory(), m.Memory())
+		t.Fail()
+	}
+}
+
+func TestTypedAOF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dmap.aof")
+	m := NewMap()
+	a, err := NewAOF(path, m, FsyncAlways)
+	if err != nil {
+		t.Fatalf("unable to open the log: %s\n", err.Error())
+	}
+	populateTyped(m)
+	a.Close()
+	r := NewMap()
+	a, err = NewAOF(path, r, FsyncNever)
+	if err != nil {
+		t.Fatalf("unable to reopen the log: %s\n", err.Error())
+	}
+	checkTyped(t, r)
+	err = a.Rewrite()
+	a.Close()
+	if err != nil {
+		t.Fatalf("unable to rewrite the log: %s\n", err.Error())
+	}
+	r = NewMap()
+	a, err = NewAOF(path, r, FsyncNever)
+	if err != nil {
+		t.Fatalf("unable to reopen the log: %s\n", err.Error())
+	}
+	defer a.Close()
+	checkTyped(t, r)
+}
+
+// typedClient is implemented by all the clients.
+type typedClient interface {
+	Client
+	Type(key string) (string, error)
+	LPush(key string, values ...[]byte) (int, error)
+	RPush(key string, values ...[]byte) (int, error)
+	LPop(key string) ([]byte, error)
+	RPop(key string) ([]byte, error)
+	LRange(key string, start, stop int) ([][]byte, error)
+	LLen(key string) (int, error)
+	SAdd(key string, members ...string) (int, error)
+	SRem(key string, members ...string) (int, error)
+	SMembers(key string) ([]string, error)
+	SIsMember(key string, member string) (bool, error)
+	HSet(key string, fields map[string][]byte) (int, error)
+	HGet(key, field string) ([]byte, error)
+	HDel(key string, fields ...string) (int, error)
+	HGetAll(key string) (map[string][]byte, error)
+}
+
+func testTyped(t *testing.T, c typedClient) {
+	n, err := c.RPush("list", []byte("b"), []byte("c"))
+	if err != nil || n != 2 {
+		t.Fatalf("error: unexpected push: %d %v\n", n, err)
+	}
+	c.LPush("list", []byte("a"))
+	values, err := c.LRange("list", 0, -1)
+	if err != nil || len(values) != 3 || string(values[0]) != "a" {
+		t.Logf("error: unexpected range: %q %v\n", values, err)
+		t.Fail()
+	}
+	if n, _ := c.LLen("list"); n != 3 {
+		t.Logf("error: unexpected length: %d\n", n)
+		t.Fail()
+	}
+	b, _ := c.RPop("list")
+	if string(b) != "c" {
+		t.Logf("error: unexpected pop: %s\n", b)
+		t.Fail()
+	}
+	if b, err := c.LPop("missing"); b != nil || err != nil {
+		t.Logf("error: expected no value: %q %v\n", b, err)
+		t.Fail()
+	}
+	if _, err := c.Get("list"); err != ErrWrongType {
+		t.Logf("error: expected a wrong type: %v\n", err)
+		t.Fail()
+	}
+	if _, err := c.SAdd("list", "a"); err != ErrWrongType {
+		t.Logf("error: expected a wrong type: %v\n", err)
+		t.Fail()
+	}
+	if s, _ := c.Type("list"); s != "list" {
+		t.Logf("error: unexpected type: %s\n", s)
+		t.Fail()
+	}
+	n, _ = c.SAdd("set", "b", "a")
+	members, _ := c.SMembers("set")
+	if n != 2 || !reflect.DeepEqual(members, []string{"a", "b"}) {
+		t.Logf("error: unexpected members: %d %v\n", n, members)
+		t.Fail()
+	}
+	if ok, _ := c.SIsMember("set", "a"); !ok {
+		t.Logf("error: expected a member\n")
+		t.Fail()
+	}
+	if n, _ := c.SRem("set", "a", "c"); n != 1 {
+		t.Logf("error: unexpected removal: %d\n", n)
+		t.Fail()
+	}
+	n, _ = c.HSet("hash", map[string][]byte{"f1": []byte("v1"), "f2": []byte("v2")})
+	b, _ = c.HGet("hash", "f1")
+	if n != 2 || string(b) != "v1" {
+		t.Logf("error: unexpected hash: %d %s\n", n, b)
+		t.Fail()
+	}
+	if b, err := c.HGet("hash", "f3"); b != nil || err != nil {
+		t.Logf("error: expected no value: %q %v\n", b, err)
+		t.Fail()
+	}
+	fields, _ := c.HGetAll("hash")
+	if len(fields) != 2 || string(fields["f2"]) != "v2" {
+		t.Logf("error: unexpected fields: %q\n", fields)
+		t.Fail()
+	}
+	if n, _ := c.HDel("hash", "f1"); n != 1 {
+		t.Logf("error: unexpected removal: %d\n", n)
+		t.Fail()
+	}
+	for _, key := range []string{"list", "set", "hash"} {
+		c.Delete(key)
+	}
+}
+
+func TestTypedClients(t *testing.T) {
+	m := NewMap()
+	var wg sync.WaitGroup
+	wg.Add(3)
+	ts, err := NewTCPMapServer("localhost", 12353, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	go ts.Serve()
+	us, err := NewUDPMapServer("localhost", 12354, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the UDP server: %s\n", err.Error())
+	}
+	go us.Serve()
+	hs, err := NewHTTPMapServer("localhost", 8084, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the HTTP server: %s\n", err.Error())
+	}
+	go hs.Serve()
+	time.Sleep(100 * time.Millisecond)
+	tc, bc := NewTCPMapClient("localhost", 12353), NewTCPMapClient("localhost", 12353)
+	bc.SetBinary(true)
+	uc, bu := NewUDPMapClient("localhost", 12354), NewUDPMapClient("localhost", 12354)
+	bu.SetBinary(true)
+	for _, c := range []typedClient{tc, bc, uc, bu, NewHTTPMapClient("localhost", 8084)} {
+		err = c.Dial()
+		if err != nil {
+			t.Fatalf("error: unable to dial in: %s\n", err.Error())
+		}
+		testTyped(t, c)
+		c.Close()
+	}
+	if m.Size() != 0 {
+		t.Logf("error: unexpected size: %d\n", m.Size())
+		t.Fail()
+	}
+	ts.Shutdown()
+	us.Shutdown()
+	hs.Shutdown()
+}
@@ -0,0 +1,97 @@
+package dmap
+
+import "time"
+
+// Meta describes the value of a key: Version grows at every write of the key,
+// and is never given twice by the Map, Modified is the time of the write.
+type Meta struct {
+	Version  uint64
+	Modified time.Time
+}
+
+// revision is a past value of a key, retained by WithHistory.
+type revision struct {
+	n uint64
+	w int64
+	v []byte
+}
+
+// WithHistory retains the last n values replaced of every key, so that GetAt
+// can read them: they count towards the memory bound. The history of a key
+// is dropped along with the key, and not persisted.
+func WithHistory(n int) Option {
+	return func(m *Map) {
+		m.hist = n
+	}
+}
+
+func (it *item) stamp(m *Map, now int64) {
+	it.restamp(m, now)
+	it.r = it.n
+}
+
+// restamp versions a change of the ttl only: GetAt goes on reading the value
+// from its last write on.
+func (it *item) restamp(m *Map, now int64) {
+	it.n = m.next()
+	it.w = now
+}
+
+// GetWithMeta returns the value of the key and its Meta, false if the key is
+// not found: the value is nil if the key holds a list, a set or a hash.
+func (m *Map) GetWithMeta(key string) ([]byte, Meta, bool) {
+	return m.shard(key).getWithMeta(key)
+}
+
+func (e *entry) getWithMeta(key string) ([]byte, Meta, bool) {
+	e.l.RLock()
+	defer e.l.RUnlock()
+	it, ok := e.m[key]
+	if !ok || it.expired(time.Now().UnixNano()) {
+		return nil, Meta{}, false
+	}
+	return it.v, Meta{Version: it.n, Modified: time.Unix(0, it.w)}, true
+}
+
+// GetAt returns the value the key held at the version, i.e. the one of the
+// last write up to it, false if the key is not found or the value is no
+// longer retained.
+func (m *Map) GetAt(key string, version uint64) ([]byte, bool) {
+	e := m.shard(key)
+	e.l.RLock()
+	defer e.l.RUnlock()
+	it, ok := e.m[key]
+	if !ok || it.expired(time.Now().UnixNano()) || it.t != kindString {
+		return nil, false
+	}
+	if version >= it.r {
+		return it.v, true
+	}
+	for i := len(it.h) - 1; i >= 0; i-- {
+		if it.h[i].n <= version {
+			return it.h[i].v, true
+		}
+	}
+	return nil, false
+}
+
+// history returns the revisions to retain in place of old: its own, plus the
+// one of old, the last m.hist of them.
+func (m *Map) history(old *item) []revision {
+	if m.hist <= 0 || old.t != kindString {
+		return nil
+	}
+	h := append(old.h, revision{n: old.r, w: old.w, v: old.v})
+	if len(h) > m.hist {
+		h = h[len(h)-m.hist:]
+	}
+	return append([]revision(nil), h...)
+}
+
+func revisionsSize(h []revision) int64 {
+	var n int64
+	for _, r := range h {
+		n += int64(len(r.v))
+	}
+	return n
+}
@@ -0,0 +1,176 @@
+package dmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMapMeta(t *testing.T) {
+	m := NewMap()
+	before := time.Now()
+	m.Put("key", []byte("value1"))
+	m.Put("other", []byte("value"))
+	_, first, ok := m.GetWithMeta("key")
+	if !ok || first.Version == 0 || first.Modified.Before(before) {
+		t.Fatalf("unexpected meta: %v %v\n", first, ok)
+	}
+	_, other, _ := m.GetWithMeta("other")
+	m.Put("key", []byte("value2"))
+	value, second, _ := m.GetWithMeta("key")
+	if string(value) != "value2" || second.Version <= other.Version || other.Version <= first.Version {
+		t.Logf("expected increasing versions: %d %d %d\n", first.Version, other.Version, second.Version)
+		t.Fail()
+	}
+	m.Expire("key", time.Hour)
+	if _, meta, _ := m.GetWithMeta("key"); meta.Version <= second.Version {
+		t.Logf("expected a new version on expire: %d\n", meta.Version)
+		t.Fail()
+	}
+	m.SAdd("set", "a")
+	if value, meta, ok := m.GetWithMeta("set"); !ok || value != nil || meta.Version == 0 {
+		t.Logf("unexpected meta of a set: %v %v\n", meta, ok)
+		t.Fail()
+	}
+	if _, _, ok := m.GetWithMeta("missing"); ok {
+		t.Logf("expected no meta\n")
+		t.Fail()
+	}
+}
+
+func TestMapHistory(t *testing.T) {
+	m := NewMap(WithShards(1), WithHistory(2))
+	var versions []uint64
+	for _, v := range []string{"v1", "v2", "v3", "v4"} {
+		m.Put("key", []byte(v))
+		_, meta, _ := m.GetWithMeta("key")
+		versions = append(versions, meta.Version)
+	}
+	if _, ok := m.GetAt("key", versions[0]); ok {
+		t.Logf("expected the first value not to be retained\n")
+		t.Fail()
+	}
+	for i, expected := range []string{"v2", "v3", "v4"} {
+		value, ok := m.GetAt("key", versions[i+1])
+		if !ok || string(value) != expected {
+			t.Logf("unexpected value at %d: %s %v\n", versions[i+1], value, ok)
+			t.Fail()
+		}
+	}
+	if value, _ := m.GetAt("key", versions[3]+100); string(value) != "v4" {
+		t.Logf("expected the last value: %s\n", value)
+		t.Fail()
+	}
+	if m.Memory() != int64(len("key")+3*len("v1")) {
+		t.Logf("expected the history in memory: %d\n", m.Memory())
+		t.Fail()
+	}
+	m.Delete("key")
+	if _, ok := m.GetAt("key", versions[2]); ok || m.Memory() != 0 {
+		t.Logf("expected the history dropped: %d\n", m.Memory())
+		t.Fail()
+	}
+	m.Put("key", []byte("a"))
+	_, meta, _ := m.GetWithMeta("key")
+	m.Expire("key", time.Hour)
+	m.Persist("key")
+	if value, ok := m.GetAt("key", meta.Version); !ok || string(value) != "a" {
+		t.Logf("expected the value read across the ttl changes: %s %v\n", value, ok)
+		t.Fail()
+	}
+	m.Put("key", []byte("b"))
+	if value, ok := m.GetAt("key", meta.Version); !ok || string(value) != "a" {
+		t.Logf("expected the value rewritten retained: %s %v\n", value, ok)
+		t.Fail()
+	}
+	if _, after, _ := m.GetWithMeta("key"); after.Version <= meta.Version+2 {
+		t.Logf("expected the ttl changes versioned: %d %d\n", meta.Version, after.Version)
+		t.Fail()
+	}
+}
+
+func TestMetaClients(t *testing.T) {
+	m := NewMap(WithHistory(1))
+	var wg sync.WaitGroup
+	wg.Add(2)
+	ts, err := NewTCPMapServer("localhost", 12356, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	go ts.Serve()
+	defer ts.Shutdown()
+	hs, err := NewHTTPMapServer("localhost", 8086, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the HTTP server: %s\n", err.Error())
+	}
+	go hs.Serve()
+	defer hs.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	tc, bc := NewTCPMapClient("localhost", 12356), NewTCPMapClient("localhost", 12356)
+	bc.SetBinary(true)
+	hc := NewHTTPMapClient("localhost", 8086)
+	for _, c := range []interface {
+		Client
+		GetWithMeta(string) ([]byte, Meta, error)
+		GetAt(string, uint64) ([]byte, error)
+	}{tc, bc, hc} {
+		err = c.Dial()
+		if err != nil {
+			t.Fatalf("error: unable to dial in: %s\n", err.Error())
+		}
+		c.Put("key", []byte("old"))
+		_, old, _ := m.GetWithMeta("key")
+		c.Put("key", []byte("new"))
+		value, meta, err := c.GetWithMeta("key")
+		_, expected, _ := m.GetWithMeta("key")
+		if err != nil || string(value) != "new" || meta.Version != expected.Version {
+			t.Logf("error: unexpected meta: %s %v %v\n", value, meta, err)
+			t.Fail()
+		}
+		if meta.Modified.Before(expected.Modified.Add(-time.Second)) || meta.Modified.After(expected.Modified) {
+			t.Logf("error: unexpected modified: %v %v\n", meta.Modified, expected.Modified)
+			t.Fail()
+		}
+		value, err = c.GetAt("key", old.Version)
+		if err != nil || string(value) != "old" {
+			t.Logf("error: unexpected value at %d: %s %v\n", old.Version, value, err)
+			t.Fail()
+		}
+		if value, meta, err = c.GetWithMeta("missing"); value != nil || meta.Version != 0 || err != nil {
+			t.Logf("error: expected no meta: %v %v\n", meta, err)
+			t.Fail()
+		}
+		c.Close()
+	}
+	req, _ := http.NewRequest("GET", "http://localhost:8086/api/v1/map?key=key", nil)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error: unable to get: %s\n", err.Error())
+	}
+	res.Body.Close()
+	tag := res.Header.Get("ETag")
+	if tag == "" || res.Header.Get("Last-Modified") == "" {
+		t.Fatalf("error: expected the ETag and Last-Modified headers\n")
+	}
+	body, _ := json.Marshal(map[string]string{"key": "key", "value": "newer"})
+	for i, expected := range []int{http.StatusOK, http.StatusPreconditionFailed} {
+		req, _ := http.NewRequest("POST", "http://localhost:8086/api/v1/map", bytes.NewBuffer(body))
+		req.Header.Add("Accept", "application/json")
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("If-Match", tag)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error: unable to post: %s\n", err.Error())
+		}
+		res.Body.Close()
+		if res.StatusCode != expected {
+			t.Logf("error: unexpected status of post %d: %d\n", i, res.StatusCode)
+			t.Fail()
+		}
+	}
+}
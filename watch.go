@@ -0,0 +1,379 @@
+package dmap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const watchBuffer = 1024
+
+type EventType byte
+
+const (
+	EventPut EventType = iota + 1
+	EventDelete
+	EventExpire
+	EventClear
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	case EventClear:
+		return "clear"
+	}
+	return "unknown"
+}
+
+func parseEventType(s string) (EventType, bool) {
+	for t := EventPut; t <= EventClear; t++ {
+		if t.String() == s {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// Event notifies a change of a key: Value is set for EventPut of strings
+// only, Key is empty for EventClear.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value []byte
+}
+
+type watcher struct {
+	pattern string
+	c       chan Event
+	l       sync.Mutex
+	closed  bool
+}
+
+// Watch streams the changes of the keys matching the glob-style pattern, e.g.
+// a key, "prefix*" or "*" for all of them, plus every Clear of the Map, until
+// cancel is called. Events are buffered: a watcher not keeping up is dropped,
+// its channel being closed.
+func (m *Map) Watch(pattern string) (<-chan Event, func()) {
+	w := &watcher{pattern: pattern, c: make(chan Event, watchBuffer)}
+	unregister := m.observe(w.observe)
+	cancel := func() {
+		unregister()
+		w.close()
+	}
+	return w.c, cancel
+}
+
+func (w *watcher) observe(shard int, mu Mutation) {
+	var ev Event
+	switch mu.Op {
+	case OpPut:
+		ev = Event{Type: EventPut, Key: mu.Key, Value: mu.Value}
+	case OpTyped:
+		ev = Event{Type: EventPut, Key: mu.Key}
+	case OpDelete:
+		ev = Event{Type: EventDelete, Key: mu.Key}
+	case OpExpired:
+		ev = Event{Type: EventExpire, Key: mu.Key}
+	case OpClear:
+		ev = Event{Type: EventClear}
+	default:
+		return
+	}
+	if ev.Type != EventClear && !match(w.pattern, ev.Key) {
+		return
+	}
+	w.l.Lock()
+	defer w.l.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.c <- ev:
+	default:
+		w.closed = true
+		close(w.c)
+	}
+}
+
+func (w *watcher) close() {
+	w.l.Lock()
+	defer w.l.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.c)
+	}
+}
+
+// eventLine formats the event as streamed over TCP: EVENT=<type> [<key>
+// [<value>]].
+func eventLine(ev Event) string {
+	line := "EVENT=" + ev.Type.String()
+	if ev.Type == EventClear {
+		return line
+	}
+	line += " " + ev.Key
+	if ev.Type == EventPut {
+		line += " " + string(ev.Value)
+	}
+	return line
+}
+
+func parseEventLine(line string) (Event, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "EVENT=") {
+		return Event{}, errors.New("Unexpected event: " + line)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(line, "EVENT="), " ", 3)
+	t, ok := parseEventType(parts[0])
+	if !ok {
+		return Event{}, errors.New("Unexpected event: " + line)
+	}
+	ev := Event{Type: t}
+	if len(parts) > 1 {
+		ev.Key = parts[1]
+	}
+	if t == EventPut {
+		ev.Value = []byte{}
+		if len(parts) > 2 {
+			ev.Value = []byte(parts[2])
+		}
+	}
+	return ev, nil
+}
+
+// watch streams the events of the keys matching the pattern, as lines, until
+// UNWATCH: it returns false if the connection is over.
+func (ts *TCPMapServer) watch(r *bufio.Reader, w *bufio.Writer, pattern string) bool {
+	events, cancel := ts.m.Watch(pattern)
+	defer cancel()
+	w.WriteString("OK=" + pattern + "\r\n")
+	if w.Flush() != nil {
+		return false
+	}
+	unwatch := make(chan bool, 1)
+	go func() {
+		for {
+			line, err := r.ReadSlice('\n')
+			if err != nil && err != bufio.ErrBufferFull {
+				unwatch <- false
+				return
+			}
+			switch strings.ToLower(strings.TrimSpace(string(line))) {
+			case "unwatch":
+				unwatch <- true
+				return
+			case "close":
+				unwatch <- false
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case ok := <-unwatch:
+			if !ok {
+				return false
+			}
+			w.WriteString("OK=UNWATCH\r\n")
+			return w.Flush() == nil
+		case ev, ok := <-events:
+			if !ok {
+				w.WriteString("KO=Watcher dropped, not keeping up with the events\r\n")
+				w.Flush()
+				return false
+			}
+			w.WriteString(eventLine(ev))
+			_, err := w.WriteString("\r\n")
+			if err == nil && len(events) == 0 {
+				err = w.Flush()
+			}
+			if err != nil {
+				log.Printf("error: not able to write: %s\n", err.Error())
+				return false
+			}
+		}
+	}
+}
+
+// ?pattern=<pattern>, "*" if missing: the events are streamed as Server-Sent
+// Events, named after their type and carrying { "key": <key>, "value": <value> }.
+func (hs *HTTPMapServer) watchHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || r.Method != "GET" {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"outcome\":\"KO\",\"error\":\"Bad request: only GET with streaming accepted\"}"))
+		return
+	}
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		pattern = "*"
+	}
+	log.Printf("info: serving WATCH %s\n", pattern)
+	events, cancel := hs.m.Watch(pattern)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data := map[string]interface{}{"key": ev.Key}
+			if ev.Type == EventPut {
+				data["value"] = string(ev.Value)
+			}
+			buf, _ := json.Marshal(data)
+			_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, buf)
+			if err != nil {
+				return
+			}
+			if len(events) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// Watch streams the changes of the keys matching the pattern over a dedicated
+// connection, until ctx is done: the channel is closed then, or as soon as the
+// connection is over.
+func (tc *TCPMapClient) Watch(ctx context.Context, pattern string) (<-chan Event, error) {
+	conn, err := net.Dial("tcp", net.JoinHostPort(tc.host, strconv.Itoa(tc.port)))
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	commands := []string{"WATCH " + pattern}
+	if tc.ns != "" {
+		commands = append([]string{"SELECT " + tc.ns}, commands...)
+	}
+	for _, command := range commands {
+		_, err = conn.Write([]byte(command + "\r\n"))
+		if err == nil {
+			var line string
+			line, err = r.ReadString('\n')
+			if err == nil {
+				_, err = tc.parse(strings.TrimRight(line, "\r\n"))
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := make(chan Event, watchBuffer)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+	go func() {
+		defer close(c)
+		defer close(done)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			ev, err := parseEventLine(line)
+			if err != nil {
+				log.Printf("error: %s\n", err.Error())
+				return
+			}
+			select {
+			case c <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (uc *UDPMapClient) Watch(ctx context.Context, pattern string) (<-chan Event, error) {
+	return nil, errors.New("Watch not supported over UDP")
+}
+
+// Watch streams the changes of the keys matching the pattern, reading the
+// Server-Sent Events, until ctx is done.
+func (hc *HTTPMapClient) Watch(ctx context.Context, pattern string) (<-chan Event, error) {
+	u := fmt.Sprintf("http://%s:%d%s/map/watch?pattern=%s", hc.host, hc.port, hc.api(), url.QueryEscape(pattern))
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "text/event-stream")
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+	c := make(chan Event, watchBuffer)
+	go func() {
+		defer close(c)
+		defer resp.Body.Close()
+		r := bufio.NewReader(resp.Body)
+		var ev Event
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				ev.Type, _ = parseEventType(strings.TrimPrefix(line, "event: "))
+			case strings.HasPrefix(line, "data: "):
+				var data struct {
+					Key   string  `json:"key"`
+					Value *string `json:"value"`
+				}
+				if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data) != nil {
+					return
+				}
+				ev.Key = data.Key
+				if data.Value != nil {
+					ev.Value = []byte(*data.Value)
+				}
+			case line == "" && ev.Type != 0:
+				select {
+				case c <- ev:
+				case <-ctx.Done():
+					return
+				}
+				ev = Event{}
+			}
+		}
+	}()
+	return c, nil
+}
@@ -0,0 +1,128 @@
+package dmap
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatalf("unexpected end of the events\n")
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no event received\n")
+	}
+	return Event{}
+}
+
+func TestMapWatch(t *testing.T) {
+	m := NewMap(WithExpiration(10 * time.Millisecond))
+	defer m.Close()
+	events, cancel := m.Watch("config:*")
+	m.Put("other", []byte("ignored"))
+	m.Put("config:db", []byte("host"))
+	m.Delete("config:db")
+	m.PutWithTTL("config:tmp", []byte("1"), 20*time.Millisecond)
+	m.Clear()
+	m.Put("config:tmp", []byte("2"))
+	expected := []Event{
+		{Type: EventPut, Key: "config:db", Value: []byte("host")},
+		{Type: EventDelete, Key: "config:db"},
+		{Type: EventPut, Key: "config:tmp", Value: []byte("1")},
+		{Type: EventClear},
+		{Type: EventPut, Key: "config:tmp", Value: []byte("2")},
+	}
+	for _, e := range expected {
+		ev := nextEvent(t, events)
+		if ev.Type != e.Type || ev.Key != e.Key || string(ev.Value) != string(e.Value) {
+			t.Logf("unexpected event: %v %s %s, expected: %v %s\n", ev.Type, ev.Key, ev.Value, e.Type, e.Key)
+			t.Fail()
+		}
+	}
+	m.PutWithTTL("config:tmp", []byte("3"), 20*time.Millisecond)
+	nextEvent(t, events)
+	if ev := nextEvent(t, events); ev.Type != EventExpire || ev.Key != "config:tmp" {
+		t.Logf("expected an expire event: %v %s\n", ev.Type, ev.Key)
+		t.Fail()
+	}
+	cancel()
+	m.Put("config:db", []byte("host"))
+	if _, ok := <-events; ok {
+		t.Logf("expected no event after cancel\n")
+		t.Fail()
+	}
+}
+
+func TestMapWatchSlow(t *testing.T) {
+	m := NewMap()
+	events, cancel := m.Watch("*")
+	defer cancel()
+	for i := 0; i <= watchBuffer; i++ {
+		m.Put("key", []byte("value"))
+	}
+	n := 0
+	for range events {
+		n++
+	}
+	if n != watchBuffer {
+		t.Logf("expected the watcher to be dropped after %d events: %d\n", watchBuffer, n)
+		t.Fail()
+	}
+}
+
+func TestMapClientsWatch(t *testing.T) {
+	m := NewMap()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	ts, err := NewTCPMapServer("localhost", 12351, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the TCP server: %s\n", err.Error())
+	}
+	go ts.Serve()
+	defer ts.Shutdown()
+	hs, err := NewHTTPMapServer("localhost", 8081, &wg, m, true)
+	if err != nil {
+		t.Fatalf("error: unable to start the HTTP server: %s\n", err.Error())
+	}
+	go hs.Serve()
+	defer hs.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	uc := NewUDPMapClient("localhost", 12351)
+	if _, err := uc.Watch(context.Background(), "*"); err == nil {
+		t.Logf("error: expected Watch not to be supported over UDP\n")
+		t.Fail()
+	}
+	for _, c := range []Client{NewTCPMapClient("localhost", 12351), NewHTTPMapClient("localhost", 8081)} {
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := c.Watch(ctx, "watched*")
+		if err != nil {
+			t.Fatalf("error: unable to watch: %s\n", err.Error())
+		}
+		time.Sleep(50 * time.Millisecond)
+		m.Put("other", []byte("ignored"))
+		m.Put("watched1", []byte("value with spaces"))
+		m.Delete("watched1")
+		m.Clear()
+		ev := nextEvent(t, events)
+		if ev.Type != EventPut || ev.Key != "watched1" || string(ev.Value) != "value with spaces" {
+			t.Logf("unexpected event: %v %s %s\n", ev.Type, ev.Key, ev.Value)
+			t.Fail()
+		}
+		if ev := nextEvent(t, events); ev.Type != EventDelete || ev.Key != "watched1" {
+			t.Logf("unexpected event: %v %s\n", ev.Type, ev.Key)
+			t.Fail()
+		}
+		if ev := nextEvent(t, events); ev.Type != EventClear {
+			t.Logf("unexpected event: %v %s\n", ev.Type, ev.Key)
+			t.Fail()
+		}
+		cancel()
+		for range events {
+		}
+	}
+}